@@ -0,0 +1,249 @@
+// Package auditproxytest runs an audit-proxy inside a test, so applications
+// can assert what they send through the proxy. The proxy records entries in
+// memory, intercepts TLS with a throwaway CA its Client already trusts, and
+// trusts the fake upstreams started with Upstream and TLSUpstream.
+//
+//	p := auditproxytest.New(t)
+//	up := p.TLSUpstream(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+//		io.WriteString(w, `{"ok":true}`)
+//	}))
+//	resp, err := p.Client().Post(up.URL+"/v1/chat/completions", "application/json", body)
+//	...
+//	e := p.WaitEntries(1)[0]
+//	// e.Kind == auditproxytest.KindMITM, e.Request.Excerpt holds the body sent
+package auditproxytest
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kdhira/audit-proxy/internal/audit"
+	"github.com/kdhira/audit-proxy/internal/config"
+	"github.com/kdhira/audit-proxy/internal/mitm"
+	"github.com/kdhira/audit-proxy/internal/proxy"
+)
+
+// Entry is an audit entry recorded by the proxy.
+type Entry = audit.Entry
+
+// Config is the proxy configuration Options adjust.
+type Config = config.Config
+
+// Entry kinds.
+const (
+	KindHTTP    = audit.KindHTTP
+	KindMITM    = audit.KindMITM
+	KindConnect = audit.KindConnect
+)
+
+// Query selects entries for Proxy.Query. Zero fields match anything.
+type Query = audit.Query
+
+// WaitTimeout bounds how long WaitEntries waits.
+var WaitTimeout = 5 * time.Second
+
+// MaxEntries is how many entries a proxy keeps; older ones are dropped.
+var MaxEntries = 10000
+
+// Option adjusts the configuration before the proxy starts.
+type Option func(*Config)
+
+// Proxy is a running proxy under test.
+type Proxy struct {
+	// URL is the proxy's address, for clients configured by hand.
+	URL *url.URL
+
+	t      testing.TB
+	ca     *x509.Certificate
+	issuer *mitm.Issuer
+	rec    *audit.MemoryLogger
+}
+
+// New starts a proxy for the duration of t. By default it intercepts TLS,
+// records body excerpts and may tunnel to any port; opts change that.
+func New(t testing.TB, opts ...Option) *Proxy {
+	t.Helper()
+	dir := t.TempDir()
+	ca, key, err := newCA()
+	if err != nil {
+		t.Fatalf("auditproxytest: create CA: %v", err)
+	}
+	certFile, keyFile := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca.key")
+	if err := writeCA(certFile, keyFile, ca, key); err != nil {
+		t.Fatalf("auditproxytest: write CA: %v", err)
+	}
+
+	cfg := config.Default()
+	cfg.Addr = "127.0.0.1:0"
+	cfg.LogFile = ""
+	cfg.LogBodies = true
+	cfg.MITM = true
+	cfg.MITMCACert, cfg.MITMCAKey = certFile, keyFile
+	cfg.Connect.Ports = []string{"*"}
+	cfg.Egress.RootCAs = []string{certFile}
+	for _, o := range opts {
+		o(&cfg)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("auditproxytest: %v", err)
+	}
+
+	rec := audit.NewMemoryLogger(MaxEntries)
+	srv, err := proxy.New(cfg, rec)
+	if err != nil {
+		t.Fatalf("auditproxytest: %v", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("auditproxytest: listen: %v", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := srv.Serve(ln); err != nil {
+			t.Errorf("auditproxytest: serve: %v", err)
+		}
+	}()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(ctx)
+		<-done
+		if t.Failed() && rec.Len() > 0 {
+			var b strings.Builder
+			_, _ = rec.WriteTo(&b)
+			t.Logf("auditproxytest: entries recorded:\n%s", b.String())
+		}
+	})
+	return &Proxy{
+		URL:    &url.URL{Scheme: "http", Host: ln.Addr().String()},
+		t:      t,
+		ca:     ca,
+		issuer: mitm.NewIssuer(ca, key),
+		rec:    rec,
+	}
+}
+
+// CA returns the certificate of the CA the proxy intercepts TLS with, which
+// also signs the certificates of TLS upstreams.
+func (p *Proxy) CA() *x509.Certificate {
+	return p.ca
+}
+
+// Client returns a client that sends everything through the proxy and
+// trusts its CA.
+func (p *Proxy) Client() *http.Client {
+	roots := x509.NewCertPool()
+	roots.AddCert(p.ca)
+	tr := &http.Transport{
+		Proxy:           http.ProxyURL(p.URL),
+		TLSClientConfig: &tls.Config{RootCAs: roots},
+	}
+	p.t.Cleanup(tr.CloseIdleConnections)
+	return &http.Client{Transport: tr}
+}
+
+// Upstream starts a plain HTTP server for h, closed when the test ends.
+func (p *Proxy) Upstream(h http.Handler) *httptest.Server {
+	srv := httptest.NewServer(h)
+	p.t.Cleanup(srv.Close)
+	return srv
+}
+
+// TLSUpstream starts an HTTPS server for h with a certificate for
+// 127.0.0.1 from the proxy's CA, closed when the test ends.
+func (p *Proxy) TLSUpstream(h http.Handler) *httptest.Server {
+	p.t.Helper()
+	cert, err := p.issuer.IssueCertificate("127.0.0.1")
+	if err != nil {
+		p.t.Fatalf("auditproxytest: issue upstream certificate: %v", err)
+	}
+	srv := httptest.NewUnstartedServer(h)
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{*cert}}
+	srv.StartTLS()
+	p.t.Cleanup(srv.Close)
+	return srv
+}
+
+// Entries returns the entries recorded so far, in the order they were
+// written. A CONNECT entry is written when its tunnel closes.
+func (p *Proxy) Entries() []Entry {
+	return p.rec.Entries()
+}
+
+// Query returns the entries recorded so far that match q, in the order
+// they were written.
+func (p *Proxy) Query(q Query) []Entry {
+	return p.rec.Query(q)
+}
+
+// WaitEntries waits for at least n entries, failing the test after
+// WaitTimeout, and returns all recorded so far. Entries are written once a
+// response has been sent, so a client may see the response first.
+func (p *Proxy) WaitEntries(n int) []Entry {
+	p.t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), WaitTimeout)
+	defer cancel()
+	es, err := p.rec.Wait(ctx, n)
+	if err != nil {
+		p.t.Fatalf("auditproxytest: got %d entries, want %d", len(es), n)
+	}
+	return es
+}
+
+// Reset forgets the entries recorded so far.
+func (p *Proxy) Reset() {
+	p.rec.Reset()
+}
+
+// newCA creates a self-signed CA for the test.
+func newCA() (*x509.Certificate, crypto.Signer, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "auditproxytest CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return nil, nil, err
+	}
+	ca, err := x509.ParseCertificate(der)
+	return ca, key, err
+}
+
+// writeCA writes ca and key as PEM for the proxy's MITM settings.
+func writeCA(certFile, keyFile string, ca *x509.Certificate, key crypto.Signer) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0o600); err != nil {
+		return err
+	}
+	return os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600)
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"maps"
+	"net"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/kdhira/audit-proxy/internal/audit"
+	"github.com/kdhira/audit-proxy/internal/bundle"
+	"github.com/kdhira/audit-proxy/internal/config"
+)
+
+// sessionFilter selects the entries exported into a bundle.
+type sessionFilter struct {
+	since, until time.Time
+	user, client string
+	source       string
+}
+
+func (f sessionFilter) match(e audit.Entry) bool {
+	if !f.since.IsZero() && e.Time.Before(f.since) || !f.until.IsZero() && !e.Time.Before(f.until) {
+		return false
+	}
+	if f.user != "" && e.Conn.User != f.user || f.client != "" && e.Conn.Client != f.client {
+		return false
+	}
+	if f.source != "" {
+		host, _, err := net.SplitHostPort(e.Conn.ClientAddr)
+		if err != nil || host != f.source {
+			return false
+		}
+	}
+	return true
+}
+
+// info records the selection in the manifest.
+func (f sessionFilter) info() map[string]string {
+	m := map[string]string{}
+	set := func(k, v string) {
+		if v != "" {
+			m[k] = v
+		}
+	}
+	if !f.since.IsZero() {
+		set("since", f.since.UTC().Format(time.RFC3339))
+	}
+	if !f.until.IsZero() {
+		set("until", f.until.UTC().Format(time.RFC3339))
+	}
+	set("user", f.user)
+	set("client", f.client)
+	set("source", f.source)
+	return m
+}
+
+// issuedCert is a leaf certificate the proxy presented to the client of
+// intercepted tunnels.
+type issuedCert struct {
+	Host      string    `json:"host"`
+	Serial    string    `json:"serial"`
+	SHA256    string    `json:"sha256"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Tunnels   int       `json:"tunnels"`
+}
+
+// runExportBundle implements "audit-proxy export-bundle --key k.pem -o
+// out.tar.gz [selection flags] [-- proxy flags]", packaging the selected
+// entries, their body excerpts, the certificates shown to clients, the
+// effective configuration and version information into a signed bundle.
+func runExportBundle(args []string) error {
+	fs := flag.NewFlagSet("export-bundle", flag.ContinueOnError)
+	keyFile := fs.String("key", "", "PEM private key signing the bundle (required)")
+	out := fs.String("o", "", "bundle file to write (required)")
+	var f sessionFilter
+	var logs []string
+	fs.Func("since", "only entries at or after this time (RFC 3339, or a duration such as 24h before now)", timeFlag(&f.since))
+	fs.Func("until", "only entries before this time (RFC 3339, or a duration before now)", timeFlag(&f.until))
+	fs.StringVar(&f.user, "user", "", "only entries of this authenticated proxy user")
+	fs.StringVar(&f.client, "client", "", "only entries of this client policy")
+	fs.StringVar(&f.source, "source", "", "only entries from this client IP address")
+	fs.Func("log", "audit log to read, repeatable (default: the configured log file)", func(v string) error {
+		logs = append(logs, v)
+		return nil
+	})
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *keyFile == "" || *out == "" {
+		return errors.New("usage: audit-proxy export-bundle --key key.pem -o bundle.tar.gz [--since t] [--until t] [--user u] [--client c] [--source ip] [--log file...] [-- proxy flags]")
+	}
+	cfg, err := config.Load(fs.Args())
+	if err != nil {
+		return err
+	}
+	signer, err := bundle.LoadSigner(*keyFile)
+	if err != nil {
+		return err
+	}
+	if len(logs) == 0 {
+		logs = []string{cfg.LogFile}
+	}
+
+	var entries bytes.Buffer
+	enc := json.NewEncoder(&entries)
+	enc.SetEscapeHTML(false)
+	bodies := map[string][]byte{}
+	certs := map[string]*issuedCert{}
+	n := 0
+	err = readLogs(logs, func(e audit.Entry) error {
+		if !f.match(e) {
+			return nil
+		}
+		n++
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+		addBodies(bodies, e)
+		addCert(certs, e)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	info := f.info()
+	info["entries"] = strconv.Itoa(n)
+	file, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	w, err := bundle.NewWriter(file, signer, info)
+	if err != nil {
+		return err
+	}
+	if err := w.Add("entries.jsonl", entries.Bytes()); err != nil {
+		return err
+	}
+	for _, name := range slices.Sorted(maps.Keys(bodies)) {
+		if err := w.Add(name, bodies[name]); err != nil {
+			return err
+		}
+	}
+	if err := addIssued(w, cfg, certs); err != nil {
+		return err
+	}
+	conf, err := yaml.Marshal(cfg.Redacted())
+	if err != nil {
+		return err
+	}
+	if err := w.Add("config.yaml", conf); err != nil {
+		return err
+	}
+	version, err := json.MarshalIndent(buildVersion(), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := w.Add("version.json", append(version, '\n')); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	fmt.Printf("wrote %s: %d entries, %d body excerpts, %d certificates\n", *out, n, len(bodies), len(certs))
+	return nil
+}
+
+// addBodies adds e's body excerpts, decompressed, as
+// bodies/<id>.request and bodies/<id>.response. The finish record of a
+// two-phase entry replaces the start record's.
+func addBodies(bodies map[string][]byte, e audit.Entry) {
+	if err := audit.DecompressExcerpts(&e); err != nil {
+		return
+	}
+	if e.Request.Excerpt != "" {
+		bodies["bodies/"+e.ID+".request"] = []byte(e.Request.Excerpt)
+	}
+	if e.Response != nil && e.Response.Excerpt != "" {
+		bodies["bodies/"+e.ID+".response"] = []byte(e.Response.Excerpt)
+	}
+}
+
+// addCert notes the leaf certificate of an intercepted tunnel.
+func addCert(certs map[string]*issuedCert, e audit.Entry) {
+	if e.Kind != audit.KindConnect || e.Phase == audit.PhaseStart {
+		return
+	}
+	sum, _ := e.Attributes["mitm.cert_sha256"].(string)
+	if sum == "" {
+		return
+	}
+	c, ok := certs[sum]
+	if !ok {
+		serial, _ := e.Attributes["mitm.cert_serial"].(string)
+		c = &issuedCert{Host: e.Request.Host, Serial: serial, SHA256: sum, FirstSeen: e.Time}
+		certs[sum] = c
+	}
+	c.LastSeen = e.Time
+	c.Tunnels++
+}
+
+// addIssued adds certs/issued.json and, with MITM configured, the CA
+// certificate the leaves chain to as certs/ca.pem. The CA key is never
+// included.
+func addIssued(w *bundle.Writer, cfg config.Config, certs map[string]*issuedCert) error {
+	if cfg.MITMCACert != "" {
+		ca, err := os.ReadFile(cfg.MITMCACert)
+		if err != nil {
+			return err
+		}
+		if err := w.Add("certs/ca.pem", ca); err != nil {
+			return err
+		}
+	}
+	list := make([]*issuedCert, 0, len(certs))
+	for _, c := range certs {
+		list = append(list, c)
+	}
+	slices.SortFunc(list, func(a, b *issuedCert) int { return a.FirstSeen.Compare(b.FirstSeen) })
+	b, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	return w.Add("certs/issued.json", append(b, '\n'))
+}
+
+// buildVersion describes the running binary.
+func buildVersion() map[string]string {
+	v := map[string]string{
+		"go":       runtime.Version(),
+		"platform": runtime.GOOS + "/" + runtime.GOARCH,
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		v["module"] = bi.Main.Path
+		v["version"] = bi.Main.Version
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision", "vcs.time", "vcs.modified":
+				v[s.Key] = s.Value
+			}
+		}
+	}
+	return v
+}
+
+// runVerifyBundle implements "audit-proxy verify-bundle --pubkey k.pem
+// bundle.tar.gz".
+func runVerifyBundle(args []string) error {
+	fs := flag.NewFlagSet("verify-bundle", flag.ContinueOnError)
+	keyFile := fs.String("pubkey", "", "PEM public key or certificate of the signer (required)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *keyFile == "" || fs.NArg() != 1 {
+		return errors.New("usage: audit-proxy verify-bundle --pubkey key.pub bundle.tar.gz")
+	}
+	pub, err := bundle.LoadPublicKey(*keyFile)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	m, err := bundle.Verify(file, pub)
+	if err != nil {
+		return fmt.Errorf("%s: %w", fs.Arg(0), err)
+	}
+	fmt.Printf("%s: OK, %d files, created %s, signed by key %s\n",
+		fs.Arg(0), len(m.Files), m.Created.Format(time.RFC3339), m.KeyID)
+	for _, k := range slices.Sorted(maps.Keys(m.Info)) {
+		fmt.Printf("  %s: %s\n", k, m.Info[k])
+	}
+	return nil
+}
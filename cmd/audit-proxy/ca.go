@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/kdhira/audit-proxy/internal/mitm"
+)
+
+// runCA implements "audit-proxy ca init".
+func runCA(args []string) error {
+	if len(args) == 0 || args[0] != "init" {
+		return errors.New("usage: audit-proxy ca init [flags]")
+	}
+	return runCAInit(args[1:])
+}
+
+// runCAInit implements "audit-proxy ca init [--cert ca.pem] [--key ca.key]
+// [--key-type ecdsa|rsa] [--days n] [--cn name] [--org name] [--force]",
+// generating a root CA for interception and explaining how to trust it.
+func runCAInit(args []string) error {
+	fs := flag.NewFlagSet("ca init", flag.ContinueOnError)
+	certFile := fs.String("cert", "ca.pem", "CA certificate file to write")
+	keyFile := fs.String("key", "ca.key", "CA private key file to write, readable only by its owner")
+	var o mitm.CAOptions
+	fs.StringVar(&o.KeyType, "key-type", "ecdsa", "key algorithm: ecdsa (P-256) or rsa")
+	fs.IntVar(&o.RSABits, "rsa-bits", 3072, "RSA key size")
+	days := fs.Int("days", 3650, "validity in days")
+	fs.StringVar(&o.CommonName, "cn", "audit-proxy local CA", "subject common name")
+	fs.StringVar(&o.Organization, "org", "audit-proxy", "subject organization")
+	force := fs.Bool("force", false, "overwrite existing files")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return errors.New("usage: audit-proxy ca init [--cert ca.pem] [--key ca.key] [--key-type ecdsa|rsa] [--days n] [--cn name] [--org name] [--force]")
+	}
+	o.Validity = time.Duration(*days) * 24 * time.Hour
+	certPEM, keyPEM, err := mitm.GenerateCA(o)
+	if err != nil {
+		return err
+	}
+	if err := writeNew(*keyFile, keyPEM, 0o600, *force); err != nil {
+		return err
+	}
+	if err := writeNew(*certFile, certPEM, 0o644, *force); err != nil {
+		return err
+	}
+	fmt.Printf("wrote %s and %s (%s, valid %d days)\n\n", *certFile, *keyFile, o.KeyType, *days)
+	fmt.Print(installInstructions(*certFile, *keyFile))
+	return nil
+}
+
+// writeNew writes data to a new file with mode perm, or over an existing
+// one if force is set.
+func writeNew(name string, data []byte, perm os.FileMode, force bool) error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if force {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	f, err := os.OpenFile(name, flags, perm)
+	if errors.Is(err, os.ErrExist) {
+		return fmt.Errorf("%s exists; use --force to replace it", name)
+	}
+	if err != nil {
+		return err
+	}
+	// OpenFile leaves the mode of existing files alone.
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// installInstructions explains how to trust the CA in certFile on each
+// platform and run the proxy with it.
+func installInstructions(certFile, keyFile string) string {
+	abs := func(name string) string {
+		if p, err := filepath.Abs(name); err == nil {
+			return p
+		}
+		return name
+	}
+	return fmt.Sprintf(`Trust the CA on the machines whose traffic is intercepted:
+
+  macOS:
+    sudo security add-trusted-cert -d -r trustRoot -k /Library/Keychains/System.keychain %[1]s
+  Debian, Ubuntu:
+    sudo cp %[1]s /usr/local/share/ca-certificates/audit-proxy.crt && sudo update-ca-certificates
+  Fedora, RHEL:
+    sudo cp %[1]s /etc/pki/ca-trust/source/anchors/audit-proxy.pem && sudo update-ca-trust
+  Windows (administrator prompt):
+    certutil -addstore -f Root %[1]s
+  Firefox keeps its own store: Settings > Privacy & Security > Certificates >
+  View Certificates > Authorities > Import. Node.js reads
+  NODE_EXTRA_CA_CERTS=%[1]s, Python requests REQUESTS_CA_BUNDLE.
+
+Then start the proxy with interception:
+
+  audit-proxy --mitm --mitm-ca-cert %[1]s --mitm-ca-key %[2]s
+
+Keep %[2]s secret: anyone holding it can impersonate any site to clients
+trusting the CA.
+`, abs(certFile), abs(keyFile))
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"os"
+
+	"github.com/kdhira/audit-proxy/internal/audit"
+	"github.com/kdhira/audit-proxy/internal/config"
+	"github.com/kdhira/audit-proxy/internal/report"
+)
+
+// runCompact implements "audit-proxy compact [file...]", merging the start
+// and finish records of two-phase entries and writing JSON lines to stdout.
+// Merged entries appear in the order they finished, followed by any that
+// never did.
+func runCompact(args []string) error {
+	fs := flag.NewFlagSet("compact", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	files := fs.Args()
+	if len(files) == 0 {
+		files = []string{config.Default().LogFile}
+	}
+	w := bufio.NewWriter(os.Stdout)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	c := report.NewCompactor()
+	err := readLogs(files, func(e audit.Entry) error {
+		if e, ok := c.Add(e); ok {
+			return enc.Encode(e)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, e := range c.Incomplete() {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
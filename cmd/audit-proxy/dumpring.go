@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"os"
+
+	"github.com/kdhira/audit-proxy/internal/audit"
+)
+
+// runDumpRing implements "audit-proxy dump-ring [-n N] file", writing the
+// entries recovered from a ring file to stdout as JSON lines, oldest first.
+func runDumpRing(args []string) error {
+	fs := flag.NewFlagSet("dump-ring", flag.ContinueOnError)
+	last := fs.Int("n", 0, "only the last n entries (0 for all)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: audit-proxy dump-ring [-n N] file")
+	}
+	entries, err := audit.ReadRing(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if *last > 0 && len(entries) > *last {
+		entries = entries[len(entries)-*last:]
+	}
+	w := bufio.NewWriter(os.Stdout)
+	for _, e := range entries {
+		w.Write(e)
+		w.WriteByte('\n')
+	}
+	return w.Flush()
+}
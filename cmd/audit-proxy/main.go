@@ -0,0 +1,252 @@
+// Command audit-proxy runs the auditing forward proxy.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/kdhira/audit-proxy/internal/audit"
+	"github.com/kdhira/audit-proxy/internal/config"
+	"github.com/kdhira/audit-proxy/internal/proxy"
+	"github.com/kdhira/audit-proxy/internal/report"
+)
+
+// recentEntries is how many entries /admin/entries can return.
+const recentEntries = 1000
+
+// commands are the subcommands; anything else runs the proxy.
+var commands = map[string]func(args []string) error{
+	"report":         runReport,
+	"compact":        runCompact,
+	"top":            runTop,
+	"dump-ring":      runDumpRing,
+	"test-policy":    runTestPolicy,
+	"export-bundle":  runExportBundle,
+	"verify-bundle":  runVerifyBundle,
+	"ca":             runCA,
+	"onboard":        runOnboard,
+	"override-token": runOverrideToken,
+}
+
+func main() {
+	args, cmd := os.Args[1:], run
+	if len(args) > 0 {
+		if c, ok := commands[args[0]]; ok {
+			args, cmd = args[1:], c
+		}
+	}
+	if err := cmd(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(2)
+		}
+		fmt.Fprintln(os.Stderr, "audit-proxy:", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string) error {
+	cfg, err := config.Load(args)
+	if err != nil {
+		return err
+	}
+	var logger audit.Logger
+	policy := audit.SyncPolicy{Mode: cfg.LogSync.Mode, Entries: cfg.LogSync.Entries, Interval: cfg.LogSync.Interval}
+	excerpt := audit.ExcerptCompression{MinBytes: cfg.ExcerptCompression.MinBytes}
+	if cfg.ExcerptCompression.Codec != "" {
+		if excerpt.Codec, err = audit.CodecByName(cfg.ExcerptCompression.Codec); err != nil {
+			return err
+		}
+	}
+	if logger, err = audit.NewFileLogger(cfg.LogFile, policy, timeFormat(cfg.LogTime), excerpt); err != nil {
+		return err
+	}
+	if cfg.Ring.Path != "" {
+		ring, err := audit.OpenRing(cfg.Ring.Path, cfg.Ring.Entries, cfg.Ring.SlotSize)
+		if err != nil {
+			logger.Close()
+			return err
+		}
+		logger = audit.NewRingLogger(logger, ring)
+	}
+	recent := audit.NewMemoryLogger(recentEntries)
+	logger = audit.Tee(logger, recent)
+	defer logger.Close()
+
+	srv, err := proxy.New(cfg, logger)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// reload re-reads the configuration, with the same flags, and swaps in
+	// the rules it holds.
+	reload := func() error {
+		next, err := config.Load(args)
+		if err == nil {
+			err = srv.Reload(next)
+		}
+		if err != nil {
+			slog.Error("reload config", "err", err)
+		}
+		return err
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	go func() {
+		for range hup {
+			_ = reload()
+		}
+	}()
+
+	errc := make(chan error, 2)
+	go func() { errc <- srv.ListenAndServe() }()
+	slog.Info("audit-proxy starting", "mitm", cfg.MITM, "logfile", cfg.LogFile)
+
+	if cfg.MetricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", srv.Metrics().Handler())
+		mux.HandleFunc("/health/upstreams", func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(srv.Health())
+		})
+		mux.HandleFunc("/admin/activity", func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(srv.Activity())
+		})
+		mux.HandleFunc("/admin/cache", func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(srv.CacheStats())
+		})
+		mux.HandleFunc("/admin/threat-feeds", func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(srv.ThreatFeeds())
+		})
+		mux.HandleFunc("/admin/entries", serveEntries(recent))
+		mux.HandleFunc("/admin/sla", serveSLA(recent))
+		mux.HandleFunc("POST /admin/reload", func(w http.ResponseWriter, _ *http.Request) {
+			if err := reload(); err != nil {
+				http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		})
+		msrv := &http.Server{Addr: cfg.MetricsAddr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+		go func() {
+			if err := msrv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				errc <- fmt.Errorf("metrics: %w", err)
+			}
+		}()
+		defer msrv.Close()
+		slog.Info("serving metrics", "addr", cfg.MetricsAddr)
+	}
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	slog.Info("shutting down", "drain_timeout", cfg.DrainTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.DrainTimeout)
+	defer cancel()
+	return srv.Shutdown(shutdownCtx)
+}
+
+// timeFormat converts the validated log_time settings.
+func timeFormat(c config.LogTimeConfig) audit.TimeFormat {
+	f := audit.TimeFormat{EpochMillis: c.EpochMillis}
+	switch c.Precision {
+	case "s":
+		f.Precision = time.Second
+	case "ms":
+		f.Precision = time.Millisecond
+	case "us":
+		f.Precision = time.Microsecond
+	case "ns":
+		f.Precision = time.Nanosecond
+	}
+	if c.Timezone != "" {
+		f.Location, _ = time.LoadLocation(c.Timezone) // checked by Validate
+	}
+	return f
+}
+
+// serveEntries answers /admin/entries with the recent entries matching the
+// query parameters kind, host, client, user, blocked, since (RFC 3339 or a
+// duration before now) and limit, as JSON lines oldest first.
+func serveEntries(recent *audit.MemoryLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		v := r.URL.Query()
+		q := audit.Query{Kind: v.Get("kind"), Host: v.Get("host"), Client: v.Get("client"), User: v.Get("user")}
+		var err error
+		if s := v.Get("blocked"); s != "" {
+			if q.Blocked, err = strconv.ParseBool(s); err != nil {
+				http.Error(w, "blocked: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if s := v.Get("since"); s != "" {
+			if err := timeFlag(&q.Since)(s); err != nil {
+				http.Error(w, "since: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if s := v.Get("limit"); s != "" {
+			if q.Limit, err = strconv.Atoi(s); err != nil || q.Limit < 0 {
+				http.Error(w, "limit: want a non-negative number", http.StatusBadRequest)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		enc := json.NewEncoder(w)
+		enc.SetEscapeHTML(false)
+		for _, e := range recent.Query(q) {
+			if err := enc.Encode(e); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// serveSLA answers /admin/sla with the SLA report over the recent entries,
+// optionally limited by since and measured against objective, as JSON.
+func serveSLA(recent *audit.MemoryLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		v := r.URL.Query()
+		var since time.Time
+		if s := v.Get("since"); s != "" {
+			if err := timeFlag(&since)(s); err != nil {
+				http.Error(w, "since: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		objective := report.DefaultObjective
+		if s := v.Get("objective"); s != "" {
+			var err error
+			if objective, err = strconv.ParseFloat(s, 64); err != nil || objective <= 0 || objective > 100 {
+				http.Error(w, "objective: want a percentage above 0 and at most 100", http.StatusBadRequest)
+				return
+			}
+		}
+		c := report.NewSLACollector(objective)
+		for _, e := range recent.Query(audit.Query{Since: since}) {
+			if e.Phase != audit.PhaseStart {
+				c.Add(e)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(c.Report())
+	}
+}
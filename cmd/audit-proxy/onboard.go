@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/kdhira/audit-proxy/internal/config"
+	"github.com/kdhira/audit-proxy/internal/onboard"
+)
+
+// runOnboard implements "audit-proxy onboard [--proxy host:port] [--pac]
+// [--wifi-ssid s] [-o dir] [-- proxy flags]", writing the files that set
+// up iOS, macOS and Android test devices to use the proxy and trust its
+// MITM CA.
+func runOnboard(args []string) error {
+	fs := flag.NewFlagSet("onboard", flag.ContinueOnError)
+	proxyAddr := fs.String("proxy", "", "proxy address as devices reach it (default: pac.proxy, else the listen address)")
+	usePAC := fs.Bool("pac", false, "configure devices with the proxy auto-config file instead of a fixed proxy")
+	var o onboard.Options
+	fs.StringVar(&o.WiFiSSID, "wifi-ssid", "", "add this Wi-Fi network, using the proxy, to the Apple profile")
+	fs.StringVar(&o.WiFiPassword, "wifi-password", "", "WPA password of --wifi-ssid (empty for an open network)")
+	caFile := fs.String("ca", "", "MITM CA certificate (default: the configured mitm_ca_cert)")
+	out := fs.String("o", "onboarding", "directory to write the files to")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	cfg, err := config.Load(fs.Args())
+	if err != nil {
+		return err
+	}
+	if *caFile == "" {
+		*caFile = cfg.MITMCACert
+	}
+	if *caFile == "" {
+		return errors.New("no MITM CA: set mitm_ca_cert or pass --ca (see audit-proxy ca init)")
+	}
+	ca, err := readCertificate(*caFile)
+	if err != nil {
+		return err
+	}
+	o.CA = ca
+	if *proxyAddr == "" {
+		*proxyAddr = cfg.PAC.Proxy
+	}
+	if *proxyAddr == "" {
+		*proxyAddr = cfg.Addr
+	}
+	host, port, err := net.SplitHostPort(*proxyAddr)
+	if err != nil {
+		return fmt.Errorf("proxy address: %w", err)
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && (ip.IsUnspecified() || ip.IsLoopback()) {
+		return fmt.Errorf("devices cannot reach the proxy at %q; pass --proxy host:port", *proxyAddr)
+	}
+	o.Host = host
+	if o.Port, err = strconv.Atoi(port); err != nil {
+		return fmt.Errorf("proxy address: bad port %q", port)
+	}
+	if *usePAC {
+		if !cfg.PAC.Enabled {
+			return errors.New("--pac needs pac.enabled")
+		}
+		o.PACURL = "http://" + net.JoinHostPort(host, port) + "/proxy.pac"
+	}
+
+	profile, err := onboard.MobileConfig(o)
+	if err != nil {
+		return err
+	}
+	system := onboard.AndroidSystemName(ca)
+	readme := onboardInstructions(o, *out, system)
+	files := []struct {
+		name string
+		data []byte
+	}{
+		{"audit-proxy.mobileconfig", profile},
+		{"android/audit-proxy-ca.crt", ca.Raw},
+		{"android/" + system, onboard.PEM(ca)},
+		{"android/network_security_config.xml", []byte(onboard.NetworkSecurityConfig)},
+		{"README.txt", []byte(readme)},
+	}
+	for _, f := range files {
+		name := filepath.Join(*out, f.name)
+		if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(name, f.data, 0o644); err != nil {
+			return err
+		}
+	}
+	fmt.Print(readme)
+	return nil
+}
+
+// readCertificate reads the first certificate of a PEM file.
+func readCertificate(file string) (*x509.Certificate, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("%s: no PEM certificate", file)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return cert, nil
+}
+
+// onboardInstructions explains how to use the files written to dir.
+func onboardInstructions(o onboard.Options, dir, systemName string) string {
+	proxy := net.JoinHostPort(o.Host, strconv.Itoa(o.Port))
+	if o.PACURL != "" {
+		proxy = "auto-config " + o.PACURL
+	}
+	wifi := "It sets a global HTTP proxy, which iOS applies on supervised devices\n  only; on others set the proxy by hand (" + proxy + ") under\n  Settings > Wi-Fi > (network) > Configure Proxy, or regenerate with --wifi-ssid."
+	if o.WiFiSSID != "" {
+		wifi = "It adds the Wi-Fi network " + o.WiFiSSID + " using " + proxy + "."
+	}
+	return fmt.Sprintf(`Onboarding files for proxy %[1]s in %[2]s:
+
+iOS and iPadOS
+  Open audit-proxy.mobileconfig on the device (AirDrop, mail or a web page),
+  then install it under Settings > General > VPN & Device Management. Enable
+  full trust for the CA under Settings > General > About > Certificate Trust
+  Settings. %[3]s
+
+macOS
+  Open audit-proxy.mobileconfig and install it in System Settings > Privacy &
+  Security > Profiles, or run: sudo profiles install -path audit-proxy.mobileconfig
+
+Android
+  Copy android/audit-proxy-ca.crt to the device and install it under Settings >
+  Security > Encryption & credentials > Install a certificate > CA certificate,
+  or push it with: adb push android/audit-proxy-ca.crt /sdcard/Download/
+  Point the device at the proxy:
+    adb shell settings put global http_proxy %[4]s
+    (undo with: adb shell settings put global http_proxy :0)
+  Apps targeting Android 7 or later ignore user CAs; add
+  android/network_security_config.xml to debug builds of the app under test.
+  On emulators and rooted devices the CA can go in the system store instead:
+    adb root && adb remount
+    adb push android/%[5]s /system/etc/security/cacerts/
+    adb shell chmod 644 /system/etc/security/cacerts/%[5]s && adb reboot
+`, proxy, dir, wifi, net.JoinHostPort(o.Host, strconv.Itoa(o.Port)), systemName)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/kdhira/audit-proxy/internal/config"
+	"github.com/kdhira/audit-proxy/internal/override"
+)
+
+const overrideUsage = "usage: audit-proxy override-token --filter name (--user name | --client name) [--ttl 15m] [--reason text] [--operator name] [-- proxy flags]"
+
+// runOverrideToken implements "audit-proxy override-token", issuing a token
+// that lets one caller skip a filter for one request, signed with the
+// overrides secret of the configuration the proxy flags select.
+func runOverrideToken(args []string) error {
+	fs := flag.NewFlagSet("override-token", flag.ContinueOnError)
+	var c override.Claims
+	fs.StringVar(&c.Filter, "filter", "", "name of the filter to skip")
+	fs.StringVar(&c.User, "user", "", "proxy user the token is issued to")
+	fs.StringVar(&c.Client, "client", "", "client policy the token is issued to")
+	fs.StringVar(&c.Reason, "reason", "", "why the override is granted, for the audit log")
+	fs.StringVar(&c.Operator, "operator", os.Getenv("USER"), "who grants the override")
+	ttl := fs.Duration("ttl", 15*time.Minute, "how long the token is valid")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if c.Filter == "" || c.User == "" && c.Client == "" {
+		return errors.New(overrideUsage)
+	}
+	cfg, err := config.Load(fs.Args())
+	if err != nil {
+		return err
+	}
+	o := cfg.Overrides
+	switch {
+	case o.Secret == "":
+		return errors.New("overrides.secret is not configured")
+	case !slices.Contains(o.Filters, c.Filter):
+		return fmt.Errorf("filter %s is not in overrides.filters", c.Filter)
+	case *ttl <= 0:
+		return errors.New("--ttl must be positive")
+	case o.MaxTTL > 0 && *ttl > o.MaxTTL, o.MaxTTL == 0 && *ttl > time.Hour:
+		return errors.New("--ttl is longer than overrides.max_ttl")
+	}
+	now := time.Now()
+	c.ID = override.NewID()
+	c.IssuedAt = now.Unix()
+	c.Expires = now.Add(*ttl).Unix()
+	token, err := override.Sign([]byte(os.ExpandEnv(o.Secret)), c)
+	if err != nil {
+		return err
+	}
+	fmt.Println(token)
+	return nil
+}
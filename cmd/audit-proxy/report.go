@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/kdhira/audit-proxy/internal/audit"
+	"github.com/kdhira/audit-proxy/internal/config"
+	"github.com/kdhira/audit-proxy/internal/report"
+)
+
+// runReport implements "audit-proxy report <kind> [flags] [file...]".
+func runReport(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: audit-proxy report deprecations|graph|sla [--json] [--since t] [--until t] [file...]")
+	}
+	kind, args := args[0], args[1:]
+	fs := flag.NewFlagSet("report "+kind, flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "emit JSON instead of a table (graph: instead of DOT)")
+	var since, until time.Time
+	fs.Func("since", "only entries at or after this time (RFC 3339, or a duration such as 24h before now)", timeFlag(&since))
+	fs.Func("until", "only entries before this time (RFC 3339, or a duration before now)", timeFlag(&until))
+	objective := fs.Float64("objective", report.DefaultObjective, "sla: availability objective in percent")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *objective <= 0 || *objective > 100 {
+		return errors.New("objective: want a percentage above 0 and at most 100")
+	}
+	files := fs.Args()
+	if len(files) == 0 {
+		files = []string{config.Default().LogFile}
+	}
+	read := func(fn func(audit.Entry)) error {
+		return readLogs(files, func(e audit.Entry) error {
+			if e.Phase == audit.PhaseStart {
+				return nil // the finish record describes the exchange
+			}
+			if (since.IsZero() || !e.Time.Before(since)) && (until.IsZero() || e.Time.Before(until)) {
+				fn(e)
+			}
+			return nil
+		})
+	}
+
+	switch kind {
+	case "deprecations":
+		c := report.NewDeprecationCollector()
+		if err := read(c.Add); err != nil {
+			return err
+		}
+		r := c.Report()
+		if *asJSON {
+			return writeJSON(os.Stdout, r)
+		}
+		return printDeprecations(os.Stdout, r)
+	case "graph":
+		c := report.NewGraphCollector()
+		if err := read(c.Add); err != nil {
+			return err
+		}
+		g := c.Graph()
+		if *asJSON {
+			return writeJSON(os.Stdout, g)
+		}
+		return printDOT(os.Stdout, g)
+	case "sla":
+		c := report.NewSLACollector(*objective)
+		if err := read(c.Add); err != nil {
+			return err
+		}
+		r := c.Report()
+		if *asJSON {
+			return writeJSON(os.Stdout, r)
+		}
+		return printSLA(os.Stdout, r)
+	default:
+		return fmt.Errorf("unknown report %q", kind)
+	}
+}
+
+// timeFlag parses an RFC 3339 time or a duration before now into t.
+func timeFlag(t *time.Time) func(string) error {
+	return func(v string) error {
+		if d, err := time.ParseDuration(v); err == nil {
+			*t = time.Now().Add(-d)
+			return nil
+		}
+		parsed, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return errors.New("want an RFC 3339 time or a duration")
+		}
+		*t = parsed
+		return nil
+	}
+}
+
+// readLogs streams entries from each file in turn; "-" reads stdin.
+func readLogs(files []string, fn func(audit.Entry) error) error {
+	for _, name := range files {
+		var r io.Reader = os.Stdin
+		if name != "-" {
+			f, err := os.Open(name)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+		if err := audit.ReadEntries(r, fn); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func writeJSON(w io.Writer, v any) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func printDeprecations(w io.Writer, r report.DeprecationReport) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "HOST\tOPERATION\tCOUNT\tLAST SEEN\tSUNSET\tSOURCE\tNOTE")
+	for _, d := range r.Deprecations {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%s\t%s\n",
+			d.Host, d.Operation, d.Count, d.LastSeen.Format("2006-01-02 15:04"),
+			orDash(d.Sunset), strings.Join(d.Sources, ","), d.Note)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if len(r.VersionDrift) == 0 {
+		return nil
+	}
+	fmt.Fprintln(w)
+	tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "HOST\tAPI VERSIONS")
+	for _, v := range r.VersionDrift {
+		var parts []string
+		for ver, n := range v.Versions {
+			parts = append(parts, fmt.Sprintf("%s (%d)", ver, n))
+		}
+		slices.Sort(parts)
+		fmt.Fprintf(tw, "%s\t%s\n", v.Host, strings.Join(parts, ", "))
+	}
+	return tw.Flush()
+}
+
+// printSLA renders r as a table with one row per service.
+func printSLA(w io.Writer, r report.SLAReport) error {
+	fmt.Fprintf(w, "objective: %g%% availability\n\n", r.Objective)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SERVICE\tREQUESTS\tERRORS\tAVAILABILITY\tP50\tP90\tP99\tMAX\tBUDGET LEFT")
+	for _, s := range r.Services {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%.3f%%\t%dms\t%dms\t%dms\t%dms\t%.1f%%\n",
+			s.Service, s.Requests, s.Errors, s.Availability,
+			s.P50MS, s.P90MS, s.P99MS, s.MaxMS, 100*s.BudgetRemaining)
+	}
+	return tw.Flush()
+}
+
+// printDOT renders g as a Graphviz digraph with edges labelled by count.
+func printDOT(w io.Writer, g report.Graph) error {
+	shapes := map[string]string{
+		report.NodeClient:    "box",
+		report.NodeHost:      "ellipse",
+		report.NodeOperation: "note",
+	}
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "digraph dependencies {")
+	fmt.Fprintln(bw, "  rankdir=LR;")
+	for _, n := range g.Nodes {
+		fmt.Fprintf(bw, "  %s [label=%s, shape=%s];\n", dotQuote(n.ID), dotQuote(n.Label), shapes[n.Kind])
+	}
+	for _, e := range g.Edges {
+		fmt.Fprintf(bw, "  %s -> %s [label=\"%d\"];\n", dotQuote(e.From), dotQuote(e.To), e.Count)
+	}
+	fmt.Fprintln(bw, "}")
+	return bw.Flush()
+}
+
+var dotEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func dotQuote(s string) string { return `"` + dotEscaper.Replace(s) + `"` }
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
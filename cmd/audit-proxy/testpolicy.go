@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/kdhira/audit-proxy/internal/config"
+	"github.com/kdhira/audit-proxy/internal/proxy"
+)
+
+// policyFixtures is the file test-policy reads.
+type policyFixtures struct {
+	Cases []policyCase `yaml:"cases"`
+}
+
+// policyCase is one example request and the decision expected for it.
+type policyCase struct {
+	Name    string            `yaml:"name"`
+	Method  string            `yaml:"method"` // default GET
+	Scheme  string            `yaml:"scheme"` // default https
+	Host    string            `yaml:"host"`
+	Path    string            `yaml:"path"`
+	Headers map[string]string `yaml:"headers"`
+	Body    string            `yaml:"body"`
+	User    string            `yaml:"user"`   // authenticated proxy user
+	Source  string            `yaml:"source"` // default 127.0.0.1
+	Expect  policyExpect      `yaml:"expect"`
+}
+
+// policyExpect lists the expected parts of a decision; unset fields are
+// not checked. Reason matches as a substring.
+type policyExpect struct {
+	Outcome    string         `yaml:"outcome"`
+	Status     int            `yaml:"status"`
+	Filter     string         `yaml:"filter"`
+	Reason     string         `yaml:"reason"`
+	Profile    string         `yaml:"profile"`
+	Client     string         `yaml:"client"`
+	Service    string         `yaml:"service"`
+	Attributes map[string]any `yaml:"attributes"`
+}
+
+// runTestPolicy implements "audit-proxy test-policy [-v] fixtures.yaml
+// [proxy flags]", checking the example requests of a fixtures file against
+// the configuration the proxy flags (and environment) select.
+func runTestPolicy(args []string) error {
+	fs := flag.NewFlagSet("test-policy", flag.ContinueOnError)
+	verbose := fs.Bool("v", false, "list passing cases too")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errors.New("usage: audit-proxy test-policy [-v] fixtures.yaml [proxy flags]")
+	}
+	data, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	var fx policyFixtures
+	if err := yaml.Unmarshal(data, &fx); err != nil {
+		return fmt.Errorf("%s: %w", fs.Arg(0), err)
+	}
+	cfg, err := config.Load(fs.Args()[1:])
+	if err != nil {
+		return err
+	}
+	checker, err := proxy.NewPolicyChecker(cfg)
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for i, c := range fx.Cases {
+		name := c.Name
+		if name == "" {
+			name = fmt.Sprintf("cases[%d]", i)
+		}
+		req, err := c.request()
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		source := c.Source
+		if source == "" {
+			source = "127.0.0.1"
+		}
+		d := checker.Check(req, c.User, source)
+		if problems := c.Expect.check(d); len(problems) > 0 {
+			failed++
+			fmt.Printf("FAIL  %s\n", name)
+			for _, p := range problems {
+				fmt.Printf("      %s\n", p)
+			}
+		} else if *verbose {
+			fmt.Printf("ok    %s: %s\n", name, describe(d))
+		}
+	}
+	fmt.Printf("%d passed, %d failed\n", len(fx.Cases)-failed, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d of %d policy cases failed", failed, len(fx.Cases))
+	}
+	return nil
+}
+
+// request builds the absolute-form request c describes.
+func (c policyCase) request() (*http.Request, error) {
+	if c.Host == "" {
+		return nil, errors.New("host is required")
+	}
+	scheme := c.Scheme
+	if scheme == "" {
+		scheme = "https"
+	}
+	path := c.Path
+	if path == "" {
+		path = "/"
+	}
+	u, err := url.Parse(scheme + "://" + c.Host + path)
+	if err != nil {
+		return nil, err
+	}
+	method := c.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	var body io.Reader
+	if c.Body != "" {
+		body = strings.NewReader(c.Body)
+	}
+	req, err := http.NewRequest(strings.ToUpper(method), u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range c.Headers {
+		req.Header.Set(k, v)
+	}
+	return req, nil
+}
+
+// check returns how d differs from what e expects.
+func (e policyExpect) check(d proxy.Decision) []string {
+	var out []string
+	mismatch := func(what string, got, want any) {
+		out = append(out, fmt.Sprintf("%s: got %v, want %v", what, got, want))
+	}
+	if e.Outcome != "" && d.Outcome != e.Outcome {
+		mismatch("outcome", describe(d), e.Outcome)
+	}
+	if e.Status != 0 && d.Status != e.Status {
+		mismatch("status", d.Status, e.Status)
+	}
+	if e.Filter != "" && d.Filter != e.Filter {
+		mismatch("filter", orDash(d.Filter), e.Filter)
+	}
+	if e.Reason != "" && !strings.Contains(d.Reason, e.Reason) {
+		mismatch("reason", fmt.Sprintf("%q", d.Reason), fmt.Sprintf("%q", e.Reason))
+	}
+	if e.Profile != "" && d.Profile != e.Profile {
+		mismatch("profile", orDash(d.Profile), e.Profile)
+	}
+	if e.Client != "" && d.Client != e.Client {
+		mismatch("client", orDash(d.Client), e.Client)
+	}
+	if e.Service != "" && d.Service != e.Service {
+		mismatch("service", orDash(d.Service), e.Service)
+	}
+	for _, k := range slices.Sorted(maps.Keys(e.Attributes)) {
+		got, ok := d.Attributes[k]
+		if want := e.Attributes[k]; !ok || fmt.Sprint(got) != fmt.Sprint(want) {
+			mismatch("attribute "+k, got, want)
+		}
+	}
+	return out
+}
+
+// describe summarises d in one line.
+func describe(d proxy.Decision) string {
+	s := d.Outcome
+	if d.Status != 0 {
+		s += fmt.Sprintf(" %d", d.Status)
+	}
+	if d.Filter != "" {
+		s += " by " + d.Filter
+	}
+	if d.Reason != "" {
+		s += fmt.Sprintf(" (%s)", d.Reason)
+	}
+	if d.Profile != "" {
+		s += ", profile " + d.Profile
+	}
+	return s
+}
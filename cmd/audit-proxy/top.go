@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/kdhira/audit-proxy/internal/proxy"
+)
+
+// Rows shown per table by "audit-proxy top".
+const topRows = 10
+
+// runTop implements "audit-proxy top [-addr host:port] [-interval d]
+// [-once]", a live terminal view of a running proxy polled from the admin
+// API on its metrics address.
+func runTop(args []string) error {
+	fs := flag.NewFlagSet("top", flag.ContinueOnError)
+	addr := fs.String("addr", "127.0.0.1:9090", "metrics_addr of the proxy")
+	interval := fs.Duration("interval", 2*time.Second, "refresh interval")
+	once := fs.Bool("once", false, "print one snapshot and exit")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *interval <= 0 {
+		return errors.New("top: interval must be positive")
+	}
+	url := "http://" + *addr + "/admin/activity"
+	client := &http.Client{Timeout: 5 * time.Second}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	var prev *proxy.Activity
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		cur, err := fetchActivity(ctx, client, url)
+		if err != nil {
+			return err
+		}
+		w := bufio.NewWriter(os.Stdout)
+		if !*once {
+			w.WriteString("\x1b[H\x1b[2J") // home and clear
+		}
+		renderTop(w, *addr, prev, cur)
+		if err := w.Flush(); err != nil || *once {
+			return err
+		}
+		prev = cur
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func fetchActivity(ctx context.Context, client *http.Client, url string) (*proxy.Activity, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("top: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return nil, fmt.Errorf("top: %s answered %s", url, resp.Status)
+	}
+	var a proxy.Activity
+	if err := json.NewDecoder(resp.Body).Decode(&a); err != nil {
+		return nil, fmt.Errorf("top: decode activity: %w", err)
+	}
+	return &a, nil
+}
+
+// renderTop writes the view of cur. Rates are over the time since prev;
+// without prev they are left blank.
+func renderTop(w io.Writer, addr string, prev, cur *proxy.Activity) {
+	var secs float64
+	if prev != nil {
+		secs = cur.Time.Sub(prev.Time).Seconds()
+	}
+	rate := func(now, before int64) string {
+		if secs <= 0 {
+			return "-"
+		}
+		return fmt.Sprintf("%.1f/s", float64(now-before)/secs)
+	}
+	var before proxy.Activity
+	prevHosts := map[string]proxy.HostActivity{}
+	if prev != nil {
+		before = *prev
+		for _, h := range prev.Hosts {
+			prevHosts[h.Host] = h
+		}
+	}
+
+	fmt.Fprintf(w, "audit-proxy top  %s  %s\n\n", addr, cur.Time.Local().Format(time.TimeOnly))
+	fmt.Fprintf(w, "requests %s (%d)   blocked %s (%d)   tokens in %s (%d)  out %s (%d)\n\n",
+		rate(cur.Requests, before.Requests), cur.Requests,
+		rate(cur.Blocked, before.Blocked), cur.Blocked,
+		rate(cur.InputTokens, before.InputTokens), cur.InputTokens,
+		rate(cur.OutputTokens, before.OutputTokens), cur.OutputTokens)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "HOST\tREQ/S\tREQUESTS\tBLOCKED\tTOKENS IN\tTOKENS OUT")
+	for _, h := range cur.Hosts[:min(len(cur.Hosts), topRows)] {
+		p := prevHosts[h.Host]
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\t%d\n", h.Host, rate(h.Requests, p.Requests),
+			h.Requests, h.Blocked, h.InputTokens, h.OutputTokens)
+	}
+	tw.Flush()
+
+	fmt.Fprintf(w, "\nACTIVE TUNNELS (%d)\n", len(cur.Tunnels))
+	tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TARGET\tCLIENT\tUSER\tMITM\tOPEN")
+	for _, t := range cur.Tunnels[:min(len(cur.Tunnels), topRows)] {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%v\t%s\n", t.Target, t.Client, t.User, t.MITM,
+			cur.Time.Sub(t.Since).Round(time.Second))
+	}
+	tw.Flush()
+
+	if len(cur.Filters) > 0 {
+		fmt.Fprintf(w, "\nFILTERS\n")
+		tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "FILTER\tPHASE\tEVALUATIONS\tBLOCKS\tMEAN MS\tMAX MS")
+		for _, f := range cur.Filters[:min(len(cur.Filters), topRows)] {
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%.3f\t%.3f\n", f.Name, f.Phase, f.Evaluations, f.Blocks, f.MeanMS, f.MaxMS)
+		}
+		tw.Flush()
+	}
+
+	fmt.Fprintf(w, "\nRECENT BLOCKS\n")
+	tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tHOST\tCLIENT\tFILTER\tREASON")
+	blocks := cur.RecentBlocks[max(len(cur.RecentBlocks)-topRows, 0):]
+	for i := len(blocks) - 1; i >= 0; i-- {
+		b := blocks[i]
+		filter := b.Filter
+		if filter == "" {
+			filter = "proxy"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", b.Time.Local().Format(time.TimeOnly), b.Host,
+			b.Client, filter, strings.ReplaceAll(b.Reason, "\n", " "))
+	}
+	tw.Flush()
+}
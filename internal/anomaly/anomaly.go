@@ -0,0 +1,184 @@
+// Package anomaly learns per-host response status and latency behaviour and
+// flags sudden deviations such as 401 storms or latency doubling.
+//
+// Each host keeps a slow and a fast exponentially weighted moving average of
+// its latency and of the share of responses in a few status classes. An
+// anomaly is reported when the fast average departs far enough from the
+// slow baseline. Memory is bounded by the number of tracked hosts.
+package anomaly
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/kdhira/audit-proxy/internal/config"
+)
+
+const (
+	slowAlpha = 0.02
+	fastAlpha = 0.2
+)
+
+// Kinds of anomaly.
+const (
+	KindStatusSpike = "status_spike"
+	KindLatency     = "latency_increase"
+)
+
+// classes are the status classes tracked per host. A spike in 4xx is not
+// reported when one of the specific 4xx classes before it already spiked.
+var classes = []struct {
+	name    string
+	general bool
+	match   func(status int) bool
+}{
+	{"401", false, func(s int) bool { return s == 401 }},
+	{"403", false, func(s int) bool { return s == 403 }},
+	{"429", false, func(s int) bool { return s == 429 }},
+	{"4xx", true, func(s int) bool { return s >= 400 && s < 500 }},
+	{"5xx", false, func(s int) bool { return s >= 500 }},
+}
+
+// Anomaly is one detected deviation.
+type Anomaly struct {
+	Host     string
+	Kind     string
+	Class    string // status class for KindStatusSpike
+	Baseline float64
+	Current  float64
+	Samples  int
+}
+
+// Message describes the anomaly for humans.
+func (a Anomaly) Message() string {
+	if a.Kind == KindLatency {
+		return fmt.Sprintf("latency to %s rose from %.0fms to %.0fms", a.Host, a.Baseline, a.Current)
+	}
+	return fmt.Sprintf("%s responses from %s rose from %.0f%% to %.0f%%", a.Class, a.Host, a.Baseline*100, a.Current*100)
+}
+
+type hostStats struct {
+	samples  int
+	lastSeen time.Time
+	slowLat  float64
+	fastLat  float64
+	slowRate [5]float64
+	fastRate [5]float64
+	alerted  map[string]time.Time
+}
+
+// Detector tracks hosts and reports anomalies. It is safe for concurrent
+// use.
+type Detector struct {
+	cfg config.AnomalyConfig
+
+	mu    sync.Mutex
+	hosts map[string]*hostStats
+}
+
+// New returns a Detector; zero config fields take their defaults.
+func New(cfg config.AnomalyConfig) *Detector {
+	if cfg.MinSamples <= 0 {
+		cfg.MinSamples = 50
+	}
+	if cfg.StatusDelta <= 0 {
+		cfg.StatusDelta = 0.25
+	}
+	if cfg.LatencyFactor <= 1 {
+		cfg.LatencyFactor = 2
+	}
+	if cfg.MinLatencyMS <= 0 {
+		cfg.MinLatencyMS = 100
+	}
+	if cfg.Cooldown <= 0 {
+		cfg.Cooldown = 5 * time.Minute
+	}
+	if cfg.MaxHosts <= 0 {
+		cfg.MaxHosts = 1000
+	}
+	return &Detector{cfg: cfg, hosts: map[string]*hostStats{}}
+}
+
+// Observe records one response and returns any anomalies it triggers.
+func (d *Detector) Observe(host string, status int, latency time.Duration, now time.Time) []Anomaly {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	hs := d.hosts[host]
+	if hs == nil {
+		d.evict()
+		hs = &hostStats{alerted: map[string]time.Time{}}
+		d.hosts[host] = hs
+	}
+	hs.lastSeen = now
+	ms := float64(latency) / float64(time.Millisecond)
+
+	if hs.samples == 0 {
+		hs.slowLat, hs.fastLat = ms, ms
+	} else {
+		hs.slowLat += slowAlpha * (ms - hs.slowLat)
+		hs.fastLat += fastAlpha * (ms - hs.fastLat)
+	}
+	for i, c := range classes {
+		x := 0.0
+		if c.match(status) {
+			x = 1
+		}
+		if hs.samples == 0 {
+			hs.slowRate[i], hs.fastRate[i] = x, x
+			continue
+		}
+		hs.slowRate[i] += slowAlpha * (x - hs.slowRate[i])
+		hs.fastRate[i] += fastAlpha * (x - hs.fastRate[i])
+	}
+	hs.samples++
+	if hs.samples < d.cfg.MinSamples {
+		return nil
+	}
+
+	var out []Anomaly
+	specific := false // a 401/403/429 spike was seen
+	for i, c := range classes {
+		if hs.fastRate[i]-hs.slowRate[i] < d.cfg.StatusDelta || (c.general && specific) {
+			continue
+		}
+		specific = specific || !c.general
+		out = d.alert(out, hs, now, Anomaly{
+			Host: host, Kind: KindStatusSpike, Class: c.name,
+			Baseline: hs.slowRate[i], Current: hs.fastRate[i], Samples: hs.samples,
+		})
+	}
+	if hs.fastLat >= d.cfg.MinLatencyMS && hs.fastLat >= hs.slowLat*d.cfg.LatencyFactor {
+		out = d.alert(out, hs, now, Anomaly{
+			Host: host, Kind: KindLatency,
+			Baseline: hs.slowLat, Current: hs.fastLat, Samples: hs.samples,
+		})
+	}
+	return out
+}
+
+// alert appends a unless the same kind/class fired within the cooldown.
+func (d *Detector) alert(out []Anomaly, hs *hostStats, now time.Time, a Anomaly) []Anomaly {
+	key := a.Kind + "/" + a.Class
+	if last, ok := hs.alerted[key]; ok && now.Sub(last) < d.cfg.Cooldown {
+		return out
+	}
+	hs.alerted[key] = now
+	return append(out, a)
+}
+
+// evict drops the least recently seen host when the table is full.
+func (d *Detector) evict() {
+	if len(d.hosts) < d.cfg.MaxHosts {
+		return
+	}
+	var oldest string
+	var oldestAt time.Time
+	for h, s := range d.hosts {
+		if oldest == "" || s.lastSeen.Before(oldestAt) {
+			oldest, oldestAt = h, s.lastSeen
+		}
+	}
+	delete(d.hosts, oldest)
+}
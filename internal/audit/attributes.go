@@ -0,0 +1,140 @@
+package audit
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"sync"
+)
+
+// Attributes collects annotations made while a request is in flight, for
+// example by filters, before they are copied into the Entry. It also
+// holds the query parameters to mask in the entry's URLs.
+type Attributes struct {
+	mu    sync.Mutex
+	m     map[string]any
+	query []string // parameters to mask; see RedactQuery
+}
+
+type attributesKey struct{}
+
+// WithAttributes returns a context carrying a fresh attribute set.
+func WithAttributes(ctx context.Context) (context.Context, *Attributes) {
+	a := &Attributes{m: map[string]any{}}
+	return context.WithValue(ctx, attributesKey{}, a), a
+}
+
+// Annotate records key=value on the attribute set carried by ctx. It is a
+// no-op if ctx carries none.
+func Annotate(ctx context.Context, key string, value any) {
+	if a, ok := ctx.Value(attributesKey{}).(*Attributes); ok {
+		a.Set(key, value)
+	}
+}
+
+// AnnotateAppend appends value to the list recorded under key on the
+// attribute set carried by ctx.
+func AnnotateAppend(ctx context.Context, key, value string) {
+	if a, ok := ctx.Value(attributesKey{}).(*Attributes); ok {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		list, _ := a.m[key].([]string)
+		a.m[key] = append(list, value)
+	}
+}
+
+// RedactQuery has the values of the query parameters named in params masked
+// in the URLs of the entry the attribute set carried by ctx is copied into:
+// the request URL, raw target, canonical URL and the URL attributes. It is a
+// no-op if ctx carries no attribute set.
+func RedactQuery(ctx context.Context, params ...string) {
+	if a, ok := ctx.Value(attributesKey{}).(*Attributes); ok {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		for _, p := range params {
+			if !slices.Contains(a.query, p) {
+				a.query = append(a.query, p)
+			}
+		}
+	}
+}
+
+// RedactURL returns rawURL with the query parameters named by RedactQuery
+// masked.
+func (a *Attributes) RedactURL(rawURL string) string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return RedactQueryParams(rawURL, a.query)
+}
+
+// Set records key=value.
+func (a *Attributes) Set(key string, value any) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.m[key] = value
+}
+
+// CopyTo merges the collected attributes into e.
+func (a *Attributes) CopyTo(e *Entry) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.m) == 0 {
+		return
+	}
+	if e.Attributes == nil {
+		e.Attributes = make(map[string]any, len(a.m))
+	}
+	maps.Copy(e.Attributes, a.m)
+	a.redactURLs(e)
+}
+
+// RedactURLs masks the query parameters named by RedactQuery in the URLs of
+// e, as CopyTo does.
+func (a *Attributes) RedactURLs(e *Entry) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.redactURLs(e)
+}
+
+func (a *Attributes) redactURLs(e *Entry) {
+	if len(a.query) == 0 {
+		return
+	}
+	r := &e.Request
+	r.URL = RedactQueryParams(r.URL, a.query)
+	r.RawTarget = RedactQueryParams(r.RawTarget, a.query)
+	r.CanonicalURL = RedactQueryParams(r.CanonicalURL, a.query)
+	for _, k := range urlAttributes {
+		if u, ok := e.Attributes[k].(string); ok {
+			e.Attributes[k] = RedactQueryParams(u, a.query)
+		}
+	}
+}
+
+// urlAttributes are the attributes holding URLs.
+var urlAttributes = []string{AttrTransformURL, AttrRewriteURL, AttrRewriteOriginalURL, "failover.url"}
+
+// Attribute keys for deprecation notices and API versions, shared by the
+// proxy, profiles, filters and reports.
+const (
+	AttrDeprecated        = "deprecated"
+	AttrDeprecationSource = "deprecation.source"
+	AttrDeprecationNote   = "deprecation.note"
+	AttrDeprecationDate   = "deprecation.date"
+	AttrSunset            = "sunset"
+	AttrAPIVersion        = "api_version"
+)
+
+// Attribute keys for request transformations: the names of the transforms
+// applied and the URL sent upstream after rewriting.
+const (
+	AttrTransform    = "transform"
+	AttrTransformURL = "transform.url"
+)
+
+// Attribute keys for URL rewrites: the URL a rewrite filter saw and the one
+// it sent upstream.
+const (
+	AttrRewriteOriginalURL = "rewrite.original_url"
+	AttrRewriteURL         = "rewrite.url"
+)
@@ -0,0 +1,145 @@
+package audit
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Codec compresses excerpts. Codecs are registered by name, which is
+// recorded with each compressed excerpt so readers can reverse it.
+type Codec interface {
+	Name() string
+	Compress(p []byte) ([]byte, error)
+	Decompress(p []byte) ([]byte, error)
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[string]Codec{"gzip": gzipCodec{}}
+)
+
+// RegisterCodec makes c available by its name, replacing any codec of that
+// name.
+func RegisterCodec(c Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	codecs[c.Name()] = c
+}
+
+// CodecByName returns the registered codec called name.
+func CodecByName(name string) (Codec, error) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	c, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown excerpt codec %q (have %s)", name, strings.Join(slices.Sorted(maps.Keys(codecs)), ", "))
+	}
+	return c, nil
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) Name() string { return "gzip" }
+
+func (gzipCodec) Compress(p []byte) ([]byte, error) {
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	if _, err := w.Write(p); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (gzipCodec) Decompress(p []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(p))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+// base64Suffix marks the text wrapping of a compressed excerpt in its
+// excerpt_encoding, after the codec name.
+const base64Suffix = "+base64"
+
+// ExcerptCompression compresses the excerpts of entries FileLogger writes.
+// Excerpts shorter than MinBytes, or that do not shrink, are left as they
+// are.
+type ExcerptCompression struct {
+	Codec    Codec // nil disables compression
+	MinBytes int
+}
+
+// apply returns e with its excerpts compressed. e's response is copied
+// rather than modified, as other loggers may hold the same entry.
+func (c ExcerptCompression) apply(e Entry) Entry {
+	if c.Codec == nil {
+		return e
+	}
+	e.Request.Excerpt, e.Request.ExcerptEncoding = c.compress(e.Request.Excerpt, e.Request.ExcerptEncoding)
+	if e.Response != nil && e.Response.Excerpt != "" {
+		resp := *e.Response
+		resp.Excerpt, resp.ExcerptEncoding = c.compress(resp.Excerpt, resp.ExcerptEncoding)
+		e.Response = &resp
+	}
+	return e
+}
+
+func (c ExcerptCompression) compress(s, encoding string) (string, string) {
+	if encoding != "" || len(s) == 0 || len(s) < c.MinBytes {
+		return s, encoding
+	}
+	z, err := c.Codec.Compress([]byte(s))
+	if err != nil || base64.StdEncoding.EncodedLen(len(z)) >= len(s) {
+		return s, encoding
+	}
+	return base64.StdEncoding.EncodeToString(z), c.Codec.Name() + base64Suffix
+}
+
+// DecompressExcerpts restores compressed excerpts of e in place.
+func DecompressExcerpts(e *Entry) error {
+	var err error
+	e.Request.Excerpt, e.Request.ExcerptEncoding, err = decompress(e.Request.Excerpt, e.Request.ExcerptEncoding)
+	if err != nil {
+		return fmt.Errorf("request excerpt: %w", err)
+	}
+	if r := e.Response; r != nil {
+		if r.Excerpt, r.ExcerptEncoding, err = decompress(r.Excerpt, r.ExcerptEncoding); err != nil {
+			return fmt.Errorf("response excerpt: %w", err)
+		}
+	}
+	return nil
+}
+
+func decompress(s, encoding string) (string, string, error) {
+	if encoding == "" {
+		return s, "", nil
+	}
+	name, ok := strings.CutSuffix(encoding, base64Suffix)
+	if !ok {
+		return "", "", fmt.Errorf("unknown excerpt encoding %q", encoding)
+	}
+	c, err := CodecByName(name)
+	if err != nil {
+		return "", "", err
+	}
+	z, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return "", "", err
+	}
+	p, err := c.Decompress(z)
+	if err != nil {
+		return "", "", err
+	}
+	return string(p), "", nil
+}
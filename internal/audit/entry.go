@@ -0,0 +1,176 @@
+// Package audit defines the audit record written for every proxied exchange,
+// the Logger sinks that persist them, and the redaction applied before
+// anything is written.
+package audit
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"time"
+)
+
+// Entry kinds.
+const (
+	KindHTTP    = "http"    // plain HTTP request in proxy form
+	KindMITM    = "mitm"    // request decrypted from an intercepted tunnel
+	KindConnect = "connect" // opaque CONNECT tunnel
+	KindAnomaly = "anomaly" // traffic anomaly detected by the proxy
+	KindDrain   = "drain"   // summary of the drain on shutdown
+	KindShadow  = "shadow"  // request mirrored to a shadow upstream
+	KindLeaf    = "leaf"    // leaf certificate issued for interception
+
+	KindUnaudited = "unaudited" // counts of traffic passed through unaudited
+)
+
+// Entry levels. Entries describing traffic leave Level empty.
+const (
+	LevelWarn = "warn"
+)
+
+// Entry phases. Without two-phase logging entries have no phase.
+const (
+	PhaseStart  = "start"  // written before the request or tunnel goes upstream
+	PhaseFinish = "finish" // written when the exchange completes
+)
+
+// Entry is one audit record. Entries are written as a single JSON line.
+type Entry struct {
+	ID    string    `json:"id"`
+	Time  time.Time `json:"time"`
+	Kind  string    `json:"kind"`
+	Level string    `json:"level,omitempty"`
+	// Phase marks the start and finish records of a two-phase exchange,
+	// which share an ID.
+	Phase     string            `json:"phase,omitempty"`
+	Conn      ConnMetadata      `json:"conn"`
+	Request   RequestMetadata   `json:"request"`
+	Response  *ResponseMetadata `json:"response,omitempty"`
+	Profile   string            `json:"profile,omitempty"`
+	Operation string            `json:"operation,omitempty"`
+	// Service is the canonical name of the target from the services table,
+	// shared by all of its hostnames.
+	Service string `json:"service,omitempty"`
+	// Fingerprint identifies the request by method, normalised URL,
+	// selected headers and body, for forwarded requests.
+	Fingerprint string `json:"fingerprint,omitempty"`
+
+	DurationMS int64 `json:"duration_ms"`
+	BytesIn    int64 `json:"bytes_in"`
+	BytesOut   int64 `json:"bytes_out"`
+
+	Blocked bool   `json:"blocked,omitempty"`
+	Filter  string `json:"filter,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+	Error   string `json:"error,omitempty"`
+
+	Attributes map[string]any `json:"attributes,omitempty"`
+}
+
+// ConnMetadata describes the client connection and the upstream target.
+type ConnMetadata struct {
+	ClientAddr string `json:"client_addr,omitempty"`
+	// User is the identity authenticated with Proxy-Authorization, and
+	// AuthMethod how it was established ("basic" or "bearer").
+	User       string `json:"user,omitempty"`
+	AuthMethod string `json:"auth_method,omitempty"`
+	// Client is the name of the client policy applied, if any.
+	Client string `json:"client,omitempty"`
+	Target string `json:"target,omitempty"`
+	// Upstream is the pool endpoint the request was routed to, when the
+	// target is served by an upstream pool.
+	Upstream string `json:"upstream,omitempty"`
+	// ResolvedIP is the upstream address the proxy connected to.
+	ResolvedIP string `json:"resolved_ip,omitempty"`
+	TLS        bool   `json:"tls,omitempty"`
+	// Workload is where the client connection came from, when workload
+	// resolution is configured and finds it.
+	Workload *Workload `json:"workload,omitempty"`
+	// ClientCert is the certificate the client presented to the proxy on
+	// an intercepted tunnel that requested one.
+	ClientCert *ClientCert `json:"client_cert,omitempty"`
+	// ClientTLS is what the client negotiated with the proxy on an
+	// intercepted tunnel.
+	ClientTLS *TLSSession `json:"client_tls,omitempty"`
+}
+
+// TLSSession describes the parameters of a TLS connection.
+type TLSSession struct {
+	Version     string `json:"version"`      // "1.2", "1.3"
+	CipherSuite string `json:"cipher_suite"` // Go name
+	ALPN        string `json:"alpn,omitempty"`
+	ServerName  string `json:"server_name,omitempty"`
+}
+
+// ClientCert describes a TLS client certificate.
+type ClientCert struct {
+	Subject string `json:"subject"`
+	Issuer  string `json:"issuer,omitempty"`
+	Serial  string `json:"serial,omitempty"` // hex
+	SHA256  string `json:"sha256"`           // of the DER certificate, hex
+	// Verified is set when the certificate chained to a configured CA.
+	Verified bool `json:"verified,omitempty"`
+}
+
+// Workload identifies the pod, container or host process behind a client
+// connection.
+type Workload struct {
+	Kind      string `json:"kind"` // pod, container or process
+	Name      string `json:"name,omitempty"`
+	Namespace string `json:"namespace,omitempty"` // pods; compose project for containers
+	Container string `json:"container,omitempty"` // the container within a pod, if known
+	// ContainerID is the runtime's ID of the container, if known.
+	ContainerID string `json:"container_id,omitempty"`
+	// Image is the container's image or, for a pod matched by address, the
+	// images of its containers, comma-separated.
+	Image string `json:"image,omitempty"`
+	PID   int    `json:"pid,omitempty"` // processes found through /proc
+}
+
+// RequestMetadata describes the request sent upstream.
+type RequestMetadata struct {
+	Method           string      `json:"method,omitempty"`
+	URL              string      `json:"url,omitempty"`
+	Host             string      `json:"host,omitempty"`
+	Headers          http.Header `json:"headers,omitempty"`
+	Excerpt          string      `json:"excerpt,omitempty"`
+	ExcerptTruncated bool        `json:"excerpt_truncated,omitempty"`
+	ExcerptEncoding  string      `json:"excerpt_encoding,omitempty"` // e.g. gzip+base64; see ExcerptCompression
+	// RawTarget is the request target as the client sent it, and
+	// CanonicalURL the normalised URL, each kept when it differs from URL.
+	RawTarget    string `json:"raw_target,omitempty"`
+	CanonicalURL string `json:"canonical_url,omitempty"`
+	// HostMismatch is set when the Host header named another host than the
+	// URL or, for intercepted requests, the tunnel; HostHeader holds it.
+	HostMismatch bool   `json:"host_mismatch,omitempty"`
+	HostHeader   string `json:"host_header,omitempty"`
+}
+
+// ResponseMetadata describes the upstream response.
+type ResponseMetadata struct {
+	Status           int         `json:"status"`
+	Headers          http.Header `json:"headers,omitempty"`
+	Excerpt          string      `json:"excerpt,omitempty"`
+	ExcerptTruncated bool        `json:"excerpt_truncated,omitempty"`
+	ExcerptEncoding  string      `json:"excerpt_encoding,omitempty"` // e.g. gzip+base64; see ExcerptCompression
+}
+
+// NewEntry returns an Entry with a fresh ID and the current time.
+func NewEntry(kind string) Entry {
+	return Entry{ID: NewID(), Time: time.Now().UTC(), Kind: kind}
+}
+
+// NewID returns a random 128-bit identifier in hex.
+func NewID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// SetAttribute sets a single attribute, allocating the map if needed.
+func (e *Entry) SetAttribute(key string, value any) {
+	if e.Attributes == nil {
+		e.Attributes = map[string]any{}
+	}
+	e.Attributes[key] = value
+}
@@ -0,0 +1,222 @@
+package audit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Logger persists audit entries. Implementations must be safe for
+// concurrent use.
+type Logger interface {
+	Log(e Entry) error
+	Close() error
+}
+
+// Sync modes for SyncPolicy.
+const (
+	SyncNone     = "none"     // leave write-back to the OS
+	SyncAlways   = "always"   // fsync before Log returns
+	SyncPeriodic = "periodic" // fsync every Entries entries or Interval
+)
+
+// SyncPolicy sets how durably FileLogger writes entries. The zero value is
+// SyncNone. With SyncPeriodic, a zero Entries syncs on Interval alone and a
+// zero Interval defaults to one second.
+type SyncPolicy struct {
+	Mode     string
+	Entries  int
+	Interval time.Duration
+}
+
+// TimeFormat sets how FileLogger writes entry times. The zero value writes
+// UTC RFC 3339 times with trailing fractional zeros trimmed.
+type TimeFormat struct {
+	// Precision fixes the fractional digits: time.Second, Millisecond,
+	// Microsecond or Nanosecond. Zero trims trailing zeros.
+	Precision time.Duration
+	// Location is the zone times are written in, as an offset; nil for UTC.
+	Location *time.Location
+	// EpochMillis adds time_ms, milliseconds since the Unix epoch.
+	EpochMillis bool
+}
+
+// timedEntry is an Entry with its time formatted by a TimeFormat. Its
+// fields shadow Entry's time when encoded.
+type timedEntry struct {
+	Time   string `json:"time"`
+	TimeMS int64  `json:"time_ms,omitempty"`
+	Entry
+}
+
+// apply returns e ready for encoding under f.
+func (f TimeFormat) apply(e Entry) any {
+	if f == (TimeFormat{}) {
+		return e
+	}
+	t := e.Time
+	if f.Location != nil {
+		t = t.In(f.Location)
+	}
+	layout := time.RFC3339Nano
+	switch f.Precision {
+	case time.Second:
+		layout = time.RFC3339
+	case time.Millisecond:
+		layout = "2006-01-02T15:04:05.000Z07:00"
+	case time.Microsecond:
+		layout = "2006-01-02T15:04:05.000000Z07:00"
+	case time.Nanosecond:
+		layout = "2006-01-02T15:04:05.000000000Z07:00"
+	}
+	te := timedEntry{Time: t.Format(layout), Entry: e}
+	if f.EpochMillis {
+		te.TimeMS = e.Time.UnixMilli()
+	}
+	return te
+}
+
+// FileLogger appends entries as JSON lines to a file, or to stdout when the
+// path is "-". Writes to stdout are never synced.
+type FileLogger struct {
+	mu      sync.Mutex
+	w       io.Writer
+	c       io.Closer
+	f       *os.File // nil for stdout
+	enc     *json.Encoder
+	policy  SyncPolicy
+	format  TimeFormat
+	excerpt ExcerptCompression
+	pending int // entries written since the last sync
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// NewFileLogger opens path for appending, creating parent directories as
+// needed, syncs it according to policy, writes times as format says and
+// compresses excerpts as excerpt says.
+func NewFileLogger(path string, policy SyncPolicy, format TimeFormat, excerpt ExcerptCompression) (*FileLogger, error) {
+	if path == "" || path == "-" {
+		return newFileLogger(os.Stdout, nil, nil, SyncPolicy{}, format, excerpt), nil
+	}
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0o750); err != nil {
+			return nil, fmt.Errorf("create log directory: %w", err)
+		}
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return nil, fmt.Errorf("open audit log: %w", err)
+	}
+	return newFileLogger(f, f, f, policy, format, excerpt), nil
+}
+
+func newFileLogger(w io.Writer, c io.Closer, f *os.File, policy SyncPolicy, format TimeFormat, excerpt ExcerptCompression) *FileLogger {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	l := &FileLogger{w: w, c: c, f: f, enc: enc, policy: policy, format: format, excerpt: excerpt}
+	if f != nil && policy.Mode == SyncPeriodic {
+		if l.policy.Interval <= 0 {
+			l.policy.Interval = time.Second
+		}
+		l.stop, l.done = make(chan struct{}), make(chan struct{})
+		go l.syncLoop()
+	}
+	return l
+}
+
+// syncLoop syncs pending entries every Interval until Close.
+func (l *FileLogger) syncLoop() {
+	defer close(l.done)
+	t := time.NewTicker(l.policy.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-t.C:
+			l.mu.Lock()
+			if err := l.sync(); err != nil {
+				slog.Error("sync audit log", "err", err)
+			}
+			l.mu.Unlock()
+		}
+	}
+}
+
+// sync flushes pending entries to stable storage. The caller holds l.mu.
+func (l *FileLogger) sync() error {
+	if l.f == nil || l.pending == 0 {
+		return nil
+	}
+	l.pending = 0
+	return l.f.Sync()
+}
+
+// Log writes e as one JSON line, syncing as the policy requires.
+func (l *FileLogger) Log(e Entry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.enc.Encode(l.format.apply(l.excerpt.apply(e))); err != nil {
+		return err
+	}
+	l.pending++
+	switch l.policy.Mode {
+	case SyncAlways:
+		return l.sync()
+	case SyncPeriodic:
+		if l.policy.Entries > 0 && l.pending >= l.policy.Entries {
+			return l.sync()
+		}
+	}
+	return nil
+}
+
+// Close syncs any pending entries unless the policy is SyncNone and closes
+// the underlying file.
+func (l *FileLogger) Close() error {
+	if l.stop != nil {
+		close(l.stop)
+		<-l.done
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.c == nil {
+		return nil
+	}
+	var err error
+	if l.policy.Mode == SyncAlways || l.policy.Mode == SyncPeriodic {
+		err = l.sync()
+	}
+	return errors.Join(err, l.c.Close())
+}
+
+// Tee returns a Logger writing every entry to each of loggers in turn.
+// Closing it closes them all.
+func Tee(loggers ...Logger) Logger {
+	return tee(loggers)
+}
+
+type tee []Logger
+
+func (t tee) Log(e Entry) error {
+	var errs []error
+	for _, l := range t {
+		errs = append(errs, l.Log(e))
+	}
+	return errors.Join(errs...)
+}
+
+func (t tee) Close() error {
+	var errs []error
+	for _, l := range t {
+		errs = append(errs, l.Close())
+	}
+	return errors.Join(errs...)
+}
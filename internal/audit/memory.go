@@ -0,0 +1,178 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// MemoryLogger keeps the latest entries in memory, dropping the oldest once
+// it holds its capacity. It serves as a short-term store for tests and for
+// the admin API, which query it while entries keep arriving.
+type MemoryLogger struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	buf     []Entry
+	next    int    // slot the next entry goes in once buf is full
+	logged  uint64 // entries logged since creation or Reset
+	dropped uint64 // entries pushed out by newer ones
+}
+
+// NewMemoryLogger returns a MemoryLogger holding up to capacity entries. A
+// capacity below one is treated as one.
+func NewMemoryLogger(capacity int) *MemoryLogger {
+	l := &MemoryLogger{buf: make([]Entry, 0, max(capacity, 1))}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// Log stores e, dropping the oldest entry if the logger is full.
+func (l *MemoryLogger) Log(e Entry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.buf) < cap(l.buf) {
+		l.buf = append(l.buf, e)
+	} else {
+		l.buf[l.next] = e
+		l.next = (l.next + 1) % len(l.buf)
+		l.dropped++
+	}
+	l.logged++
+	l.cond.Broadcast()
+	return nil
+}
+
+// Close does nothing; the entries stay readable.
+func (l *MemoryLogger) Close() error { return nil }
+
+// Len returns the number of entries held.
+func (l *MemoryLogger) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.buf)
+}
+
+// Dropped returns the number of entries pushed out by newer ones.
+func (l *MemoryLogger) Dropped() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.dropped
+}
+
+// Entries returns a copy of the entries held, oldest first.
+func (l *MemoryLogger) Entries() []Entry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.snapshot()
+}
+
+// snapshot copies buf in logging order. The caller holds l.mu.
+func (l *MemoryLogger) snapshot() []Entry {
+	out := make([]Entry, 0, len(l.buf))
+	out = append(out, l.buf[l.next:]...)
+	return append(out, l.buf[:l.next]...)
+}
+
+// Filter returns the entries held for which fn reports true, oldest first.
+func (l *MemoryLogger) Filter(fn func(Entry) bool) []Entry {
+	var out []Entry
+	for _, e := range l.Entries() {
+		if fn(e) {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// Query returns the entries held that match q, oldest first.
+func (l *MemoryLogger) Query(q Query) []Entry {
+	out := l.Filter(q.Match)
+	if q.Limit > 0 && len(out) > q.Limit {
+		out = out[len(out)-q.Limit:]
+	}
+	return out
+}
+
+// Wait blocks until at least n entries have been logged since the logger
+// was created or last Reset, or ctx is done, and returns the entries held.
+// The error is ctx's if it ended the wait.
+func (l *MemoryLogger) Wait(ctx context.Context, n int) ([]Entry, error) {
+	stop := context.AfterFunc(ctx, func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.cond.Broadcast()
+	})
+	defer stop()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for l.logged < uint64(max(n, 0)) {
+		if err := ctx.Err(); err != nil {
+			return l.snapshot(), err
+		}
+		l.cond.Wait()
+	}
+	return l.snapshot(), nil
+}
+
+// Reset forgets the entries held and the counts.
+func (l *MemoryLogger) Reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	clear(l.buf)
+	l.buf, l.next, l.logged, l.dropped = l.buf[:0], 0, 0, 0
+}
+
+// WriteTo writes the entries held as JSON lines, the format of the audit
+// log, so a snapshot can be read back with ReadEntries.
+func (l *MemoryLogger) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	enc := json.NewEncoder(bw)
+	enc.SetEscapeHTML(false)
+	for _, e := range l.Entries() {
+		if err := enc.Encode(e); err != nil {
+			return cw.n, err
+		}
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Query selects entries from a MemoryLogger. Zero fields match anything.
+type Query struct {
+	Kind    string    // entry kind
+	Host    string    // request host
+	Client  string    // client policy name
+	User    string    // authenticated user
+	Blocked bool      // only blocked or denied entries
+	Since   time.Time // entries at or after this time
+	Limit   int       // at most this many, the latest
+}
+
+// Match reports whether e is selected by q, ignoring Limit.
+func (q Query) Match(e Entry) bool {
+	switch {
+	case q.Kind != "" && e.Kind != q.Kind,
+		q.Host != "" && e.Request.Host != q.Host,
+		q.Client != "" && e.Conn.Client != q.Client,
+		q.User != "" && e.Conn.User != q.User,
+		q.Blocked && !e.Blocked,
+		!q.Since.IsZero() && e.Time.Before(q.Since):
+		return false
+	}
+	return true
+}
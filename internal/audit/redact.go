@@ -0,0 +1,111 @@
+package audit
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Redacted replaces sensitive values in headers and excerpts.
+const Redacted = "***REDACTED***"
+
+// sensitiveHeaders are masked entirely, except for a Bearer/Basic scheme
+// prefix which is kept for context.
+var sensitiveHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+	"Set-Cookie":          true,
+	"X-Api-Key":           true,
+	"Api-Key":             true,
+	"Openai-Api-Key":      true,
+}
+
+// SanitiseHeaders returns a copy of h with credentials masked.
+func SanitiseHeaders(h http.Header) http.Header {
+	if h == nil {
+		return nil
+	}
+	out := make(http.Header, len(h))
+	for k, vs := range h {
+		ck := http.CanonicalHeaderKey(k)
+		if !sensitiveHeaders[ck] {
+			out[ck] = append([]string(nil), vs...)
+			continue
+		}
+		masked := make([]string, len(vs))
+		for i, v := range vs {
+			masked[i] = maskCredential(v)
+		}
+		out[ck] = masked
+	}
+	return out
+}
+
+func maskCredential(v string) string {
+	if scheme, _, ok := strings.Cut(v, " "); ok {
+		switch strings.ToLower(scheme) {
+		case "bearer", "basic", "token":
+			return scheme + " " + Redacted
+		}
+	}
+	return Redacted
+}
+
+var excerptPatterns = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	// OpenAI-style secret keys.
+	{regexp.MustCompile(`sk-[A-Za-z0-9_\-]{16,}`), Redacted},
+	// Bearer tokens embedded in bodies.
+	{regexp.MustCompile(`(?i)(bearer\s+)[A-Za-z0-9._~+/\-]+=*`), "${1}" + Redacted},
+	// JSON string fields with credential-like names.
+	{regexp.MustCompile(`(?i)("(?:api_key|apikey|access_token|refresh_token|client_secret|password|secret)"\s*:\s*)"(?:[^"\\]|\\.)*"`), `${1}"` + Redacted + `"`},
+}
+
+// RedactExcerpt masks credentials that appear in a body excerpt.
+func RedactExcerpt(s string) string {
+	for _, p := range excerptPatterns {
+		s = p.re.ReplaceAllString(s, p.repl)
+	}
+	return s
+}
+
+// RedactQueryParams returns rawURL with the values of the query parameters
+// named in params, compared without regard to case, masked. The rest of
+// rawURL is kept as it was written.
+func RedactQueryParams(rawURL string, params []string) string {
+	if len(params) == 0 {
+		return rawURL
+	}
+	base, query, ok := strings.Cut(rawURL, "?")
+	if !ok {
+		return rawURL
+	}
+	query, fragment, hasFragment := strings.Cut(query, "#")
+	pairs := strings.Split(query, "&")
+	for i, pair := range pairs {
+		k, _, _ := strings.Cut(pair, "=")
+		if name, err := url.QueryUnescape(k); err == nil && MatchesParam(name, params) {
+			pairs[i] = k + "=" + Redacted
+		}
+	}
+	out := base + "?" + strings.Join(pairs, "&")
+	if hasFragment {
+		out += "#" + fragment
+	}
+	return out
+}
+
+// MatchesParam reports whether the query parameter name is one of params,
+// compared without regard to case.
+func MatchesParam(name string, params []string) bool {
+	for _, p := range params {
+		if strings.EqualFold(name, p) {
+			return true
+		}
+	}
+	return false
+}
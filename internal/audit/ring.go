@@ -0,0 +1,228 @@
+package audit
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+// Ring file layout: a header followed by fixed-size slots, each holding one
+// JSON entry. A slot starts with its sequence number (0 when empty or being
+// rewritten), the length and CRC-32 of the data, then the data.
+const (
+	ringMagic      = "APRING1\n"
+	ringHeaderSize = 64
+	slotHeaderSize = 16
+
+	// DefaultRingEntries and DefaultRingSlotSize size a ring when the
+	// configuration leaves them zero.
+	DefaultRingEntries  = 1024
+	DefaultRingSlotSize = 16 << 10
+)
+
+// Ring keeps the most recent entries in a memory-mapped file. Writes land in
+// the shared mapping, so they survive a crash of the process without a
+// write system call; the OS writes them back to disk in its own time. It is
+// meant for forensics after a crash, not as an audit log.
+type Ring struct {
+	mu       sync.Mutex
+	f        *os.File
+	data     []byte
+	slots    int
+	slotSize int
+	next     uint64
+}
+
+// OpenRing opens or creates the ring file at path with room for entries
+// entries of up to slotSize bytes each. An existing ring of the same shape
+// is continued; one of a different shape is replaced.
+func OpenRing(path string, entries, slotSize int) (*Ring, error) {
+	if entries <= 0 {
+		entries = DefaultRingEntries
+	}
+	if slotSize <= 0 {
+		slotSize = DefaultRingSlotSize
+	}
+	if slotSize <= slotHeaderSize+64 {
+		return nil, fmt.Errorf("ring slot size %d is too small", slotSize)
+	}
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0o750); err != nil {
+			return nil, fmt.Errorf("create ring directory: %w", err)
+		}
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o640)
+	if err != nil {
+		return nil, fmt.Errorf("open ring: %w", err)
+	}
+	size := ringHeaderSize + entries*slotSize
+	hdr := make([]byte, ringHeaderSize)
+	_, _ = f.ReadAt(hdr, 0)
+	if !bytes.Equal(hdr[:8], []byte(ringMagic)) ||
+		binary.LittleEndian.Uint32(hdr[8:]) != uint32(slotSize) ||
+		binary.LittleEndian.Uint32(hdr[12:]) != uint32(entries) {
+		if err := f.Truncate(0); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("reset ring: %w", err)
+		}
+		clear(hdr)
+		copy(hdr, ringMagic)
+		binary.LittleEndian.PutUint32(hdr[8:], uint32(slotSize))
+		binary.LittleEndian.PutUint32(hdr[12:], uint32(entries))
+		if _, err := f.WriteAt(hdr, 0); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("write ring header: %w", err)
+		}
+	}
+	if err := f.Truncate(int64(size)); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("size ring: %w", err)
+	}
+	data, err := mapFile(f, size)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("map ring: %w", err)
+	}
+	r := &Ring{f: f, data: data, slots: entries, slotSize: slotSize}
+	for i := range entries {
+		r.next = max(r.next, binary.LittleEndian.Uint64(r.slot(i)))
+	}
+	r.next++
+	return r, nil
+}
+
+func (r *Ring) slot(i int) []byte {
+	off := ringHeaderSize + i*r.slotSize
+	return r.data[off : off+r.slotSize]
+}
+
+// Append stores e in the oldest slot. Entries too large for a slot are
+// stored without bodies, headers and attributes, or failing that as a stub
+// carrying only their identity.
+func (r *Ring) Append(e Entry) error {
+	data, err := r.fit(e)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	seq := r.next
+	r.next++
+	s := r.slot(int(seq % uint64(r.slots)))
+	// Clear the sequence first so a crash mid-write leaves the slot
+	// recognisably invalid rather than old data under a new checksum.
+	binary.LittleEndian.PutUint64(s, 0)
+	copy(s[slotHeaderSize:], data)
+	binary.LittleEndian.PutUint32(s[8:], uint32(len(data)))
+	binary.LittleEndian.PutUint32(s[12:], crc32.ChecksumIEEE(data))
+	binary.LittleEndian.PutUint64(s, seq)
+	return nil
+}
+
+func (r *Ring) fit(e Entry) ([]byte, error) {
+	limit := r.slotSize - slotHeaderSize
+	data, err := marshal(e)
+	if err != nil || len(data) <= limit {
+		return data, err
+	}
+	e.Request.Excerpt, e.Request.Headers, e.Attributes = "", nil, nil
+	if e.Response != nil {
+		resp := *e.Response
+		resp.Excerpt, resp.Headers = "", nil
+		e.Response = &resp
+	}
+	if data, err = marshal(e); err != nil || len(data) <= limit {
+		return data, err
+	}
+	return marshal(Entry{ID: e.ID, Time: e.Time, Kind: e.Kind, Error: "entry too large for ring slot"})
+}
+
+// marshal encodes e as FileLogger does, without the trailing newline.
+func marshal(e Entry) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(e); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// Close unmaps and closes the ring file.
+func (r *Ring) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return errors.Join(unmapFile(r.data), r.f.Close())
+}
+
+// ReadRing returns the valid entries of the ring file at path, oldest first,
+// as the raw JSON stored for each.
+func ReadRing(path string) ([][]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < ringHeaderSize || !bytes.Equal(b[:8], []byte(ringMagic)) {
+		return nil, fmt.Errorf("%s is not a ring file", path)
+	}
+	slotSize := int(binary.LittleEndian.Uint32(b[8:]))
+	entries := int(binary.LittleEndian.Uint32(b[12:]))
+	type rec struct {
+		seq  uint64
+		data []byte
+	}
+	var recs []rec
+	for i := range entries {
+		off := ringHeaderSize + i*slotSize
+		if off+slotSize > len(b) {
+			break
+		}
+		s := b[off : off+slotSize]
+		seq := binary.LittleEndian.Uint64(s)
+		n := int(binary.LittleEndian.Uint32(s[8:]))
+		if seq == 0 || n > slotSize-slotHeaderSize {
+			continue
+		}
+		data := s[slotHeaderSize : slotHeaderSize+n]
+		if crc32.ChecksumIEEE(data) != binary.LittleEndian.Uint32(s[12:]) {
+			continue
+		}
+		recs = append(recs, rec{seq, data})
+	}
+	slices.SortFunc(recs, func(a, b rec) int { return cmp.Compare(a.seq, b.seq) })
+	out := make([][]byte, len(recs))
+	for i, r := range recs {
+		out[i] = r.data
+	}
+	return out, nil
+}
+
+// RingLogger records every entry in a Ring before passing it to the
+// wrapped Logger, so the ring holds entries the sink may not have written.
+type RingLogger struct {
+	Logger
+	ring *Ring
+}
+
+// NewRingLogger wraps l with ring. Closing the result closes both.
+func NewRingLogger(l Logger, ring *Ring) *RingLogger {
+	return &RingLogger{Logger: l, ring: ring}
+}
+
+// Log appends e to the ring, then writes it to the wrapped logger.
+func (l *RingLogger) Log(e Entry) error {
+	return errors.Join(l.ring.Append(e), l.Logger.Log(e))
+}
+
+// Close closes the wrapped logger and the ring.
+func (l *RingLogger) Close() error {
+	return errors.Join(l.Logger.Close(), l.ring.Close())
+}
@@ -0,0 +1,16 @@
+//go:build !unix
+
+package audit
+
+import (
+	"errors"
+	"os"
+)
+
+func mapFile(*os.File, int) ([]byte, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func unmapFile([]byte) error {
+	return nil
+}
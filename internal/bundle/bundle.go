@@ -0,0 +1,305 @@
+// Package bundle writes and verifies signed evidence bundles: a gzipped tar
+// of files together with a manifest listing their sizes and SHA-256
+// digests, and a signature over the manifest. A bundle verifies only if
+// the signature matches and every file is present, unaltered and listed.
+package bundle
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Names of the manifest and its signature, the last two files of a bundle.
+const (
+	ManifestName  = "manifest.json"
+	SignatureName = "manifest.sig"
+)
+
+// Manifest describes a bundle.
+type Manifest struct {
+	Created time.Time `json:"created"`
+	// KeyID is the SHA-256 of the signing key's public key (PKIX, DER), in
+	// hex.
+	KeyID string `json:"key_id"`
+	// Info holds what the creator recorded about the bundle, such as how
+	// its contents were selected.
+	Info  map[string]string `json:"info,omitempty"`
+	Files []File            `json:"files"`
+}
+
+// File is one file of a bundle.
+type File struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Writer writes a bundle.
+type Writer struct {
+	gz       *gzip.Writer
+	tw       *tar.Writer
+	signer   crypto.Signer
+	manifest Manifest
+	names    map[string]bool
+}
+
+// NewWriter returns a Writer writing to w and signing with signer. info
+// is recorded in the manifest.
+func NewWriter(w io.Writer, signer crypto.Signer, info map[string]string) (*Writer, error) {
+	id, err := KeyID(signer.Public())
+	if err != nil {
+		return nil, err
+	}
+	gz := gzip.NewWriter(w)
+	return &Writer{
+		gz:       gz,
+		tw:       tar.NewWriter(gz),
+		signer:   signer,
+		manifest: Manifest{Created: time.Now().UTC(), KeyID: id, Info: info},
+		names:    map[string]bool{},
+	}, nil
+}
+
+// Add adds a file holding data.
+func (w *Writer) Add(name string, data []byte) error {
+	if name == ManifestName || name == SignatureName || !validName(name) {
+		return fmt.Errorf("invalid bundle file name %q", name)
+	}
+	if w.names[name] {
+		return fmt.Errorf("duplicate bundle file %q", name)
+	}
+	w.names[name] = true
+	if err := w.write(name, data); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	w.manifest.Files = append(w.manifest.Files, File{Name: name, Size: int64(len(data)), SHA256: hex.EncodeToString(sum[:])})
+	return nil
+}
+
+// Close writes the manifest and its signature and finishes the bundle. It
+// does not close the underlying writer.
+func (w *Writer) Close() error {
+	m, err := json.MarshalIndent(w.manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	m = append(m, '\n')
+	sig, err := sign(w.signer, m)
+	if err != nil {
+		return fmt.Errorf("sign manifest: %w", err)
+	}
+	if err := w.write(ManifestName, m); err != nil {
+		return err
+	}
+	if err := w.write(SignatureName, sig); err != nil {
+		return err
+	}
+	if err := w.tw.Close(); err != nil {
+		return err
+	}
+	return w.gz.Close()
+}
+
+func (w *Writer) write(name string, data []byte) error {
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0o644,
+		Size:    int64(len(data)),
+		ModTime: w.manifest.Created,
+		Format:  tar.FormatPAX,
+	}
+	if err := w.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := w.tw.Write(data)
+	return err
+}
+
+// validName reports whether name is a clean relative path.
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && path.Clean(name) == name &&
+		!path.IsAbs(name) && !strings.HasPrefix(name, "../")
+}
+
+// Verify checks the bundle read from r against pub and returns its
+// manifest.
+func Verify(r io.Reader, pub crypto.PublicKey) (*Manifest, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	var manifest, sig []byte
+	found := map[string]File{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			continue // added by tools repacking the bundle
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			return nil, fmt.Errorf("%s: not a regular file", hdr.Name)
+		}
+		if _, dup := found[hdr.Name]; dup || (hdr.Name == ManifestName && manifest != nil) || (hdr.Name == SignatureName && sig != nil) {
+			return nil, fmt.Errorf("%s: duplicate file", hdr.Name)
+		}
+		switch hdr.Name {
+		case ManifestName:
+			if manifest, err = io.ReadAll(tr); err != nil {
+				return nil, err
+			}
+		case SignatureName:
+			if sig, err = io.ReadAll(tr); err != nil {
+				return nil, err
+			}
+		default:
+			d := sha256.New()
+			n, err := io.Copy(d, tr)
+			if err != nil {
+				return nil, err
+			}
+			found[hdr.Name] = File{Name: hdr.Name, Size: n, SHA256: hex.EncodeToString(d.Sum(nil))}
+		}
+	}
+	if manifest == nil || sig == nil {
+		return nil, errors.New("bundle has no signed manifest")
+	}
+	if err := verify(pub, manifest, sig); err != nil {
+		return nil, err
+	}
+	var m Manifest
+	if err := json.Unmarshal(manifest, &m); err != nil {
+		return nil, fmt.Errorf("manifest: %w", err)
+	}
+	for _, f := range m.Files {
+		got, ok := found[f.Name]
+		switch {
+		case !ok:
+			return nil, fmt.Errorf("%s: missing", f.Name)
+		case got != f:
+			return nil, fmt.Errorf("%s: contents do not match the manifest", f.Name)
+		}
+		delete(found, f.Name)
+	}
+	for name := range found {
+		return nil, fmt.Errorf("%s: not listed in the manifest", name)
+	}
+	return &m, nil
+}
+
+// sign signs msg: Ed25519 keys sign it directly, others its SHA-256 digest.
+func sign(s crypto.Signer, msg []byte) ([]byte, error) {
+	if _, ok := s.Public().(ed25519.PublicKey); ok {
+		return s.Sign(rand.Reader, msg, crypto.Hash(0))
+	}
+	d := sha256.Sum256(msg)
+	return s.Sign(rand.Reader, d[:], crypto.SHA256)
+}
+
+func verify(pub crypto.PublicKey, msg, sig []byte) error {
+	d := sha256.Sum256(msg)
+	ok := false
+	switch k := pub.(type) {
+	case ed25519.PublicKey:
+		ok = ed25519.Verify(k, msg, sig)
+	case *ecdsa.PublicKey:
+		ok = ecdsa.VerifyASN1(k, d[:], sig)
+	case *rsa.PublicKey:
+		ok = rsa.VerifyPKCS1v15(k, crypto.SHA256, d[:], sig) == nil
+	default:
+		return fmt.Errorf("unsupported public key type %T", pub)
+	}
+	if !ok {
+		return errors.New("manifest signature does not match the key")
+	}
+	return nil
+}
+
+// KeyID returns the ID of pub recorded in manifests.
+func KeyID(pub crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// LoadSigner reads a PEM private key: PKCS #8, or an EC or RSA key in
+// their older forms.
+func LoadSigner(file string) (crypto.Signer, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", file)
+	}
+	var key any
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	s, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%s: key cannot sign", file)
+	}
+	return s, nil
+}
+
+// LoadPublicKey reads a PEM public key (PKIX), or the key of a PEM
+// certificate.
+func LoadPublicKey(file string) (crypto.PublicKey, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", file)
+	}
+	if block.Type == "CERTIFICATE" {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		return cert.PublicKey, nil
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return pub, nil
+}
@@ -0,0 +1,301 @@
+// Package cache keeps upstream responses for reuse, as a shared HTTP cache
+// would: entries are looked up by key, remember the request header values
+// their response varies on, and are served only while fresh. The least
+// recently used entries are evicted to stay within a byte budget.
+package cache
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Lookup results, as recorded in entries and metrics.
+const (
+	Hit    = "hit"
+	Miss   = "miss"
+	Stale  = "stale"
+	Bypass = "bypass" // the request asked not to be served from cache
+)
+
+// Entry is one cached response.
+type Entry struct {
+	Key    string      `json:"key"`
+	URL    string      `json:"url"`
+	Status int         `json:"status"`
+	Header http.Header `json:"header,omitempty"`
+	Body   []byte      `json:"body"`
+	// Vary holds the request header values selected by the response's
+	// Vary header; a request must have the same values to be served.
+	Vary http.Header `json:"vary,omitempty"`
+	// Stored is when the response was generated, allowing for the age
+	// upstream reported.
+	Stored  time.Time `json:"stored"`
+	Expires time.Time `json:"expires"`
+}
+
+// Age returns the age of e at now.
+func (e *Entry) Age(now time.Time) time.Duration {
+	return max(now.Sub(e.Stored), 0)
+}
+
+// matches reports whether e may answer a request with header h.
+func (e *Entry) matches(h http.Header) bool {
+	for name, vs := range e.Vary {
+		if !slices.Equal(h.Values(name), vs) {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *Entry) size() int64 {
+	n := int64(len(e.Body) + len(e.URL))
+	for k, vs := range e.Header {
+		for _, v := range vs {
+			n += int64(len(k) + len(v))
+		}
+	}
+	return n
+}
+
+// Stats summarises a Cache.
+type Stats struct {
+	Entries   int   `json:"entries"`
+	Bytes     int64 `json:"bytes"`
+	MaxBytes  int64 `json:"max_bytes"`
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Stale     int64 `json:"stale"`
+	Stores    int64 `json:"stores"`
+	Evictions int64 `json:"evictions"`
+}
+
+// store holds the entries of a Cache, which serialises calls to it.
+type store interface {
+	load(key string) (*Entry, error)
+	save(e *Entry) error
+	remove(key string)
+}
+
+// Cache is a byte-bounded LRU cache of responses. It is safe for
+// concurrent use.
+type Cache struct {
+	mu    sync.Mutex
+	store store
+	max   int64
+	lru   *list.List // of *item, most recently used first
+	items map[string]*list.Element
+	stats Stats
+}
+
+type item struct {
+	key  string
+	size int64
+}
+
+// NewMemory returns a cache holding up to maxBytes in memory.
+func NewMemory(maxBytes int64) *Cache {
+	return newCache(memoryStore{}, maxBytes)
+}
+
+// NewDisk returns a cache holding up to maxBytes as one file per entry in
+// dir, creating it if needed. Entries already in dir are kept, most
+// recently stored first, as far as they fit.
+func NewDisk(dir string, maxBytes int64) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("create cache directory: %w", err)
+	}
+	s := diskStore{dir: dir}
+	c := newCache(s, maxBytes)
+	names, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var found []*Entry
+	for _, name := range names {
+		e, err := s.read(name)
+		if err != nil {
+			os.Remove(name)
+			continue
+		}
+		found = append(found, e)
+	}
+	slices.SortFunc(found, func(a, b *Entry) int { return b.Stored.Compare(a.Stored) })
+	for _, e := range found {
+		if c.stats.Bytes+e.size() > maxBytes {
+			s.remove(e.Key)
+			continue
+		}
+		c.add(e)
+	}
+	return c, nil
+}
+
+func newCache(s store, maxBytes int64) *Cache {
+	return &Cache{
+		store: s,
+		max:   maxBytes,
+		lru:   list.New(),
+		items: map[string]*list.Element{},
+		stats: Stats{MaxBytes: maxBytes},
+	}
+}
+
+// Lookup returns the entry for key that may answer a request with header
+// h at now, and whether it was a Hit, a Miss or Stale. Only a hit returns
+// an entry.
+func (c *Cache) Lookup(key string, h http.Header, now time.Time) (*Entry, string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		c.stats.Misses++
+		return nil, Miss
+	}
+	e, err := c.store.load(key)
+	if err != nil {
+		c.drop(el)
+		c.stats.Misses++
+		return nil, Miss
+	}
+	if !e.matches(h) {
+		c.stats.Misses++
+		return nil, Miss
+	}
+	if !now.Before(e.Expires) {
+		c.stats.Stale++
+		return nil, Stale
+	}
+	c.lru.MoveToFront(el)
+	c.stats.Hits++
+	return e, Hit
+}
+
+// Put stores e, replacing any entry with its key and evicting the least
+// recently used entries to make room. Entries larger than the cache are
+// not stored.
+func (c *Cache) Put(e *Entry) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[e.Key]; ok {
+		c.drop(el)
+	}
+	if e.size() > c.max {
+		return nil
+	}
+	for c.stats.Bytes+e.size() > c.max {
+		c.drop(c.lru.Back())
+		c.stats.Evictions++
+	}
+	if err := c.store.save(e); err != nil {
+		return err
+	}
+	c.add(e)
+	c.stats.Stores++
+	return nil
+}
+
+// Stats returns the cache's statistics.
+func (c *Cache) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+func (c *Cache) add(e *Entry) {
+	c.items[e.Key] = c.lru.PushFront(&item{key: e.Key, size: e.size()})
+	c.stats.Entries++
+	c.stats.Bytes += e.size()
+}
+
+func (c *Cache) drop(el *list.Element) {
+	it := c.lru.Remove(el).(*item)
+	delete(c.items, it.key)
+	c.store.remove(it.key)
+	c.stats.Entries--
+	c.stats.Bytes -= it.size
+}
+
+// memoryStore keeps entries in a map. Entries are never modified once
+// stored, so they are shared with callers.
+type memoryStore map[string]*Entry
+
+func (s memoryStore) load(key string) (*Entry, error) {
+	e, ok := s[key]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	return e, nil
+}
+
+func (s memoryStore) save(e *Entry) error {
+	s[e.Key] = e
+	return nil
+}
+
+func (s memoryStore) remove(key string) {
+	delete(s, key)
+}
+
+// diskStore keeps entries as JSON files named by key.
+type diskStore struct {
+	dir string
+}
+
+func (s diskStore) path(key string) string {
+	return filepath.Join(s.dir, key+".json")
+}
+
+func (s diskStore) load(key string) (*Entry, error) {
+	return s.read(s.path(key))
+}
+
+func (s diskStore) read(name string) (*Entry, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var e Entry
+	if err := json.Unmarshal(b, &e); err != nil {
+		return nil, fmt.Errorf("cache entry %s: %w", filepath.Base(name), err)
+	}
+	if e.Key == "" || s.path(e.Key) != name {
+		return nil, errors.New("cache entry " + filepath.Base(name) + ": key does not match file name")
+	}
+	return &e, nil
+}
+
+// save writes e so that readers never see a partly written file.
+func (s diskStore) save(e *Entry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(s.dir, ".entry-*")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), s.path(e.Key))
+}
+
+func (s diskStore) remove(key string) {
+	os.Remove(s.path(key))
+}
@@ -0,0 +1,121 @@
+package cache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cacheableStatus lists the statuses cached by default (RFC 9111, section
+// 3, leaving out those the proxy has no use for).
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusMovedPermanently:     true,
+	http.StatusNotFound:             true,
+	http.StatusGone:                 true,
+}
+
+// directives parses a Cache-Control header into lower-case directive
+// names and their values, unquoted.
+func directives(h http.Header) map[string]string {
+	d := map[string]string{}
+	for _, v := range h.Values("Cache-Control") {
+		for _, part := range strings.Split(v, ",") {
+			name, val, _ := strings.Cut(strings.TrimSpace(part), "=")
+			if name != "" {
+				d[strings.ToLower(name)] = strings.Trim(val, `"`)
+			}
+		}
+	}
+	return d
+}
+
+// NoCache reports whether a request with header h asks for a response
+// from upstream rather than from cache.
+func NoCache(h http.Header) bool {
+	d := directives(h)
+	_, noCache := d["no-cache"]
+	_, noStore := d["no-store"]
+	return noCache || noStore || d["max-age"] == "0" ||
+		len(d) == 0 && strings.EqualFold(h.Get("Pragma"), "no-cache")
+}
+
+// Lifetime returns how long a response with status and header, answering
+// a request with header req, stays fresh, or 0 if it may not be stored.
+// Responses without explicit freshness get def. Responses that set
+// cookies or vary on everything are never stored.
+func Lifetime(status int, req, resp http.Header, def time.Duration) time.Duration {
+	if !cacheableStatus[status] || resp.Get("Set-Cookie") != "" || resp.Get("Vary") == "*" {
+		return 0
+	}
+	if _, ok := directives(req)["no-store"]; ok {
+		return 0
+	}
+	d := directives(resp)
+	for _, k := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := d[k]; ok {
+			return 0
+		}
+	}
+	for _, k := range []string{"s-maxage", "max-age"} {
+		if v, ok := d[k]; ok {
+			secs, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || secs <= 0 {
+				return 0
+			}
+			return time.Duration(secs) * time.Second
+		}
+	}
+	if v := resp.Get("Expires"); v != "" {
+		expires, err := http.ParseTime(v)
+		if err != nil {
+			return 0
+		}
+		date, err := http.ParseTime(resp.Get("Date"))
+		if err != nil {
+			date = time.Now()
+		}
+		return max(expires.Sub(date), 0)
+	}
+	return def
+}
+
+// ageOf returns the age upstream reported for a response with header h.
+func ageOf(h http.Header) time.Duration {
+	secs, err := strconv.ParseInt(h.Get("Age"), 10, 64)
+	if err != nil || secs < 0 {
+		return 0
+	}
+	return time.Duration(secs) * time.Second
+}
+
+// NewEntry returns the entry for a response with status, header and body
+// to a request for url with header req, received at now and fresh for
+// lifetime. Hop-by-hop fields are expected to have been removed from
+// header; the entry takes ownership of it.
+func NewEntry(key, url string, req http.Header, status int, header http.Header, body []byte, now time.Time, lifetime time.Duration) *Entry {
+	stored := now.Add(-ageOf(header))
+	e := &Entry{
+		Key:     key,
+		URL:     url,
+		Status:  status,
+		Header:  header,
+		Body:    body,
+		Stored:  stored,
+		Expires: stored.Add(lifetime),
+	}
+	for _, v := range header.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				if e.Vary == nil {
+					e.Vary = http.Header{}
+				}
+				e.Vary[http.CanonicalHeaderKey(name)] = req.Values(name)
+			}
+		}
+	}
+	header.Del("Age")
+	return e
+}
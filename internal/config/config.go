@@ -0,0 +1,2106 @@
+// Package config loads audit-proxy settings from defaults, an optional YAML
+// file, AUDITPROXY_* environment variables and command-line flags, in that
+// order of increasing precedence.
+package config
+
+import (
+	"cmp"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the complete runtime configuration of the proxy.
+type Config struct {
+	Addr string `yaml:"addr"`
+	// Listeners serve the proxy on further addresses alongside Addr, which
+	// may then be empty.
+	Listeners []ListenSpec `yaml:"listeners"`
+	LogFile   string       `yaml:"logfile"`
+	// DrainTimeout bounds how long shutdown waits for in-flight requests
+	// and open tunnels before closing them.
+	DrainTimeout time.Duration `yaml:"drain_timeout"`
+	// LogBeforeForward writes a preliminary entry for each request before it
+	// is sent upstream, so the attempt is recorded even if the proxy dies
+	// before the exchange completes.
+	LogBeforeForward bool `yaml:"log_before_forward"`
+	// LogSync sets how durably audit entries are written to LogFile.
+	LogSync LogSyncConfig `yaml:"log_sync"`
+	// LogTime sets how entry times are written to LogFile.
+	LogTime LogTimeConfig `yaml:"log_time"`
+	// Ring keeps the latest entries in a crash-safe file for dump-ring.
+	Ring RingConfig `yaml:"ring"`
+	// AllowHosts lists the targets the proxy may reach: exact hosts,
+	// *.suffix wildcards, IP addresses or CIDR ranges, each optionally with a
+	// :port, or * for any.
+	AllowHosts []string `yaml:"allow_hosts"`
+	// DenyHosts takes the same patterns and wins over AllowHosts.
+	DenyHosts []string `yaml:"deny_hosts"`
+	// Profiles lists the profiles annotating entries.
+	Profiles []string `yaml:"profiles"`
+	// ProfileMatching sets the order profiles are evaluated in and whether
+	// more than one may annotate an entry.
+	ProfileMatching ProfileMatchingConfig `yaml:"profile_matching"`
+	// CustomProfiles define profiles without code. They are enabled
+	// without being listed in Profiles and evaluated before the listed
+	// ones, unless Profiles names them.
+	CustomProfiles []CustomProfile `yaml:"custom_profiles"`
+	// Services names the targets entries record as their service.
+	Services []ServiceConfig `yaml:"services"`
+	// ForwardedHeaders adds Via to requests and responses and appends the
+	// client address to X-Forwarded-For on upstream requests.
+	ForwardedHeaders bool `yaml:"forwarded_headers"`
+	// RejectHostMismatch refuses intercepted requests whose Host header
+	// names another host than their tunnel, instead of only recording it.
+	RejectHostMismatch bool `yaml:"reject_host_mismatch"`
+	// ResponseHeaders edits upstream response headers before they reach
+	// clients.
+	ResponseHeaders ResponseHeadersConfig `yaml:"response_headers"`
+	// CORS answers preflights and adds CORS headers for browser clients.
+	CORS CORSConfig `yaml:"cors"`
+	// Connect limits what CONNECT tunnels may reach and carry.
+	Connect ConnectConfig `yaml:"connect"`
+	// Direct decides what happens to requests sent to the listener as if it
+	// were a web server.
+	Direct DirectConfig `yaml:"direct"`
+	// DirectHosts take the same patterns as AllowHosts and name targets
+	// passed through unaudited by design: no policy, interception or audit
+	// entries, only counts.
+	DirectHosts []string `yaml:"direct_hosts"`
+	// DirectSummaryInterval is how often counts of the traffic to
+	// DirectHosts are written to the audit log (0 for only at shutdown).
+	DirectSummaryInterval time.Duration `yaml:"direct_summary_interval"`
+	// PAC serves a proxy auto-config file built from AllowHosts.
+	PAC PACConfig `yaml:"pac"`
+	// Fingerprint selects what identifies a request besides its method,
+	// URL and body.
+	Fingerprint FingerprintConfig `yaml:"fingerprint"`
+	// Mocks answer matching requests with canned responses instead of
+	// forwarding them. The first matching rule applies.
+	Mocks []MockRule `yaml:"mocks"`
+	// Replay records upstream responses by request fingerprint and serves
+	// them back instead of forwarding.
+	Replay ReplayConfig `yaml:"replay"`
+	// Cache keeps cacheable GET responses of selected hosts and answers
+	// repeated requests from it.
+	Cache CacheConfig `yaml:"cache"`
+
+	// LogBodies enables request/response body excerpts in audit entries.
+	// Bodies are only visible for plain HTTP and intercepted (MITM) traffic.
+	LogBodies bool `yaml:"log_bodies"`
+	// ExcerptLimit caps the number of body bytes kept per excerpt.
+	ExcerptLimit int `yaml:"excerpt_limit"`
+	// ExcerptCompression compresses excerpts written to LogFile.
+	ExcerptCompression ExcerptCompressionConfig `yaml:"excerpt_compression"`
+	// ExcerptPII scrubs personal data from excerpts before entries are
+	// written.
+	ExcerptPII ExcerptPIIConfig `yaml:"excerpt_pii"`
+	// Capture records bodies in full for requests matching its rules,
+	// whatever LogBodies says.
+	Capture CaptureConfig `yaml:"capture"`
+
+	MITM             bool     `yaml:"mitm"`
+	MITMCACert       string   `yaml:"mitm_ca_cert"`
+	MITMCAKey        string   `yaml:"mitm_ca_key"`
+	MITMDisableHosts []string `yaml:"mitm_disable_hosts"`
+	// MITMCAWatch is how often the CA files are checked for changes, which
+	// rotate the CA as a reload does; 0 checks only on reload.
+	MITMCAWatch time.Duration `yaml:"mitm_ca_watch"`
+	// MITMHosts selects the hosts whose tunnels are intercepted.
+	MITMHosts MITMHostsConfig `yaml:"mitm_hosts"`
+	// MITMLeafKey is the algorithm of issued leaf keys, ecdsa (P-256) or
+	// rsa (2048 bits). MITMReuseLeafKey has all leaves share one key.
+	MITMLeafKey      string `yaml:"mitm_leaf_key"`
+	MITMReuseLeafKey bool   `yaml:"mitm_reuse_leaf_key"`
+	// MITMCacheSize is how many hosts' leaves are kept; the least recently
+	// used are dropped past it.
+	MITMCacheSize int `yaml:"mitm_cache_size"`
+	// MITMUpstreamErrors is what clients of intercepted tunnels see when
+	// the upstream's certificate fails verification: fail, an error
+	// response to each request, or mirror, a leaf they reject for the same
+	// reason, found by connecting upstream before the client handshake.
+	MITMUpstreamErrors string `yaml:"mitm_upstream_errors"`
+	// MITMPinning handles clients that reject the proxy's leaf during the
+	// handshake, as clients pinning certificates do.
+	MITMPinning MITMPinningConfig `yaml:"mitm_pinning"`
+	// MITMClientCerts asks clients of intercepted tunnels for certificates.
+	MITMClientCerts MITMClientCertsConfig `yaml:"mitm_client_certs"`
+	// MITMTLS restricts the TLS intercepted clients may negotiate.
+	MITMTLS MITMTLSConfig `yaml:"mitm_tls"`
+	// MITMSessionTickets lets clients of intercepted tunnels resume TLS
+	// sessions rather than repeat full handshakes.
+	MITMSessionTickets MITMSessionTicketsConfig `yaml:"mitm_session_tickets"`
+
+	// MITMRollout, when set, intercepts only the tunnels of its cohort, so
+	// interception can be enabled for a growing share of clients.
+	MITMRollout *RolloutConfig `yaml:"mitm_rollout"`
+
+	Filters []FilterSpec `yaml:"filters"`
+
+	ProxyAuth ProxyAuthConfig `yaml:"proxy_auth"`
+
+	// Clients override policy for matching clients. The first match wins.
+	Clients []ClientConfig `yaml:"clients"`
+
+	Listener ListenerConfig `yaml:"listener"`
+	Egress   EgressConfig   `yaml:"egress"`
+	Timeouts TimeoutsConfig `yaml:"timeouts"`
+	Retry    RetryConfig    `yaml:"retry"`
+
+	// UpstreamTLS sets protocol versions and, per host, trust and client
+	// certificates for TLS to upstreams.
+	UpstreamTLS UpstreamTLSConfig `yaml:"upstream_tls"`
+
+	CircuitBreaker CircuitBreakerConfig `yaml:"circuit_breaker"`
+
+	// Reaper periodically closes idle connections in long-running
+	// deployments.
+	Reaper ReaperConfig `yaml:"reaper"`
+
+	// Workload records the pod, container or process behind each client
+	// connection.
+	Workload WorkloadConfig `yaml:"workload"`
+
+	// UpstreamPools load-balance logical hosts across endpoints.
+	UpstreamPools []UpstreamPool `yaml:"upstream_pools"`
+
+	// Failover retries failed requests against fallback providers. The
+	// first rule matching the request's host applies.
+	Failover []FailoverRule `yaml:"failover"`
+
+	// Shadow mirrors matching requests to secondary upstreams in the
+	// background. The first rule matching a request applies.
+	Shadow []ShadowRule `yaml:"shadow"`
+
+	// Concurrency limits in-flight upstream requests and queues the excess
+	// by priority class.
+	Concurrency ConcurrencyConfig `yaml:"concurrency"`
+
+	// Quotas limit when clients may send requests and how many, or how many
+	// bytes, per period.
+	Quotas QuotasConfig `yaml:"quotas"`
+
+	// Budgets cap what clients may spend a day on LLM APIs, priced from
+	// the token usage responses report.
+	Budgets BudgetsConfig `yaml:"budgets"`
+
+	// ThreatFeeds deny the targets listed by threat-intelligence feeds,
+	// reloaded periodically.
+	ThreatFeeds []ThreatFeed `yaml:"threat_feeds"`
+
+	// Overrides let trusted callers skip a named filter for one request
+	// with a signed header.
+	Overrides OverrideConfig `yaml:"overrides"`
+
+	// MetricsAddr, when set, serves Prometheus metrics at /metrics.
+	MetricsAddr string        `yaml:"metrics_addr"`
+	Anomaly     AnomalyConfig `yaml:"anomaly"`
+}
+
+// ListenSpec is an extra proxy listener. Network is tcp (the default) with
+// a host:port Addr, or unix with a socket path. With TLSCert and TLSKey set,
+// clients reach the proxy itself over TLS, e.g. https://proxy:8443 as the
+// proxy URL. A Transparent listener instead takes TLS connections the
+// kernel redirected to it (iptables REDIRECT or TPROXY) and tunnels each
+// to the host its ClientHello names, or to its original destination.
+type ListenSpec struct {
+	Network     string `yaml:"network"`
+	Addr        string `yaml:"addr"`
+	TLSCert     string `yaml:"tls_cert"`
+	TLSKey      string `yaml:"tls_key"`
+	Transparent bool   `yaml:"transparent"`
+}
+
+// LogSyncConfig selects when the audit log is fsynced: Mode "none" (the
+// default) leaves it to the OS, "always" syncs every entry before moving on,
+// and "periodic" syncs after Entries entries or every Interval (1s),
+// whichever comes first.
+type LogSyncConfig struct {
+	Mode     string        `yaml:"mode"`
+	Entries  int           `yaml:"entries"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+// LogTimeConfig formats entry times. Precision fixes the fractional digits
+// at s, ms, us or ns; by default trailing zeros are trimmed. Timezone is
+// UTC (the default), Local, or an IANA name such as Europe/Berlin, written
+// as an offset. EpochMillis adds time_ms, the time as milliseconds since the
+// Unix epoch, for sinks that prefer numbers.
+type LogTimeConfig struct {
+	Precision   string `yaml:"precision"`
+	Timezone    string `yaml:"timezone"`
+	EpochMillis bool   `yaml:"epoch_millis"`
+}
+
+// ExcerptCompressionConfig compresses excerpts of at least MinBytes with
+// Codec (gzip; empty for none), base64-encoded and marked with an
+// excerpt_encoding. Excerpts that do not shrink are kept as they are.
+type ExcerptCompressionConfig struct {
+	Codec    string `yaml:"codec"`
+	MinBytes int    `yaml:"min_bytes"`
+}
+
+// ExcerptPIIConfig lists the personal data replaced in excerpts: the
+// built-in kinds in Detect, email, phone and credit_card, and Patterns of
+// its own. Nothing is scrubbed when both are empty.
+type ExcerptPIIConfig struct {
+	Detect   []string     `yaml:"detect"`
+	Patterns []PIIPattern `yaml:"patterns"`
+}
+
+// PIIPattern is a regular expression matching personal data of the kind
+// Name.
+type PIIPattern struct {
+	Name  string `yaml:"name"`
+	Match string `yaml:"match"`
+}
+
+// PIIKinds are the built-in kinds of ExcerptPIIConfig.Detect.
+var PIIKinds = []string{"credit_card", "email", "phone"}
+
+// ResponseHeadersConfig strips and adds upstream response headers. Remove
+// takes header names, or prefixes ending in * such as X-Internal-*; Set
+// adds headers, replacing any upstream value.
+type ResponseHeadersConfig struct {
+	Remove []string          `yaml:"remove"`
+	Set    map[string]string `yaml:"set"`
+}
+
+// ConnectConfig keeps CONNECT from turning the proxy into a generic TCP
+// relay. Ports lists the target ports tunnels may reach (default 443), each
+// a number, a range such as 8000-8999, or * for any. With RequireTLS, a
+// tunnel whose client does not open with a TLS handshake is closed.
+type ConnectConfig struct {
+	Ports      []string `yaml:"ports"`
+	RequireTLS bool     `yaml:"require_tls"`
+}
+
+// ProfileMatchingConfig orders profile evaluation. By default profiles are
+// evaluated as listed in Profiles, except fallback profiles matching any
+// request (generic), which come last.
+type ProfileMatchingConfig struct {
+	// Order lists profiles to evaluate first, in this order, even
+	// fallbacks; the others follow in the default order.
+	Order []string `yaml:"order"`
+	// StopOnFirstMatch has only the first matching profile annotate an
+	// entry (the default). Otherwise every matching one does, in order,
+	// and the first is recorded as the entry's profile.
+	StopOnFirstMatch bool `yaml:"stop_on_first_match"`
+}
+
+// CustomProfile is a profile defined in config. It matches requests to
+// Hosts (exact names or *.suffix wildcards, any port) and names their
+// operation after the first of Operations matching. CaptureHeaders are
+// recorded as attributes, from the request or else the response, and
+// MaskHeaders are masked in the entry like credentials.
+type CustomProfile struct {
+	Name           string             `yaml:"name"`
+	Hosts          []string           `yaml:"hosts"`
+	Operations     []ProfileOperation `yaml:"operations"`
+	CaptureHeaders []string           `yaml:"capture_headers"`
+	MaskHeaders    []string           `yaml:"mask_headers"`
+}
+
+// ProfileOperation names the operation of requests to Path, exact or a
+// prefix ending in *, with Method if set.
+type ProfileOperation struct {
+	Method string `yaml:"method"`
+	Path   string `yaml:"path"`
+	Name   string `yaml:"name"`
+}
+
+// ServiceConfig maps the hostnames of one service, such as its regional
+// endpoints or CDN fronts, to a canonical Name. Hosts take allow_hosts
+// patterns; the first service matching a target applies.
+type ServiceConfig struct {
+	Name  string   `yaml:"name"`
+	Hosts []string `yaml:"hosts"`
+}
+
+// DirectConfig handles origin-form requests, which name no target. They
+// are refused unless Upstream, an http or https URL, is set; the proxy then
+// forwards them there as a reverse proxy, appending the request path to
+// Upstream's.
+type DirectConfig struct {
+	Upstream string `yaml:"upstream"`
+}
+
+// PACConfig serves a proxy auto-config file at /proxy.pac and /wpad.dat
+// that sends hosts in AllowHosts through the proxy and everything else
+// direct. Proxy is the host:port the file names, by default the address
+// the client fetched it from.
+type PACConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Proxy   string `yaml:"proxy"`
+}
+
+// FingerprintConfig lists the request headers whose values are part of a
+// request's fingerprint, such as Accept or a tenant header. Header names
+// are case-insensitive.
+type FingerprintConfig struct {
+	Headers []string `yaml:"headers"`
+}
+
+// CORSConfig lets browser-based tools call upstreams through the proxy. It
+// is enabled by AllowOrigins: exact origins, patterns with one * such as
+// https://*.example.com, or * for any. For requests from an allowed origin to
+// a target matching Hosts (default: all), the proxy answers preflights
+// itself and replaces the CORS headers of upstream responses with its own.
+// Requests from other origins pass through untouched. AllowMethods defaults
+// to the common methods, AllowHeaders to whatever the preflight asks for and
+// MaxAge to 10m.
+type CORSConfig struct {
+	Hosts            []string      `yaml:"hosts"`
+	AllowOrigins     []string      `yaml:"allow_origins"`
+	AllowMethods     []string      `yaml:"allow_methods"`
+	AllowHeaders     []string      `yaml:"allow_headers"`
+	ExposeHeaders    []string      `yaml:"expose_headers"`
+	AllowCredentials bool          `yaml:"allow_credentials"`
+	MaxAge           time.Duration `yaml:"max_age"`
+}
+
+// MockRule answers requests to Hosts (default: all) with one of Methods
+// (default: any) whose path is Path, or starts with it if it ends in *,
+// without contacting the upstream. The response has Status (default 200),
+// Headers and either the contents of BodyFile or Body, a Go text/template
+// executed with the request's Method, Host, Path, Query, Header and Body.
+type MockRule struct {
+	Hosts    []string          `yaml:"hosts"`
+	Methods  []string          `yaml:"methods"`
+	Path     string            `yaml:"path"`
+	Status   int               `yaml:"status"`
+	Headers  map[string]string `yaml:"headers"`
+	Body     string            `yaml:"body"`
+	BodyFile string            `yaml:"body_file"`
+}
+
+// ReplayConfig keeps recordings in Dir, one file per request
+// fingerprint. Responses with bodies larger than MaxBody (10 MiB; 0 for no
+// limit) are not recorded. The first rule matching a request's host sets its mode.
+type ReplayConfig struct {
+	Dir     string       `yaml:"dir"`
+	MaxBody int64        `yaml:"max_body"`
+	Rules   []ReplayRule `yaml:"rules"`
+}
+
+// ReplayRule applies Mode to requests for Hosts (default: all). In
+// "record" mode responses are forwarded and recorded; in "replay" mode
+// they are served from recordings only, and requests without one fail; in
+// "auto" mode recordings are served when present and made otherwise.
+type ReplayRule struct {
+	Hosts []string `yaml:"hosts"`
+	Mode  string   `yaml:"mode"`
+}
+
+// CacheConfig enables the response cache for requests to Hosts. Store is
+// "memory" (the default) or "disk", which keeps entries in Dir across
+// restarts. The cache holds up to MaxBytes (64 MiB) of response bodies,
+// evicting the least recently used; responses larger than MaxBody (1 MiB)
+// are not cached. Responses without explicit freshness are kept for
+// DefaultTTL (0: not cached).
+type CacheConfig struct {
+	Hosts      []string      `yaml:"hosts"`
+	Store      string        `yaml:"store"`
+	Dir        string        `yaml:"dir"`
+	MaxBytes   int64         `yaml:"max_bytes"`
+	MaxBody    int64         `yaml:"max_body"`
+	DefaultTTL time.Duration `yaml:"default_ttl"`
+}
+
+// CaptureConfig keeps up to MaxBytes (1 MiB) of each body of requests
+// matching one of Rules. Until the response decides whether a rule
+// applies, the bodies of requests that may match are held in memory.
+type CaptureConfig struct {
+	MaxBytes int           `yaml:"max_bytes"`
+	Rules    []CaptureRule `yaml:"rules"`
+}
+
+// CaptureRule matches requests meeting all of its conditions: Hosts,
+// Methods, Path (a prefix if it ends in *), the Profile recognising the
+// request, the Clients policies, a response status between MinStatus and
+// MaxStatus, and with FirstSeen a host not requested before since the
+// proxy started. Unset conditions match anything. Percent (default 100)
+// samples the matching requests.
+type CaptureRule struct {
+	Name      string   `yaml:"name"`
+	Hosts     []string `yaml:"hosts"`
+	Methods   []string `yaml:"methods"`
+	Path      string   `yaml:"path"`
+	Profile   string   `yaml:"profile"`
+	Clients   []string `yaml:"clients"`
+	MinStatus int      `yaml:"min_status"`
+	MaxStatus int      `yaml:"max_status"`
+	FirstSeen bool     `yaml:"first_seen"`
+	Percent   float64  `yaml:"percent"`
+}
+
+// MITMHostsConfig selects the tunnels intercepted by target. Include and
+// Exclude take host patterns as in AllowHosts, or regular expressions
+// written /like this/ matching the whole host name. With Include or
+// Profiles set, only tunnels to hosts Include or one of Profiles matches
+// are intercepted; Exclude, like MITMDisableHosts, wins over both.
+// Profiles see a request for the host's root, without a path. Intercepted
+// tunnels to hosts HeadersOnly matches, with the same patterns, are
+// audited by request line and headers: bodies pass through unread by the
+// proxy's logging, capture, cache, recording and shadowing.
+type MITMHostsConfig struct {
+	Include     []string `yaml:"include"`
+	Exclude     []string `yaml:"exclude"`
+	Profiles    []string `yaml:"profiles"`
+	HeadersOnly []string `yaml:"headers_only"`
+}
+
+// MITMPinningConfig handles hosts whose clients reject the proxy's leaf.
+// With Bypass, such a host's tunnels are passed through without
+// interception for BypassFor (24h; 0 until restart) after the rejection.
+type MITMPinningConfig struct {
+	Bypass    bool          `yaml:"bypass"`
+	BypassFor time.Duration `yaml:"bypass_for"`
+}
+
+// MITMClientCertsConfig has intercepted tunnels request TLS client
+// certificates, which are recorded. Hosts limits the request to the
+// tunnels it matches, all if empty. Certificates are verified against
+// ClientCAs if set; with Require, a tunnel without one, or without a
+// verified one, fails the handshake.
+type MITMClientCertsConfig struct {
+	Request   bool     `yaml:"request"`
+	Hosts     []string `yaml:"hosts"`
+	ClientCAs []string `yaml:"client_cas"`
+	Require   bool     `yaml:"require"`
+}
+
+// MITMTLSConfig is the TLS policy of the proxy's side of intercepted
+// tunnels. MinVersion (default 1.2) and MaxVersion (default 1.3) take
+// min_version values. CipherSuites, by Go name, limits the suites of TLS
+// 1.2 and older; TLS 1.3 suites are not configurable. ALPN is the
+// application protocols offered, http/1.1 (default) and http/1.0, as the
+// proxy speaks nothing newer to clients.
+type MITMTLSConfig struct {
+	MinVersion   string   `yaml:"min_version"`
+	MaxVersion   string   `yaml:"max_version"`
+	CipherSuites []string `yaml:"cipher_suites"`
+	ALPN         []string `yaml:"alpn"`
+}
+
+// MITMSessionTicketsConfig controls TLS session tickets on intercepted
+// tunnels. Unless Disable is set, tickets are encrypted with a key
+// generated at startup and replaced every Rotate (24h; 0 never), the
+// previous key still accepted for another Rotate. KeyFile instead names a
+// file of hex-encoded 32-byte keys, one per line, the first encrypting and
+// all decrypting, so proxies sharing it resume each other's sessions; it is
+// read again on reload.
+type MITMSessionTicketsConfig struct {
+	Disable bool          `yaml:"disable"`
+	KeyFile string        `yaml:"key_file"`
+	Rotate  time.Duration `yaml:"rotate"`
+}
+
+// RingConfig enables the ring file of recent entries when Path is set.
+// Entries (1024) and SlotSize (16384 bytes per entry) size it.
+type RingConfig struct {
+	Path     string `yaml:"path"`
+	Entries  int    `yaml:"entries"`
+	SlotSize int    `yaml:"slot_size"`
+}
+
+// ListenerConfig protects the proxy listener from slow or abusive clients.
+// Zero disables a limit.
+type ListenerConfig struct {
+	// ReadHeaderTimeout bounds how long a client may take to send request
+	// headers once it starts a request.
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	// IdleTimeout closes keep-alive connections waiting for a next request.
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+	// MaxRequestsPerConn closes a keep-alive connection after that many
+	// requests; the client reconnects.
+	MaxRequestsPerConn int `yaml:"max_requests_per_conn"`
+	// MaxRequestRate is the sustained requests per second allowed on one
+	// connection, with bursts of the same size. Requests over it are refused
+	// with 429 and the connection is closed.
+	MaxRequestRate float64 `yaml:"max_request_rate"`
+	// StrictFraming refuses requests whose framing is ambiguous, such as
+	// duplicate Content-Length headers, Content-Length with
+	// Transfer-Encoding or malformed chunks, with 400 and closes the
+	// connection, so they cannot smuggle requests through the proxy.
+	StrictFraming bool `yaml:"strict_framing"`
+}
+
+// ReaperConfig sets how often idle connections are swept: every Interval
+// (0 disables the reaper) pooled upstream connections not in use are
+// closed, as are intercepted tunnels idle between requests for longer than
+// MITMIdle (0 leaves them to listener.idle_timeout).
+type ReaperConfig struct {
+	Interval time.Duration `yaml:"interval"`
+	MITMIdle time.Duration `yaml:"mitm_idle"`
+}
+
+// WorkloadConfig resolves client connections to the workloads they came
+// from. Pods and containers are listed every Refresh (30s), and again soon
+// after a client matches none.
+type WorkloadConfig struct {
+	Kubernetes KubernetesConfig `yaml:"kubernetes"`
+	// DockerSocket is the Docker Engine API socket to list containers
+	// from, e.g. /var/run/docker.sock.
+	DockerSocket string `yaml:"docker_socket"`
+	// Proc finds the process owning a client connection from the same
+	// host through /proc, and its container through its cgroup. Seeing
+	// other users' processes needs root or CAP_SYS_PTRACE.
+	Proc    bool          `yaml:"proc"`
+	Refresh time.Duration `yaml:"refresh"`
+}
+
+// KubernetesConfig looks pods up by IP address or container ID. PodsURL
+// returns a PodList: the API server's pods, or the kubelet's /pods. It
+// defaults, in a cluster, to the API server's pods on the node named by
+// $NODE_NAME, or all pods without it. TokenFile and CAFile default to the
+// pod's service account.
+type KubernetesConfig struct {
+	Enabled            bool   `yaml:"enabled"`
+	PodsURL            string `yaml:"pods_url"`
+	TokenFile          string `yaml:"token_file"`
+	CAFile             string `yaml:"ca_file"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+// EgressConfig controls how upstream hosts are resolved and which
+// addresses the proxy may connect to.
+type EgressConfig struct {
+	// DNSServers (host or host:port) replace the system resolver.
+	DNSServers []string `yaml:"dns_servers"`
+	// CacheTTL is how long DNS answers are reused; 0 disables caching.
+	CacheTTL time.Duration `yaml:"cache_ttl"`
+	// BlockPrivate refuses targets that are or resolve to loopback,
+	// private, link-local or shared addresses, except AllowPrivate ranges.
+	BlockPrivate bool     `yaml:"block_private"`
+	AllowPrivate []string `yaml:"allow_private"`
+	// RootCAs are PEM files of CA certificates trusted for upstream TLS in
+	// addition to the system roots, e.g. for internal services.
+	RootCAs []string `yaml:"root_cas"`
+	// Hosts pins hostnames to fixed IP addresses instead of resolving them,
+	// e.g. for split-horizon test environments.
+	Hosts map[string][]string `yaml:"hosts"`
+	// BindAddress is the local IP upstream connections are made from.
+	// Interface instead binds them to the addresses of a network interface,
+	// one per address family. At most one of the two may be set.
+	BindAddress string `yaml:"bind_address"`
+	Interface   string `yaml:"interface"`
+	// FallbackDelay is how long a connection attempt runs before the next
+	// address, alternating IPv6 and IPv4, is tried in parallel (happy
+	// eyeballs); 0 tries addresses one after another.
+	FallbackDelay time.Duration `yaml:"fallback_delay"`
+}
+
+// Timeouts bound upstream connections. Zero means no limit.
+type Timeouts struct {
+	// Dial bounds DNS resolution plus TCP connect, for requests and CONNECT
+	// tunnels alike.
+	Dial         time.Duration `yaml:"dial"`
+	TLSHandshake time.Duration `yaml:"tls_handshake"`
+	// ResponseHeader bounds the wait for response headers once the request
+	// has been written.
+	ResponseHeader time.Duration `yaml:"response_header"`
+	// Idle is how long a pooled upstream connection may sit unused.
+	Idle time.Duration `yaml:"idle"`
+}
+
+// TimeoutsConfig holds the default upstream timeouts and per-host
+// overrides; the first override whose hosts match applies, and its unset
+// fields inherit the defaults.
+type TimeoutsConfig struct {
+	Timeouts `yaml:",inline"`
+	Hosts    []HostTimeouts `yaml:"hosts"`
+}
+
+// HostTimeouts overrides timeouts for targets matching Match, which takes
+// allow_hosts patterns.
+type HostTimeouts struct {
+	Match    []string `yaml:"match"`
+	Timeouts `yaml:",inline"`
+}
+
+// UpstreamTLSConfig applies to TLS connections to upstreams, for plain and
+// intercepted requests alike. MinVersion ("1.0" to "1.3", default 1.2) is
+// the oldest protocol version accepted; the first Hosts entry matching a
+// target adjusts the settings for it.
+type UpstreamTLSConfig struct {
+	MinVersion string           `yaml:"min_version"`
+	Hosts      []HostTLS        `yaml:"hosts"`
+	Revocation RevocationConfig `yaml:"revocation"`
+}
+
+// RevocationConfig has verified upstream certificates checked for
+// revocation when Check is set: by the OCSP response the server staples
+// or, with CRL, by the CRLs the certificate names, fetched over HTTP and
+// cached until their next update. A revoked certificate fails the
+// connection; with FailClosed, so does one whose status cannot be
+// established.
+type RevocationConfig struct {
+	Check      bool `yaml:"check"`
+	CRL        bool `yaml:"crl"`
+	FailClosed bool `yaml:"fail_closed"`
+}
+
+// HostTLS applies to targets matching Match, which takes allow_hosts
+// patterns. RootCAs are trusted besides the system roots and
+// egress.root_cas. ClientCert and ClientKey are PEM files presenting a
+// client certificate for mutual TLS. InsecureSkipVerify accepts any server
+// certificate and is meant for test environments only.
+type HostTLS struct {
+	Match              []string `yaml:"match"`
+	RootCAs            []string `yaml:"root_cas"`
+	ClientCert         string   `yaml:"client_cert"`
+	ClientKey          string   `yaml:"client_key"`
+	MinVersion         string   `yaml:"min_version"`
+	InsecureSkipVerify bool     `yaml:"insecure_skip_verify"`
+}
+
+// tlsVersions maps the accepted min_version values to their protocol
+// versions.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLSVersion returns the protocol version named by a min_version value, or
+// 0 for an empty or invalid one.
+func TLSVersion(v string) uint16 {
+	return tlsVersions[v]
+}
+
+// TLSCipherSuite returns the cipher suite with the Go name, insecure ones
+// included, or 0 if there is none.
+func TLSCipherSuite(name string) uint16 {
+	for _, cs := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		if cs.Name == name {
+			return cs.ID
+		}
+	}
+	return 0
+}
+
+// RetryConfig retries idempotent upstream requests (GET and HEAD without a
+// body) that fail to connect or are answered 502 or 503. Attempts counts the
+// first try, so 0 or 1 disables retries. The wait before each retry starts
+// at Backoff (100ms) and doubles up to MaxBackoff (2s).
+type RetryConfig struct {
+	Attempts   int           `yaml:"attempts"`
+	Backoff    time.Duration `yaml:"backoff"`
+	MaxBackoff time.Duration `yaml:"max_backoff"`
+}
+
+// CircuitBreakerConfig stops sending requests to an upstream host whose
+// recent error rate is too high. Once at least MinRequests (20) requests in
+// the last Window (30s) have failed at ErrorRate (0.5) or above, requests to
+// the host fail fast with 503 for OpenFor (30s); then a single trial request
+// is let through, closing the breaker on success or reopening it on failure.
+// Connection errors and 5xx responses are failures. Hosts limits the
+// breaker to matching targets (default: all).
+type CircuitBreakerConfig struct {
+	Enabled     bool          `yaml:"enabled"`
+	Hosts       []string      `yaml:"hosts"`
+	ErrorRate   float64       `yaml:"error_rate"`
+	MinRequests int           `yaml:"min_requests"`
+	Window      time.Duration `yaml:"window"`
+	OpenFor     time.Duration `yaml:"open_for"`
+}
+
+// UpstreamPool maps requests for Host (an allow_hosts pattern, usually a
+// logical name such as llm.internal) to weighted Endpoints. An endpoint with
+// MaxFails (3) consecutive failures is skipped for FailTimeout (30s), and
+// with HealthCheck set, also while its active probe reports it unhealthy.
+type UpstreamPool struct {
+	Host        string         `yaml:"host"`
+	Endpoints   []PoolEndpoint `yaml:"endpoints"`
+	MaxFails    int            `yaml:"max_fails"`
+	FailTimeout time.Duration  `yaml:"fail_timeout"`
+	HealthCheck *HealthCheck   `yaml:"health_check"`
+}
+
+// PoolEndpoint is a base URL and its relative weight (default 1).
+type PoolEndpoint struct {
+	URL    string `yaml:"url"`
+	Weight int    `yaml:"weight"`
+}
+
+// FailoverRule retries requests to Hosts against Target when the primary
+// answers with one of Statuses (default 429 and 5xx) or cannot be reached.
+// Target is a base URL; the request path is appended to its path.
+// SetHeaders values expand $VAR and ${VAR} from the environment so keys for
+// the fallback provider need not be written into the file. With
+// HealthCheck set, an unhealthy Target is not failed over to.
+type FailoverRule struct {
+	Name          string            `yaml:"name"`
+	Hosts         []string          `yaml:"hosts"`
+	Statuses      []int             `yaml:"statuses"`
+	Target        string            `yaml:"target"`
+	SetHeaders    map[string]string `yaml:"set_headers"`
+	RemoveHeaders []string          `yaml:"remove_headers"`
+	HealthCheck   *HealthCheck      `yaml:"health_check"`
+}
+
+// ShadowRule mirrors requests to Hosts whose path is Path, or starts with
+// it if it ends in * (default: any path), to Target, a base URL to which
+// the request path is appended. The client is served by the primary alone;
+// the mirrored response is discarded once audited. Headers are adjusted as
+// for failover, and each mirrored request may take Timeout (30s).
+type ShadowRule struct {
+	Name          string            `yaml:"name"`
+	Hosts         []string          `yaml:"hosts"`
+	Path          string            `yaml:"path"`
+	Target        string            `yaml:"target"`
+	SetHeaders    map[string]string `yaml:"set_headers"`
+	RemoveHeaders []string          `yaml:"remove_headers"`
+	Timeout       time.Duration     `yaml:"timeout"`
+}
+
+// HealthCheck actively probes an upstream every Interval (10s), allowing
+// Timeout (2s) per probe. A target turns unhealthy after UnhealthyThreshold
+// (3) consecutive failed probes and healthy again after HealthyThreshold (2)
+// successes. Zero values select the defaults in parentheses.
+type HealthCheck struct {
+	// Method is GET (default) or HEAD.
+	Method string `yaml:"method"`
+	// Path is appended to the upstream's base path (default /).
+	Path               string        `yaml:"path"`
+	Interval           time.Duration `yaml:"interval"`
+	Timeout            time.Duration `yaml:"timeout"`
+	HealthyThreshold   int           `yaml:"healthy_threshold"`
+	UnhealthyThreshold int           `yaml:"unhealthy_threshold"`
+	// ExpectStatus lists passing statuses (default any 2xx or 3xx).
+	ExpectStatus []int `yaml:"expect_status"`
+}
+
+func (h *HealthCheck) validate(field string) []error {
+	if h == nil {
+		return nil
+	}
+	var errs []error
+	if h.Method != "" && h.Method != http.MethodGet && h.Method != http.MethodHead {
+		errs = append(errs, fmt.Errorf("%s.method must be GET or HEAD", field))
+	}
+	if h.Interval < 0 || h.Timeout < 0 || h.HealthyThreshold < 0 || h.UnhealthyThreshold < 0 {
+		errs = append(errs, fmt.Errorf("%s: settings must not be negative", field))
+	}
+	return errs
+}
+
+// ConcurrencyConfig bounds in-flight upstream requests proxy-wide
+// (MaxRequests), per target host (PerHost) and per client (PerClient,
+// counting by authenticated user, else client policy, else source
+// address); zero means unlimited. Requests over a limit wait in a queue
+// shared by priority Classes, which are served by weighted fair queueing.
+// CONNECT tunnels are not counted.
+type ConcurrencyConfig struct {
+	MaxRequests int `yaml:"max_requests"`
+	PerHost     int `yaml:"per_host"`
+	PerClient   int `yaml:"per_client"`
+	// MaxQueue bounds waiting requests (1000); QueueTimeout (30s) bounds the
+	// wait. Requests over either are refused with 503.
+	MaxQueue     int           `yaml:"max_queue"`
+	QueueTimeout time.Duration `yaml:"queue_timeout"`
+	// Classes in the order listed. A request's class is the first listing
+	// its user or client, else the one named by PriorityHeader
+	// (X-Priority-Class), else DefaultClass (the first class). Without
+	// classes all requests share one FIFO queue.
+	Classes        []PriorityClass `yaml:"classes"`
+	PriorityHeader string          `yaml:"priority_header"`
+	DefaultClass   string          `yaml:"default_class"`
+}
+
+// PriorityClass is a queueing class. Weight (default 1) is its share of
+// freed slots relative to other classes with waiting requests.
+type PriorityClass struct {
+	Name    string   `yaml:"name"`
+	Weight  int      `yaml:"weight"`
+	Users   []string `yaml:"users"`
+	Clients []string `yaml:"clients"`
+}
+
+// AnomalyConfig tunes per-host status and latency anomaly detection. Zero
+// values select the defaults noted on each field.
+type AnomalyConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// MinSamples is the number of responses from a host before it can alert
+	// (50).
+	MinSamples int `yaml:"min_samples"`
+	// StatusDelta is the rise in the share of a status class, e.g. 401s,
+	// that counts as a spike (0.25).
+	StatusDelta float64 `yaml:"status_delta"`
+	// LatencyFactor is the ratio of recent to baseline latency that counts
+	// as a slowdown (2), ignored below MinLatencyMS (100).
+	LatencyFactor float64 `yaml:"latency_factor"`
+	MinLatencyMS  float64 `yaml:"min_latency_ms"`
+	// Cooldown suppresses repeats of the same anomaly for a host (5m).
+	Cooldown time.Duration `yaml:"cooldown"`
+	// MaxHosts bounds the number of hosts tracked (1000).
+	MaxHosts int `yaml:"max_hosts"`
+}
+
+func (c ConcurrencyConfig) validate() []error {
+	var errs []error
+	if c.MaxRequests < 0 || c.PerHost < 0 || c.PerClient < 0 || c.MaxQueue < 0 || c.QueueTimeout < 0 {
+		errs = append(errs, errors.New("concurrency settings must not be negative"))
+	}
+	names := map[string]bool{}
+	for i, cl := range c.Classes {
+		if cl.Name == "" {
+			errs = append(errs, fmt.Errorf("concurrency.classes[%d]: name is required", i))
+		} else if names[cl.Name] {
+			errs = append(errs, fmt.Errorf("concurrency.classes[%d]: duplicate name %q", i, cl.Name))
+		}
+		names[cl.Name] = true
+		if cl.Weight < 0 {
+			errs = append(errs, fmt.Errorf("concurrency.classes[%d]: weight must not be negative", i))
+		}
+	}
+	if c.DefaultClass != "" && !names[c.DefaultClass] {
+		errs = append(errs, fmt.Errorf("concurrency.default_class %q is not a class", c.DefaultClass))
+	}
+	return errs
+}
+
+// QuotasConfig holds the quota rules. StateFile, if set, keeps the
+// counters across restarts.
+type QuotasConfig struct {
+	StateFile string      `yaml:"state_file"`
+	Rules     []QuotaRule `yaml:"rules"`
+}
+
+// QuotaRule limits the requests it selects: those of the listed Users or
+// Clients, if any, to the listed Hosts, if any. Outside its Windows, if
+// any, they are refused. Each client may send at most Requests requests,
+// and Bytes bytes in both directions, in any Period (1h); 0 is no limit.
+// Windows are in Timezone, an IANA name, or local time.
+type QuotaRule struct {
+	Name     string        `yaml:"name"`
+	Users    []string      `yaml:"users"`
+	Clients  []string      `yaml:"clients"`
+	Hosts    []string      `yaml:"hosts"`
+	Windows  []TimeWindow  `yaml:"windows"`
+	Timezone string        `yaml:"timezone"`
+	Period   time.Duration `yaml:"period"`
+	Requests int64         `yaml:"requests"`
+	Bytes    int64         `yaml:"bytes"`
+}
+
+// TimeWindow is a time of day, From up to To as HH:MM, on Days (mon to
+// sun; every day if empty). A To before From ends on the next day.
+type TimeWindow struct {
+	Days []string `yaml:"days"`
+	From string   `yaml:"from"`
+	To   string   `yaml:"to"`
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// Weekday returns the day named by a TimeWindow day.
+func Weekday(name string) (time.Weekday, bool) {
+	d, ok := weekdays[strings.ToLower(name)]
+	return d, ok
+}
+
+// ClockTime returns the time of day a TimeWindow bound names, as the time
+// since midnight.
+func ClockTime(s string) (time.Duration, bool) {
+	h, m, ok := strings.Cut(s, ":")
+	hh, err1 := strconv.Atoi(h)
+	mm, err2 := strconv.Atoi(m)
+	if !ok || len(m) != 2 || err1 != nil || err2 != nil || hh < 0 || hh > 24 || mm < 0 || mm > 59 || (hh == 24 && mm > 0) {
+		return 0, false
+	}
+	return time.Duration(hh)*time.Hour + time.Duration(mm)*time.Minute, true
+}
+
+func (c QuotasConfig) validate() []error {
+	var errs []error
+	names := map[string]bool{}
+	for i, r := range c.Rules {
+		field := fmt.Sprintf("quotas.rules[%d]", i)
+		if r.Name == "" {
+			errs = append(errs, fmt.Errorf("%s: name is required", field))
+		} else if names[r.Name] {
+			errs = append(errs, fmt.Errorf("%s: duplicate name %q", field, r.Name))
+		}
+		names[r.Name] = true
+		if r.Period < 0 || r.Requests < 0 || r.Bytes < 0 {
+			errs = append(errs, fmt.Errorf("%s: period, requests and bytes must not be negative", field))
+		}
+		if r.Period > 0 && r.Period < time.Minute {
+			errs = append(errs, fmt.Errorf("%s: period must be at least a minute", field))
+		}
+		if len(r.Windows) == 0 && r.Requests == 0 && r.Bytes == 0 {
+			errs = append(errs, fmt.Errorf("%s: windows, requests or bytes is required", field))
+		}
+		if r.Timezone != "" {
+			if _, err := time.LoadLocation(r.Timezone); err != nil {
+				errs = append(errs, fmt.Errorf("%s: timezone: %w", field, err))
+			}
+		}
+		for j, w := range r.Windows {
+			for _, d := range w.Days {
+				if _, ok := Weekday(d); !ok {
+					errs = append(errs, fmt.Errorf("%s.windows[%d]: unknown day %q", field, j, d))
+				}
+			}
+			from, ok1 := ClockTime(w.From)
+			to, ok2 := ClockTime(w.To)
+			if !ok1 || !ok2 {
+				errs = append(errs, fmt.Errorf("%s.windows[%d]: from and to must be times as HH:MM", field, j))
+			} else if from == to {
+				errs = append(errs, fmt.Errorf("%s.windows[%d]: from and to are the same", field, j))
+			}
+		}
+	}
+	return errs
+}
+
+// BudgetsConfig holds the budget rules and the prices they charge.
+// StateFile, if set, keeps the day's totals across restarts.
+type BudgetsConfig struct {
+	StateFile string       `yaml:"state_file"`
+	Prices    []ModelPrice `yaml:"prices"`
+	Rules     []BudgetRule `yaml:"rules"`
+}
+
+// ModelPrice is what a model's tokens cost, in dollars per million. Model
+// may hold * wildcards; the first price matching a response's model
+// applies.
+type ModelPrice struct {
+	Model  string  `yaml:"model"`
+	Input  float64 `yaml:"input"`
+	Output float64 `yaml:"output"`
+}
+
+// BudgetRule caps the daily cost of the requests it selects: those of the
+// listed Users or Clients, if any, to the listed Hosts, if any. Spend is
+// totalled By client (the default) or by api_key, a hash of the API key
+// the request carries, and the day starts at midnight in Timezone, an IANA
+// name, or local time.
+type BudgetRule struct {
+	Name      string   `yaml:"name"`
+	Users     []string `yaml:"users"`
+	Clients   []string `yaml:"clients"`
+	Hosts     []string `yaml:"hosts"`
+	By        string   `yaml:"by"`
+	DailyCost float64  `yaml:"daily_cost"`
+	Timezone  string   `yaml:"timezone"`
+}
+
+func (c BudgetsConfig) validate() []error {
+	var errs []error
+	for i, p := range c.Prices {
+		field := fmt.Sprintf("budgets.prices[%d]", i)
+		if _, err := path.Match(p.Model, ""); p.Model == "" || err != nil {
+			errs = append(errs, fmt.Errorf("%s: model must be a name or pattern", field))
+		}
+		if p.Input < 0 || p.Output < 0 {
+			errs = append(errs, fmt.Errorf("%s: input and output must not be negative", field))
+		}
+	}
+	names := map[string]bool{}
+	for i, r := range c.Rules {
+		field := fmt.Sprintf("budgets.rules[%d]", i)
+		if r.Name == "" {
+			errs = append(errs, fmt.Errorf("%s: name is required", field))
+		} else if names[r.Name] {
+			errs = append(errs, fmt.Errorf("%s: duplicate name %q", field, r.Name))
+		}
+		names[r.Name] = true
+		if r.DailyCost <= 0 {
+			errs = append(errs, fmt.Errorf("%s: daily_cost must be positive", field))
+		}
+		if r.By != "" && r.By != "client" && r.By != "api_key" {
+			errs = append(errs, fmt.Errorf("%s: by must be client or api_key", field))
+		}
+		if r.Timezone != "" {
+			if _, err := time.LoadLocation(r.Timezone); err != nil {
+				errs = append(errs, fmt.Errorf("%s: timezone: %w", field, err))
+			}
+		}
+	}
+	if len(c.Rules) > 0 && len(c.Prices) == 0 {
+		errs = append(errs, errors.New("budgets.prices is required with budgets.rules"))
+	}
+	return errs
+}
+
+// ThreatFeed is a list of malicious domains and IP addresses, fetched from
+// URL, an http(s) URL or a file path, every Refresh (1h). Format is text
+// (the default), one entry per line; csv, with entries in Column, a header
+// name or 1-based index (the first column by default); or stix, a STIX 2
+// bundle of indicators and observables. Headers are sent with each fetch,
+// for feeds that need an API key, and expand $VAR and ${VAR} from the
+// environment.
+type ThreatFeed struct {
+	Name    string            `yaml:"name"`
+	URL     string            `yaml:"url"`
+	Format  string            `yaml:"format"`
+	Column  string            `yaml:"column"`
+	Refresh time.Duration     `yaml:"refresh"`
+	Headers map[string]string `yaml:"headers"`
+}
+
+func validateThreatFeeds(feeds []ThreatFeed) []error {
+	var errs []error
+	names := map[string]bool{}
+	for i, f := range feeds {
+		field := fmt.Sprintf("threat_feeds[%d]", i)
+		if f.Name == "" {
+			errs = append(errs, fmt.Errorf("%s: name is required", field))
+		} else if names[f.Name] {
+			errs = append(errs, fmt.Errorf("%s: duplicate name %q", field, f.Name))
+		}
+		names[f.Name] = true
+		if f.URL == "" {
+			errs = append(errs, fmt.Errorf("%s: url is required", field))
+		} else if strings.Contains(f.URL, "://") && !httpURL(f.URL) {
+			errs = append(errs, fmt.Errorf("%s: url must be an http(s) URL or a file path", field))
+		}
+		switch f.Format {
+		case "", "text", "stix":
+			if f.Column != "" {
+				errs = append(errs, fmt.Errorf("%s: column is only for csv feeds", field))
+			}
+		case "csv":
+		default:
+			errs = append(errs, fmt.Errorf("%s: format must be text, csv or stix", field))
+		}
+		if f.Refresh != 0 && f.Refresh < time.Minute {
+			errs = append(errs, fmt.Errorf("%s: refresh must be at least a minute", field))
+		}
+	}
+	return errs
+}
+
+// OverrideConfig accepts override tokens sent in Header (X-Audit-Override)
+// and signed with HMAC-SHA256 under Secret, which expands $VAR and ${VAR}
+// from the environment. A valid token lets the caller it names skip one of
+// Filters for a single request. Tokens valid for longer than MaxTTL (1h)
+// are refused. Overrides are off while Secret is empty.
+type OverrideConfig struct {
+	Header  string        `yaml:"header"`
+	Secret  string        `yaml:"secret"`
+	Filters []string      `yaml:"filters"`
+	MaxTTL  time.Duration `yaml:"max_ttl"`
+}
+
+// minOverrideSecret is the shortest override secret accepted, in bytes.
+const minOverrideSecret = 16
+
+func (c OverrideConfig) validate() []error {
+	if c.Secret == "" {
+		if len(c.Filters) > 0 {
+			return []error{errors.New("overrides.secret is required with overrides.filters")}
+		}
+		return nil
+	}
+	var errs []error
+	if len(os.ExpandEnv(c.Secret)) < minOverrideSecret {
+		errs = append(errs, fmt.Errorf("overrides.secret must be at least %d bytes", minOverrideSecret))
+	}
+	if len(c.Filters) == 0 {
+		errs = append(errs, errors.New("overrides.filters is required with overrides.secret"))
+	}
+	if c.MaxTTL < 0 {
+		errs = append(errs, errors.New("overrides.max_ttl must not be negative"))
+	}
+	return errs
+}
+
+// ClientConfig scopes policy to a set of clients, identified by
+// authenticated user and/or source address. All configured matchers must
+// match. Unset policy fields inherit the global value; Filters run after
+// the global filters and DenyHosts add to the global deny list.
+type ClientConfig struct {
+	Name       string   `yaml:"name"`
+	Users      []string `yaml:"users"`
+	SourceCIDR string   `yaml:"source_cidr"`
+
+	AllowHosts   []string     `yaml:"allow_hosts"`
+	DenyHosts    []string     `yaml:"deny_hosts"`
+	Filters      []FilterSpec `yaml:"filters"`
+	LogBodies    *bool        `yaml:"log_bodies"`
+	ExcerptLimit *int         `yaml:"excerpt_limit"`
+}
+
+// ProxyAuthConfig requires clients to authenticate to the proxy with
+// Proxy-Authorization. It is enabled when any users or tokens are listed.
+type ProxyAuthConfig struct {
+	Realm  string       `yaml:"realm"`
+	Users  []ProxyUser  `yaml:"users"`
+	Tokens []ProxyToken `yaml:"tokens"`
+}
+
+// Enabled reports whether proxy authentication is required.
+func (c ProxyAuthConfig) Enabled() bool {
+	return len(c.Users) > 0 || len(c.Tokens) > 0
+}
+
+// ProxyUser is a Basic credential. Exactly one of Password and
+// PasswordSHA256 (hex) must be set.
+type ProxyUser struct {
+	Username       string `yaml:"username"`
+	Password       string `yaml:"password"`
+	PasswordSHA256 string `yaml:"password_sha256"`
+}
+
+// ProxyToken is a Bearer credential identifying Name, e.g. a CI job.
+// Exactly one of Token and TokenSHA256 (hex) must be set.
+type ProxyToken struct {
+	Name        string `yaml:"name"`
+	Token       string `yaml:"token"`
+	TokenSHA256 string `yaml:"token_sha256"`
+}
+
+// Default returns the configuration used when nothing else is specified.
+func Default() Config {
+	return Config{
+		Addr:            "127.0.0.1:8080",
+		LogFile:         "logs/audit.jsonl",
+		DrainTimeout:    30 * time.Second,
+		AllowHosts:      []string{"*"},
+		Profiles:        []string{"cloud_metadata", "openai", "azure_openai", "generic"},
+		ProfileMatching: ProfileMatchingConfig{StopOnFirstMatch: true},
+		ExcerptLimit:    64 << 10,
+
+		DirectSummaryInterval: time.Hour,
+		MITMLeafKey:           "ecdsa",
+		MITMReuseLeafKey:      true,
+		MITMCacheSize:         10000,
+		MITMUpstreamErrors:    "fail",
+		MITMPinning:           MITMPinningConfig{BypassFor: 24 * time.Hour},
+		MITMSessionTickets:    MITMSessionTicketsConfig{Rotate: 24 * time.Hour},
+		Listener: ListenerConfig{
+			ReadHeaderTimeout: 10 * time.Second,
+			IdleTimeout:       2 * time.Minute,
+		},
+		Connect:  ConnectConfig{Ports: []string{"443"}},
+		Workload: WorkloadConfig{Refresh: 30 * time.Second},
+		Egress:   EgressConfig{CacheTTL: 30 * time.Second, FallbackDelay: 250 * time.Millisecond},
+		Timeouts: TimeoutsConfig{Timeouts: Timeouts{
+			Dial:         30 * time.Second,
+			TLSHandshake: 10 * time.Second,
+			Idle:         90 * time.Second,
+		}},
+		ExcerptCompression: ExcerptCompressionConfig{MinBytes: 1024},
+		Reaper:             ReaperConfig{Interval: 5 * time.Minute},
+		Replay:             ReplayConfig{MaxBody: 10 << 20},
+		Cache:              CacheConfig{Store: "memory", MaxBytes: 64 << 20, MaxBody: 1 << 20},
+		Capture:            CaptureConfig{MaxBytes: 1 << 20},
+	}
+}
+
+// FilterSpec is the configuration of one filter. Name, Type and Hosts are
+// common to every filter; the remaining keys are specific to the filter type
+// and are decoded by the filter itself via Decode.
+type FilterSpec struct {
+	Name  string   `yaml:"name"`
+	Type  string   `yaml:"type"`
+	Hosts []string `yaml:"hosts"`
+
+	// Rollout, when set, applies the filter only to its cohort.
+	Rollout *RolloutConfig `yaml:"rollout"`
+
+	raw yaml.Node
+}
+
+// RolloutConfig selects the cohort a policy change is rolled out to:
+// clients authenticated as one of Users or matching one of the Clients
+// policies, and Percent of all others. Those are chosen by hashing their
+// identity, the proxy user or else the source IP, so each keeps its cohort
+// from request to request and as Percent grows.
+type RolloutConfig struct {
+	Percent float64  `yaml:"percent"`
+	Users   []string `yaml:"users"`
+	Clients []string `yaml:"clients"`
+}
+
+func (r *RolloutConfig) validate(field string) []error {
+	if r == nil {
+		return nil
+	}
+	if r.Percent < 0 || r.Percent > 100 {
+		return []error{fmt.Errorf("%s.percent must be between 0 and 100", field)}
+	}
+	return nil
+}
+
+// UnmarshalYAML records the raw node so type-specific options can be decoded
+// later by the filter implementation.
+func (s *FilterSpec) UnmarshalYAML(node *yaml.Node) error {
+	type plain FilterSpec
+	var p plain
+	if err := node.Decode(&p); err != nil {
+		return err
+	}
+	*s = FilterSpec(p)
+	s.raw = *node
+	return nil
+}
+
+// MarshalYAML writes the filter as it was read, type-specific options
+// included.
+func (s FilterSpec) MarshalYAML() (any, error) {
+	if s.raw.Kind == 0 {
+		type plain FilterSpec
+		return plain(s), nil
+	}
+	return &s.raw, nil
+}
+
+// Decode decodes the full filter configuration into v.
+func (s FilterSpec) Decode(v any) error {
+	if s.raw.Kind == 0 {
+		return nil
+	}
+	return s.raw.Decode(v)
+}
+
+// Load builds a Config from defaults, the file named by --config (or
+// AUDITPROXY_CONFIG), the environment and args.
+func Load(args []string) (Config, error) {
+	fs := flag.NewFlagSet("audit-proxy", flag.ContinueOnError)
+	configPath := fs.String("config", os.Getenv("AUDITPROXY_CONFIG"), "path to a YAML config file")
+	set := map[string]string{}
+	for _, s := range settings {
+		s := s
+		store := func(v string) error {
+			set[s.name] = v
+			return nil
+		}
+		if s.boolean {
+			fs.BoolFunc(s.name, s.usage, func(v string) error { return store(v) })
+		} else {
+			fs.Func(s.name, s.usage, store)
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+	if fs.NArg() > 0 {
+		return Config{}, fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+
+	cfg := Default()
+	if *configPath != "" {
+		if err := cfg.loadFile(*configPath); err != nil {
+			return Config{}, err
+		}
+	}
+	for _, s := range settings {
+		if v, ok := os.LookupEnv(s.env()); ok {
+			if err := s.apply(&cfg, v); err != nil {
+				return Config{}, fmt.Errorf("%s: %w", s.env(), err)
+			}
+		}
+	}
+	for _, s := range settings {
+		if v, ok := set[s.name]; ok {
+			if err := s.apply(&cfg, v); err != nil {
+				return Config{}, fmt.Errorf("--%s: %w", s.name, err)
+			}
+		}
+	}
+	return cfg, cfg.Validate()
+}
+
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read config: %w", err)
+	}
+	if err := yaml.Unmarshal(data, c); err != nil {
+		return fmt.Errorf("parse config %s: %w", path, err)
+	}
+	return nil
+}
+
+// redacted replaces credentials.
+const redacted = "REDACTED"
+
+// Redacted returns a copy of c fit to hand to others: proxy credentials,
+// their hashes, the override secret and the headers set on failover and
+// shadow requests are replaced.
+func (c Config) Redacted() Config {
+	c.ProxyAuth.Users = slices.Clone(c.ProxyAuth.Users)
+	for i, u := range c.ProxyAuth.Users {
+		c.ProxyAuth.Users[i].Password = redactSet(u.Password)
+		c.ProxyAuth.Users[i].PasswordSHA256 = redactSet(u.PasswordSHA256)
+	}
+	c.ProxyAuth.Tokens = slices.Clone(c.ProxyAuth.Tokens)
+	for i, t := range c.ProxyAuth.Tokens {
+		c.ProxyAuth.Tokens[i].Token = redactSet(t.Token)
+		c.ProxyAuth.Tokens[i].TokenSHA256 = redactSet(t.TokenSHA256)
+	}
+	c.Overrides.Secret = redactSet(c.Overrides.Secret)
+	c.Failover = slices.Clone(c.Failover)
+	for i, f := range c.Failover {
+		c.Failover[i].SetHeaders = redactValues(f.SetHeaders)
+	}
+	c.Shadow = slices.Clone(c.Shadow)
+	for i, s := range c.Shadow {
+		c.Shadow[i].SetHeaders = redactValues(s.SetHeaders)
+	}
+	return c
+}
+
+func redactSet(s string) string {
+	if s == "" {
+		return ""
+	}
+	return redacted
+}
+
+func redactValues(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	out := make(map[string]string, len(m))
+	for k := range m {
+		out[k] = redacted
+	}
+	return out
+}
+
+// Validate reports configuration errors that would prevent the proxy from
+// starting.
+func (c Config) Validate() error {
+	var errs []error
+	if c.Addr == "" && len(c.Listeners) == 0 {
+		errs = append(errs, errors.New("addr must not be empty unless listeners are set"))
+	}
+	for i, l := range c.Listeners {
+		if l.Network != "" && l.Network != "tcp" && l.Network != "unix" {
+			errs = append(errs, fmt.Errorf("listeners[%d]: network %q must be tcp or unix", i, l.Network))
+		}
+		if l.Addr == "" {
+			errs = append(errs, fmt.Errorf("listeners[%d]: addr is required", i))
+		}
+		if (l.TLSCert == "") != (l.TLSKey == "") {
+			errs = append(errs, fmt.Errorf("listeners[%d]: tls_cert and tls_key must be set together", i))
+		}
+		if l.Transparent && (l.Network == "unix" || l.TLSCert != "") {
+			errs = append(errs, fmt.Errorf("listeners[%d]: transparent listeners take plain tcp", i))
+		}
+		if l.Transparent && c.ProxyAuth.Enabled() {
+			errs = append(errs, fmt.Errorf("listeners[%d]: transparent listeners cannot authenticate clients, as proxy_auth requires", i))
+		}
+	}
+	if c.ExcerptLimit < 0 {
+		errs = append(errs, errors.New("excerpt_limit must not be negative"))
+	}
+	switch c.ExcerptCompression.Codec {
+	case "", "gzip":
+	default:
+		errs = append(errs, fmt.Errorf("excerpt_compression.codec %q must be gzip or empty", c.ExcerptCompression.Codec))
+	}
+	if c.ExcerptCompression.MinBytes < 0 {
+		errs = append(errs, errors.New("excerpt_compression.min_bytes must not be negative"))
+	}
+	for _, kind := range c.ExcerptPII.Detect {
+		if !slices.Contains(PIIKinds, kind) {
+			errs = append(errs, fmt.Errorf("excerpt_pii.detect: unknown kind %q; known kinds are %s", kind, strings.Join(PIIKinds, ", ")))
+		}
+	}
+	for i, p := range c.ExcerptPII.Patterns {
+		if p.Name == "" || p.Match == "" {
+			errs = append(errs, fmt.Errorf("excerpt_pii.patterns[%d]: name and match are required", i))
+		}
+	}
+	if c.MITM && (c.MITMCACert == "" || c.MITMCAKey == "") {
+		errs = append(errs, errors.New("mitm requires mitm_ca_cert and mitm_ca_key"))
+	}
+	if c.MITMLeafKey != "ecdsa" && c.MITMLeafKey != "rsa" {
+		errs = append(errs, fmt.Errorf("mitm_leaf_key %q must be ecdsa or rsa", c.MITMLeafKey))
+	}
+	if c.MITMCacheSize <= 0 {
+		errs = append(errs, errors.New("mitm_cache_size must be positive"))
+	}
+	if c.MITMUpstreamErrors != "fail" && c.MITMUpstreamErrors != "mirror" {
+		errs = append(errs, fmt.Errorf("mitm_upstream_errors %q must be fail or mirror", c.MITMUpstreamErrors))
+	}
+	if c.MITMCAWatch < 0 {
+		errs = append(errs, errors.New("mitm_ca_watch must not be negative"))
+	}
+	if c.MITMPinning.BypassFor < 0 {
+		errs = append(errs, errors.New("mitm_pinning.bypass_for must not be negative"))
+	}
+	if cc := c.MITMClientCerts; !cc.Request && (len(cc.Hosts) > 0 || len(cc.ClientCAs) > 0 || cc.Require) {
+		errs = append(errs, errors.New("mitm_client_certs: hosts, client_cas and require need request"))
+	}
+	if v := c.MITMTLS.MinVersion; v != "" && TLSVersion(v) == 0 {
+		errs = append(errs, fmt.Errorf("mitm_tls.min_version: unknown version %q (want 1.0 to 1.3)", v))
+	}
+	if v := c.MITMTLS.MaxVersion; v != "" && TLSVersion(v) == 0 {
+		errs = append(errs, fmt.Errorf("mitm_tls.max_version: unknown version %q (want 1.0 to 1.3)", v))
+	}
+	if lo, hi := cmp.Or(TLSVersion(c.MITMTLS.MinVersion), tls.VersionTLS12), TLSVersion(c.MITMTLS.MaxVersion); hi != 0 && hi < lo {
+		errs = append(errs, errors.New("mitm_tls.max_version must not be older than min_version (default 1.2)"))
+	}
+	for i, name := range c.MITMTLS.CipherSuites {
+		if TLSCipherSuite(name) == 0 {
+			errs = append(errs, fmt.Errorf("mitm_tls.cipher_suites[%d]: unknown cipher suite %q", i, name))
+		}
+	}
+	for i, p := range c.MITMTLS.ALPN {
+		if p != "http/1.1" && p != "http/1.0" {
+			errs = append(errs, fmt.Errorf("mitm_tls.alpn[%d]: %q must be http/1.1 or http/1.0", i, p))
+		}
+	}
+	if c.MITMSessionTickets.Rotate < 0 {
+		errs = append(errs, errors.New("mitm_session_tickets.rotate must not be negative"))
+	}
+	if t := c.MITMSessionTickets; t.Disable && t.KeyFile != "" {
+		errs = append(errs, errors.New("mitm_session_tickets: key_file is set but tickets are disabled"))
+	}
+	for i, u := range c.ProxyAuth.Users {
+		if u.Username == "" || (u.Password == "") == (u.PasswordSHA256 == "") {
+			errs = append(errs, fmt.Errorf("proxy_auth.users[%d]: username and one of password or password_sha256 are required", i))
+		}
+	}
+	for i, t := range c.ProxyAuth.Tokens {
+		if t.Name == "" || (t.Token == "") == (t.TokenSHA256 == "") {
+			errs = append(errs, fmt.Errorf("proxy_auth.tokens[%d]: name and one of token or token_sha256 are required", i))
+		}
+	}
+	for i, f := range c.Filters {
+		if f.Type == "" {
+			errs = append(errs, fmt.Errorf("filters[%d]: type is required", i))
+		}
+		errs = append(errs, f.Rollout.validate(fmt.Sprintf("filters[%d].rollout", i))...)
+	}
+	switch c.LogSync.Mode {
+	case "", "none", "always", "periodic":
+	default:
+		errs = append(errs, fmt.Errorf("log_sync.mode %q must be none, always or periodic", c.LogSync.Mode))
+	}
+	switch c.LogTime.Precision {
+	case "", "s", "ms", "us", "ns":
+	default:
+		errs = append(errs, fmt.Errorf("log_time.precision %q must be s, ms, us or ns", c.LogTime.Precision))
+	}
+	if c.LogTime.Timezone != "" {
+		if _, err := time.LoadLocation(c.LogTime.Timezone); err != nil {
+			errs = append(errs, fmt.Errorf("log_time.timezone: %w", err))
+		}
+	}
+	if c.LogSync.Entries < 0 || c.LogSync.Interval < 0 {
+		errs = append(errs, errors.New("log_sync settings must not be negative"))
+	}
+	for i, name := range c.ResponseHeaders.Remove {
+		if strings.TrimSuffix(name, "*") == "" {
+			errs = append(errs, fmt.Errorf("response_headers.remove[%d]: header name is required", i))
+		}
+	}
+	for k := range c.ResponseHeaders.Set {
+		if k == "" || strings.ContainsAny(k, " \t\r\n:") {
+			errs = append(errs, fmt.Errorf("response_headers.set: invalid header name %q", k))
+		}
+	}
+	for i, o := range c.CORS.AllowOrigins {
+		if o == "" || strings.Count(o, "*") > 1 {
+			errs = append(errs, fmt.Errorf("cors.allow_origins[%d]: %q must be an origin with at most one *", i, o))
+		}
+	}
+	if c.CORS.MaxAge < 0 {
+		errs = append(errs, errors.New("cors.max_age must not be negative"))
+	}
+	customNames := map[string]bool{}
+	for i, p := range c.CustomProfiles {
+		switch {
+		case p.Name == "":
+			errs = append(errs, fmt.Errorf("custom_profiles[%d]: name is required", i))
+		case customNames[p.Name]:
+			errs = append(errs, fmt.Errorf("custom_profiles[%d]: duplicate name %q", i, p.Name))
+		}
+		customNames[p.Name] = true
+		if len(p.Hosts) == 0 || slices.Contains(p.Hosts, "") {
+			errs = append(errs, fmt.Errorf("custom_profiles[%d]: hosts are required and must not be empty", i))
+		}
+		for j, op := range p.Operations {
+			if !strings.HasPrefix(op.Path, "/") || op.Name == "" {
+				errs = append(errs, fmt.Errorf("custom_profiles[%d].operations[%d]: path must start with / and name is required", i, j))
+			}
+		}
+	}
+	for i, name := range c.MITMHosts.Profiles {
+		if !slices.Contains(c.Profiles, name) && !customNames[name] {
+			errs = append(errs, fmt.Errorf("mitm_hosts.profiles[%d]: %q is not in profiles or custom_profiles", i, name))
+		}
+	}
+	for i, name := range c.ProfileMatching.Order {
+		switch {
+		case !slices.Contains(c.Profiles, name) && !customNames[name]:
+			errs = append(errs, fmt.Errorf("profile_matching.order[%d]: %q is not in profiles or custom_profiles", i, name))
+		case slices.Index(c.ProfileMatching.Order, name) < i:
+			errs = append(errs, fmt.Errorf("profile_matching.order[%d]: %q is listed twice", i, name))
+		}
+	}
+	for i, s := range c.Services {
+		if s.Name == "" || len(s.Hosts) == 0 {
+			errs = append(errs, fmt.Errorf("services[%d]: name and hosts are required", i))
+		}
+	}
+	for i, m := range c.Mocks {
+		if m.Status != 0 && (m.Status < 100 || m.Status > 599) {
+			errs = append(errs, fmt.Errorf("mocks[%d]: status %d is not a valid HTTP status", i, m.Status))
+		}
+		if m.Body != "" && m.BodyFile != "" {
+			errs = append(errs, fmt.Errorf("mocks[%d]: body and body_file are mutually exclusive", i))
+		}
+	}
+	for i, r := range c.Replay.Rules {
+		switch r.Mode {
+		case "record", "replay", "auto":
+		default:
+			errs = append(errs, fmt.Errorf("replay.rules[%d]: mode %q must be record, replay or auto", i, r.Mode))
+		}
+	}
+	if len(c.Replay.Rules) > 0 && c.Replay.Dir == "" {
+		errs = append(errs, errors.New("replay.dir is required with replay rules"))
+	}
+	if c.Replay.MaxBody < 0 {
+		errs = append(errs, errors.New("replay.max_body must not be negative"))
+	}
+	if c.Capture.MaxBytes < 0 {
+		errs = append(errs, errors.New("capture.max_bytes must not be negative"))
+	}
+	captureNames := map[string]bool{}
+	for i, r := range c.Capture.Rules {
+		switch {
+		case r.Name == "":
+			errs = append(errs, fmt.Errorf("capture.rules[%d]: name is required", i))
+		case captureNames[r.Name]:
+			errs = append(errs, fmt.Errorf("capture.rules[%d]: duplicate name %q", i, r.Name))
+		}
+		captureNames[r.Name] = true
+		if r.Percent < 0 || r.Percent > 100 {
+			errs = append(errs, fmt.Errorf("capture.rules[%d]: percent must be between 0 and 100", i))
+		}
+		if r.MinStatus < 0 || r.MaxStatus < 0 || r.MaxStatus != 0 && r.MaxStatus < r.MinStatus {
+			errs = append(errs, fmt.Errorf("capture.rules[%d]: invalid status range", i))
+		}
+	}
+	switch c.Cache.Store {
+	case "memory":
+	case "disk":
+		if c.Cache.Dir == "" {
+			errs = append(errs, errors.New("cache.dir is required with the disk store"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("cache.store %q must be memory or disk", c.Cache.Store))
+	}
+	if c.Cache.MaxBytes <= 0 || c.Cache.MaxBody <= 0 {
+		errs = append(errs, errors.New("cache.max_bytes and cache.max_body must be positive"))
+	}
+	if c.Cache.DefaultTTL < 0 {
+		errs = append(errs, errors.New("cache.default_ttl must not be negative"))
+	}
+	if c.Direct.Upstream != "" {
+		u, err := url.Parse(c.Direct.Upstream)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("direct.upstream %q must be an http or https URL", c.Direct.Upstream))
+		}
+	}
+	if c.DrainTimeout < 0 {
+		errs = append(errs, errors.New("drain_timeout must not be negative"))
+	}
+	if c.Workload.Refresh <= 0 {
+		errs = append(errs, errors.New("workload.refresh must be positive"))
+	}
+	if u := c.Workload.Kubernetes.PodsURL; u != "" && !httpURL(u) {
+		errs = append(errs, fmt.Errorf("workload.kubernetes.pods_url %q must be an http or https URL", u))
+	}
+	if c.DirectSummaryInterval < 0 {
+		errs = append(errs, errors.New("direct_summary_interval must not be negative"))
+	}
+	if c.Ring.Entries < 0 || c.Ring.SlotSize < 0 {
+		errs = append(errs, errors.New("ring.entries and ring.slot_size must not be negative"))
+	}
+	if l := c.Listener; l.ReadHeaderTimeout < 0 || l.IdleTimeout < 0 || l.MaxRequestsPerConn < 0 || l.MaxRequestRate < 0 {
+		errs = append(errs, errors.New("listener settings must not be negative"))
+	}
+	if c.Timeouts.negative() {
+		errs = append(errs, errors.New("timeouts must not be negative"))
+	}
+	for i, h := range c.Timeouts.Hosts {
+		if len(h.Match) == 0 {
+			errs = append(errs, fmt.Errorf("timeouts.hosts[%d]: match is required", i))
+		}
+		if h.negative() {
+			errs = append(errs, fmt.Errorf("timeouts.hosts[%d]: timeouts must not be negative", i))
+		}
+	}
+	if v := c.UpstreamTLS.MinVersion; v != "" && TLSVersion(v) == 0 {
+		errs = append(errs, fmt.Errorf("upstream_tls.min_version: unknown version %q (want 1.0 to 1.3)", v))
+	}
+	if r := c.UpstreamTLS.Revocation; !r.Check && (r.CRL || r.FailClosed) {
+		errs = append(errs, errors.New("upstream_tls.revocation: crl and fail_closed need check"))
+	}
+	for i, h := range c.UpstreamTLS.Hosts {
+		if len(h.Match) == 0 {
+			errs = append(errs, fmt.Errorf("upstream_tls.hosts[%d]: match is required", i))
+		}
+		if (h.ClientCert == "") != (h.ClientKey == "") {
+			errs = append(errs, fmt.Errorf("upstream_tls.hosts[%d]: client_cert and client_key must be set together", i))
+		}
+		if h.MinVersion != "" && TLSVersion(h.MinVersion) == 0 {
+			errs = append(errs, fmt.Errorf("upstream_tls.hosts[%d].min_version: unknown version %q (want 1.0 to 1.3)", i, h.MinVersion))
+		}
+	}
+	if c.Retry.Attempts < 0 || c.Retry.Backoff < 0 || c.Retry.MaxBackoff < 0 {
+		errs = append(errs, errors.New("retry settings must not be negative"))
+	}
+	if cb := c.CircuitBreaker; cb.ErrorRate < 0 || cb.ErrorRate > 1 || cb.MinRequests < 0 || cb.Window < 0 || cb.OpenFor < 0 {
+		errs = append(errs, errors.New("circuit_breaker: error_rate must be within 0-1 and other settings not negative"))
+	}
+	if c.Egress.CacheTTL < 0 {
+		errs = append(errs, errors.New("egress.cache_ttl must not be negative"))
+	}
+	for i, p := range c.Egress.AllowPrivate {
+		if _, err := netip.ParsePrefix(p); err != nil {
+			errs = append(errs, fmt.Errorf("egress.allow_private[%d]: %w", i, err))
+		}
+	}
+	for host, addrs := range c.Egress.Hosts {
+		if len(addrs) == 0 {
+			errs = append(errs, fmt.Errorf("egress.hosts[%s]: at least one address is required", host))
+		}
+		for _, a := range addrs {
+			if _, err := netip.ParseAddr(a); err != nil {
+				errs = append(errs, fmt.Errorf("egress.hosts[%s]: %w", host, err))
+			}
+		}
+	}
+	if c.Egress.BindAddress != "" {
+		if _, err := netip.ParseAddr(c.Egress.BindAddress); err != nil {
+			errs = append(errs, fmt.Errorf("egress.bind_address: %w", err))
+		}
+		if c.Egress.Interface != "" {
+			errs = append(errs, errors.New("egress: bind_address and interface are mutually exclusive"))
+		}
+	}
+	if c.Reaper.Interval < 0 || c.Reaper.MITMIdle < 0 {
+		errs = append(errs, errors.New("reaper settings must not be negative"))
+	}
+	if c.Egress.FallbackDelay < 0 {
+		errs = append(errs, errors.New("egress.fallback_delay must not be negative"))
+	}
+	for i, p := range c.UpstreamPools {
+		if p.Host == "" || len(p.Endpoints) == 0 {
+			errs = append(errs, fmt.Errorf("upstream_pools[%d]: host and endpoints are required", i))
+		}
+		if p.MaxFails < 0 || p.FailTimeout < 0 {
+			errs = append(errs, fmt.Errorf("upstream_pools[%d]: max_fails and fail_timeout must not be negative", i))
+		}
+		errs = append(errs, p.HealthCheck.validate(fmt.Sprintf("upstream_pools[%d].health_check", i))...)
+		for j, e := range p.Endpoints {
+			if !httpURL(e.URL) {
+				errs = append(errs, fmt.Errorf("upstream_pools[%d].endpoints[%d]: url must be an http(s) URL", i, j))
+			}
+			if e.Weight < 0 {
+				errs = append(errs, fmt.Errorf("upstream_pools[%d].endpoints[%d]: weight must not be negative", i, j))
+			}
+		}
+	}
+	for i, f := range c.Failover {
+		if f.Name == "" || len(f.Hosts) == 0 {
+			errs = append(errs, fmt.Errorf("failover[%d]: name and hosts are required", i))
+		}
+		if !httpURL(f.Target) {
+			errs = append(errs, fmt.Errorf("failover[%d]: target must be an http(s) URL", i))
+		}
+		errs = append(errs, f.HealthCheck.validate(fmt.Sprintf("failover[%d].health_check", i))...)
+	}
+	for i, r := range c.Shadow {
+		if r.Name == "" || len(r.Hosts) == 0 {
+			errs = append(errs, fmt.Errorf("shadow[%d]: name and hosts are required", i))
+		}
+		if !httpURL(r.Target) {
+			errs = append(errs, fmt.Errorf("shadow[%d]: target must be an http(s) URL", i))
+		}
+		if r.Timeout < 0 {
+			errs = append(errs, fmt.Errorf("shadow[%d]: timeout must not be negative", i))
+		}
+	}
+	errs = append(errs, c.MITMRollout.validate("mitm_rollout")...)
+	errs = append(errs, c.Concurrency.validate()...)
+	errs = append(errs, c.Quotas.validate()...)
+	errs = append(errs, c.Budgets.validate()...)
+	errs = append(errs, validateThreatFeeds(c.ThreatFeeds)...)
+	errs = append(errs, c.Overrides.validate()...)
+	if c.Anomaly.MinSamples < 0 || c.Anomaly.StatusDelta < 0 || c.Anomaly.LatencyFactor < 0 ||
+		c.Anomaly.MinLatencyMS < 0 || c.Anomaly.Cooldown < 0 || c.Anomaly.MaxHosts < 0 {
+		errs = append(errs, errors.New("anomaly settings must not be negative"))
+	}
+	for i, cl := range c.Clients {
+		if cl.Name == "" {
+			errs = append(errs, fmt.Errorf("clients[%d]: name is required", i))
+		}
+		if len(cl.Users) == 0 && cl.SourceCIDR == "" {
+			errs = append(errs, fmt.Errorf("clients[%d]: users or source_cidr is required", i))
+		}
+		if cl.SourceCIDR != "" {
+			if _, err := netip.ParsePrefix(cl.SourceCIDR); err != nil {
+				errs = append(errs, fmt.Errorf("clients[%d]: source_cidr: %w", i, err))
+			}
+		}
+		if cl.ExcerptLimit != nil && *cl.ExcerptLimit < 0 {
+			errs = append(errs, fmt.Errorf("clients[%d]: excerpt_limit must not be negative", i))
+		}
+		for j, f := range cl.Filters {
+			if f.Type == "" {
+				errs = append(errs, fmt.Errorf("clients[%d].filters[%d]: type is required", i, j))
+			}
+			errs = append(errs, f.Rollout.validate(fmt.Sprintf("clients[%d].filters[%d].rollout", i, j))...)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func httpURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+func (t Timeouts) negative() bool {
+	return t.Dial < 0 || t.TLSHandshake < 0 || t.ResponseHeader < 0 || t.Idle < 0
+}
+
+// Merge returns t with the non-zero fields of o applied.
+func (t Timeouts) Merge(o Timeouts) Timeouts {
+	if o.Dial != 0 {
+		t.Dial = o.Dial
+	}
+	if o.TLSHandshake != 0 {
+		t.TLSHandshake = o.TLSHandshake
+	}
+	if o.ResponseHeader != 0 {
+		t.ResponseHeader = o.ResponseHeader
+	}
+	if o.Idle != 0 {
+		t.Idle = o.Idle
+	}
+	return t
+}
+
+// setting describes a scalar option that can be set from a flag or the
+// environment.
+type setting struct {
+	name    string
+	usage   string
+	boolean bool
+	apply   func(c *Config, v string) error
+}
+
+func (s setting) env() string {
+	return "AUDITPROXY_" + strings.ToUpper(strings.ReplaceAll(s.name, "-", "_"))
+}
+
+var settings = []setting{
+	{name: "addr", usage: "proxy listen address", apply: func(c *Config, v string) error {
+		c.Addr = v
+		return nil
+	}},
+	{name: "logfile", usage: "audit log path (JSON lines, - for stdout)", apply: func(c *Config, v string) error {
+		c.LogFile = v
+		return nil
+	}},
+	{name: "allow-hosts", usage: "comma-separated hosts the proxy may reach (* for any)", apply: func(c *Config, v string) error {
+		c.AllowHosts = splitList(v)
+		return nil
+	}},
+	{name: "deny-hosts", usage: "comma-separated hosts the proxy must not reach, overriding allow-hosts", apply: func(c *Config, v string) error {
+		c.DenyHosts = splitList(v)
+		return nil
+	}},
+	{name: "direct-hosts", usage: "comma-separated hosts passed through without policy, interception or audit entries", apply: func(c *Config, v string) error {
+		c.DirectHosts = splitList(v)
+		return nil
+	}},
+	{name: "log-before-forward", usage: "write a preliminary entry before forwarding each request", boolean: true, apply: func(c *Config, v string) (err error) {
+		c.LogBeforeForward, err = strconv.ParseBool(v)
+		return err
+	}},
+	{name: "log-timezone", usage: "timezone of entry times: UTC, Local or an IANA name", apply: func(c *Config, v string) error {
+		c.LogTime.Timezone = v
+		return nil
+	}},
+	{name: "log-time-precision", usage: "fractional digits of entry times: s, ms, us or ns", apply: func(c *Config, v string) error {
+		c.LogTime.Precision = v
+		return nil
+	}},
+	{name: "log-sync", usage: "when to fsync the audit log: none, always or periodic", apply: func(c *Config, v string) error {
+		c.LogSync.Mode = v
+		return nil
+	}},
+	{name: "forwarded-headers", usage: "add Via and X-Forwarded-For headers", boolean: true, apply: func(c *Config, v string) (err error) {
+		c.ForwardedHeaders, err = strconv.ParseBool(v)
+		return err
+	}},
+	{name: "strip-response-headers", usage: "comma-separated upstream response headers to remove (Name or Prefix-*)", apply: func(c *Config, v string) error {
+		c.ResponseHeaders.Remove = splitList(v)
+		return nil
+	}},
+	{name: "direct-upstream", usage: "reverse-proxy requests sent to the listener directly to this URL (empty to refuse them)", apply: func(c *Config, v string) error {
+		c.Direct.Upstream = v
+		return nil
+	}},
+	{name: "reject-host-mismatch", usage: "refuse intercepted requests whose Host header differs from the tunnel's host", boolean: true, apply: func(c *Config, v string) (err error) {
+		c.RejectHostMismatch, err = strconv.ParseBool(v)
+		return err
+	}},
+	{name: "pac", usage: "serve a proxy auto-config file at /proxy.pac and /wpad.dat", boolean: true, apply: func(c *Config, v string) (err error) {
+		c.PAC.Enabled, err = strconv.ParseBool(v)
+		return err
+	}},
+	{name: "connect-ports", usage: "comma-separated ports or ranges CONNECT may reach, * for any", apply: func(c *Config, v string) error {
+		c.Connect.Ports = splitList(v)
+		return nil
+	}},
+	{name: "cors-origins", usage: "comma-separated browser origins allowed to call upstreams through the proxy", apply: func(c *Config, v string) error {
+		c.CORS.AllowOrigins = splitList(v)
+		return nil
+	}},
+	{name: "ring-file", usage: "keep recent entries in this crash-safe ring file (empty to disable)", apply: func(c *Config, v string) error {
+		c.Ring.Path = v
+		return nil
+	}},
+	{name: "profiles", usage: "comma-separated profiles to enable", apply: func(c *Config, v string) error {
+		c.Profiles = splitList(v)
+		return nil
+	}},
+	{name: "log-bodies", usage: "record request/response body excerpts", boolean: true, apply: func(c *Config, v string) (err error) {
+		c.LogBodies, err = strconv.ParseBool(v)
+		return err
+	}},
+	{name: "excerpt-limit", usage: "maximum body bytes kept per excerpt", apply: func(c *Config, v string) (err error) {
+		c.ExcerptLimit, err = strconv.Atoi(v)
+		return err
+	}},
+	{name: "excerpt-compression", usage: "codec compressing excerpts in the audit log: gzip, or empty for none", apply: func(c *Config, v string) error {
+		c.ExcerptCompression.Codec = v
+		return nil
+	}},
+	{name: "excerpt-pii", usage: "comma-separated kinds of personal data scrubbed from excerpts: " + strings.Join(PIIKinds, ", "), apply: func(c *Config, v string) error {
+		c.ExcerptPII.Detect = splitList(v)
+		return nil
+	}},
+	{name: "mitm", usage: "intercept CONNECT tunnels with certificates from the MITM CA", boolean: true, apply: func(c *Config, v string) (err error) {
+		c.MITM, err = strconv.ParseBool(v)
+		return err
+	}},
+	{name: "mitm-ca-cert", usage: "PEM certificate of the MITM CA", apply: func(c *Config, v string) error {
+		c.MITMCACert = v
+		return nil
+	}},
+	{name: "mitm-ca-key", usage: "PEM private key of the MITM CA", apply: func(c *Config, v string) error {
+		c.MITMCAKey = v
+		return nil
+	}},
+	{name: "mitm-ca-watch", usage: "how often to check the MITM CA files for changes (0 to check only on reload)", apply: func(c *Config, v string) (err error) {
+		c.MITMCAWatch, err = time.ParseDuration(v)
+		return err
+	}},
+	{name: "mitm-disable-hosts", usage: "comma-separated hosts to tunnel without interception", apply: func(c *Config, v string) error {
+		c.MITMDisableHosts = splitList(v)
+		return nil
+	}},
+	{name: "mitm-leaf-key", usage: "algorithm of intercepted tunnels' leaf keys: ecdsa or rsa", apply: func(c *Config, v string) error {
+		c.MITMLeafKey = v
+		return nil
+	}},
+	{name: "mitm-reuse-leaf-key", usage: "share one pre-generated key among all leaf certificates", boolean: true, apply: func(c *Config, v string) (err error) {
+		c.MITMReuseLeafKey, err = strconv.ParseBool(v)
+		return err
+	}},
+	{name: "mitm-cache-size", usage: "hosts whose leaf certificates are kept for reuse", apply: func(c *Config, v string) (err error) {
+		c.MITMCacheSize, err = strconv.Atoi(v)
+		return err
+	}},
+	{name: "mitm-upstream-errors", usage: "fail or mirror: how intercepted clients learn of upstream certificates failing verification", apply: func(c *Config, v string) error {
+		c.MITMUpstreamErrors = v
+		return nil
+	}},
+	{name: "mitm-pinning-bypass", usage: "tunnel hosts whose clients reject the leaf certificate without interception for a while", boolean: true, apply: func(c *Config, v string) (err error) {
+		c.MITMPinning.Bypass, err = strconv.ParseBool(v)
+		return err
+	}},
+	{name: "mitm-request-client-certs", usage: "ask clients of intercepted tunnels for TLS client certificates and record them", boolean: true, apply: func(c *Config, v string) (err error) {
+		c.MITMClientCerts.Request, err = strconv.ParseBool(v)
+		return err
+	}},
+	{name: "mitm-min-tls", usage: "oldest TLS version intercepted clients may use: 1.0, 1.1, 1.2 or 1.3", apply: func(c *Config, v string) error {
+		c.MITMTLS.MinVersion = v
+		return nil
+	}},
+	{name: "mitm-max-tls", usage: "newest TLS version intercepted clients may use: 1.0, 1.1, 1.2 or 1.3", apply: func(c *Config, v string) error {
+		c.MITMTLS.MaxVersion = v
+		return nil
+	}},
+	{name: "mitm-cipher-suites", usage: "comma-separated TLS 1.2 cipher suites intercepted clients may use, by Go name", apply: func(c *Config, v string) error {
+		c.MITMTLS.CipherSuites = splitList(v)
+		return nil
+	}},
+	{name: "mitm-disable-session-tickets", usage: "make clients of intercepted tunnels repeat full TLS handshakes rather than resume", boolean: true, apply: func(c *Config, v string) (err error) {
+		c.MITMSessionTickets.Disable, err = strconv.ParseBool(v)
+		return err
+	}},
+	{name: "mitm-session-ticket-keys", usage: "file of hex-encoded TLS session ticket keys shared by proxies, the first encrypting", apply: func(c *Config, v string) error {
+		c.MITMSessionTickets.KeyFile = v
+		return nil
+	}},
+	{name: "drain-timeout", usage: "time shutdown waits for in-flight requests and tunnels (0 to close them at once)", apply: func(c *Config, v string) (err error) {
+		c.DrainTimeout, err = time.ParseDuration(v)
+		return err
+	}},
+	{name: "read-header-timeout", usage: "time a client may take to send request headers (0 for none)", apply: func(c *Config, v string) (err error) {
+		c.Listener.ReadHeaderTimeout, err = time.ParseDuration(v)
+		return err
+	}},
+	{name: "max-requests-per-conn", usage: "requests served per client keep-alive connection (0 for no limit)", apply: func(c *Config, v string) (err error) {
+		c.Listener.MaxRequestsPerConn, err = strconv.Atoi(v)
+		return err
+	}},
+	{name: "max-request-rate", usage: "requests per second allowed on one client connection (0 for no limit)", apply: func(c *Config, v string) (err error) {
+		c.Listener.MaxRequestRate, err = strconv.ParseFloat(v, 64)
+		return err
+	}},
+	{name: "strict-framing", usage: "refuse requests with ambiguous Content-Length or Transfer-Encoding framing", boolean: true, apply: func(c *Config, v string) (err error) {
+		c.Listener.StrictFraming, err = strconv.ParseBool(v)
+		return err
+	}},
+	{name: "reaper-interval", usage: "how often idle connections are closed (0 to disable)", apply: func(c *Config, v string) (err error) {
+		c.Reaper.Interval, err = time.ParseDuration(v)
+		return err
+	}},
+	{name: "replay-dir", usage: "directory holding recorded responses", apply: func(c *Config, v string) error {
+		c.Replay.Dir = v
+		return nil
+	}},
+	{name: "replay-mode", usage: "record, replay or auto: record-and-replay mode for hosts no other replay rule matches", apply: func(c *Config, v string) error {
+		// Replace a trailing catch-all rule, so later sources override it.
+		if n := len(c.Replay.Rules); n > 0 && len(c.Replay.Rules[n-1].Hosts) == 0 {
+			c.Replay.Rules[n-1].Mode = v
+			return nil
+		}
+		c.Replay.Rules = append(c.Replay.Rules, ReplayRule{Mode: v})
+		return nil
+	}},
+	{name: "cache-hosts", usage: "comma-separated hosts whose GET responses are cached", apply: func(c *Config, v string) error {
+		c.Cache.Hosts = splitList(v)
+		return nil
+	}},
+	{name: "cache-dir", usage: "keep the response cache on disk in this directory", apply: func(c *Config, v string) error {
+		c.Cache.Store, c.Cache.Dir = "disk", v
+		return nil
+	}},
+	{name: "dns-servers", usage: "comma-separated DNS servers for upstream lookups (default: system resolver)", apply: func(c *Config, v string) error {
+		c.Egress.DNSServers = splitList(v)
+		return nil
+	}},
+	{name: "block-private", usage: "refuse upstream targets that resolve to private or link-local addresses", boolean: true, apply: func(c *Config, v string) (err error) {
+		c.Egress.BlockPrivate, err = strconv.ParseBool(v)
+		return err
+	}},
+	{name: "bind-address", usage: "local IP address to make upstream connections from", apply: func(c *Config, v string) error {
+		c.Egress.BindAddress = v
+		return nil
+	}},
+	{name: "bind-interface", usage: "network interface to make upstream connections from", apply: func(c *Config, v string) error {
+		c.Egress.Interface = v
+		return nil
+	}},
+	{name: "upstream-ca", usage: "comma-separated PEM files of CAs trusted for upstream TLS besides the system roots", apply: func(c *Config, v string) error {
+		c.Egress.RootCAs = splitList(v)
+		return nil
+	}},
+	{name: "upstream-min-tls", usage: "oldest TLS version accepted from upstreams: 1.0, 1.1, 1.2 or 1.3", apply: func(c *Config, v string) error {
+		c.UpstreamTLS.MinVersion = v
+		return nil
+	}},
+	{name: "upstream-check-revocation", usage: "fail upstream TLS connections whose certificates a stapled OCSP response says are revoked", boolean: true, apply: func(c *Config, v string) (err error) {
+		c.UpstreamTLS.Revocation.Check, err = strconv.ParseBool(v)
+		return err
+	}},
+	{name: "dial-timeout", usage: "upstream resolve and connect timeout (0 for none)", apply: func(c *Config, v string) (err error) {
+		c.Timeouts.Dial, err = time.ParseDuration(v)
+		return err
+	}},
+	{name: "tls-handshake-timeout", usage: "upstream TLS handshake timeout (0 for none)", apply: func(c *Config, v string) (err error) {
+		c.Timeouts.TLSHandshake, err = time.ParseDuration(v)
+		return err
+	}},
+	{name: "response-header-timeout", usage: "time to wait for upstream response headers (0 for none)", apply: func(c *Config, v string) (err error) {
+		c.Timeouts.ResponseHeader, err = time.ParseDuration(v)
+		return err
+	}},
+	{name: "idle-timeout", usage: "how long idle upstream connections are kept (0 for no limit)", apply: func(c *Config, v string) (err error) {
+		c.Timeouts.Idle, err = time.ParseDuration(v)
+		return err
+	}},
+	{name: "max-requests", usage: "maximum in-flight upstream requests (0 for no limit)", apply: func(c *Config, v string) (err error) {
+		c.Concurrency.MaxRequests, err = strconv.Atoi(v)
+		return err
+	}},
+	{name: "max-requests-per-host", usage: "maximum in-flight upstream requests per target host (0 for no limit)", apply: func(c *Config, v string) (err error) {
+		c.Concurrency.PerHost, err = strconv.Atoi(v)
+		return err
+	}},
+	{name: "max-requests-per-client", usage: "maximum in-flight upstream requests per client (0 for no limit)", apply: func(c *Config, v string) (err error) {
+		c.Concurrency.PerClient, err = strconv.Atoi(v)
+		return err
+	}},
+	{name: "max-queue", usage: "requests that may wait for an upstream slot before more are refused with 503", apply: func(c *Config, v string) (err error) {
+		c.Concurrency.MaxQueue, err = strconv.Atoi(v)
+		return err
+	}},
+	{name: "queue-timeout", usage: "how long a request may wait for an upstream slot before it is refused with 503", apply: func(c *Config, v string) (err error) {
+		c.Concurrency.QueueTimeout, err = time.ParseDuration(v)
+		return err
+	}},
+	{name: "retry-attempts", usage: "attempts for idempotent upstream requests that fail with connection errors, 502 or 503 (0 or 1 to disable)", apply: func(c *Config, v string) (err error) {
+		c.Retry.Attempts, err = strconv.Atoi(v)
+		return err
+	}},
+	{name: "circuit-breaker", usage: "fail fast to upstream hosts with a high error rate", boolean: true, apply: func(c *Config, v string) (err error) {
+		c.CircuitBreaker.Enabled, err = strconv.ParseBool(v)
+		return err
+	}},
+	{name: "metrics-addr", usage: "address to serve Prometheus metrics on (empty to disable)", apply: func(c *Config, v string) error {
+		c.MetricsAddr = v
+		return nil
+	}},
+	{name: "anomaly", usage: "detect per-host status and latency anomalies", boolean: true, apply: func(c *Config, v string) (err error) {
+		c.Anomaly.Enabled, err = strconv.ParseBool(v)
+		return err
+	}},
+}
+
+func splitList(v string) []string {
+	var out []string
+	for _, p := range strings.Split(v, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
@@ -0,0 +1,54 @@
+package filters
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/kdhira/audit-proxy/internal/config"
+)
+
+// blockFilter rejects requests by method and/or path prefix. With neither
+// configured it blocks every request to its hosts.
+//
+//	filters:
+//	  - name: no-deletes
+//	    type: block
+//	    hosts: [api.github.com]
+//	    methods: [DELETE]
+//	    path_prefixes: [/repos/]
+type blockFilter struct {
+	name     string
+	methods  []string
+	prefixes []string
+}
+
+func newBlockFilter(spec config.FilterSpec) (any, error) {
+	var opts struct {
+		Methods      []string `yaml:"methods"`
+		PathPrefixes []string `yaml:"path_prefixes"`
+	}
+	if err := spec.Decode(&opts); err != nil {
+		return nil, err
+	}
+	f := &blockFilter{name: spec.Name, prefixes: opts.PathPrefixes}
+	for _, m := range opts.Methods {
+		f.methods = append(f.methods, strings.ToUpper(m))
+	}
+	return f, nil
+}
+
+func (f *blockFilter) Name() string { return f.name }
+
+func (f *blockFilter) OnRequest(_ context.Context, req *http.Request) error {
+	if len(f.methods) > 0 && !slices.Contains(f.methods, req.Method) {
+		return nil
+	}
+	if len(f.prefixes) > 0 && !slices.ContainsFunc(f.prefixes, func(p string) bool {
+		return strings.HasPrefix(req.URL.Path, p)
+	}) {
+		return nil
+	}
+	return &BlockError{Reason: req.Method + " " + req.URL.Path}
+}
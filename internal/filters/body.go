@@ -0,0 +1,131 @@
+package filters
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+
+	"github.com/kdhira/audit-proxy/internal/audit"
+	"github.com/kdhira/audit-proxy/internal/config"
+)
+
+// defaultBodyInspect is how much of a request body a body filter reads
+// when max_bytes is not set.
+const defaultBodyInspect = 1 << 20
+
+// bodyFilter rejects requests whose body matches one of its rules: a
+// regular expression, or any of a list of literal strings. Only the first
+// max_bytes of a body are inspected; the whole body is still forwarded.
+// The name of the rule that matched is recorded in the body.rule attribute.
+//
+//	filters:
+//	  - name: model-policy
+//	    type: body
+//	    hosts: [api.openai.com]
+//	    max_bytes: 65536   # default 1 MiB
+//	    rules:
+//	      - name: gpt-4-32k
+//	        match: '"model"\s*:\s*"gpt-4-32k"'
+//	      - name: codenames
+//	        contains: [bluebird, nightjar]
+type bodyFilter struct {
+	name  string
+	limit int64
+	rules []bodyRule
+}
+
+type bodyRule struct {
+	name     string
+	match    *regexp.Regexp
+	contains [][]byte
+}
+
+func newBodyFilter(spec config.FilterSpec) (any, error) {
+	var opts struct {
+		MaxBytes int64 `yaml:"max_bytes"`
+		Rules    []struct {
+			Name     string   `yaml:"name"`
+			Match    string   `yaml:"match"`
+			Contains []string `yaml:"contains"`
+		} `yaml:"rules"`
+	}
+	if err := spec.Decode(&opts); err != nil {
+		return nil, err
+	}
+	if opts.MaxBytes < 0 {
+		return nil, errors.New("max_bytes must not be negative")
+	}
+	if len(opts.Rules) == 0 {
+		return nil, errors.New("rules are required")
+	}
+	f := &bodyFilter{name: spec.Name, limit: opts.MaxBytes}
+	if f.limit == 0 {
+		f.limit = defaultBodyInspect
+	}
+	for i, r := range opts.Rules {
+		if (r.Match == "") == (len(r.Contains) == 0) {
+			return nil, fmt.Errorf("rules[%d]: exactly one of match and contains is required", i)
+		}
+		rule := bodyRule{name: r.Name}
+		if rule.name == "" {
+			rule.name = fmt.Sprintf("rule-%d", i)
+		}
+		if r.Match != "" {
+			re, err := regexp.Compile(r.Match)
+			if err != nil {
+				return nil, fmt.Errorf("rules[%d]: %w", i, err)
+			}
+			rule.match = re
+		}
+		for _, s := range r.Contains {
+			if s == "" {
+				return nil, fmt.Errorf("rules[%d]: contains has an empty string", i)
+			}
+			rule.contains = append(rule.contains, []byte(s))
+		}
+		f.rules = append(f.rules, rule)
+	}
+	return f, nil
+}
+
+func (f *bodyFilter) Name() string { return f.name }
+
+func (f *bodyFilter) OnRequest(ctx context.Context, req *http.Request) error {
+	if req.Method == http.MethodConnect {
+		// Tunnels are opaque; their requests are inspected once decrypted.
+		return nil
+	}
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil
+	}
+	data, err := io.ReadAll(io.LimitReader(req.Body, f.limit))
+	// What was read is put back in front of the rest, so the body is
+	// forwarded whole.
+	req.Body = readCloser{io.MultiReader(bytes.NewReader(data), req.Body), req.Body}
+	if err != nil {
+		return fmt.Errorf("read request body: %w", err)
+	}
+	for _, r := range f.rules {
+		if r.matches(data) {
+			audit.Annotate(ctx, "body.rule", r.name)
+			return &BlockError{Reason: "request body matches rule " + r.name}
+		}
+	}
+	return nil
+}
+
+func (r bodyRule) matches(data []byte) bool {
+	if r.match != nil {
+		return r.match.Match(data)
+	}
+	for _, s := range r.contains {
+		if bytes.Contains(data, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,165 @@
+package filters
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/kdhira/audit-proxy/internal/config"
+	"github.com/kdhira/audit-proxy/internal/rollout"
+)
+
+// factory builds a filter from its configuration. The returned value must
+// implement RequestFilter, ResponseFilter, or both.
+type factory func(spec config.FilterSpec) (any, error)
+
+var factories = map[string]factory{
+	"block":          newBlockFilter,
+	"body":           newBodyFilter,
+	"cel":            newCELFilter,
+	"cloud_metadata": newMetadataFilter,
+	"dlp":            newDLPFilter,
+	"openapi":        newOpenAPIFilter,
+	"query":          newQueryFilter,
+	"response_body":  newResponseBodyFilter,
+	"rewrite":        newRewriteFilter,
+	"transform":      newTransformFilter,
+	"webhook":        newWebhookFilter,
+}
+
+// group filters build their members from factories, so they are added to
+// it once it is initialised.
+func init() {
+	factories["group"] = newGroupFilter
+}
+
+// Observer is told of every evaluation of a filter: its name, the phase,
+// "request" or "response", how long it took and the error blocking the
+// exchange, if any. Filters skipped for hosts out of scope, requests
+// outside their rollout or overridden requests are not evaluated.
+type Observer interface {
+	ObserveFilter(name, phase string, took time.Duration, err error)
+}
+
+// Build constructs a Chain from filter specs, preserving their order. obs,
+// if not nil, observes the filters' evaluations.
+func Build(specs []config.FilterSpec, obs Observer) (Chain, error) {
+	var c Chain
+	for i, spec := range specs {
+		rf, sf, err := build(i, spec, obs)
+		if err != nil {
+			return Chain{}, err
+		}
+		if rf != nil {
+			c.Request = append(c.Request, rf)
+		}
+		if sf != nil {
+			c.Response = append(c.Response, sf)
+		}
+	}
+	return c, nil
+}
+
+// build constructs the i'th filter of a list, scoped to its hosts and
+// rollout. At least one of the filters returned is not nil.
+func build(i int, spec config.FilterSpec, obs Observer) (RequestFilter, ResponseFilter, error) {
+	mk, ok := factories[spec.Type]
+	if !ok {
+		return nil, nil, fmt.Errorf("filters[%d]: unknown type %q", i, spec.Type)
+	}
+	if spec.Name == "" {
+		spec.Name = fmt.Sprintf("%s-%d", spec.Type, i)
+	}
+	f, err := mk(spec)
+	if err != nil {
+		return nil, nil, fmt.Errorf("filters[%d] (%s): %w", i, spec.Name, err)
+	}
+	hosts := lowerAll(spec.Hosts)
+	ro := rollout.New(spec.Name, spec.Rollout)
+	var (
+		rf RequestFilter
+		sf ResponseFilter
+	)
+	if r, ok := f.(RequestFilter); ok {
+		rf = scopedRequest{hosts: hosts, rollout: ro, obs: obs, RequestFilter: r}
+	}
+	if r, ok := f.(ResponseFilter); ok {
+		sf = scopedResponse{hosts: hosts, rollout: ro, obs: obs, ResponseFilter: r}
+	}
+	if rf == nil && sf == nil {
+		return nil, nil, fmt.Errorf("filters[%d] (%s): type %q is not a filter", i, spec.Name, spec.Type)
+	}
+	return rf, sf, nil
+}
+
+// scopedRequest applies a RequestFilter only to the configured hosts and,
+// while it is rolled out, the rollout's cohort.
+type scopedRequest struct {
+	hosts   []string
+	rollout *rollout.Rollout
+	obs     Observer
+	RequestFilter
+}
+
+func (s scopedRequest) OnRequest(ctx context.Context, req *http.Request) error {
+	if !inScope(s.hosts, req) || !s.rollout.Admit(ctx) || overridden(ctx, s.Name()) {
+		return nil
+	}
+	start := time.Now()
+	err := s.RequestFilter.OnRequest(ctx, req)
+	observe(s.obs, s.Name(), "request", start, err)
+	return err
+}
+
+// scopedResponse applies a ResponseFilter only to the configured hosts and,
+// while it is rolled out, the rollout's cohort.
+type scopedResponse struct {
+	hosts   []string
+	rollout *rollout.Rollout
+	obs     Observer
+	ResponseFilter
+}
+
+func (s scopedResponse) OnResponse(ctx context.Context, req *http.Request, resp *http.Response) error {
+	if !inScope(s.hosts, req) || !s.rollout.Admit(ctx) || overridden(ctx, s.Name()) {
+		return nil
+	}
+	start := time.Now()
+	err := s.ResponseFilter.OnResponse(ctx, req, resp)
+	observe(s.obs, s.Name(), "response", start, err)
+	return err
+}
+
+type overrideKey struct{}
+
+// WithOverride returns a context in which the filter named name is skipped,
+// for a request a trusted caller may let through it.
+func WithOverride(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, overrideKey{}, name)
+}
+
+func overridden(ctx context.Context, name string) bool {
+	o, ok := ctx.Value(overrideKey{}).(string)
+	return ok && o == name
+}
+
+func observe(obs Observer, name, phase string, start time.Time, err error) {
+	if obs != nil {
+		obs.ObserveFilter(name, phase, time.Since(start), err)
+	}
+}
+
+func inScope(hosts []string, req *http.Request) bool {
+	return len(hosts) == 0 || slices.Contains(hosts, requestHost(req))
+}
+
+func lowerAll(in []string) []string {
+	out := make([]string, len(in))
+	for i, s := range in {
+		out[i] = strings.ToLower(s)
+	}
+	return out
+}
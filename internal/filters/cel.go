@@ -0,0 +1,213 @@
+package filters
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/ext"
+
+	"github.com/kdhira/audit-proxy/internal/audit"
+	"github.com/kdhira/audit-proxy/internal/config"
+	"github.com/kdhira/audit-proxy/internal/rollout"
+)
+
+// celCostLimit bounds the work one evaluation may do, so an expression
+// over a large header map cannot stall requests.
+const celCostLimit = 1_000_000
+
+// celFilter matches exchanges with CEL expressions over the request and,
+// for the response expression, the response. A match blocks the exchange
+// or, with action annotate, is listed in the cel.matched attribute. An
+// expression that fails to evaluate, for example by reading a header that
+// is not there, blocks the exchange too; `"x" in request.headers` tests
+// for one first and `request.headers[?"x"].orValue("")` reads one that may
+// be missing.
+//
+//	filters:
+//	  - name: no-admin-deletes
+//	    type: cel
+//	    request: request.method == "DELETE" && request.path.startsWith("/admin/")
+//	    response: response.status >= 500 && client.user == ""   # optional
+//	    action: block    # or annotate
+//	    reason: deletes under /admin are not allowed   # default: the expression
+//	    status: 403
+type celFilter struct {
+	name     string
+	request  *celProgram
+	response *celProgram
+	annotate bool
+	reason   string
+	status   int
+}
+
+type celProgram struct {
+	expr string
+	prg  cel.Program
+}
+
+// celEnv declares the variables expressions see; see celRequest,
+// celResponse and celClient for their fields.
+var celEnv = sync.OnceValues(func() (*cel.Env, error) {
+	return cel.NewEnv(
+		cel.Variable("request", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("response", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("client", cel.MapType(cel.StringType, cel.StringType)),
+		ext.Strings(),
+		cel.OptionalTypes(),
+	)
+})
+
+func newCELFilter(spec config.FilterSpec) (any, error) {
+	var opts struct {
+		Request  string `yaml:"request"`
+		Response string `yaml:"response"`
+		Action   string `yaml:"action"`
+		Reason   string `yaml:"reason"`
+		Status   int    `yaml:"status"`
+	}
+	if err := spec.Decode(&opts); err != nil {
+		return nil, err
+	}
+	if opts.Request == "" && opts.Response == "" {
+		return nil, errors.New("request or response is required")
+	}
+	f := &celFilter{name: spec.Name, reason: opts.Reason, status: opts.Status}
+	switch opts.Action {
+	case "", "block":
+	case "annotate":
+		f.annotate = true
+	default:
+		return nil, fmt.Errorf("unknown action %q", opts.Action)
+	}
+	if f.status != 0 && (f.status < 400 || f.status > 599) {
+		return nil, fmt.Errorf("status %d is not an error status", f.status)
+	}
+	var err error
+	if f.request, err = compileCEL("request", opts.Request); err != nil {
+		return nil, err
+	}
+	if f.response, err = compileCEL("response", opts.Response); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// compileCEL compiles expr, which must yield a bool, or returns nil if expr
+// is empty.
+func compileCEL(field, expr string) (*celProgram, error) {
+	if expr == "" {
+		return nil, nil
+	}
+	env, err := celEnv()
+	if err != nil {
+		return nil, err
+	}
+	ast, iss := env.Compile(expr)
+	if iss.Err() != nil {
+		return nil, fmt.Errorf("%s: %w", field, iss.Err())
+	}
+	if ast.OutputType() != cel.BoolType {
+		return nil, fmt.Errorf("%s: expression yields %s, not bool", field, ast.OutputType())
+	}
+	prg, err := env.Program(ast, cel.CostLimit(celCostLimit))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", field, err)
+	}
+	return &celProgram{expr: expr, prg: prg}, nil
+}
+
+func (f *celFilter) Name() string { return f.name }
+
+func (f *celFilter) OnRequest(ctx context.Context, req *http.Request) error {
+	if f.request == nil {
+		return nil
+	}
+	return f.eval(ctx, f.request, map[string]any{
+		"request":  celRequest(req),
+		"response": map[string]any{},
+		"client":   celClient(ctx),
+	})
+}
+
+func (f *celFilter) OnResponse(ctx context.Context, req *http.Request, resp *http.Response) error {
+	if f.response == nil {
+		return nil
+	}
+	return f.eval(ctx, f.response, map[string]any{
+		"request":  celRequest(req),
+		"response": celResponse(resp),
+		"client":   celClient(ctx),
+	})
+}
+
+func (f *celFilter) eval(ctx context.Context, p *celProgram, vars map[string]any) error {
+	out, _, err := p.prg.ContextEval(ctx, vars)
+	if err != nil {
+		audit.Annotate(ctx, "cel.error", err.Error())
+		return &BlockError{Reason: "cel: " + err.Error(), Status: f.status}
+	}
+	if matched, _ := out.Value().(bool); !matched {
+		return nil
+	}
+	if f.annotate {
+		audit.AnnotateAppend(ctx, "cel.matched", f.name)
+		return nil
+	}
+	reason := f.reason
+	if reason == "" {
+		reason = p.expr
+	}
+	return &BlockError{Reason: reason, Status: f.status}
+}
+
+// celRequest returns the request variable: method, scheme, host (without
+// port), path, query (first values by name), url, headers (by lower-case
+// name, values joined with ", ") and size (the Content-Length, -1 if
+// unknown).
+func celRequest(req *http.Request) map[string]any {
+	query := map[string]string{}
+	for k, vs := range req.URL.Query() {
+		query[k] = vs[0]
+	}
+	return map[string]any{
+		"method":  req.Method,
+		"scheme":  req.URL.Scheme,
+		"host":    requestHost(req),
+		"path":    req.URL.Path,
+		"query":   query,
+		"url":     req.URL.String(),
+		"headers": celHeaders(req.Header),
+		"size":    req.ContentLength,
+	}
+}
+
+// celResponse returns the response variable: status, headers and size, as
+// for the request.
+func celResponse(resp *http.Response) map[string]any {
+	return map[string]any{
+		"status":  resp.StatusCode,
+		"headers": celHeaders(resp.Header),
+		"size":    resp.ContentLength,
+	}
+}
+
+// celClient returns the client variable: user (the authenticated proxy
+// user), name (the matching client policy) and address (the source IP),
+// each "" if unknown.
+func celClient(ctx context.Context) map[string]string {
+	s := rollout.SubjectFrom(ctx)
+	return map[string]string{"user": s.User, "name": s.Client, "address": s.Source}
+}
+
+func celHeaders(h http.Header) map[string]string {
+	out := make(map[string]string, len(h))
+	for k, vs := range h {
+		out[strings.ToLower(k)] = strings.Join(vs, ", ")
+	}
+	return out
+}
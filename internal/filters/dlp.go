@@ -0,0 +1,322 @@
+package filters
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"mime"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/kdhira/audit-proxy/internal/audit"
+	"github.com/kdhira/audit-proxy/internal/config"
+)
+
+// dlpSecrets are the built-in secret patterns, by name.
+var dlpSecrets = map[string]*regexp.Regexp{
+	"aws_access_key": regexp.MustCompile(`\b(?:AKIA|ASIA|ABIA|ACCA)[0-9A-Z]{16}\b`),
+	"github_token":   regexp.MustCompile(`\b(?:gh[pousr]_[A-Za-z0-9]{36,255}|github_pat_[A-Za-z0-9_]{22,255})\b`),
+	// The END line is optional so a key cut off by max_bytes still matches.
+	"private_key": regexp.MustCompile(`-----BEGIN (?:[A-Z0-9]+ )*PRIVATE KEY-----(?:[\s\S]*?-----END (?:[A-Z0-9]+ )*PRIVATE KEY-----)?`),
+}
+
+// dlpActions are what a pattern may do to a request or response it is found
+// in, in order of precedence.
+var dlpActions = []string{"block", "redact", "annotate"}
+
+// dlpFilter scans outbound request headers and bodies for secrets, and with
+// direction response or both, the response headers and bodies coming back.
+// Each pattern blocks the exchange, redacts what it matched before the
+// request is forwarded or the response returned, or only annotates the
+// entry. Patterns without match name a built-in one; with no patterns every
+// built-in applies. Where each was found is recorded in the dlp.findings
+// attribute, or dlp.response_findings, never the secret. A blocked response
+// is answered with 502.
+//
+//	filters:
+//	  - name: secrets
+//	    type: dlp
+//	    direction: both        # request (the default), response or both
+//	    action: block          # default for patterns that set none
+//	    max_bytes: 1048576     # of a body to scan; default 1 MiB
+//	    ignore_headers: [Authorization]   # the default
+//	    patterns:
+//	      - name: aws_access_key
+//	      - name: github_token
+//	        action: redact
+//	      - name: private_key
+//	      - name: internal-token
+//	        match: 'itk_[a-z0-9]{32}'
+//	        action: annotate
+type dlpFilter struct {
+	name     string
+	requests bool // scan requests
+	response bool // scan responses
+	limit    int64
+	ignore   []string // canonical header names
+	patterns []dlpPattern
+}
+
+type dlpPattern struct {
+	name   string
+	re     *regexp.Regexp
+	action string
+}
+
+// dlpFinding is a pattern matched in a header or the body.
+type dlpFinding struct {
+	pattern *dlpPattern
+	where   string // a header name or "body"
+}
+
+func (f dlpFinding) String() string { return f.pattern.name + " in " + f.where }
+
+func newDLPFilter(spec config.FilterSpec) (any, error) {
+	var opts struct {
+		Direction     string    `yaml:"direction"`
+		Action        string    `yaml:"action"`
+		MaxBytes      int64     `yaml:"max_bytes"`
+		IgnoreHeaders *[]string `yaml:"ignore_headers"`
+		Patterns      []struct {
+			Name   string `yaml:"name"`
+			Match  string `yaml:"match"`
+			Action string `yaml:"action"`
+		} `yaml:"patterns"`
+	}
+	if err := spec.Decode(&opts); err != nil {
+		return nil, err
+	}
+	if opts.Action == "" {
+		opts.Action = "block"
+	}
+	if !slices.Contains(dlpActions, opts.Action) {
+		return nil, fmt.Errorf("unknown action %q", opts.Action)
+	}
+	if opts.MaxBytes < 0 {
+		return nil, errors.New("max_bytes must not be negative")
+	}
+	f := &dlpFilter{name: spec.Name, limit: opts.MaxBytes, ignore: []string{"Authorization"}}
+	switch opts.Direction {
+	case "", "request":
+		f.requests = true
+	case "response":
+		f.response = true
+	case "both":
+		f.requests, f.response = true, true
+	default:
+		return nil, fmt.Errorf("unknown direction %q", opts.Direction)
+	}
+	if f.limit == 0 {
+		f.limit = defaultBodyInspect
+	}
+	if opts.IgnoreHeaders != nil {
+		f.ignore = nil
+		for _, h := range *opts.IgnoreHeaders {
+			f.ignore = append(f.ignore, http.CanonicalHeaderKey(h))
+		}
+	}
+	if len(opts.Patterns) == 0 {
+		for _, name := range slices.Sorted(maps.Keys(dlpSecrets)) {
+			f.patterns = append(f.patterns, dlpPattern{name: name, re: dlpSecrets[name], action: opts.Action})
+		}
+		return f, nil
+	}
+	for i, p := range opts.Patterns {
+		pat := dlpPattern{name: p.Name, action: cmp.Or(p.Action, opts.Action)}
+		if !slices.Contains(dlpActions, pat.action) {
+			return nil, fmt.Errorf("patterns[%d]: unknown action %q", i, p.Action)
+		}
+		if p.Match == "" {
+			pat.re = dlpSecrets[p.Name]
+			if pat.re == nil {
+				return nil, fmt.Errorf("patterns[%d]: unknown built-in pattern %q; custom patterns need match", i, p.Name)
+			}
+		} else {
+			if p.Name == "" {
+				return nil, fmt.Errorf("patterns[%d]: name is required", i)
+			}
+			re, err := regexp.Compile(p.Match)
+			if err != nil {
+				return nil, fmt.Errorf("patterns[%d]: %w", i, err)
+			}
+			pat.re = re
+		}
+		f.patterns = append(f.patterns, pat)
+	}
+	return f, nil
+}
+
+func (f *dlpFilter) Name() string { return f.name }
+
+func (f *dlpFilter) OnRequest(ctx context.Context, req *http.Request) error {
+	if req.Method == http.MethodConnect {
+		// Tunnels are opaque; their requests are scanned once decrypted.
+		return nil
+	}
+	if f.response {
+		// Ask for a response the filter can scan. The upstream transport
+		// still compresses the exchange itself when it can.
+		req.Header.Del("Accept-Encoding")
+	}
+	if !f.requests {
+		return nil
+	}
+	body, orig, err := f.readBody(&req.Body, req.Header)
+	if err != nil {
+		return fmt.Errorf("read request body: %w", err)
+	}
+	found := f.scan(req.Header, body)
+	if len(found) == 0 {
+		return nil
+	}
+	audit.Annotate(ctx, "dlp.findings", findingNames(found))
+	if fd, ok := blocking(found); ok {
+		audit.Annotate(ctx, "dlp.action", "block")
+		return &BlockError{Reason: "request contains " + fd.String()}
+	}
+	redacted, ok := f.redact(found, req.Header, body)
+	if !ok {
+		audit.Annotate(ctx, "dlp.action", "annotate")
+		return nil
+	}
+	audit.Annotate(ctx, "dlp.action", "redact")
+	if body != nil {
+		setRedactedBody(req, redacted, len(body), orig)
+	}
+	return nil
+}
+
+// OnResponse scans the response when the filter's direction includes
+// responses. Event stream bodies are not scanned, as holding them until
+// max_bytes arrived would stall the stream.
+func (f *dlpFilter) OnResponse(ctx context.Context, req *http.Request, resp *http.Response) error {
+	if !f.response || req.Method == http.MethodConnect {
+		return nil
+	}
+	var body []byte
+	var orig io.ReadCloser
+	if mt, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mt != "text/event-stream" {
+		var err error
+		if body, orig, err = f.readBody(&resp.Body, resp.Header); err != nil {
+			return fmt.Errorf("read response body: %w", err)
+		}
+	}
+	found := f.scan(resp.Header, body)
+	if len(found) == 0 {
+		return nil
+	}
+	audit.Annotate(ctx, "dlp.response_findings", findingNames(found))
+	if fd, ok := blocking(found); ok {
+		audit.Annotate(ctx, "dlp.response_action", "block")
+		return &BlockError{Reason: "response contains " + fd.String(), Status: http.StatusBadGateway}
+	}
+	redacted, ok := f.redact(found, resp.Header, body)
+	if !ok {
+		audit.Annotate(ctx, "dlp.response_action", "annotate")
+		return nil
+	}
+	audit.Annotate(ctx, "dlp.response_action", "redact")
+	if body != nil {
+		resp.Body = readCloser{io.MultiReader(bytes.NewReader(redacted), orig), orig}
+		if resp.ContentLength >= 0 {
+			setBodyLength(resp, resp.ContentLength+int64(len(redacted)-len(body)))
+		}
+	}
+	return nil
+}
+
+// scan returns the patterns found in the headers of h not ignored and in
+// body, in pattern order.
+func (f *dlpFilter) scan(h http.Header, body []byte) []dlpFinding {
+	var found []dlpFinding
+	for i := range f.patterns {
+		p := &f.patterns[i]
+		for _, k := range slices.Sorted(maps.Keys(h)) {
+			if slices.Contains(f.ignore, k) {
+				continue
+			}
+			if slices.ContainsFunc(h[k], p.re.MatchString) {
+				found = append(found, dlpFinding{p, k})
+			}
+		}
+		if body != nil && p.re.Match(body) {
+			found = append(found, dlpFinding{p, "body"})
+		}
+	}
+	return found
+}
+
+// redact masks the findings of redacting patterns, in the header values of
+// h in place and in body, which it returns with whether any pattern
+// redacted.
+func (f *dlpFilter) redact(found []dlpFinding, h http.Header, body []byte) ([]byte, bool) {
+	redacted := false
+	for _, fd := range found {
+		if fd.pattern.action != "redact" {
+			continue
+		}
+		redacted = true
+		if fd.where != "body" {
+			vs := h[fd.where]
+			for j, v := range vs {
+				vs[j] = fd.pattern.re.ReplaceAllString(v, audit.Redacted)
+			}
+			continue
+		}
+		body = fd.pattern.re.ReplaceAll(body, []byte(audit.Redacted))
+	}
+	return body, redacted
+}
+
+// blocking returns the first finding of a blocking pattern.
+func blocking(found []dlpFinding) (dlpFinding, bool) {
+	i := slices.IndexFunc(found, func(fd dlpFinding) bool { return fd.pattern.action == "block" })
+	if i < 0 {
+		return dlpFinding{}, false
+	}
+	return found[i], true
+}
+
+func findingNames(found []dlpFinding) []string {
+	names := make([]string, len(found))
+	for i, fd := range found {
+		names[i] = fd.String()
+	}
+	return names
+}
+
+// readBody returns the part of *body to scan, leaving *body readable, and
+// the original body, which the part was read from. It returns a nil part
+// when there is no body or h says it is encoded, as a compressed body
+// cannot be scanned or redacted.
+func (f *dlpFilter) readBody(body *io.ReadCloser, h http.Header) ([]byte, io.ReadCloser, error) {
+	if *body == nil || *body == http.NoBody {
+		return nil, nil, nil
+	}
+	if ce := h.Get("Content-Encoding"); ce != "" && !strings.EqualFold(ce, "identity") {
+		return nil, nil, nil
+	}
+	orig := *body
+	data, err := io.ReadAll(io.LimitReader(orig, f.limit))
+	*body = readCloser{io.MultiReader(bytes.NewReader(data), orig), orig}
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, orig, nil
+}
+
+// setRedactedBody has req send redacted, which replaces the first n bytes
+// of orig, followed by the rest of orig.
+func setRedactedBody(req *http.Request, redacted []byte, n int, orig io.ReadCloser) {
+	req.Body = readCloser{io.MultiReader(bytes.NewReader(redacted), orig), orig}
+	if req.ContentLength >= 0 {
+		req.ContentLength += int64(len(redacted) - n)
+	}
+	req.GetBody = nil
+}
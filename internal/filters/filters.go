@@ -0,0 +1,114 @@
+// Package filters implements the request/response middleware chain that can
+// block or annotate proxied traffic.
+package filters
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// ErrBlocked is wrapped by every BlockError.
+var ErrBlocked = errors.New("blocked by policy")
+
+// BlockError reports that a filter rejected an exchange.
+type BlockError struct {
+	Filter string
+	Reason string
+	// Status is the HTTP status returned to the client; 0 means 403.
+	Status int
+}
+
+func (e *BlockError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("%s: %v", e.Filter, ErrBlocked)
+	}
+	return fmt.Sprintf("%s: %v: %s", e.Filter, ErrBlocked, e.Reason)
+}
+
+func (e *BlockError) Unwrap() error { return ErrBlocked }
+
+// StatusCode returns the HTTP status to send for the block.
+func (e *BlockError) StatusCode() int {
+	if e.Status == 0 {
+		return http.StatusForbidden
+	}
+	return e.Status
+}
+
+// RequestFilter inspects a request before it is forwarded. Returning an
+// error blocks the request.
+type RequestFilter interface {
+	Name() string
+	OnRequest(ctx context.Context, req *http.Request) error
+}
+
+// ResponseFilter inspects an upstream response before it is returned to the
+// client. Returning an error blocks the response.
+type ResponseFilter interface {
+	Name() string
+	OnResponse(ctx context.Context, req *http.Request, resp *http.Response) error
+}
+
+// Chain is an ordered set of filters. The zero value allows everything.
+type Chain struct {
+	Request  []RequestFilter
+	Response []ResponseFilter
+}
+
+// OnRequest runs the request filters in order, stopping at the first error.
+// Errors are always returned as *BlockError.
+func (c Chain) OnRequest(ctx context.Context, req *http.Request) error {
+	for _, f := range c.Request {
+		if err := f.OnRequest(ctx, req); err != nil {
+			return asBlock(f.Name(), err)
+		}
+	}
+	return nil
+}
+
+// OnResponse runs the response filters in order, stopping at the first
+// error. Errors are always returned as *BlockError.
+func (c Chain) OnResponse(ctx context.Context, req *http.Request, resp *http.Response) error {
+	for _, f := range c.Response {
+		if err := f.OnResponse(ctx, req, resp); err != nil {
+			return asBlock(f.Name(), err)
+		}
+	}
+	return nil
+}
+
+func asBlock(name string, err error) *BlockError {
+	var be *BlockError
+	if errors.As(err, &be) {
+		if be.Filter == "" {
+			be.Filter = name
+		}
+		return be
+	}
+	return &BlockError{Filter: name, Reason: err.Error()}
+}
+
+// requestHost returns the lower-cased host of req without a port.
+func requestHost(req *http.Request) string {
+	host := req.URL.Host
+	if host == "" {
+		host = req.Host
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.Trim(host, "[]"))
+}
+
+// Append returns a chain running c's filters followed by other's.
+func (c Chain) Append(other Chain) Chain {
+	return Chain{
+		Request:  append(slices.Clip(c.Request), other.Request...),
+		Response: append(slices.Clip(c.Response), other.Response...),
+	}
+}
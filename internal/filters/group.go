@@ -0,0 +1,160 @@
+package filters
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/kdhira/audit-proxy/internal/config"
+)
+
+// groupFilter composes filters into one condition. Its members run in
+// order, each matching when it would block. With match all (the default)
+// the group matches when every member does and stops at the first that
+// does not; with any, it matches when one does and stops there. negate
+// inverts the result. A matching group blocks with its reason and status,
+// by default those of the last member that matched or, for a negated
+// group, 403 and "<name> not satisfied".
+//
+// Members are configured like filters, hosts and rollout included; one
+// out of scope does not match. They may be groups themselves. A group runs
+// in one phase, request (the default) or response, and its members must
+// all run in it.
+//
+//	filters:
+//	  - name: internal-api-guard
+//	    type: group
+//	    hosts: [api.internal.example.com]
+//	    match: all       # or any
+//	    negate: true     # block unless every member matches
+//	    reason: requests need a public path and an X-Request-Id
+//	    filters:
+//	      - name: public-path
+//	        type: block
+//	        path_prefixes: [/v1/public/]
+//	      - name: has-request-id
+//	        type: cel
+//	        request: '"x-request-id" in request.headers'
+type groupFilter struct {
+	name   string
+	any    bool
+	negate bool
+	reason string
+	status int
+}
+
+type requestGroup struct {
+	groupFilter
+	members []RequestFilter
+}
+
+type responseGroup struct {
+	groupFilter
+	members []ResponseFilter
+}
+
+func newGroupFilter(spec config.FilterSpec) (any, error) {
+	var opts struct {
+		Match   string              `yaml:"match"`
+		Negate  bool                `yaml:"negate"`
+		Reason  string              `yaml:"reason"`
+		Status  int                 `yaml:"status"`
+		Phase   string              `yaml:"phase"`
+		Filters []config.FilterSpec `yaml:"filters"`
+	}
+	if err := spec.Decode(&opts); err != nil {
+		return nil, err
+	}
+	if len(opts.Filters) == 0 {
+		return nil, errors.New("filters is required")
+	}
+	g := groupFilter{name: spec.Name, negate: opts.Negate, reason: opts.Reason, status: opts.Status}
+	switch opts.Match {
+	case "", "all":
+	case "any":
+		g.any = true
+	default:
+		return nil, fmt.Errorf("unknown match %q", opts.Match)
+	}
+	if g.status != 0 && (g.status < 400 || g.status > 599) {
+		return nil, fmt.Errorf("status %d is not an error status", g.status)
+	}
+	rg, sg := &requestGroup{groupFilter: g}, &responseGroup{groupFilter: g}
+	for i, ms := range opts.Filters {
+		if ms.Name == "" {
+			ms.Name = fmt.Sprintf("%s/%s-%d", spec.Name, ms.Type, i)
+		}
+		// Members are observed as part of the group.
+		rf, sf, err := build(i, ms, nil)
+		if err != nil {
+			return nil, err
+		}
+		switch opts.Phase {
+		case "", "request":
+			if rf == nil {
+				return nil, fmt.Errorf("filters[%d] (%s) does not run on requests", i, ms.Name)
+			}
+			rg.members = append(rg.members, rf)
+		case "response":
+			if sf == nil {
+				return nil, fmt.Errorf("filters[%d] (%s) does not run on responses", i, ms.Name)
+			}
+			sg.members = append(sg.members, sf)
+		default:
+			return nil, fmt.Errorf("unknown phase %q", opts.Phase)
+		}
+	}
+	if opts.Phase == "response" {
+		return sg, nil
+	}
+	return rg, nil
+}
+
+func (g *groupFilter) Name() string { return g.name }
+
+func (g *requestGroup) OnRequest(ctx context.Context, req *http.Request) error {
+	return g.result(len(g.members), func(i int) *BlockError {
+		if err := g.members[i].OnRequest(ctx, req); err != nil {
+			return asBlock(g.members[i].Name(), err)
+		}
+		return nil
+	})
+}
+
+func (g *responseGroup) OnResponse(ctx context.Context, req *http.Request, resp *http.Response) error {
+	return g.result(len(g.members), func(i int) *BlockError {
+		if err := g.members[i].OnResponse(ctx, req, resp); err != nil {
+			return asBlock(g.members[i].Name(), err)
+		}
+		return nil
+	})
+}
+
+// result evaluates the n members with eval, which returns the block of a
+// member that matches, and blocks if the group matches.
+func (g *groupFilter) result(n int, eval func(i int) *BlockError) error {
+	matched := !g.any
+	var last *BlockError
+	for i := range n {
+		be := eval(i)
+		if be != nil {
+			last = be
+		}
+		if g.any == (be != nil) {
+			matched = g.any
+			break
+		}
+	}
+	if matched == g.negate {
+		return nil
+	}
+	if g.negate {
+		return &BlockError{Reason: cmp.Or(g.reason, g.name+" not satisfied"), Status: g.status}
+	}
+	return &BlockError{
+		Reason: cmp.Or(g.reason, last.Filter+": "+last.Reason),
+		Status: cmp.Or(g.status, last.Status),
+	}
+}
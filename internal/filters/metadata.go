@@ -0,0 +1,68 @@
+package filters
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/kdhira/audit-proxy/internal/audit"
+	"github.com/kdhira/audit-proxy/internal/config"
+	"github.com/kdhira/audit-proxy/internal/profiles/cloudmetadata"
+)
+
+// metadataFilter refuses requests to cloud instance metadata services,
+// 169.254.169.254 and the like, whose credentials a client has no business
+// fetching through the proxy. Tunnels to them are refused too. Every request
+// it sees is annotated with the cloud_metadata attributes; with action
+// annotate, or credentials_only for requests not asking for credentials,
+// that is all it does.
+//
+//	filters:
+//	  - name: no-imds
+//	    type: cloud_metadata
+//	    action: block           # the default, or annotate
+//	    credentials_only: true  # block only credential and token requests
+type metadataFilter struct {
+	name            string
+	block           bool
+	credentialsOnly bool
+}
+
+func newMetadataFilter(spec config.FilterSpec) (any, error) {
+	var opts struct {
+		Action          string `yaml:"action"`
+		CredentialsOnly bool   `yaml:"credentials_only"`
+	}
+	if err := spec.Decode(&opts); err != nil {
+		return nil, err
+	}
+	f := &metadataFilter{name: spec.Name, credentialsOnly: opts.CredentialsOnly}
+	switch opts.Action {
+	case "", "block":
+		f.block = true
+	case "annotate":
+	default:
+		return nil, fmt.Errorf("unknown action %q", opts.Action)
+	}
+	return f, nil
+}
+
+func (f *metadataFilter) Name() string { return f.name }
+
+func (f *metadataFilter) OnRequest(ctx context.Context, req *http.Request) error {
+	path := req.URL.Path
+	if req.Method == http.MethodConnect {
+		path = ""
+	}
+	ep, ok := cloudmetadata.Detect(requestHost(req), path, req.Header)
+	if !ok {
+		return nil
+	}
+	cloudmetadata.Record(func(key string, value any) { audit.Annotate(ctx, key, value) }, ep)
+	if !f.block || f.credentialsOnly && !ep.Credentials {
+		audit.Annotate(ctx, "cloud_metadata.action", "annotate")
+		return nil
+	}
+	audit.Annotate(ctx, "cloud_metadata.action", "block")
+	return &BlockError{Reason: "cloud metadata endpoint " + ep.Address}
+}
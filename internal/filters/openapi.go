@@ -0,0 +1,400 @@
+package filters
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/kdhira/audit-proxy/internal/audit"
+	"github.com/kdhira/audit-proxy/internal/config"
+)
+
+// openAPIFilter validates requests against an OpenAPI 3 (or Swagger 2)
+// document: the path and method must exist and required parameters and
+// bodies must be present. Violations block the request with 400, or are only
+// recorded as attributes when action is "annotate". Operations marked
+// deprecated in the document are tagged on the entry.
+//
+//	filters:
+//	  - name: openai-schema
+//	    type: openapi
+//	    hosts: [api.openai.com]
+//	    spec: specs/openai.yaml
+//	    base_path: /v1    # optional, defaults to the path of servers[].url
+//	    action: annotate  # block (default) or annotate
+type openAPIFilter struct {
+	name     string
+	spec     *apiSpec
+	annotate bool
+}
+
+func newOpenAPIFilter(spec config.FilterSpec) (any, error) {
+	var opts struct {
+		Spec     string `yaml:"spec"`
+		BasePath string `yaml:"base_path"`
+		Action   string `yaml:"action"`
+	}
+	if err := spec.Decode(&opts); err != nil {
+		return nil, err
+	}
+	if opts.Spec == "" {
+		return nil, errors.New("spec is required")
+	}
+	f := &openAPIFilter{name: spec.Name}
+	switch opts.Action {
+	case "", "block":
+	case "annotate":
+		f.annotate = true
+	default:
+		return nil, fmt.Errorf("unknown action %q", opts.Action)
+	}
+	s, err := loadAPISpec(opts.Spec, opts.BasePath)
+	if err != nil {
+		return nil, err
+	}
+	f.spec = s
+	return f, nil
+}
+
+func (f *openAPIFilter) Name() string { return f.name }
+
+func (f *openAPIFilter) OnRequest(ctx context.Context, req *http.Request) error {
+	if req.Method == http.MethodConnect {
+		// Tunnels are opaque; their requests are validated once decrypted.
+		return nil
+	}
+	op, violations := f.spec.validate(req)
+	if op != nil && op.id != "" {
+		audit.Annotate(ctx, "openapi.operation", op.id)
+	}
+	if op != nil && op.deprecated {
+		audit.Annotate(ctx, audit.AttrDeprecated, true)
+		audit.Annotate(ctx, audit.AttrDeprecationSource, "openapi")
+	}
+	if len(violations) == 0 {
+		return nil
+	}
+	audit.Annotate(ctx, "openapi.violations", violations)
+	if f.annotate {
+		return nil
+	}
+	return &BlockError{Reason: strings.Join(violations, "; "), Status: http.StatusBadRequest}
+}
+
+// apiSpec is the compiled subset of an OpenAPI document needed for request
+// validation.
+type apiSpec struct {
+	basePaths []string
+	routes    []*apiRoute
+}
+
+type apiRoute struct {
+	template string
+	pattern  *regexp.Regexp
+	literals int
+	ops      map[string]*apiOperation
+}
+
+type apiOperation struct {
+	id           string
+	deprecated   bool
+	params       []apiParameter
+	bodyRequired bool
+	contentTypes []string
+}
+
+type apiParameter struct {
+	Ref      string `yaml:"$ref"`
+	Name     string `yaml:"name"`
+	In       string `yaml:"in"`
+	Required bool   `yaml:"required"`
+}
+
+type apiRequestBody struct {
+	Ref      string               `yaml:"$ref"`
+	Required bool                 `yaml:"required"`
+	Content  map[string]yaml.Node `yaml:"content"`
+}
+
+type apiOperationDoc struct {
+	OperationID string          `yaml:"operationId"`
+	Deprecated  bool            `yaml:"deprecated"`
+	Parameters  []apiParameter  `yaml:"parameters"`
+	RequestBody *apiRequestBody `yaml:"requestBody"`
+	Consumes    []string        `yaml:"consumes"`
+}
+
+type apiDocument struct {
+	BasePath string `yaml:"basePath"`
+	Servers  []struct {
+		URL string `yaml:"url"`
+	} `yaml:"servers"`
+	Paths      map[string]map[string]yaml.Node `yaml:"paths"`
+	Parameters map[string]apiParameter         `yaml:"parameters"`
+	Components struct {
+		Parameters    map[string]apiParameter   `yaml:"parameters"`
+		RequestBodies map[string]apiRequestBody `yaml:"requestBodies"`
+	} `yaml:"components"`
+}
+
+var apiMethods = []string{"get", "put", "post", "delete", "options", "head", "patch", "trace"}
+
+// loadAPISpec reads and compiles the OpenAPI document at path. basePath, if
+// set, overrides the base paths declared by the document.
+func loadAPISpec(path, basePath string) (*apiSpec, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read spec: %w", err)
+	}
+	var doc apiDocument
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("parse spec %s: %w", path, err)
+	}
+	if len(doc.Paths) == 0 {
+		return nil, fmt.Errorf("spec %s declares no paths", path)
+	}
+
+	s := &apiSpec{}
+	if basePath != "" {
+		s.basePaths = []string{basePath}
+	} else {
+		if doc.BasePath != "" {
+			s.basePaths = append(s.basePaths, doc.BasePath)
+		}
+		for _, srv := range doc.Servers {
+			if u, err := url.Parse(srv.URL); err == nil && u.Path != "" {
+				s.basePaths = append(s.basePaths, u.Path)
+			}
+		}
+	}
+	for i, bp := range s.basePaths {
+		s.basePaths[i] = "/" + strings.Trim(bp, "/")
+	}
+	// Longest base path first so nested prefixes strip correctly.
+	sort.Slice(s.basePaths, func(i, j int) bool { return len(s.basePaths[i]) > len(s.basePaths[j]) })
+
+	for template, item := range doc.Paths {
+		route, err := compileRoute(template)
+		if err != nil {
+			return nil, err
+		}
+		var shared []apiParameter
+		if n, ok := item["parameters"]; ok {
+			if err := n.Decode(&shared); err != nil {
+				return nil, fmt.Errorf("%s parameters: %w", template, err)
+			}
+		}
+		for _, m := range apiMethods {
+			n, ok := item[m]
+			if !ok {
+				continue
+			}
+			var od apiOperationDoc
+			if err := n.Decode(&od); err != nil {
+				return nil, fmt.Errorf("%s %s: %w", strings.ToUpper(m), template, err)
+			}
+			op, err := doc.compileOperation(od, shared)
+			if err != nil {
+				return nil, fmt.Errorf("%s %s: %w", strings.ToUpper(m), template, err)
+			}
+			route.ops[strings.ToUpper(m)] = op
+		}
+		s.routes = append(s.routes, route)
+	}
+	// Concrete paths take precedence over templated ones.
+	sort.SliceStable(s.routes, func(i, j int) bool {
+		if s.routes[i].literals != s.routes[j].literals {
+			return s.routes[i].literals > s.routes[j].literals
+		}
+		return s.routes[i].template < s.routes[j].template
+	})
+	return s, nil
+}
+
+var templateParam = regexp.MustCompile(`\{[^/{}]+\}`)
+
+func compileRoute(template string) (*apiRoute, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	rest := template
+	for {
+		loc := templateParam.FindStringIndex(rest)
+		if loc == nil {
+			b.WriteString(regexp.QuoteMeta(rest))
+			break
+		}
+		b.WriteString(regexp.QuoteMeta(rest[:loc[0]]))
+		b.WriteString("[^/]+")
+		rest = rest[loc[1]:]
+	}
+	b.WriteString("/?$")
+	re, err := regexp.Compile(b.String())
+	if err != nil {
+		return nil, fmt.Errorf("path %s: %w", template, err)
+	}
+	literals := 0
+	for _, seg := range strings.Split(strings.Trim(template, "/"), "/") {
+		if !strings.Contains(seg, "{") {
+			literals++
+		}
+	}
+	return &apiRoute{template: template, pattern: re, literals: literals, ops: map[string]*apiOperation{}}, nil
+}
+
+func (d *apiDocument) compileOperation(od apiOperationDoc, shared []apiParameter) (*apiOperation, error) {
+	op := &apiOperation{id: od.OperationID, deprecated: od.Deprecated}
+	seen := map[string]bool{}
+	// Operation-level parameters override path-level ones with the same
+	// name and location.
+	for _, list := range [][]apiParameter{od.Parameters, shared} {
+		for _, p := range list {
+			p, err := d.resolveParameter(p)
+			if err != nil {
+				return nil, err
+			}
+			key := p.In + ":" + strings.ToLower(p.Name)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			if p.In == "body" {
+				op.bodyRequired = op.bodyRequired || p.Required
+				continue
+			}
+			op.params = append(op.params, p)
+		}
+	}
+	if rb := od.RequestBody; rb != nil {
+		if rb.Ref != "" {
+			name := strings.TrimPrefix(rb.Ref, "#/components/requestBodies/")
+			resolved, ok := d.Components.RequestBodies[name]
+			if !ok {
+				return nil, fmt.Errorf("unresolved $ref %s", rb.Ref)
+			}
+			rb = &resolved
+		}
+		op.bodyRequired = rb.Required
+		for ct := range rb.Content {
+			op.contentTypes = append(op.contentTypes, strings.ToLower(ct))
+		}
+	}
+	for _, ct := range od.Consumes {
+		op.contentTypes = append(op.contentTypes, strings.ToLower(ct))
+	}
+	return op, nil
+}
+
+func (d *apiDocument) resolveParameter(p apiParameter) (apiParameter, error) {
+	if p.Ref == "" {
+		return p, nil
+	}
+	var (
+		resolved apiParameter
+		ok       bool
+	)
+	switch {
+	case strings.HasPrefix(p.Ref, "#/components/parameters/"):
+		resolved, ok = d.Components.Parameters[strings.TrimPrefix(p.Ref, "#/components/parameters/")]
+	case strings.HasPrefix(p.Ref, "#/parameters/"):
+		resolved, ok = d.Parameters[strings.TrimPrefix(p.Ref, "#/parameters/")]
+	}
+	if !ok {
+		return apiParameter{}, fmt.Errorf("unresolved $ref %s", p.Ref)
+	}
+	return resolved, nil
+}
+
+// lookup finds the route and operation for a request. Either may be nil when
+// the spec does not define them.
+func (s *apiSpec) lookup(method, path string) (*apiRoute, *apiOperation) {
+	candidates := []string{path}
+	for _, bp := range s.basePaths {
+		if bp == "/" {
+			continue
+		}
+		if rest, ok := strings.CutPrefix(path, bp); ok && (rest == "" || rest[0] == '/') {
+			candidates = []string{rest, path}
+			break
+		}
+	}
+	for _, p := range candidates {
+		if p == "" {
+			p = "/"
+		}
+		for _, r := range s.routes {
+			if r.pattern.MatchString(p) {
+				return r, r.ops[method]
+			}
+		}
+	}
+	return nil, nil
+}
+
+// validate checks req against the spec, returning the matched operation (if
+// any) and a list of human-readable violations.
+func (s *apiSpec) validate(req *http.Request) (*apiOperation, []string) {
+	route, op := s.lookup(req.Method, req.URL.Path)
+	if route == nil {
+		return nil, []string{fmt.Sprintf("path %s is not defined", req.URL.Path)}
+	}
+	if op == nil {
+		return nil, []string{fmt.Sprintf("method %s is not defined for %s", req.Method, route.template)}
+	}
+
+	var violations []string
+	query := req.URL.Query()
+	for _, p := range op.params {
+		if !p.Required {
+			continue
+		}
+		switch p.In {
+		case "query":
+			if !query.Has(p.Name) {
+				violations = append(violations, fmt.Sprintf("missing required query parameter %q", p.Name))
+			}
+		case "header":
+			if req.Header.Get(p.Name) == "" {
+				violations = append(violations, fmt.Sprintf("missing required header %q", p.Name))
+			}
+		case "cookie":
+			if _, err := req.Cookie(p.Name); err != nil {
+				violations = append(violations, fmt.Sprintf("missing required cookie %q", p.Name))
+			}
+		}
+	}
+
+	hasBody := req.ContentLength > 0 || (req.ContentLength < 0 && req.Body != nil && req.Body != http.NoBody)
+	if op.bodyRequired && !hasBody {
+		violations = append(violations, "missing required request body")
+	}
+	if hasBody && len(op.contentTypes) > 0 {
+		if ct := req.Header.Get("Content-Type"); !contentTypeAllowed(ct, op.contentTypes) {
+			violations = append(violations, fmt.Sprintf("content type %q is not accepted", ct))
+		}
+	}
+	return op, violations
+}
+
+func contentTypeAllowed(ct string, allowed []string) bool {
+	mt, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		mt = strings.ToLower(strings.TrimSpace(ct))
+	}
+	return slices.ContainsFunc(allowed, func(a string) bool {
+		if a == "*/*" || a == mt {
+			return true
+		}
+		major, ok := strings.CutSuffix(a, "/*")
+		return ok && strings.HasPrefix(mt, major+"/")
+	})
+}
@@ -0,0 +1,340 @@
+package filters
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/kdhira/audit-proxy/internal/audit"
+	"github.com/kdhira/audit-proxy/internal/config"
+)
+
+// defaultResponseBodyMax bounds the JSON bodies a response_body filter
+// buffers, and the lines it holds while streaming, unless max_bytes is
+// set.
+const defaultResponseBodyMax = 4 << 20
+
+// responseBodyFilter rewrites response bodies before they reach the
+// client. fields replace, or remove, the JSON values at their paths; rules
+// then replace what their regular expressions match, expanding capture
+// groups such as $1. JSON bodies are buffered whole, up to max_bytes, and
+// re-encoded if a field matched. Event streams, NDJSON and other text are
+// rewritten line by line as they pass through, fields applying to each
+// line's JSON (after "data:" in event streams), so streaming is not held
+// up; a rule cannot match across lines. The number of values and matches
+// replaced is recorded in the response_body.redacted attribute, and bodies
+// passed through unchanged because they were compressed or too large in
+// response_body.skipped.
+//
+// Paths are keys separated by dots: * matches any key, ** any number of
+// levels, and arrays are looked through, so employees.ssn reaches the ssn
+// of every element of employees.
+//
+//	filters:
+//	  - name: hide-ssn
+//	    type: response_body
+//	    hosts: [hr.internal.example.com]
+//	    fields:
+//	      - path: employees.ssn          # replaced with ***REDACTED***
+//	      - path: "**.salary"
+//	        remove: true
+//	    rules:
+//	      - match: '\b\d{3}-\d{2}-\d{4}\b'
+//	        replace: '***-**-****'
+//	    max_bytes: 4194304
+type responseBodyFilter struct {
+	name   string
+	fields []fieldRule
+	rules  []textRule
+	max    int
+}
+
+type textRule struct {
+	match   *regexp.Regexp
+	replace []byte
+}
+
+type fieldRule struct {
+	path    []string
+	replace string
+	remove  bool
+}
+
+func newResponseBodyFilter(spec config.FilterSpec) (any, error) {
+	var opts struct {
+		Fields []struct {
+			Path    string  `yaml:"path"`
+			Replace *string `yaml:"replace"`
+			Remove  bool    `yaml:"remove"`
+		} `yaml:"fields"`
+		Rules []struct {
+			Match   string `yaml:"match"`
+			Replace string `yaml:"replace"`
+		} `yaml:"rules"`
+		MaxBytes int `yaml:"max_bytes"`
+	}
+	if err := spec.Decode(&opts); err != nil {
+		return nil, err
+	}
+	if len(opts.Fields) == 0 && len(opts.Rules) == 0 {
+		return nil, errors.New("fields or rules is required")
+	}
+	if opts.MaxBytes < 0 {
+		return nil, errors.New("max_bytes must not be negative")
+	}
+	f := &responseBodyFilter{name: spec.Name, max: opts.MaxBytes}
+	if f.max == 0 {
+		f.max = defaultResponseBodyMax
+	}
+	for i, fo := range opts.Fields {
+		path := strings.Split(fo.Path, ".")
+		if fo.Path == "" || path[len(path)-1] == "**" || strings.Contains(fo.Path, "..") {
+			return nil, fmt.Errorf("fields[%d]: path %q must name a key", i, fo.Path)
+		}
+		r := fieldRule{path: path, replace: audit.Redacted, remove: fo.Remove}
+		if fo.Replace != nil {
+			r.replace = *fo.Replace
+		}
+		f.fields = append(f.fields, r)
+	}
+	for i, r := range opts.Rules {
+		re, err := regexp.Compile(r.Match)
+		if err != nil {
+			return nil, fmt.Errorf("rules[%d]: %w", i, err)
+		}
+		f.rules = append(f.rules, textRule{match: re, replace: []byte(r.Replace)})
+	}
+	return f, nil
+}
+
+func (f *responseBodyFilter) Name() string { return f.name }
+
+// OnRequest asks for an uncompressed response, which the filter can read.
+// The upstream transport still compresses the exchange itself when it
+// can.
+func (f *responseBodyFilter) OnRequest(_ context.Context, req *http.Request) error {
+	if req.Method != http.MethodConnect {
+		req.Header.Del("Accept-Encoding")
+	}
+	return nil
+}
+
+func (f *responseBodyFilter) OnResponse(ctx context.Context, req *http.Request, resp *http.Response) error {
+	if req.Method == http.MethodConnect || resp.Body == nil || resp.Body == http.NoBody {
+		return nil
+	}
+	mt, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	var whole bool
+	switch {
+	case mt == "text/event-stream" || mt == "application/x-ndjson" || mt == "application/jsonl":
+	case mt == "application/json" || strings.HasSuffix(mt, "+json"):
+		whole = true
+	case strings.HasPrefix(mt, "text/"):
+	default:
+		return nil
+	}
+	if ce := resp.Header.Get("Content-Encoding"); ce != "" && !strings.EqualFold(ce, "identity") {
+		audit.Annotate(ctx, "response_body.skipped", "encoded")
+		return nil
+	}
+	rw := &bodyRewriter{f: f, ctx: ctx, event: mt == "text/event-stream"}
+	if whole {
+		return rw.rewriteJSON(resp)
+	}
+	resp.Body = &lineRewriter{rw: rw, src: resp.Body, br: bufio.NewReaderSize(resp.Body, f.max)}
+	setBodyLength(resp, -1)
+	return nil
+}
+
+// bodyRewriter applies a filter to one response, counting what it
+// replaced.
+type bodyRewriter struct {
+	f        *responseBodyFilter
+	ctx      context.Context
+	event    bool // the body is an event stream
+	redacted int
+}
+
+// rewriteJSON buffers resp's body and rewrites it whole.
+func (rw *bodyRewriter) rewriteJSON(resp *http.Response) error {
+	data, err := io.ReadAll(io.LimitReader(resp.Body, int64(rw.f.max)+1))
+	if err != nil {
+		return err
+	}
+	if len(data) > rw.f.max {
+		audit.Annotate(rw.ctx, "response_body.skipped", "too_large")
+		resp.Body = readCloser{io.MultiReader(bytes.NewReader(data), resp.Body), resp.Body}
+		return nil
+	}
+	out := rw.rules(rw.fields(data))
+	resp.Body = readCloser{bytes.NewReader(out), resp.Body}
+	setBodyLength(resp, int64(len(out)))
+	return nil
+}
+
+// line rewrites one line of a streamed body, its line ending excluded.
+func (rw *bodyRewriter) line(line []byte) []byte {
+	if len(rw.f.fields) > 0 {
+		prefix, payload := []byte(nil), line
+		if rw.event {
+			var ok bool
+			if payload, ok = bytes.CutPrefix(line, []byte("data:")); !ok {
+				return rw.rules(line)
+			}
+			prefix = line[:len(line)-len(payload)]
+		}
+		if p := bytes.TrimLeft(payload, " "); len(p) > 0 && (p[0] == '{' || p[0] == '[') {
+			line = append(append(prefix[:len(prefix):len(prefix)], payload[:len(payload)-len(p)]...), rw.fields(p)...)
+		}
+	}
+	return rw.rules(line)
+}
+
+// fields applies the field rules to the JSON document data, returning it
+// re-encoded if a field matched and unchanged otherwise.
+func (rw *bodyRewriter) fields(data []byte) []byte {
+	if len(rw.f.fields) == 0 {
+		return data
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var doc any
+	if dec.Decode(&doc) != nil || dec.More() {
+		return data
+	}
+	n := 0
+	for _, r := range rw.f.fields {
+		n += r.edit(doc, r.path)
+	}
+	if n == 0 {
+		return data
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if enc.Encode(doc) != nil {
+		return data
+	}
+	rw.count(n)
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+}
+
+// rules applies the regular expression rules to data.
+func (rw *bodyRewriter) rules(data []byte) []byte {
+	for _, r := range rw.f.rules {
+		if n := len(r.match.FindAllIndex(data, -1)); n > 0 {
+			data = r.match.ReplaceAll(data, r.replace)
+			rw.count(n)
+		}
+	}
+	return data
+}
+
+func (rw *bodyRewriter) count(n int) {
+	rw.redacted += n
+	audit.Annotate(rw.ctx, "response_body.redacted", rw.redacted)
+}
+
+// edit applies r to the values at path below v, returning how many it
+// replaced or removed.
+func (r fieldRule) edit(v any, path []string) int {
+	n := 0
+	switch t := v.(type) {
+	case []any:
+		for _, e := range t {
+			n += r.edit(e, path)
+		}
+	case map[string]any:
+		key, rest := path[0], path[1:]
+		if key == "**" {
+			n += r.edit(t, rest)
+			for _, c := range t {
+				n += r.edit(c, path)
+			}
+			return n
+		}
+		for k, c := range t {
+			switch {
+			case key != "*" && k != key:
+			case len(rest) > 0:
+				n += r.edit(c, rest)
+			case r.remove:
+				delete(t, k)
+				n++
+			default:
+				t[k] = r.replace
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// lineRewriter rewrites a streamed body line by line as it is read. A line
+// longer than the reader's buffer is passed on unchanged, a buffer at a
+// time.
+type lineRewriter struct {
+	rw   *bodyRewriter
+	src  io.Closer
+	br   *bufio.Reader
+	out  []byte
+	long bool // in a line too long to rewrite
+	err  error
+}
+
+func (l *lineRewriter) Read(p []byte) (int, error) {
+	for len(l.out) == 0 && l.err == nil {
+		line, err := l.br.ReadSlice('\n')
+		full := errors.Is(err, bufio.ErrBufferFull)
+		if l.long || full {
+			if !l.long {
+				audit.Annotate(l.rw.ctx, "response_body.skipped", "long_line")
+			}
+			l.long = full
+			l.out = append(l.out[:0], line...)
+			if !full {
+				l.err = err
+			}
+			continue
+		}
+		l.err = err
+		body, eol := line, []byte(nil)
+		if i := bytes.IndexByte(line, '\n'); i >= 0 {
+			body, eol = line[:i], line[i:]
+			if j := len(body) - 1; j >= 0 && body[j] == '\r' {
+				body, eol = body[:j], line[j:]
+			}
+		}
+		l.out = append(append(l.out[:0], l.rw.line(body)...), eol...)
+	}
+	n := copy(p, l.out)
+	l.out = l.out[n:]
+	if len(l.out) > 0 {
+		return n, nil
+	}
+	return n, l.err
+}
+
+func (l *lineRewriter) Close() error {
+	return l.src.Close()
+}
+
+// setBodyLength records that resp's body is now n bytes long, or of
+// unknown length if n is negative.
+func setBodyLength(resp *http.Response, n int64) {
+	resp.ContentLength = n
+	if n < 0 {
+		resp.Header.Del("Content-Length")
+		return
+	}
+	resp.Header.Set("Content-Length", strconv.FormatInt(n, 10))
+}
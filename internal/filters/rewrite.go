@@ -0,0 +1,110 @@
+package filters
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/kdhira/audit-proxy/internal/audit"
+	"github.com/kdhira/audit-proxy/internal/config"
+)
+
+// rewriteFilter sends requests to another URL. The first rule whose match
+// matches the full request URL replaces it, expanding capture groups such
+// as $1 in replace; host_map then replaces the host, port included, of
+// the URL. The URL before and after is recorded in the
+// rewrite.original_url and rewrite.url attributes.
+//
+//	filters:
+//	  - name: openai-to-azure
+//	    type: rewrite
+//	    hosts: [api.openai.com]
+//	    rules:
+//	      - match: ^https://api\.openai\.com/v1/(.*)$
+//	        replace: https://api.openai.com/openai/v1/$1
+//	    host_map:
+//	      api.openai.com: example.openai.azure.com
+type rewriteFilter struct {
+	name    string
+	rules   []urlRule
+	hostMap map[string]string // by lower-cased host
+}
+
+type urlRule struct {
+	match   *regexp.Regexp
+	replace string
+}
+
+func newRewriteFilter(spec config.FilterSpec) (any, error) {
+	var opts struct {
+		Rules []struct {
+			Match   string `yaml:"match"`
+			Replace string `yaml:"replace"`
+		} `yaml:"rules"`
+		HostMap map[string]string `yaml:"host_map"`
+	}
+	if err := spec.Decode(&opts); err != nil {
+		return nil, err
+	}
+	if len(opts.Rules) == 0 && len(opts.HostMap) == 0 {
+		return nil, errors.New("rules or host_map is required")
+	}
+	f := &rewriteFilter{name: spec.Name, hostMap: make(map[string]string, len(opts.HostMap))}
+	for i, r := range opts.Rules {
+		re, err := regexp.Compile(r.Match)
+		if err != nil {
+			return nil, fmt.Errorf("rules[%d]: %w", i, err)
+		}
+		f.rules = append(f.rules, urlRule{match: re, replace: r.Replace})
+	}
+	for from, to := range opts.HostMap {
+		if to == "" {
+			return nil, fmt.Errorf("host_map: %s maps to nothing", from)
+		}
+		f.hostMap[strings.ToLower(from)] = to
+	}
+	return f, nil
+}
+
+func (f *rewriteFilter) Name() string { return f.name }
+
+func (f *rewriteFilter) OnRequest(ctx context.Context, req *http.Request) error {
+	if req.Method == http.MethodConnect {
+		// Tunnels are opaque; their requests are rewritten once decrypted.
+		return nil
+	}
+	before := req.URL.String()
+	u := req.URL
+	for i, r := range f.rules {
+		if !r.match.MatchString(before) {
+			continue
+		}
+		after := r.match.ReplaceAllString(before, r.replace)
+		var err error
+		if u, err = url.Parse(after); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("rules[%d] rewrote %s to %q, which is not an absolute URL", i, before, after)
+		}
+		break
+	}
+	if to, ok := f.hostMap[strings.ToLower(u.Hostname())]; ok {
+		if u == req.URL {
+			u = new(url.URL)
+			*u = *req.URL
+		}
+		u.Host = to
+	}
+	after := u.String()
+	if after == before {
+		return nil
+	}
+	req.URL = u
+	// The Host header follows the new URL.
+	req.Host = ""
+	audit.Annotate(ctx, audit.AttrRewriteOriginalURL, before)
+	audit.Annotate(ctx, audit.AttrRewriteURL, after)
+	return nil
+}
@@ -0,0 +1,281 @@
+package filters
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/kdhira/audit-proxy/internal/audit"
+	"github.com/kdhira/audit-proxy/internal/config"
+)
+
+// maxTransformBody bounds the JSON bodies a transform will rewrite; larger
+// bodies are forwarded unchanged.
+const maxTransformBody = 16 << 20
+
+// transformFilter rewrites requests so the proxy can sit between clients and
+// a provider that speaks a slightly different API. An optional built-in
+// dialect runs first, then header, path and JSON body rules. The names of
+// the transforms applied are recorded in the transform attribute and the
+// rewritten URL in transform.url.
+//
+//	filters:
+//	  - name: azure-shim
+//	    type: transform
+//	    hosts: [example.openai.azure.com]
+//	    dialect: openai-to-azure   # or azure-to-openai
+//	    api_version: 2024-06-01    # api-version sent to Azure
+//	    rename_headers: {X-Request-Id: X-Client-Request-Id}
+//	    remove_headers: [OpenAI-Organization]
+//	    set_headers: {X-Team: research}
+//	    paths:
+//	      - match: ^/v1/engines/([^/]+)/completions$
+//	        replace: /v1/completions
+//	    rename_fields: {max_tokens: max_completion_tokens}
+type transformFilter struct {
+	name       string
+	dialect    string
+	apiVersion string
+	rename     map[string]string
+	remove     []string
+	set        map[string]string
+	paths      []pathRule
+	fields     map[string]string
+}
+
+type pathRule struct {
+	match   *regexp.Regexp
+	replace string
+}
+
+// dialects are the built-in API translations.
+var dialects = map[string]bool{
+	"openai-to-azure": true,
+	"azure-to-openai": true,
+}
+
+func newTransformFilter(spec config.FilterSpec) (any, error) {
+	var opts struct {
+		Dialect       string            `yaml:"dialect"`
+		APIVersion    string            `yaml:"api_version"`
+		RenameHeaders map[string]string `yaml:"rename_headers"`
+		RemoveHeaders []string          `yaml:"remove_headers"`
+		SetHeaders    map[string]string `yaml:"set_headers"`
+		Paths         []struct {
+			Match   string `yaml:"match"`
+			Replace string `yaml:"replace"`
+		} `yaml:"paths"`
+		RenameFields map[string]string `yaml:"rename_fields"`
+	}
+	if err := spec.Decode(&opts); err != nil {
+		return nil, err
+	}
+	if opts.Dialect != "" && !dialects[opts.Dialect] {
+		return nil, fmt.Errorf("unknown dialect %q", opts.Dialect)
+	}
+	if opts.Dialect == "openai-to-azure" && opts.APIVersion == "" {
+		return nil, fmt.Errorf("dialect %s requires api_version", opts.Dialect)
+	}
+	f := &transformFilter{
+		name:       spec.Name,
+		dialect:    opts.Dialect,
+		apiVersion: opts.APIVersion,
+		rename:     opts.RenameHeaders,
+		remove:     opts.RemoveHeaders,
+		set:        opts.SetHeaders,
+		fields:     opts.RenameFields,
+	}
+	for i, p := range opts.Paths {
+		re, err := regexp.Compile(p.Match)
+		if err != nil {
+			return nil, fmt.Errorf("paths[%d]: %w", i, err)
+		}
+		f.paths = append(f.paths, pathRule{match: re, replace: p.Replace})
+	}
+	return f, nil
+}
+
+func (f *transformFilter) Name() string { return f.name }
+
+func (f *transformFilter) OnRequest(ctx context.Context, req *http.Request) error {
+	if req.Method == http.MethodConnect {
+		// Tunnels are opaque; their requests are transformed once decrypted.
+		return nil
+	}
+	before := req.URL.String()
+	body, err := f.readBody(req)
+	if err != nil {
+		return err
+	}
+	changed, bodyChanged := false, false
+	switch f.dialect {
+	case "openai-to-azure":
+		changed = openAIToAzure(req, body, f.apiVersion)
+	case "azure-to-openai":
+		changed, bodyChanged = azureToOpenAI(req, body)
+	}
+	changed = f.rewriteHeaders(req.Header) || changed
+	for _, p := range f.paths {
+		if p.match.MatchString(req.URL.Path) {
+			req.URL.Path = p.match.ReplaceAllString(req.URL.Path, p.replace)
+			req.URL.RawPath = ""
+			changed = true
+			break
+		}
+	}
+	for from, to := range f.fields {
+		if v, ok := body[from]; ok {
+			delete(body, from)
+			body[to] = v
+			bodyChanged = true
+		}
+	}
+	if bodyChanged {
+		if err := setJSONBody(req, body); err != nil {
+			return err
+		}
+		changed = true
+	}
+	if changed {
+		audit.AnnotateAppend(ctx, audit.AttrTransform, f.name)
+		if after := req.URL.String(); after != before {
+			audit.Annotate(ctx, audit.AttrTransformURL, after)
+		}
+	}
+	return nil
+}
+
+// readBody decodes a JSON object body when a rule needs it, leaving req.Body
+// readable either way. It returns nil when the body is absent, not a JSON
+// object or too large to rewrite.
+func (f *transformFilter) readBody(req *http.Request) (map[string]any, error) {
+	if len(f.fields) == 0 && f.dialect == "" {
+		return nil, nil
+	}
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	if mt, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); mt != "application/json" {
+		return nil, nil
+	}
+	data, err := io.ReadAll(io.LimitReader(req.Body, maxTransformBody+1))
+	if err != nil {
+		return nil, fmt.Errorf("read request body: %w", err)
+	}
+	if len(data) > maxTransformBody {
+		req.Body = readCloser{io.MultiReader(bytes.NewReader(data), req.Body), req.Body}
+		return nil, nil
+	}
+	req.Body = io.NopCloser(bytes.NewReader(data))
+	var body map[string]any
+	if json.Unmarshal(data, &body) != nil {
+		return nil, nil
+	}
+	return body, nil
+}
+
+func (f *transformFilter) rewriteHeaders(h http.Header) bool {
+	changed := false
+	for from, to := range f.rename {
+		if vs := h.Values(from); len(vs) > 0 {
+			h.Del(from)
+			for _, v := range vs {
+				h.Add(to, v)
+			}
+			changed = true
+		}
+	}
+	for _, k := range f.remove {
+		if h.Get(k) != "" {
+			h.Del(k)
+			changed = true
+		}
+	}
+	for k, v := range f.set {
+		if h.Get(k) != v {
+			h.Set(k, v)
+			changed = true
+		}
+	}
+	return changed
+}
+
+// openAIToAzure maps /v1/<op> to Azure OpenAI's
+// /openai/deployments/<model>/<op>?api-version=<v>, taking the deployment
+// from the body's model, and moves a bearer key to the api-key header.
+func openAIToAzure(req *http.Request, body map[string]any, apiVersion string) bool {
+	rest, ok := strings.CutPrefix(req.URL.Path, "/v1/")
+	if !ok {
+		return false
+	}
+	if model, _ := body["model"].(string); model != "" {
+		req.URL.Path = "/openai/deployments/" + url.PathEscape(model) + "/" + rest
+	} else {
+		req.URL.Path = "/openai/" + rest
+	}
+	req.URL.RawPath = ""
+	q := req.URL.Query()
+	q.Set("api-version", apiVersion)
+	req.URL.RawQuery = q.Encode()
+	if key, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer "); ok {
+		req.Header.Del("Authorization")
+		req.Header.Set("Api-Key", key)
+	}
+	return true
+}
+
+// azureToOpenAI is the reverse of openAIToAzure; the deployment becomes the
+// body's model unless one is already set. bodyChanged reports whether the
+// model was added.
+func azureToOpenAI(req *http.Request, body map[string]any) (changed, bodyChanged bool) {
+	rest, ok := strings.CutPrefix(req.URL.Path, "/openai/")
+	if !ok {
+		return false, false
+	}
+	if d, ok := strings.CutPrefix(rest, "deployments/"); ok {
+		deployment, op, _ := strings.Cut(d, "/")
+		rest = op
+		if _, set := body["model"]; body != nil && !set {
+			body["model"], _ = url.PathUnescape(deployment)
+			bodyChanged = true
+		}
+	}
+	req.URL.Path = "/v1/" + rest
+	req.URL.RawPath = ""
+	q := req.URL.Query()
+	q.Del("api-version")
+	req.URL.RawQuery = q.Encode()
+	if key := req.Header.Get("Api-Key"); key != "" {
+		req.Header.Del("Api-Key")
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	return true, bodyChanged
+}
+
+func setJSONBody(req *http.Request, body map[string]any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("encode request body: %w", err)
+	}
+	req.Body = io.NopCloser(bytes.NewReader(data))
+	req.ContentLength = int64(len(data))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+	return nil
+}
+
+// readCloser reads from r and closes c.
+type readCloser struct {
+	io.Reader
+	c io.Closer
+}
+
+func (r readCloser) Close() error { return r.c.Close() }
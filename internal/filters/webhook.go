@@ -0,0 +1,213 @@
+package filters
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/kdhira/audit-proxy/internal/audit"
+	"github.com/kdhira/audit-proxy/internal/config"
+	"github.com/kdhira/audit-proxy/internal/rollout"
+)
+
+const (
+	defaultWebhookTimeout = 5 * time.Second
+	// maxWebhookDecisions bounds the decisions a webhook filter caches.
+	maxWebhookDecisions = 10000
+	// maxWebhookAnswer bounds the answer read from the service.
+	maxWebhookAnswer = 64 << 10
+)
+
+// webhookFilter asks an external authorisation service whether to let a
+// request through. It POSTs a JSON summary of the request and expects a
+// 2xx answer of {"allow": bool, "reason": string}. When the service fails
+// or times out, the request is blocked with 503 unless fail_open is set.
+// Decisions are cached for cache_ttl by method, URL and client. The
+// decision is recorded in the webhook.decision attribute: allow, deny, or
+// error when the service failed.
+//
+//	filters:
+//	  - name: approvals
+//	    type: webhook
+//	    hosts: [api.openai.com]
+//	    url: https://authz.internal.example.com/check
+//	    headers: {Authorization: Bearer ${AUTHZ_TOKEN}}   # sent to the service
+//	    timeout: 2s      # default 5s
+//	    fail_open: false
+//	    cache_ttl: 1m    # default 0, no caching
+type webhookFilter struct {
+	name     string
+	url      string
+	headers  map[string]string
+	client   *http.Client
+	failOpen bool
+	ttl      time.Duration
+
+	mu        sync.Mutex
+	decisions map[webhookKey]webhookDecision
+}
+
+// webhookRequest is the summary sent to the service. Credentials in
+// headers are masked as in entries.
+type webhookRequest struct {
+	Method  string            `json:"method"`
+	URL     string            `json:"url"`
+	Host    string            `json:"host"`
+	Headers http.Header       `json:"headers,omitempty"`
+	Client  map[string]string `json:"client"`
+}
+
+// webhookAnswer is what the service answers.
+type webhookAnswer struct {
+	Allow  bool   `json:"allow"`
+	Reason string `json:"reason"`
+}
+
+type webhookKey struct {
+	method, url, user, client, source string
+}
+
+type webhookDecision struct {
+	webhookAnswer
+	expires time.Time
+}
+
+func newWebhookFilter(spec config.FilterSpec) (any, error) {
+	var opts struct {
+		URL      string            `yaml:"url"`
+		Headers  map[string]string `yaml:"headers"`
+		Timeout  time.Duration     `yaml:"timeout"`
+		FailOpen bool              `yaml:"fail_open"`
+		CacheTTL time.Duration     `yaml:"cache_ttl"`
+	}
+	if err := spec.Decode(&opts); err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(opts.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("url %q must be an http or https URL", opts.URL)
+	}
+	if opts.Timeout < 0 || opts.CacheTTL < 0 {
+		return nil, errors.New("timeout and cache_ttl must not be negative")
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = defaultWebhookTimeout
+	}
+	// Headers may name secrets in the environment, as failover's do.
+	headers := make(map[string]string, len(opts.Headers))
+	for k, v := range opts.Headers {
+		headers[k] = os.ExpandEnv(v)
+	}
+	return &webhookFilter{
+		name:      spec.Name,
+		url:       opts.URL,
+		headers:   headers,
+		client:    &http.Client{Timeout: opts.Timeout},
+		failOpen:  opts.FailOpen,
+		ttl:       opts.CacheTTL,
+		decisions: map[webhookKey]webhookDecision{},
+	}, nil
+}
+
+func (f *webhookFilter) Name() string { return f.name }
+
+func (f *webhookFilter) OnRequest(ctx context.Context, req *http.Request) error {
+	s := rollout.SubjectFrom(ctx)
+	key := webhookKey{req.Method, req.URL.String(), s.User, s.Client, s.Source}
+	answer, cached := f.cached(key)
+	if cached {
+		audit.Annotate(ctx, "webhook.cached", true)
+	} else {
+		var err error
+		answer, err = f.ask(ctx, req, s)
+		if err != nil {
+			audit.Annotate(ctx, "webhook.decision", "error")
+			audit.Annotate(ctx, "webhook.error", err.Error())
+			if f.failOpen {
+				return nil
+			}
+			return &BlockError{Reason: "authorisation service failed: " + err.Error(), Status: http.StatusServiceUnavailable}
+		}
+		f.store(key, answer)
+	}
+	if answer.Allow {
+		audit.Annotate(ctx, "webhook.decision", "allow")
+		return nil
+	}
+	audit.Annotate(ctx, "webhook.decision", "deny")
+	reason := answer.Reason
+	if reason == "" {
+		reason = "denied by authorisation service"
+	}
+	return &BlockError{Reason: reason}
+}
+
+// ask sends the summary of req to the service and returns its answer.
+func (f *webhookFilter) ask(ctx context.Context, req *http.Request, s rollout.Subject) (webhookAnswer, error) {
+	body, err := json.Marshal(webhookRequest{
+		Method:  req.Method,
+		URL:     req.URL.String(),
+		Host:    requestHost(req),
+		Headers: audit.SanitiseHeaders(req.Header),
+		Client:  map[string]string{"user": s.User, "name": s.Client, "address": s.Source},
+	})
+	if err != nil {
+		return webhookAnswer{}, err
+	}
+	// The service is asked even if the client has gone, so the answer can
+	// be cached.
+	out, err := http.NewRequestWithContext(context.WithoutCancel(ctx), http.MethodPost, f.url, bytes.NewReader(body))
+	if err != nil {
+		return webhookAnswer{}, err
+	}
+	out.Header.Set("Content-Type", "application/json")
+	for k, v := range f.headers {
+		out.Header.Set(k, v)
+	}
+	resp, err := f.client.Do(out)
+	if err != nil {
+		return webhookAnswer{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return webhookAnswer{}, fmt.Errorf("service answered %s", resp.Status)
+	}
+	var a webhookAnswer
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxWebhookAnswer)).Decode(&a); err != nil {
+		return webhookAnswer{}, fmt.Errorf("malformed answer: %w", err)
+	}
+	return a, nil
+}
+
+func (f *webhookFilter) cached(key webhookKey) (webhookAnswer, bool) {
+	if f.ttl == 0 {
+		return webhookAnswer{}, false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, ok := f.decisions[key]
+	if !ok || time.Now().After(d.expires) {
+		return webhookAnswer{}, false
+	}
+	return d.webhookAnswer, true
+}
+
+func (f *webhookFilter) store(key webhookKey, a webhookAnswer) {
+	if f.ttl == 0 {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.decisions) >= maxWebhookDecisions {
+		clear(f.decisions)
+	}
+	f.decisions[key] = webhookDecision{a, time.Now().Add(f.ttl)}
+}
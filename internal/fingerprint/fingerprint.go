@@ -0,0 +1,88 @@
+// Package fingerprint computes the canonical identity of a request: its
+// method, normalised URL, selected headers and a hash of its body. Audit
+// entries record it, and anything that must agree on when two requests are
+// the same, such as deduplication, record/replay or caching, keys on it.
+package fingerprint
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// Fingerprinter computes fingerprints over a fixed set of headers.
+type Fingerprinter struct {
+	headers []string // canonical names, sorted
+}
+
+// New returns a Fingerprinter including the values of headers. Names are
+// case-insensitive and duplicates are ignored.
+func New(headers []string) *Fingerprinter {
+	var hs []string
+	for _, h := range headers {
+		hs = append(hs, http.CanonicalHeaderKey(strings.TrimSpace(h)))
+	}
+	slices.Sort(hs)
+	return &Fingerprinter{headers: slices.Compact(hs)}
+}
+
+// Sum returns the fingerprint of a request with the given method, URL and
+// headers whose body hashed to body, as returned by a Body hasher's Sum or
+// by BodySum. It is 32 hex digits.
+func (f *Fingerprinter) Sum(method string, u *url.URL, h http.Header, body []byte) string {
+	d := sha256.New()
+	d.Write([]byte(strings.ToUpper(method)))
+	d.Write([]byte{'\n'})
+	d.Write([]byte(NormalizeURL(u)))
+	d.Write([]byte{'\n'})
+	for _, name := range f.headers {
+		vs := h.Values(name)
+		if len(vs) == 0 {
+			continue
+		}
+		d.Write([]byte(name + ":" + strings.Join(vs, ",") + "\n"))
+	}
+	d.Write([]byte{'\n'})
+	d.Write(body)
+	return hex.EncodeToString(d.Sum(nil)[:16])
+}
+
+// Body returns a hash to write a request body into as it streams.
+func Body() hash.Hash {
+	return sha256.New()
+}
+
+// BodySum hashes a body held in memory.
+func BodySum(b []byte) []byte {
+	s := sha256.Sum256(b)
+	return s[:]
+}
+
+// NormalizeURL renders u so that equivalent URLs compare equal: the scheme
+// and host are lower-cased, the scheme's default port is dropped, an empty
+// path becomes /, query parameters are sorted and the fragment is removed.
+func NormalizeURL(u *url.URL) string {
+	scheme := strings.ToLower(u.Scheme)
+	host := strings.ToLower(u.Host)
+	switch {
+	case scheme == "http" && strings.HasSuffix(host, ":80"):
+		host = strings.TrimSuffix(host, ":80")
+	case scheme == "https" && strings.HasSuffix(host, ":443"):
+		host = strings.TrimSuffix(host, ":443")
+	}
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	var b strings.Builder
+	b.WriteString(scheme + "://" + host + path)
+	if q := u.Query(); len(q) > 0 {
+		b.WriteByte('?')
+		b.WriteString(q.Encode()) // sorted by key, values in order
+	}
+	return b.String()
+}
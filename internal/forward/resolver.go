@@ -0,0 +1,319 @@
+package forward
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxCachedHosts bounds the resolver cache.
+const maxCachedHosts = 10000
+
+// ResolverOptions configures a Resolver.
+type ResolverOptions struct {
+	// Servers are DNS servers (host:port) queried in order instead of the
+	// system resolver.
+	Servers []string
+	// TTL is how long answers are cached; zero disables caching.
+	TTL time.Duration
+	// BlockPrivate refuses targets that resolve to loopback, private,
+	// link-local, shared (CGNAT) or unspecified addresses.
+	BlockPrivate bool
+	// Allow lists ranges exempt from BlockPrivate.
+	Allow []netip.Prefix
+	// Hosts pins lower-case hostnames to fixed addresses, bypassing DNS.
+	// Egress policy still applies to them.
+	Hosts map[string][]netip.Addr
+	// LocalAddrs are the local addresses connections are made from, one
+	// per address family at most; a target of a family without one is not
+	// dialed. Empty leaves the choice to the system.
+	LocalAddrs []netip.Addr
+	// FallbackDelay is how long a connection attempt runs before the next
+	// address is tried alongside it (happy eyeballs, RFC 8305); zero tries
+	// the addresses one after another.
+	FallbackDelay time.Duration
+}
+
+// BlockedError reports a target refused by egress policy.
+type BlockedError struct {
+	Host string
+	Addr netip.Addr
+}
+
+func (e *BlockedError) Error() string {
+	if e.Host == e.Addr.String() {
+		return fmt.Sprintf("egress to %s blocked: private address", e.Host)
+	}
+	return fmt.Sprintf("egress to %s blocked: resolves to private address %s", e.Host, e.Addr)
+}
+
+// Resolver resolves and dials upstream hosts, enforcing egress policy on
+// the resolved addresses so a name cannot be used to reach internal
+// services.
+type Resolver struct {
+	opts     ResolverOptions
+	resolver *net.Resolver
+	dialer   *net.Dialer
+
+	mu    sync.Mutex
+	cache map[string]cached
+}
+
+type cached struct {
+	addrs   []netip.Addr
+	expires time.Time
+}
+
+// NewResolver returns a Resolver for opts.
+func NewResolver(opts ResolverOptions) *Resolver {
+	r := &Resolver{
+		opts:     opts,
+		resolver: net.DefaultResolver,
+		dialer:   &net.Dialer{KeepAlive: 30 * time.Second},
+		cache:    map[string]cached{},
+	}
+	if len(opts.Servers) > 0 {
+		r.resolver = &net.Resolver{PreferGo: true, Dial: r.dialDNS}
+	}
+	return r
+}
+
+// dialDNS connects to the configured DNS servers in order, ignoring the
+// system's choice of server.
+func (r *Resolver) dialDNS(ctx context.Context, network, _ string) (net.Conn, error) {
+	var d net.Dialer
+	var errs []error
+	for _, s := range r.opts.Servers {
+		c, err := d.DialContext(ctx, network, s)
+		if err == nil {
+			return c, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, errors.Join(errs...)
+}
+
+// Resolve returns the addresses of host after applying egress policy. IP
+// literals are checked without a lookup.
+func (r *Resolver) Resolve(ctx context.Context, host string) ([]netip.Addr, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		addr = addr.Unmap()
+		return []netip.Addr{addr}, r.check(host, addr)
+	}
+	addrs, ok := r.opts.Hosts[strings.ToLower(host)]
+	if !ok {
+		var err error
+		if addrs, err = r.lookup(ctx, host); err != nil {
+			return nil, err
+		}
+	}
+	for _, a := range addrs {
+		// One private answer is enough to refuse: a rebinding name may mix
+		// public and internal addresses.
+		if err := r.check(host, a); err != nil {
+			return nil, err
+		}
+	}
+	return addrs, nil
+}
+
+func (r *Resolver) lookup(ctx context.Context, host string) ([]netip.Addr, error) {
+	now := time.Now()
+	r.mu.Lock()
+	c, ok := r.cache[host]
+	r.mu.Unlock()
+	if ok && now.Before(c.expires) {
+		return c.addrs, nil
+	}
+	ips, err := r.resolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]netip.Addr, len(ips))
+	for i, ip := range ips {
+		addrs[i] = ip.Unmap()
+	}
+	if r.opts.TTL > 0 {
+		r.mu.Lock()
+		if len(r.cache) >= maxCachedHosts {
+			r.prune(now)
+		}
+		r.cache[host] = cached{addrs: addrs, expires: now.Add(r.opts.TTL)}
+		r.mu.Unlock()
+	}
+	return addrs, nil
+}
+
+// prune drops expired entries, or everything if none have expired. The
+// caller holds r.mu.
+func (r *Resolver) prune(now time.Time) {
+	for h, c := range r.cache {
+		if !now.Before(c.expires) {
+			delete(r.cache, h)
+		}
+	}
+	if len(r.cache) >= maxCachedHosts {
+		clear(r.cache)
+	}
+}
+
+func (r *Resolver) check(host string, addr netip.Addr) error {
+	if !r.opts.BlockPrivate || !isPrivate(addr) {
+		return nil
+	}
+	for _, p := range r.opts.Allow {
+		if p.Contains(addr) {
+			return nil
+		}
+	}
+	return &BlockedError{Host: host, Addr: addr}
+}
+
+var sharedSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+func isPrivate(a netip.Addr) bool {
+	return a.IsLoopback() || a.IsPrivate() || a.IsLinkLocalUnicast() ||
+		a.IsLinkLocalMulticast() || a.IsInterfaceLocalMulticast() ||
+		a.IsUnspecified() || sharedSpace.Contains(a)
+}
+
+// DialContext resolves address under egress policy and connects to the
+// first reachable address. With a FallbackDelay, attempts alternate between
+// IPv6 and IPv4 and overlap, so a family that is unreachable, rather than
+// refused, does not hold up the other. Timeouts come from ctx.
+func (r *Resolver) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := r.Resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	addrs = interleave(forNetwork(addrs, network))
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no addresses for %s", host)
+	}
+	if r.opts.FallbackDelay <= 0 || len(addrs) == 1 {
+		var errs []error
+		for _, a := range addrs {
+			c, err := r.dialAddr(ctx, network, a, port)
+			if err == nil {
+				return c, nil
+			}
+			errs = append(errs, err)
+		}
+		return nil, errors.Join(errs...)
+	}
+	return r.race(ctx, network, addrs, port)
+}
+
+// race starts an attempt on each of addrs in turn, the next one after
+// FallbackDelay or as soon as an attempt fails, and returns the first
+// connection made. The others are abandoned and closed.
+func (r *Resolver) race(ctx context.Context, network string, addrs []netip.Addr, port string) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		c   net.Conn
+		err error
+	}
+	results := make(chan result, len(addrs))
+	next, pending := 0, 0
+	start := func() {
+		a := addrs[next]
+		next++
+		pending++
+		go func() {
+			c, err := r.dialAddr(ctx, network, a, port)
+			results <- result{c, err}
+		}()
+	}
+	start()
+	timer := time.NewTimer(r.opts.FallbackDelay)
+	defer timer.Stop()
+	var errs []error
+	for pending > 0 {
+		select {
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				go func(n int) {
+					for range n {
+						if late := <-results; late.c != nil {
+							late.c.Close()
+						}
+					}
+				}(pending)
+				return res.c, nil
+			}
+			errs = append(errs, res.err)
+		case <-timer.C:
+		}
+		if next < len(addrs) {
+			start()
+			timer.Reset(r.opts.FallbackDelay)
+		}
+	}
+	return nil, errors.Join(errs...)
+}
+
+// dialAddr connects to a from the local address of its family, if any are
+// configured.
+func (r *Resolver) dialAddr(ctx context.Context, network string, a netip.Addr, port string) (net.Conn, error) {
+	d := r.dialer
+	if len(r.opts.LocalAddrs) > 0 {
+		i := slices.IndexFunc(r.opts.LocalAddrs, func(l netip.Addr) bool { return l.Is4() == a.Is4() })
+		if i < 0 {
+			return nil, fmt.Errorf("dial %s: no local address of its family to bind", a)
+		}
+		bound := *r.dialer
+		bound.LocalAddr = &net.TCPAddr{IP: r.opts.LocalAddrs[i].AsSlice()}
+		d = &bound
+	}
+	return d.DialContext(ctx, network, net.JoinHostPort(a.String(), port))
+}
+
+// forNetwork keeps the addresses network can reach: IPv4 only for tcp4,
+// IPv6 only for tcp6.
+func forNetwork(addrs []netip.Addr, network string) []netip.Addr {
+	switch network {
+	case "tcp4":
+		return slices.DeleteFunc(slices.Clone(addrs), netip.Addr.Is6)
+	case "tcp6":
+		return slices.DeleteFunc(slices.Clone(addrs), netip.Addr.Is4)
+	}
+	return addrs
+}
+
+// interleave orders addrs alternating between address families, starting
+// with the family of the first, keeping the order within each family.
+func interleave(addrs []netip.Addr) []netip.Addr {
+	if len(addrs) < 2 {
+		return addrs
+	}
+	var first, other []netip.Addr
+	for _, a := range addrs {
+		if a.Is4() == addrs[0].Is4() {
+			first = append(first, a)
+		} else {
+			other = append(other, a)
+		}
+	}
+	out := make([]netip.Addr, 0, len(addrs))
+	for i := range max(len(first), len(other)) {
+		if i < len(first) {
+			out = append(out, first[i])
+		}
+		if i < len(other) {
+			out = append(out, other[i])
+		}
+	}
+	return out
+}
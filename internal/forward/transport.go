@@ -0,0 +1,48 @@
+// Package forward provides the upstream transport used for proxied
+// requests.
+package forward
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/kdhira/audit-proxy/internal/config"
+)
+
+// NewTransport returns a pooled transport for upstream requests that dials
+// through r with the timeouts in t and speaks TLS with a copy of tlsConfig
+// (nil for Go's defaults). It never consults proxy environment variables so
+// the proxy cannot loop through itself.
+func NewTransport(r *Resolver, t config.Timeouts, tlsConfig *tls.Config) *http.Transport {
+	tr := &http.Transport{
+		Proxy:                 nil,
+		DialContext:           Dialer(r, t.Dial),
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   16,
+		IdleConnTimeout:       t.Idle,
+		TLSHandshakeTimeout:   t.TLSHandshake,
+		ResponseHeaderTimeout: t.ResponseHeader,
+		ExpectContinueTimeout: time.Second,
+	}
+	if tlsConfig != nil {
+		tr.TLSClientConfig = tlsConfig.Clone()
+	}
+	return tr
+}
+
+// Dialer returns a dial function through r that gives up after timeout
+// (zero for no limit).
+func Dialer(r *Resolver, timeout time.Duration) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		return r.DialContext(ctx, network, address)
+	}
+}
@@ -0,0 +1,204 @@
+// Package health actively probes upstream endpoints and tracks whether each
+// is healthy, using consecutive-result thresholds to avoid flapping.
+package health
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/kdhira/audit-proxy/internal/config"
+)
+
+// Status is a point-in-time view of one probed target.
+type Status struct {
+	Name       string    `json:"name"`
+	URL        string    `json:"url"`
+	Healthy    bool      `json:"healthy"`
+	LastCheck  time.Time `json:"last_check,omitzero"`
+	LastStatus int       `json:"last_status,omitempty"`
+	LastError  string    `json:"last_error,omitempty"`
+	// Streak is the number of consecutive results matching the latest.
+	Streak int `json:"streak"`
+}
+
+// Target is one probed endpoint. Targets start healthy.
+type Target struct {
+	name   string
+	url    string
+	method string
+	check  config.HealthCheck
+
+	mu      sync.Mutex
+	healthy bool
+	lastOK  bool
+	streak  int
+	last    time.Time
+	status  int
+	err     string
+}
+
+// Healthy reports the target's current state. A nil Target is healthy.
+func (t *Target) Healthy() bool {
+	if t == nil {
+		return true
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.healthy
+}
+
+func (t *Target) snapshot() Status {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return Status{
+		Name: t.name, URL: t.url, Healthy: t.healthy, LastCheck: t.last,
+		LastStatus: t.status, LastError: t.err, Streak: t.streak,
+	}
+}
+
+// record applies one probe result and reports whether the state changed.
+func (t *Target) record(ok bool, status int, err error, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.last, t.status, t.err = now, status, ""
+	if err != nil {
+		t.err = err.Error()
+	}
+	if ok == t.lastOK {
+		t.streak++
+	} else {
+		t.lastOK, t.streak = ok, 1
+	}
+	switch {
+	case ok && !t.healthy && t.streak >= t.check.HealthyThreshold:
+		t.healthy = true
+		return true
+	case !ok && t.healthy && t.streak >= t.check.UnhealthyThreshold:
+		t.healthy = false
+		return true
+	}
+	return false
+}
+
+// Checker runs the probes.
+type Checker struct {
+	client *http.Client
+	// OnChange, if set, is called when a target changes state.
+	OnChange func(Status)
+
+	mu      sync.Mutex
+	targets []*Target
+}
+
+// NewChecker returns a Checker sending probes through rt.
+func NewChecker(rt http.RoundTripper) *Checker {
+	return &Checker{client: &http.Client{
+		Transport: rt,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}}
+}
+
+// Add registers a probe of url, which already includes the check path.
+// Zero fields of check take their defaults.
+func (c *Checker) Add(name, url string, check config.HealthCheck) *Target {
+	if check.Method == "" {
+		check.Method = http.MethodGet
+	}
+	if check.Interval <= 0 {
+		check.Interval = 10 * time.Second
+	}
+	if check.Timeout <= 0 {
+		check.Timeout = 2 * time.Second
+	}
+	if check.HealthyThreshold <= 0 {
+		check.HealthyThreshold = 2
+	}
+	if check.UnhealthyThreshold <= 0 {
+		check.UnhealthyThreshold = 3
+	}
+	t := &Target{name: name, url: url, method: check.Method, check: check, healthy: true, lastOK: true}
+	c.mu.Lock()
+	c.targets = append(c.targets, t)
+	c.mu.Unlock()
+	return t
+}
+
+// Start probes every target until ctx is done.
+func (c *Checker) Start(ctx context.Context) {
+	c.mu.Lock()
+	targets := slices.Clone(c.targets)
+	c.mu.Unlock()
+	for _, t := range targets {
+		go c.run(ctx, t)
+	}
+}
+
+func (c *Checker) run(ctx context.Context, t *Target) {
+	ticker := time.NewTicker(t.check.Interval)
+	defer ticker.Stop()
+	for {
+		c.probe(ctx, t)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *Checker) probe(ctx context.Context, t *Target) {
+	ctx, cancel := context.WithTimeout(ctx, t.check.Timeout)
+	defer cancel()
+	status, err := c.do(ctx, t)
+	if err != nil && ctx.Err() == context.Canceled {
+		return // shutting down
+	}
+	ok := err == nil && expected(t.check.ExpectStatus, status)
+	if err == nil && !ok {
+		err = fmt.Errorf("unexpected status %d", status)
+	}
+	if t.record(ok, status, err, time.Now()) && c.OnChange != nil {
+		c.OnChange(t.snapshot())
+	}
+}
+
+func (c *Checker) do(ctx context.Context, t *Target) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, t.method, t.url, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("User-Agent", "audit-proxy-health")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	return resp.StatusCode, nil
+}
+
+func expected(want []int, status int) bool {
+	if len(want) == 0 {
+		return status >= 200 && status < 400
+	}
+	return slices.Contains(want, status)
+}
+
+// Statuses returns every target's status in registration order.
+func (c *Checker) Statuses() []Status {
+	c.mu.Lock()
+	targets := slices.Clone(c.targets)
+	c.mu.Unlock()
+	out := make([]Status, len(targets))
+	for i, t := range targets {
+		out[i] = t.snapshot()
+	}
+	return out
+}
@@ -0,0 +1,394 @@
+// Package metrics is a small Prometheus-compatible metrics registry with
+// counters, gauges and histograms, exposed in the text exposition format
+// or, for scrapers that ask for it, OpenMetrics with exemplars.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Registry holds metric families in registration order.
+type Registry struct {
+	mu       sync.Mutex
+	families []family
+}
+
+type family interface {
+	write(w *bufio.Writer, om bool)
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry { return &Registry{} }
+
+func (r *Registry) register(f family) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.families = append(r.families, f)
+}
+
+// WriteTo writes every family in the Prometheus text format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	return r.writeAll(w, false)
+}
+
+// WriteOpenMetrics writes every family in the OpenMetrics text format,
+// which unlike the Prometheus format carries histogram exemplars.
+func (r *Registry) WriteOpenMetrics(w io.Writer) (int64, error) {
+	return r.writeAll(w, true)
+}
+
+func (r *Registry) writeAll(w io.Writer, om bool) (int64, error) {
+	r.mu.Lock()
+	families := slices.Clone(r.families)
+	r.mu.Unlock()
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, f := range families {
+		f.write(bw, om)
+	}
+	if om {
+		bw.WriteString("# EOF\n")
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// Handler serves the registry at any path, as OpenMetrics to clients that
+// accept it and in the Prometheus text format otherwise.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.Contains(req.Header.Get("Accept"), "application/openmetrics-text") {
+			w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+			_, _ = r.WriteOpenMetrics(w)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_, _ = r.WriteTo(w)
+	})
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// desc is the shared description of a metric family.
+type desc struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+}
+
+func (d desc) header(w *bufio.Writer, om bool) {
+	name := d.name
+	if om && d.kind == "counter" {
+		// OpenMetrics names the counter family without its _total sample
+		// suffix.
+		name = strings.TrimSuffix(name, "_total")
+	}
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, escapeHelp(d.help), name, d.kind)
+}
+
+// series returns the label set rendered as {a="x",b="y"}, with extra pairs
+// appended.
+func (d desc) series(values []string, extra ...string) string {
+	if len(d.labels) == 0 && len(extra) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, l := range d.labels {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=%s", l, quoteLabel(values[i]))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		if b.Len() > 1 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=%s", extra[i], quoteLabel(extra[i+1]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// vec stores one child per distinct label value tuple.
+type vec[T any] struct {
+	desc
+	mu       sync.Mutex
+	children map[string]*child[T]
+	make     func() *T
+}
+
+type child[T any] struct {
+	values []string
+	metric *T
+}
+
+func newVec[T any](d desc, mk func() *T) *vec[T] {
+	return &vec[T]{desc: d, children: map[string]*child[T]{}, make: mk}
+}
+
+func (v *vec[T]) with(values []string) *T {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	c, ok := v.children[key]
+	if !ok {
+		c = &child[T]{values: slices.Clone(values), metric: v.make()}
+		v.children[key] = c
+	}
+	return c.metric
+}
+
+// sorted returns the children ordered by label values.
+func (v *vec[T]) sorted() []*child[T] {
+	v.mu.Lock()
+	out := make([]*child[T], 0, len(v.children))
+	for _, c := range v.children {
+		out = append(out, c)
+	}
+	v.mu.Unlock()
+	slices.SortFunc(out, func(a, b *child[T]) int { return slices.Compare(a.values, b.values) })
+	return out
+}
+
+// Counter is a monotonically increasing value.
+type Counter struct{ v atomicFloat }
+
+// Inc adds one.
+func (c *Counter) Inc() { c.v.add(1) }
+
+// Add adds d, which must not be negative.
+func (c *Counter) Add(d float64) {
+	if d < 0 {
+		return
+	}
+	c.v.add(d)
+}
+
+// Value returns the current value.
+func (c *Counter) Value() float64 { return c.v.load() }
+
+// CounterVec is a counter family partitioned by labels.
+type CounterVec struct{ *vec[Counter] }
+
+// Counter registers a counter family.
+func (r *Registry) Counter(name, help string, labels ...string) *CounterVec {
+	v := CounterVec{newVec(desc{name: name, help: help, kind: "counter", labels: labels}, func() *Counter { return &Counter{} })}
+	r.register(v)
+	return &v
+}
+
+// With returns the counter for the given label values.
+func (v CounterVec) With(values ...string) *Counter { return v.with(values) }
+
+func (v CounterVec) write(w *bufio.Writer, om bool) {
+	v.header(w, om)
+	name := v.name
+	if om && !strings.HasSuffix(name, "_total") {
+		name += "_total"
+	}
+	for _, c := range v.sorted() {
+		fmt.Fprintf(w, "%s%s %s\n", name, v.series(c.values), formatFloat(c.metric.Value()))
+	}
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct{ v atomicFloat }
+
+// Set sets the value.
+func (g *Gauge) Set(x float64) { g.v.store(x) }
+
+// Add adds d (which may be negative).
+func (g *Gauge) Add(d float64) { g.v.add(d) }
+
+// Value returns the current value.
+func (g *Gauge) Value() float64 { return g.v.load() }
+
+// GaugeVec is a gauge family partitioned by labels.
+type GaugeVec struct{ *vec[Gauge] }
+
+// Gauge registers a gauge family.
+func (r *Registry) Gauge(name, help string, labels ...string) *GaugeVec {
+	v := GaugeVec{newVec(desc{name: name, help: help, kind: "gauge", labels: labels}, func() *Gauge { return &Gauge{} })}
+	r.register(v)
+	return &v
+}
+
+// With returns the gauge for the given label values.
+func (v GaugeVec) With(values ...string) *Gauge { return v.with(values) }
+
+func (v GaugeVec) write(w *bufio.Writer, om bool) {
+	v.header(w, om)
+	for _, c := range v.sorted() {
+		fmt.Fprintf(w, "%s%s %s\n", v.name, v.series(c.values), formatFloat(c.metric.Value()))
+	}
+}
+
+// Histogram counts observations into cumulative buckets. Each bucket keeps
+// the exemplar of its latest observation that had one.
+type Histogram struct {
+	upper     []float64
+	counts    []atomic.Uint64
+	exemplars []atomic.Pointer[exemplar] // one per bucket, then +Inf
+	sum       atomicFloat
+	count     atomic.Uint64
+}
+
+// exemplar is an observation with labels identifying an example of what
+// was observed, such as the request behind a latency.
+type exemplar struct {
+	labels string // rendered {a="x"}
+	value  float64
+	time   time.Time
+}
+
+// maxExemplarRunes is the OpenMetrics limit on the combined length of an
+// exemplar's label names and values.
+const maxExemplarRunes = 128
+
+// Observe records one value.
+func (h *Histogram) Observe(x float64) {
+	h.observe(x)
+}
+
+// ObserveWithExemplar records one value with exemplar labels given as
+// name, value pairs, e.g. "entry_id", id. Pairs past the OpenMetrics limit
+// of 128 characters are dropped.
+func (h *Histogram) ObserveWithExemplar(x float64, labels ...string) {
+	i := h.observe(x)
+	var b strings.Builder
+	b.WriteByte('{')
+	n := 0
+	for j := 0; j+1 < len(labels); j += 2 {
+		n += len([]rune(labels[j])) + len([]rune(labels[j+1]))
+		if n > maxExemplarRunes {
+			break
+		}
+		if b.Len() > 1 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=%s", labels[j], quoteLabel(labels[j+1]))
+	}
+	b.WriteByte('}')
+	h.exemplars[i].Store(&exemplar{labels: b.String(), value: x, time: time.Now()})
+}
+
+// observe records x and returns the index of its bucket, len(h.upper) for
+// +Inf.
+func (h *Histogram) observe(x float64) int {
+	i := len(h.upper)
+	for j, u := range h.upper {
+		if x <= u {
+			i = j
+			h.counts[j].Add(1)
+			break
+		}
+	}
+	h.sum.add(x)
+	h.count.Add(1)
+	return i
+}
+
+// HistogramVec is a histogram family partitioned by labels.
+type HistogramVec struct{ *vec[Histogram] }
+
+// DefaultBuckets suit request latencies in seconds.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// Histogram registers a histogram family with the given upper bounds.
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	upper := slices.Clone(buckets)
+	slices.Sort(upper)
+	v := HistogramVec{newVec(desc{name: name, help: help, kind: "histogram", labels: labels}, func() *Histogram {
+		return &Histogram{upper: upper, counts: make([]atomic.Uint64, len(upper)), exemplars: make([]atomic.Pointer[exemplar], len(upper)+1)}
+	})}
+	r.register(v)
+	return &v
+}
+
+// With returns the histogram for the given label values.
+func (v HistogramVec) With(values ...string) *Histogram { return v.with(values) }
+
+func (v HistogramVec) write(w *bufio.Writer, om bool) {
+	v.header(w, om)
+	for _, c := range v.sorted() {
+		h := c.metric
+		var cum uint64
+		for i, u := range h.upper {
+			cum += h.counts[i].Load()
+			fmt.Fprintf(w, "%s_bucket%s %d", v.name, v.series(c.values, "le", formatFloat(u)), cum)
+			h.writeExemplar(w, i, om)
+		}
+		total := h.count.Load()
+		fmt.Fprintf(w, "%s_bucket%s %d", v.name, v.series(c.values, "le", "+Inf"), total)
+		h.writeExemplar(w, len(h.upper), om)
+		fmt.Fprintf(w, "%s_sum%s %s\n", v.name, v.series(c.values), formatFloat(h.sum.load()))
+		fmt.Fprintf(w, "%s_count%s %d\n", v.name, v.series(c.values), total)
+	}
+}
+
+// writeExemplar ends a bucket line, with the bucket's exemplar in
+// OpenMetrics.
+func (h *Histogram) writeExemplar(w *bufio.Writer, i int, om bool) {
+	if e := h.exemplars[i].Load(); om && e != nil {
+		fmt.Fprintf(w, " # %s %s %s", e.labels, formatFloat(e.value),
+			strconv.FormatFloat(float64(e.time.UnixMilli())/1000, 'f', 3, 64))
+	}
+	w.WriteByte('\n')
+}
+
+// atomicFloat is a float64 updated with compare-and-swap.
+type atomicFloat struct{ bits atomic.Uint64 }
+
+func (f *atomicFloat) load() float64   { return math.Float64frombits(f.bits.Load()) }
+func (f *atomicFloat) store(x float64) { f.bits.Store(math.Float64bits(x)) }
+
+func (f *atomicFloat) add(d float64) {
+	for {
+		old := f.bits.Load()
+		if f.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+d)) {
+			return
+		}
+	}
+}
+
+func formatFloat(x float64) string {
+	switch {
+	case math.IsInf(x, 1):
+		return "+Inf"
+	case math.IsInf(x, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(x, 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func quoteLabel(s string) string { return `"` + labelEscaper.Replace(s) + `"` }
+
+func escapeHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
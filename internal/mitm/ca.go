@@ -0,0 +1,82 @@
+package mitm
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// CAOptions describe a root CA for GenerateCA.
+type CAOptions struct {
+	// KeyType is "ecdsa" (P-256) or "rsa".
+	KeyType string
+	// RSABits is the RSA key size (default 3072).
+	RSABits      int
+	CommonName   string
+	Organization string
+	Validity     time.Duration
+}
+
+// GenerateCA creates a self-signed root CA able to issue leaf certificates
+// and returns the certificate and its PKCS #8 private key as PEM.
+func GenerateCA(o CAOptions) (certPEM, keyPEM []byte, err error) {
+	var key crypto.Signer
+	switch o.KeyType {
+	case "ecdsa":
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "rsa":
+		bits := o.RSABits
+		if bits == 0 {
+			bits = 3072
+		}
+		if bits < 2048 {
+			return nil, nil, fmt.Errorf("RSA keys must have at least 2048 bits, not %d", bits)
+		}
+		key, err = rsa.GenerateKey(rand.Reader, bits)
+	default:
+		return nil, nil, fmt.Errorf("unknown key type %q (want ecdsa or rsa)", o.KeyType)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("generate CA key: %w", err)
+	}
+	if o.Validity <= 0 {
+		return nil, nil, fmt.Errorf("validity must be positive, not %s", o.Validity)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, fmt.Errorf("generate serial: %w", err)
+	}
+	subject := pkix.Name{CommonName: o.CommonName}
+	if o.Organization != "" {
+		subject.Organization = []string{o.Organization}
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               subject,
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(o.Validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("sign CA certificate: %w", err)
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}), nil
+}
@@ -0,0 +1,215 @@
+// Package mitm issues per-host leaf certificates from a local CA so CONNECT
+// tunnels can be intercepted and decrypted.
+package mitm
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"time"
+)
+
+// leafValidity is how long issued leaf certificates remain valid.
+const leafValidity = 7 * 24 * time.Hour
+
+// Leaf key algorithms.
+const (
+	LeafECDSA = "ecdsa" // P-256
+	LeafRSA   = "rsa"   // 2048 bits
+)
+
+// Issuer signs leaf certificates with a CA key pair.
+type Issuer struct {
+	ca      *x509.Certificate
+	caKey   crypto.Signer
+	leafAlg string
+	leafKey crypto.Signer // shared by all leaves; nil for a key per leaf
+}
+
+// NewIssuer returns an Issuer for the given CA certificate and key. It
+// gives each leaf its own ECDSA key until SetLeafKeys says otherwise.
+func NewIssuer(ca *x509.Certificate, key crypto.Signer) *Issuer {
+	return &Issuer{ca: ca, caKey: key, leafAlg: LeafECDSA}
+}
+
+// SetLeafKeys selects the algorithm of leaf keys, LeafECDSA or LeafRSA,
+// and whether all leaves share one key, generated now, instead of each
+// getting a fresh one. Sharing takes key generation, the bulk of the cost
+// of issuing an RSA leaf, off the path of new tunnels. Call it before
+// issuing.
+func (i *Issuer) SetLeafKeys(alg string, reuse bool) error {
+	if alg != LeafECDSA && alg != LeafRSA {
+		return fmt.Errorf("unknown leaf key algorithm %q (want ecdsa or rsa)", alg)
+	}
+	i.leafAlg, i.leafKey = alg, nil
+	if reuse {
+		key, err := generateLeafKey(alg)
+		if err != nil {
+			return err
+		}
+		i.leafKey = key
+	}
+	return nil
+}
+
+func generateLeafKey(alg string) (crypto.Signer, error) {
+	var (
+		key crypto.Signer
+		err error
+	)
+	if alg == LeafRSA {
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	} else {
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("generate leaf key: %w", err)
+	}
+	return key, nil
+}
+
+// LoadIssuer reads a PEM CA certificate and private key from disk.
+func LoadIssuer(certPath, keyPath string) (*Issuer, error) {
+	certPEM, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, fmt.Errorf("read CA certificate: %w", err)
+	}
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("read CA key: %w", err)
+	}
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("load CA key pair: %w", err)
+	}
+	ca, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("parse CA certificate: %w", err)
+	}
+	if !ca.IsCA {
+		return nil, errors.New("MITM certificate is not a CA")
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("CA key cannot sign")
+	}
+	return NewIssuer(ca, key), nil
+}
+
+// CA returns the issuing CA certificate.
+func (i *Issuer) CA() *x509.Certificate { return i.ca }
+
+// Problems with an upstream certificate IssueFlawed reproduces.
+const (
+	FlawExpired   = "expired"
+	FlawHostname  = "hostname_mismatch"
+	FlawUntrusted = "unknown_authority"
+)
+
+// IssueCertificate mints a leaf certificate for host (a DNS name or IP
+// address) signed by the CA.
+func (i *Issuer) IssueCertificate(host string) (*tls.Certificate, error) {
+	tmpl, err := leafTemplate(host)
+	if err != nil {
+		return nil, err
+	}
+	if tmpl.NotAfter.After(i.ca.NotAfter) {
+		tmpl.NotAfter = i.ca.NotAfter
+	}
+	return i.sign(tmpl, false)
+}
+
+// IssueFlawed mints a leaf for host that clients reject for the reason
+// the proxy rejected upstream's certificate up: expired like up, issued
+// for up's names instead of host, or, for FlawUntrusted and any other
+// flaw, self-signed. Flawed leaves are not cached.
+func (i *Issuer) IssueFlawed(host string, up *x509.Certificate, flaw string) (*tls.Certificate, error) {
+	tmpl, err := leafTemplate(host)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case flaw == FlawExpired && up != nil:
+		tmpl.NotBefore, tmpl.NotAfter = up.NotBefore, up.NotAfter
+	case flaw == FlawHostname && up != nil:
+		tmpl.Subject = up.Subject
+		tmpl.DNSNames, tmpl.IPAddresses = up.DNSNames, up.IPAddresses
+	default:
+		return i.sign(tmpl, true)
+	}
+	return i.sign(tmpl, false)
+}
+
+func leafTemplate(host string) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("generate serial: %w", err)
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(leafValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	} else {
+		tmpl.DNSNames = []string{host}
+	}
+	return tmpl, nil
+}
+
+// sign signs tmpl with the CA, or with the leaf's own key if selfSigned,
+// and returns it with its key and chain.
+func (i *Issuer) sign(tmpl *x509.Certificate, selfSigned bool) (*tls.Certificate, error) {
+	key := i.leafKey
+	if key == nil {
+		var err error
+		if key, err = generateLeafKey(i.leafAlg); err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := key.(*rsa.PrivateKey); ok {
+		tmpl.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
+	parent, parentKey := i.ca, i.caKey
+	if selfSigned {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, key.Public(), parentKey)
+	if err != nil {
+		return nil, fmt.Errorf("sign leaf certificate: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	chain := [][]byte{der, i.ca.Raw}
+	if selfSigned {
+		chain = chain[:1]
+	}
+	return &tls.Certificate{
+		Certificate: chain,
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+// EncodeCertificate returns cert as PEM.
+func EncodeCertificate(cert *x509.Certificate) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+}
@@ -0,0 +1,219 @@
+package mitm
+
+import (
+	"container/list"
+	"crypto/tls"
+	"crypto/x509"
+	"strings"
+	"sync"
+	"time"
+)
+
+// renewBefore is how long before it expires a cached leaf is replaced.
+const renewBefore = time.Hour
+
+// Leaf cache events, reported to Manager.OnEvent.
+const (
+	EventHit    = "hit"    // a cached leaf was used
+	EventMiss   = "miss"   // no usable leaf was cached
+	EventIssue  = "issue"  // a leaf was issued
+	EventEvict  = "evict"  // a leaf was dropped to make room
+	EventExpire = "expire" // an expiring leaf was dropped
+	EventRotate = "rotate" // a leaf of a replaced CA was dropped
+)
+
+// Manager caches leaf certificates per host, up to a number of hosts,
+// and builds server-side TLS configs for intercepted tunnels.
+type Manager struct {
+	max int
+
+	// OnEvent, if set before the Manager is used, is called with each
+	// cache event and the number of leaves then cached.
+	OnEvent func(event string, cached int)
+	// OnIssue, if set before the Manager is used, is called with each leaf
+	// it issues for host, cached or flawed, and the flaw of a flawed one.
+	OnIssue func(host string, leaf *x509.Certificate, flaw string)
+
+	mu      sync.Mutex
+	issuer  *Issuer
+	gen     int        // counts SetIssuer calls, so leaves of a replaced CA are not cached
+	lru     *list.List // of *leaf, most recently used first
+	cache   map[string]*list.Element
+	pending map[string]*issue // by host, while being issued
+}
+
+type leaf struct {
+	host string
+	cert *tls.Certificate
+}
+
+// issue is a leaf being issued; done is closed once cert or err is set.
+type issue struct {
+	done chan struct{}
+	cert *tls.Certificate
+	err  error
+}
+
+// NewManager returns a Manager issuing from issuer and caching the leaves
+// of up to maxHosts hosts, least recently used first out.
+func NewManager(issuer *Issuer, maxHosts int) *Manager {
+	return &Manager{
+		issuer:  issuer,
+		max:     max(maxHosts, 1),
+		lru:     list.New(),
+		cache:   map[string]*list.Element{},
+		pending: map[string]*issue{},
+	}
+}
+
+// Issuer returns the underlying issuer.
+func (m *Manager) Issuer() *Issuer {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.issuer
+}
+
+// SetIssuer replaces the issuer, as when the CA is rotated, and drops the
+// cached leaves of the old one. Tunnels already open keep the leaves they
+// were given. It returns how many leaves it dropped.
+func (m *Manager) SetIssuer(issuer *Issuer) int {
+	m.mu.Lock()
+	m.issuer = issuer
+	m.gen++
+	dropped := m.lru.Len()
+	m.lru.Init()
+	clear(m.cache)
+	// Callers waiting for a leaf of the old CA still get it; later ones
+	// have a new leaf issued.
+	clear(m.pending)
+	m.mu.Unlock()
+	for range dropped {
+		m.event(EventRotate, 0)
+	}
+	return dropped
+}
+
+// Certificate returns a cached or freshly issued leaf for host. Leaves for
+// different hosts are issued concurrently; callers asking for a host
+// already being issued wait for that leaf.
+func (m *Manager) Certificate(host string) (*tls.Certificate, error) {
+	host = strings.ToLower(host)
+	m.mu.Lock()
+	if el, ok := m.cache[host]; ok {
+		if c := el.Value.(*leaf).cert; fresh(c, time.Now()) {
+			m.lru.MoveToFront(el)
+			n := m.lru.Len()
+			m.mu.Unlock()
+			m.event(EventHit, n)
+			return c, nil
+		}
+	}
+	n := m.lru.Len()
+	if p, ok := m.pending[host]; ok {
+		m.mu.Unlock()
+		m.event(EventMiss, n)
+		<-p.done
+		return p.cert, p.err
+	}
+	p := &issue{done: make(chan struct{})}
+	m.pending[host] = p
+	issuer, gen := m.issuer, m.gen
+	m.mu.Unlock()
+	m.event(EventMiss, n)
+
+	p.cert, p.err = issuer.IssueCertificate(host)
+	evicted := 0
+	m.mu.Lock()
+	if m.pending[host] == p {
+		delete(m.pending, host)
+	}
+	if p.err == nil && gen == m.gen {
+		if el, ok := m.cache[host]; ok {
+			m.lru.Remove(el)
+		}
+		m.cache[host] = m.lru.PushFront(&leaf{host: host, cert: p.cert})
+		for m.lru.Len() > m.max {
+			m.drop(m.lru.Back())
+			evicted++
+		}
+	}
+	n = m.lru.Len()
+	m.mu.Unlock()
+	close(p.done)
+	if p.err == nil {
+		m.event(EventIssue, n)
+		m.issued(host, p.cert, "")
+	}
+	for range evicted {
+		m.event(EventEvict, n)
+	}
+	return p.cert, p.err
+}
+
+// IssueFlawed mints an uncached leaf for host from the current issuer, as
+// Issuer.IssueFlawed does.
+func (m *Manager) IssueFlawed(host string, up *x509.Certificate, flaw string) (*tls.Certificate, error) {
+	c, err := m.Issuer().IssueFlawed(host, up, flaw)
+	if err == nil {
+		m.issued(strings.ToLower(host), c, flaw)
+	}
+	return c, err
+}
+
+// Sweep drops the cached leaves due for renewal at now and returns how
+// many it dropped.
+func (m *Manager) Sweep(now time.Time) int {
+	m.mu.Lock()
+	dropped := 0
+	for el := m.lru.Front(); el != nil; {
+		next := el.Next()
+		if !fresh(el.Value.(*leaf).cert, now) {
+			m.drop(el)
+			dropped++
+		}
+		el = next
+	}
+	n := m.lru.Len()
+	m.mu.Unlock()
+	for range dropped {
+		m.event(EventExpire, n)
+	}
+	return dropped
+}
+
+func (m *Manager) drop(el *list.Element) {
+	delete(m.cache, m.lru.Remove(el).(*leaf).host)
+}
+
+func (m *Manager) issued(host string, c *tls.Certificate, flaw string) {
+	if m.OnIssue != nil {
+		m.OnIssue(host, c.Leaf, flaw)
+	}
+}
+
+func (m *Manager) event(event string, cached int) {
+	if m.OnEvent != nil {
+		m.OnEvent(event, cached)
+	}
+}
+
+// fresh reports whether c may still be presented at now.
+func fresh(c *tls.Certificate, now time.Time) bool {
+	return now.Before(c.Leaf.NotAfter.Add(-renewBefore))
+}
+
+// TLSConfig returns a server config presenting a certificate for the SNI
+// name, falling back to host when the client sends none.
+func (m *Manager) TLSConfig(host string) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"http/1.1"},
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			name := hello.ServerName
+			if name == "" {
+				name = host
+			}
+			return m.Certificate(name)
+		},
+	}
+}
@@ -0,0 +1,156 @@
+// Package onboard generates the files that point mobile test devices at the
+// proxy and make them trust its MITM CA: an Apple configuration profile for
+// iOS and macOS, and certificate files and a network security config for
+// Android.
+package onboard
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+)
+
+// identifier prefixes the payload identifiers of generated profiles, so a
+// newer profile replaces an installed one.
+const identifier = "com.github.kdhira.audit-proxy"
+
+// Options describe the device setup.
+type Options struct {
+	// CA is the MITM CA certificate to trust.
+	CA *x509.Certificate
+	// Host and Port are the proxy's address as devices reach it.
+	Host string
+	Port int
+	// PACURL, if set, configures the proxy through the auto-config file at
+	// that URL instead of Host and Port.
+	PACURL string
+	// WiFiSSID, if set, adds a Wi-Fi network using the proxy to the
+	// profile; otherwise the profile sets a global HTTP proxy, which iOS
+	// honours on supervised devices only. WiFiPassword is the network's
+	// WPA password, empty for an open network.
+	WiFiSSID     string
+	WiFiPassword string
+}
+
+// MobileConfig returns an unsigned Apple configuration profile
+// (.mobileconfig) installing the CA as a trusted root and configuring the
+// proxy.
+func MobileConfig(o Options) ([]byte, error) {
+	root, err := payload("com.apple.security.root", "root", "audit-proxy MITM CA")
+	if err != nil {
+		return nil, err
+	}
+	root = append(root, kv{"PayloadCertificateFileName", "audit-proxy-ca.cer"}, kv{"PayloadContent", o.CA.Raw})
+
+	var proxy dict
+	if o.WiFiSSID != "" {
+		if proxy, err = payload("com.apple.wifi.managed", "wifi", "Wi-Fi "+o.WiFiSSID+" through audit-proxy"); err != nil {
+			return nil, err
+		}
+		proxy = append(proxy,
+			kv{"SSID_STR", o.WiFiSSID},
+			kv{"HIDDEN_NETWORK", false},
+			kv{"AutoJoin", true},
+		)
+		if o.WiFiPassword != "" {
+			proxy = append(proxy, kv{"EncryptionType", "WPA"}, kv{"Password", o.WiFiPassword})
+		} else {
+			proxy = append(proxy, kv{"EncryptionType", "None"})
+		}
+	} else {
+		if proxy, err = payload("com.apple.proxy.http.global", "proxy", "audit-proxy"); err != nil {
+			return nil, err
+		}
+		proxy = append(proxy, kv{"ProxyCaptiveLoginAllowed", true})
+	}
+	if o.PACURL != "" {
+		proxy = append(proxy, kv{"ProxyType", "Auto"}, kv{"ProxyPACURL", o.PACURL})
+	} else {
+		proxy = append(proxy, kv{"ProxyType", "Manual"}, kv{"ProxyServer", o.Host}, kv{"ProxyServerPort", o.Port})
+	}
+
+	id, err := uuid()
+	if err != nil {
+		return nil, err
+	}
+	profile := dict{
+		{"PayloadType", "Configuration"},
+		{"PayloadVersion", 1},
+		{"PayloadIdentifier", identifier},
+		{"PayloadUUID", id},
+		{"PayloadDisplayName", "audit-proxy"},
+		{"PayloadDescription", "Trusts the audit-proxy CA and sends traffic through the proxy for auditing."},
+		{"PayloadOrganization", "audit-proxy"},
+		{"PayloadContent", []any{root, proxy}},
+	}
+	var b bytes.Buffer
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+`)
+	if err := encode(&b, profile, 0); err != nil {
+		return nil, err
+	}
+	b.WriteString("</plist>\n")
+	return b.Bytes(), nil
+}
+
+// payload returns the common keys of a profile payload.
+func payload(typ, name, display string) (dict, error) {
+	id, err := uuid()
+	if err != nil {
+		return nil, err
+	}
+	return dict{
+		{"PayloadType", typ},
+		{"PayloadVersion", 1},
+		{"PayloadIdentifier", identifier + "." + name},
+		{"PayloadUUID", id},
+		{"PayloadDisplayName", display},
+	}, nil
+}
+
+// uuid returns a random (version 4) UUID.
+func uuid() (string, error) {
+	var u [16]byte
+	if _, err := rand.Read(u[:]); err != nil {
+		return "", err
+	}
+	u[6] = u[6]&0x0f | 0x40
+	u[8] = u[8]&0x3f | 0x80
+	return fmt.Sprintf("%X-%X-%X-%X-%X", u[0:4], u[4:6], u[6:8], u[8:10], u[10:]), nil
+}
+
+// AndroidSystemName returns the file name Android expects for ca in its
+// system certificate store (/system/etc/security/cacerts): OpenSSL's old
+// subject hash, in hex, followed by ".0".
+func AndroidSystemName(ca *x509.Certificate) string {
+	sum := md5.Sum(ca.RawSubject)
+	return fmt.Sprintf("%08x.0", binary.LittleEndian.Uint32(sum[:4]))
+}
+
+// PEM returns ca as PEM.
+func PEM(ca *x509.Certificate) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})
+}
+
+// NetworkSecurityConfig is an Android network security config making an
+// app trust user-installed CAs, which apps targeting Android 7 or later
+// ignore by default. Debug builds only: release builds should keep the
+// default.
+const NetworkSecurityConfig = `<?xml version="1.0" encoding="utf-8"?>
+<!-- res/xml/network_security_config.xml; reference it from the manifest with
+     android:networkSecurityConfig="@xml/network_security_config" -->
+<network-security-config>
+    <debug-overrides>
+        <trust-anchors>
+            <certificates src="system" />
+            <certificates src="user" />
+        </trust-anchors>
+    </debug-overrides>
+</network-security-config>
+`
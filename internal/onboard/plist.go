@@ -0,0 +1,60 @@
+package onboard
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// kv is a key of a property list dictionary and its value.
+type kv struct {
+	key   string
+	value any
+}
+
+// dict is a property list dictionary, its keys kept in order.
+type dict []kv
+
+// encode writes v as a property list value indented by depth tabs. Values
+// are dicts, arrays ([]any), strings, ints, bools and data ([]byte).
+func encode(w io.Writer, v any, depth int) error {
+	indent := strings.Repeat("\t", depth)
+	switch v := v.(type) {
+	case dict:
+		fmt.Fprintf(w, "%s<dict>\n", indent)
+		for _, e := range v {
+			fmt.Fprintf(w, "%s\t<key>%s</key>\n", indent, escape(e.key))
+			if err := encode(w, e.value, depth+1); err != nil {
+				return err
+			}
+		}
+		fmt.Fprintf(w, "%s</dict>\n", indent)
+	case []any:
+		fmt.Fprintf(w, "%s<array>\n", indent)
+		for _, e := range v {
+			if err := encode(w, e, depth+1); err != nil {
+				return err
+			}
+		}
+		fmt.Fprintf(w, "%s</array>\n", indent)
+	case string:
+		fmt.Fprintf(w, "%s<string>%s</string>\n", indent, escape(v))
+	case int:
+		fmt.Fprintf(w, "%s<integer>%d</integer>\n", indent, v)
+	case bool:
+		fmt.Fprintf(w, "%s<%t/>\n", indent, v)
+	case []byte:
+		fmt.Fprintf(w, "%s<data>%s</data>\n", indent, base64.StdEncoding.EncodeToString(v))
+	default:
+		return fmt.Errorf("plist: unsupported value %T", v)
+	}
+	return nil
+}
+
+func escape(s string) string {
+	var b strings.Builder
+	_ = xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
@@ -0,0 +1,121 @@
+// Package azureopenai annotates traffic to Azure OpenAI resources with the
+// deployment, API version, operation, model and token usage.
+package azureopenai
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/kdhira/audit-proxy/internal/audit"
+	"github.com/kdhira/audit-proxy/internal/profiles/openai"
+)
+
+// HostSuffix ends the host of every Azure OpenAI resource.
+const HostSuffix = ".openai.azure.com"
+
+// operations maps the paths (below /openai) that have no OpenAI
+// counterpart to operation names.
+var operations = []struct {
+	prefix string
+	name   string
+}{
+	{"/extensions/chat/completions", "chat.completions"},
+	{"/deployments", "deployments"},
+}
+
+// Profile is the Azure OpenAI profile.
+type Profile struct{}
+
+// New returns the Azure OpenAI profile.
+func New() *Profile { return &Profile{} }
+
+func (*Profile) Name() string { return "azure_openai" }
+
+func (*Profile) Match(req *http.Request) bool {
+	host := req.URL.Hostname()
+	if host == "" {
+		host = req.Host
+		if h, _, ok := strings.Cut(host, ":"); ok {
+			host = h
+		}
+	}
+	return strings.HasSuffix(strings.ToLower(host), HostSuffix)
+}
+
+func (*Profile) Annotate(req *http.Request, e *audit.Entry) {
+	op, deployment := Operation(req.URL.Path)
+	e.Operation = op
+	if resource, ok := strings.CutSuffix(strings.ToLower(req.URL.Hostname()), HostSuffix); ok && resource != "" {
+		e.SetAttribute("azure_openai.resource", resource)
+	}
+	if deployment != "" {
+		e.SetAttribute("azure_openai.deployment", deployment)
+	}
+	if v := req.URL.Query().Get("api-version"); v != "" {
+		e.SetAttribute("azure_openai.api_version", v)
+	}
+	openai.AnnotateBodies(e, "azure_openai")
+	if contentFiltered(e) {
+		e.SetAttribute("azure_openai.content_filtered", true)
+	}
+	// Azure takes its key in api-key rather than Authorization.
+	if _, ok := e.Request.Headers["Api-Key"]; ok {
+		e.Request.Headers["Api-Key"] = []string{audit.Redacted}
+	}
+}
+
+// Operation returns the operation name for an Azure OpenAI path, or "" if
+// unknown, and the deployment the path names, if any. Deployment paths,
+// /openai/deployments/{name}/..., take the operations of the OpenAI API
+// below the deployment, as do the paths of the v1 API, /openai/v1/...
+func Operation(path string) (op, deployment string) {
+	rest, ok := strings.CutPrefix(path, "/openai")
+	if !ok {
+		return "", ""
+	}
+	if r, ok := strings.CutPrefix(rest, "/deployments/"); ok {
+		deployment, rest, _ = strings.Cut(r, "/")
+		if rest == "" {
+			return "deployments", deployment
+		}
+		rest = "/" + rest
+	}
+	for _, o := range operations {
+		if rest == o.prefix || strings.HasPrefix(rest, o.prefix+"/") {
+			return o.name, deployment
+		}
+	}
+	if !strings.HasPrefix(rest, "/v1/") {
+		rest = "/v1" + rest
+	}
+	return openai.Operation(rest), deployment
+}
+
+// contentFiltered reports whether Azure's content filter refused the
+// prompt or cut the completion short.
+func contentFiltered(e *audit.Entry) bool {
+	if e.Response == nil || e.Response.Excerpt == "" {
+		return false
+	}
+	var resp struct {
+		Choices []struct {
+			FinishReason string `json:"finish_reason"`
+		} `json:"choices"`
+		Error *struct {
+			Code string `json:"code"`
+		} `json:"error"`
+	}
+	if json.Unmarshal([]byte(e.Response.Excerpt), &resp) != nil {
+		return false
+	}
+	if resp.Error != nil && resp.Error.Code == "content_filter" {
+		return true
+	}
+	for _, c := range resp.Choices {
+		if c.FinishReason == "content_filter" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,249 @@
+// Package cloudmetadata recognises requests to the instance metadata
+// services of cloud providers, 169.254.169.254 and its kin, which hand out
+// the credentials of the machine they are asked from. A client reaching one
+// through the proxy is a sign of server-side request forgery or of
+// credentials being exfiltrated, so the profile marks such entries and the
+// cloud_metadata filter can refuse them.
+package cloudmetadata
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/kdhira/audit-proxy/internal/audit"
+)
+
+// Providers, as recorded in cloud_metadata.provider.
+const (
+	AWS          = "aws"
+	Azure        = "azure"
+	GCP          = "gcp"
+	Oracle       = "oracle"
+	Alibaba      = "alibaba"
+	DigitalOcean = "digitalocean"
+	OpenStack    = "openstack"
+)
+
+// shared is the address most providers serve their metadata on.
+var shared = netip.MustParseAddr("169.254.169.254")
+
+// addresses maps the other metadata addresses to their providers.
+var addresses = map[netip.Addr]string{
+	netip.MustParseAddr("fd00:ec2::254"):   AWS, // EC2 over IPv6
+	netip.MustParseAddr("169.254.170.2"):   AWS, // ECS task credentials
+	netip.MustParseAddr("169.254.170.23"):  AWS, // EKS pod identity
+	netip.MustParseAddr("fd00:ec2::23"):    AWS,
+	netip.MustParseAddr("168.63.129.16"):   Azure, // the wire server
+	netip.MustParseAddr("100.100.100.200"): Alibaba,
+}
+
+// names maps the host names of metadata services to their providers.
+var names = map[string]string{
+	"metadata.google.internal":   GCP,
+	"instance-data.ec2.internal": AWS,
+}
+
+// googleAliases are the other names GCP's service answers to. Hosts of
+// these names are as likely to be a network's own, so they only count with
+// the Metadata-Flavor header Google's clients send.
+var googleAliases = []string{"metadata", "metadata.goog"}
+
+// credentialPaths match the paths, by provider, that serve credentials or
+// identity tokens.
+var credentialPaths = map[string][]*regexp.Regexp{
+	AWS: {
+		regexp.MustCompile(`^/latest/meta-data/iam/security-credentials(/|$)`),
+		regexp.MustCompile(`^/latest/meta-data/identity-credentials/`),
+		regexp.MustCompile(`^/v2/credentials/`), // ECS
+		regexp.MustCompile(`^/v1/credentials`),  // EKS pod identity
+	},
+	Azure: {regexp.MustCompile(`^/metadata/identity/oauth2/token`)},
+	// Only tokens; the rest of service-accounts/ is the account's email,
+	// aliases and scopes.
+	GCP:     {regexp.MustCompile(`^/computeMetadata/v1/instance/service-accounts/[^/]+/(token|identity)$`)},
+	Oracle:  {regexp.MustCompile(`^/opc/v2/identity/`)},
+	Alibaba: {regexp.MustCompile(`^/latest/meta-data/ram/security-credentials(/|$)`)},
+}
+
+// tokenHeaders carry the session tokens metadata services hand out, which
+// are masked like credentials.
+var tokenHeaders = []string{"X-Aws-Ec2-Metadata-Token"}
+
+// Endpoint is a request to a metadata service.
+type Endpoint struct {
+	// Address is the metadata address or host name asked for, normalised:
+	// 2852039166 and ::ffff:a9fe:a9fe are both 169.254.169.254.
+	Address string
+	// Provider is the cloud whose service was asked, or "" where the
+	// shared address is asked in a way no provider's clients do.
+	Provider string
+	// Credentials reports whether the request asks for credentials or an
+	// identity token.
+	Credentials bool
+}
+
+// Profile is the cloud metadata profile.
+type Profile struct{}
+
+// New returns the cloud metadata profile.
+func New() *Profile { return &Profile{} }
+
+func (*Profile) Name() string { return "cloud_metadata" }
+
+func (*Profile) Match(req *http.Request) bool {
+	_, ok := Detect(host(req), req.URL.Path, req.Header)
+	return ok
+}
+
+// Annotate records the endpoint asked. The credentials and session tokens
+// a metadata service returns are masked in the entry.
+func (*Profile) Annotate(req *http.Request, e *audit.Entry) {
+	ep, ok := Detect(host(req), req.URL.Path, req.Header)
+	if !ok {
+		return
+	}
+	e.Operation = "cloud_metadata.read"
+	if ep.Credentials {
+		e.Operation = "cloud_metadata.credentials"
+	}
+	Record(e.SetAttribute, ep)
+	for _, h := range tokenHeaders {
+		if _, ok := e.Request.Headers[h]; ok {
+			e.Request.Headers[h] = []string{audit.Redacted}
+		}
+	}
+	if (ep.Credentials || req.URL.Path == "/latest/api/token") && e.Response != nil && e.Response.Excerpt != "" {
+		e.Response.Excerpt = audit.Redacted
+		e.Response.ExcerptEncoding = ""
+		e.Response.ExcerptTruncated = false
+	}
+}
+
+// Record records ep through set, under the cloud_metadata attributes.
+func Record(set func(key string, value any), ep Endpoint) {
+	set("cloud_metadata.address", ep.Address)
+	if ep.Provider != "" {
+		set("cloud_metadata.provider", ep.Provider)
+	}
+	if ep.Credentials {
+		set("cloud_metadata.credentials", true)
+	}
+}
+
+// Detect reports whether a request to host (a name or address without a
+// port, brackets optional) for path, with header, is for a metadata service, and which.
+// Addresses are recognised in any form a resolver accepts, such as
+// decimal, hex or IPv4-mapped IPv6, as used to slip past host blocklists.
+// Host names resolving to a metadata address are not; the egress
+// block_private setting refuses those.
+func Detect(host, path string, header http.Header) (Endpoint, bool) {
+	ep := Endpoint{Address: strings.TrimSuffix(strings.ToLower(strings.Trim(host, "[]")), ".")}
+	if p, ok := names[ep.Address]; ok {
+		ep.Provider = p
+	} else if slices.Contains(googleAliases, ep.Address) {
+		if header.Get("Metadata-Flavor") != "Google" {
+			return Endpoint{}, false
+		}
+		ep.Provider = GCP
+	} else {
+		a, ok := parseAddr(ep.Address)
+		if !ok {
+			return Endpoint{}, false
+		}
+		ep.Address = a.String()
+		if a == shared {
+			ep.Provider = sharedProvider(path, header)
+		} else if ep.Provider, ok = addresses[a]; !ok {
+			return Endpoint{}, false
+		}
+	}
+	for _, re := range credentialPaths[ep.Provider] {
+		if re.MatchString(path) {
+			ep.Credentials = true
+		}
+	}
+	return ep, true
+}
+
+// sharedProvider tells which provider's service on the shared address a
+// request is for, from the headers each requires and the paths each
+// serves.
+func sharedProvider(path string, header http.Header) string {
+	switch {
+	case header.Get("Metadata-Flavor") == "Google", strings.HasPrefix(path, "/computeMetadata/"):
+		return GCP
+	case strings.EqualFold(header.Get("Metadata"), "true"), strings.HasPrefix(path, "/metadata/") && !strings.HasPrefix(path, "/metadata/v1"):
+		return Azure
+	case strings.HasPrefix(path, "/opc/"):
+		return Oracle
+	case strings.HasPrefix(path, "/metadata/v1"):
+		return DigitalOcean
+	case strings.HasPrefix(path, "/openstack"):
+		return OpenStack
+	case header.Get("X-Aws-Ec2-Metadata-Token") != "", header.Get("X-Aws-Ec2-Metadata-Token-Ttl-Seconds") != "",
+		strings.HasPrefix(path, "/latest/"):
+		return AWS
+	}
+	return ""
+}
+
+// parseAddr parses an IP address as a resolver would: IPv6, possibly with
+// a zone or an IPv4 address mapped into it, or IPv4 in the forms inet_aton
+// accepts, with one to four parts in decimal, octal (leading 0) or hex
+// (leading 0x).
+func parseAddr(s string) (netip.Addr, bool) {
+	if a, err := netip.ParseAddr(s); err == nil {
+		return a.WithZone("").Unmap(), true
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) > 4 {
+		return netip.Addr{}, false
+	}
+	var v uint64
+	for i, p := range parts {
+		n, ok := parsePart(p)
+		if !ok {
+			return netip.Addr{}, false
+		}
+		// The last part fills the bytes the others leave.
+		width := uint(8)
+		if i == len(parts)-1 {
+			width = uint(8 * (4 - i))
+		}
+		if n >= 1<<width {
+			return netip.Addr{}, false
+		}
+		v = v<<width | n
+	}
+	return netip.AddrFrom4([4]byte{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)}), true
+}
+
+// parsePart parses one part of an inet_aton address.
+func parsePart(p string) (uint64, bool) {
+	base := 10
+	switch {
+	case len(p) > 2 && (p[:2] == "0x" || p[:2] == "0X"):
+		p, base = p[2:], 16
+	case len(p) > 1 && p[0] == '0':
+		p, base = p[1:], 8
+	}
+	n, err := strconv.ParseUint(p, base, 32)
+	return n, err == nil
+}
+
+// host returns req's target host name, in lower case.
+func host(req *http.Request) string {
+	h := req.URL.Hostname()
+	if h == "" {
+		h = req.Host
+		if name, _, err := net.SplitHostPort(h); err == nil {
+			h = name
+		}
+	}
+	return strings.ToLower(strings.Trim(h, "[]"))
+}
@@ -0,0 +1,130 @@
+package cloudmetadata
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestParseAddr(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want string // "" if not an address
+	}{
+		{"169.254.169.254", "169.254.169.254"},
+		{"2852039166", "169.254.169.254"},
+		{"0xA9FEA9FE", "169.254.169.254"},
+		{"0xa9fea9fe", "169.254.169.254"},
+		{"0251.0376.0251.0376", "169.254.169.254"},
+		{"169.254.43518", "169.254.169.254"},
+		{"169.16689662", "169.254.169.254"},
+		{"0xa9.0xfe.0xa9.0xfe", "169.254.169.254"},
+		{"::ffff:169.254.169.254", "169.254.169.254"},
+		{"::ffff:a9fe:a9fe", "169.254.169.254"},
+		{"fd00:ec2::254", "fd00:ec2::254"},
+		{"fe80::1%eth0", "fe80::1"},
+		{"10", "0.0.0.10"},
+
+		// Near misses.
+		{"", ""},
+		{"example.com", ""},
+		{"1.2.3.4.5", ""},
+		{"169.254.169.256", ""},
+		{"169.254.65536", ""},
+		{"4294967296", ""},
+		{"08.1.1.1", ""}, // 8 is not an octal digit
+		{"0x", ""},
+		{"1..2", ""},
+		{"1_0.0.0.1", ""},
+		{"+1.0.0.1", ""},
+		{"0xg1.0.0.1", ""},
+	} {
+		a, ok := parseAddr(tt.in)
+		got := ""
+		if ok {
+			got = a.String()
+		}
+		if got != tt.want {
+			t.Errorf("parseAddr(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestDetect(t *testing.T) {
+	google := http.Header{"Metadata-Flavor": {"Google"}}
+	for _, tt := range []struct {
+		host   string
+		path   string
+		header http.Header
+		ok     bool
+		want   Endpoint
+	}{
+		{"169.254.169.254", "/latest/meta-data/iam/security-credentials/role", nil,
+			true, Endpoint{"169.254.169.254", AWS, true}},
+		{"2852039166", "/latest/meta-data/", nil,
+			true, Endpoint{"169.254.169.254", AWS, false}},
+		{"0xA9FEA9FE", "/", nil,
+			true, Endpoint{"169.254.169.254", "", false}},
+		{"fd00:ec2::254", "/latest/api/token", nil,
+			true, Endpoint{"fd00:ec2::254", AWS, false}},
+		{"[fd00:ec2::254]", "/latest/meta-data/", nil,
+			true, Endpoint{"fd00:ec2::254", AWS, false}},
+		{"169.254.170.2", "/v2/credentials/abc", nil,
+			true, Endpoint{"169.254.170.2", AWS, true}},
+		{"169.254.169.254", "/metadata/identity/oauth2/token", http.Header{"Metadata": {"true"}},
+			true, Endpoint{"169.254.169.254", Azure, true}},
+		{"169.254.169.254", "/metadata/v1/id", nil,
+			true, Endpoint{"169.254.169.254", DigitalOcean, false}},
+		{"169.254.169.254", "/opc/v2/identity/cert.pem", nil,
+			true, Endpoint{"169.254.169.254", Oracle, true}},
+
+		// GCP tokens, but not the account's other details.
+		{"metadata.google.internal", "/computeMetadata/v1/instance/service-accounts/default/token", google,
+			true, Endpoint{"metadata.google.internal", GCP, true}},
+		{"metadata.google.internal", "/computeMetadata/v1/instance/service-accounts/default/identity", google,
+			true, Endpoint{"metadata.google.internal", GCP, true}},
+		{"metadata.google.internal", "/computeMetadata/v1/instance/service-accounts/default/email", google,
+			true, Endpoint{"metadata.google.internal", GCP, false}},
+		{"metadata.google.internal", "/computeMetadata/v1/instance/service-accounts/default/scopes", google,
+			true, Endpoint{"metadata.google.internal", GCP, false}},
+		{"metadata.google.internal.", "/", nil,
+			true, Endpoint{"metadata.google.internal", GCP, false}},
+
+		// The bare aliases only with Google's header.
+		{"metadata", "/computeMetadata/v1/", google,
+			true, Endpoint{"metadata", GCP, false}},
+		{"metadata", "/", nil, false, Endpoint{}},
+		{"metadata.goog", "/", nil, false, Endpoint{}},
+
+		{"example.com", "/latest/meta-data/", nil, false, Endpoint{}},
+		{"169.254.169.253", "/", nil, false, Endpoint{}},
+		{"10.0.0.1", "/", nil, false, Endpoint{}},
+	} {
+		got, ok := Detect(tt.host, tt.path, tt.header)
+		if ok != tt.ok || got != tt.want {
+			t.Errorf("Detect(%q, %q) = %+v, %v, want %+v, %v", tt.host, tt.path, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestHost(t *testing.T) {
+	for _, tt := range []struct {
+		url, host string
+		want      string
+	}{
+		{"http://169.254.169.254/latest/", "", "169.254.169.254"},
+		{"http://[fd00:ec2::254]:80/latest/", "", "fd00:ec2::254"},
+		{"/latest/", "[fd00:ec2::254]", "fd00:ec2::254"},
+		{"/latest/", "[fd00:ec2::254]:80", "fd00:ec2::254"},
+		{"/latest/", "Metadata.Google.Internal:80", "metadata.google.internal"},
+	} {
+		u, err := url.Parse(tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := &http.Request{URL: u, Host: tt.host}
+		if got := host(req); got != tt.want {
+			t.Errorf("host(%q, %q) = %q, want %q", tt.url, tt.host, got, tt.want)
+		}
+	}
+}
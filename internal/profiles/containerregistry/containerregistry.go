@@ -0,0 +1,222 @@
+// Package containerregistry annotates traffic to container registries,
+// Docker Hub, GitHub Container Registry and Amazon ECR, with the image and
+// tag or digest pulled or pushed, read from the OCI distribution API.
+package containerregistry
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/kdhira/audit-proxy/internal/audit"
+)
+
+// Actions, as recorded in image.action.
+const (
+	Pull   = "pull"
+	Push   = "push"
+	Delete = "delete"
+	List   = "list"
+)
+
+// registries maps registry API hosts to the registry names images are
+// known by.
+var registries = map[string]string{
+	"registry-1.docker.io": "docker.io",
+	"auth.docker.io":       "docker.io",
+	"ghcr.io":              "ghcr.io",
+	"public.ecr.aws":       "public.ecr.aws",
+}
+
+// ecrHost matches the hosts of private ECR registries,
+// account.dkr.ecr.region.amazonaws.com.
+var ecrHost = regexp.MustCompile(`^[0-9]{12}\.dkr\.ecr(-fips)?\.[a-z0-9-]+\.amazonaws\.com(\.cn)?$`)
+
+// Request is what a registry request does.
+type Request struct {
+	Registry  string
+	Operation string
+	Action    string
+	Name      string // repository, e.g. library/nginx
+	Tag       string
+	Digest    string // manifest digest
+	Blob      string // blob digest
+}
+
+// Reference returns the image reference r names, e.g.
+// docker.io/library/nginx:1.27, or "" without a repository.
+func (r Request) Reference() string {
+	if r.Name == "" {
+		return ""
+	}
+	ref := r.Registry + "/" + r.Name
+	if r.Tag != "" {
+		ref += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		ref += "@" + r.Digest
+	}
+	return ref
+}
+
+// Profile is the container registry profile.
+type Profile struct{}
+
+// New returns the container registry profile.
+func New() *Profile { return &Profile{} }
+
+func (*Profile) Name() string { return "container_registry" }
+
+func (*Profile) Match(req *http.Request) bool {
+	return registry(host(req)) != ""
+}
+
+func (*Profile) Annotate(req *http.Request, e *audit.Entry) {
+	r := Parse(host(req), req.Method, req.URL)
+	if r.Operation == "" {
+		return
+	}
+	// A manifest pulled or pushed by tag is identified by the digest the
+	// registry reports.
+	if r.Digest == "" && r.Tag != "" && e.Response != nil && e.Response.Status < 300 {
+		r.Digest = e.Response.Headers.Get("Docker-Content-Digest")
+	}
+	e.Operation = r.Operation
+	e.SetAttribute("image.registry", r.Registry)
+	for _, a := range []struct{ key, value string }{
+		{"image.action", r.Action},
+		{"image.name", r.Name},
+		{"image.tag", r.Tag},
+		{"image.digest", r.Digest},
+		{"image.blob", r.Blob},
+		{"image.reference", r.Reference()},
+	} {
+		if a.value != "" {
+			e.SetAttribute(a.key, a.value)
+		}
+	}
+}
+
+// Parse returns what a request to a registry host does, with an empty
+// Operation if it is not recognised.
+func Parse(host, method string, u *url.URL) Request {
+	r := Request{Registry: registry(host)}
+	if r.Registry == "" {
+		return r
+	}
+	if u.Path == "/token" || host == "auth.docker.io" {
+		parseToken(&r, u.Query().Get("scope"))
+		return r
+	}
+	rest, ok := strings.CutPrefix(u.Path, "/v2/")
+	switch {
+	case u.Path == "/v2" || u.Path == "/v2/":
+		r.Operation = "oci.ping"
+		return r
+	case !ok:
+		return r
+	case rest == "_catalog":
+		r.Operation, r.Action = "oci.catalog", List
+		return r
+	}
+	// The repository name may have slashes of its own, so the path is
+	// read from its end.
+	for _, kind := range []string{"/manifests/", "/blobs/uploads", "/blobs/", "/tags/list", "/referrers/"} {
+		i := strings.LastIndex(rest, kind)
+		if i <= 0 {
+			continue
+		}
+		r.Name = rest[:i]
+		ref := strings.TrimPrefix(rest[i+len(kind):], "/")
+		switch kind {
+		case "/manifests/":
+			r.Operation, r.Action = manifestOperation(method)
+			if isDigest(ref) {
+				r.Digest = ref
+			} else {
+				r.Tag = ref
+			}
+		case "/blobs/uploads":
+			r.Operation, r.Action = "oci.blob.push", Push
+			// Uploads end with the digest, or mount it from another
+			// repository.
+			r.Blob = u.Query().Get("digest")
+			if r.Blob == "" {
+				r.Blob = u.Query().Get("mount")
+			}
+		case "/blobs/":
+			r.Operation, r.Action = "oci.blob.pull", Pull
+			if method == http.MethodDelete {
+				r.Operation, r.Action = "oci.blob.delete", Delete
+			}
+			r.Blob = ref
+		case "/tags/list":
+			r.Operation, r.Action = "oci.tags", List
+		case "/referrers/":
+			r.Operation, r.Action, r.Digest = "oci.referrers", List, ref
+		}
+		return r
+	}
+	return Request{Registry: r.Registry}
+}
+
+func manifestOperation(method string) (op, action string) {
+	switch method {
+	case http.MethodPut:
+		return "oci.manifest.push", Push
+	case http.MethodDelete:
+		return "oci.manifest.delete", Delete
+	}
+	return "oci.manifest.pull", Pull
+}
+
+// parseToken reads the scope of a token request,
+// repository:name:pull,push, for the repository and the access asked for.
+func parseToken(r *Request, scope string) {
+	r.Operation = "oci.token"
+	kind, rest, ok := strings.Cut(scope, ":")
+	if !ok || kind != "repository" {
+		return
+	}
+	i := strings.LastIndexByte(rest, ':')
+	if i < 0 {
+		return
+	}
+	r.Name = rest[:i]
+	if strings.Contains(rest[i+1:], Push) {
+		r.Action = Push
+	} else {
+		r.Action = Pull
+	}
+}
+
+// isDigest reports whether ref is a digest, algorithm:hex, rather than a
+// tag, which cannot hold a colon.
+func isDigest(ref string) bool {
+	return strings.Contains(ref, ":")
+}
+
+// registry returns the registry name of host, or "" if it is not a
+// registry the profile knows.
+func registry(host string) string {
+	if name, ok := registries[host]; ok {
+		return name
+	}
+	if ecrHost.MatchString(host) {
+		return host
+	}
+	return ""
+}
+
+// host returns req's target host name, in lower case.
+func host(req *http.Request) string {
+	h := req.URL.Hostname()
+	if h == "" {
+		h = req.Host
+		if name, _, ok := strings.Cut(h, ":"); ok {
+			h = name
+		}
+	}
+	return strings.ToLower(h)
+}
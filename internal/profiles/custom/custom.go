@@ -0,0 +1,129 @@
+// Package custom builds profiles from their definitions in config: the
+// hosts they match, the operations named by path and the headers recorded
+// or masked.
+package custom
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/kdhira/audit-proxy/internal/audit"
+	"github.com/kdhira/audit-proxy/internal/config"
+)
+
+// Profile is a profile defined in config.
+type Profile struct {
+	name       string
+	hosts      []string // lower case; *.suffix wildcards
+	operations []operation
+	capture    []string // canonical header names
+	mask       []string
+}
+
+type operation struct {
+	method string // upper case; "" for any
+	path   string
+	prefix bool // path ended in *
+	name   string
+}
+
+// New returns the profile cfg defines.
+func New(cfg config.CustomProfile) *Profile {
+	p := &Profile{name: cfg.Name}
+	for _, h := range cfg.Hosts {
+		p.hosts = append(p.hosts, strings.ToLower(h))
+	}
+	for _, op := range cfg.Operations {
+		o := operation{method: strings.ToUpper(op.Method), name: op.Name}
+		o.path, o.prefix = strings.CutSuffix(op.Path, "*")
+		p.operations = append(p.operations, o)
+	}
+	for _, h := range cfg.CaptureHeaders {
+		p.capture = append(p.capture, http.CanonicalHeaderKey(h))
+	}
+	for _, h := range cfg.MaskHeaders {
+		p.mask = append(p.mask, http.CanonicalHeaderKey(h))
+	}
+	return p
+}
+
+func (p *Profile) Name() string { return p.name }
+
+func (p *Profile) Match(req *http.Request) bool {
+	host := req.URL.Hostname()
+	if host == "" {
+		host = req.Host
+		if h, _, ok := strings.Cut(host, ":"); ok {
+			host = h
+		}
+	}
+	host = strings.ToLower(host)
+	for _, pat := range p.hosts {
+		if host == pat {
+			return true
+		}
+		if suffix, ok := strings.CutPrefix(pat, "*"); ok && strings.HasSuffix(host, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Profile) Annotate(req *http.Request, e *audit.Entry) {
+	if op := p.operation(req); op != "" {
+		e.Operation = op
+	}
+	for _, name := range p.capture {
+		v := req.Header.Values(name)
+		if len(v) == 0 && e.Response != nil {
+			v = e.Response.Headers.Values(name)
+		}
+		if len(v) == 0 {
+			continue
+		}
+		value := strings.Join(v, ", ")
+		if p.masks(name) {
+			value = audit.Redacted
+		}
+		e.SetAttribute(p.name+"."+strings.ToLower(name), value)
+	}
+	mask(e.Request.Headers, p.mask)
+	if e.Response != nil {
+		mask(e.Response.Headers, p.mask)
+	}
+}
+
+// operation returns the name of the first operation matching req, or "".
+func (p *Profile) operation(req *http.Request) string {
+	for _, op := range p.operations {
+		if op.method != "" && op.method != req.Method {
+			continue
+		}
+		if op.prefix && strings.HasPrefix(req.URL.Path, op.path) || !op.prefix && req.URL.Path == op.path {
+			return op.name
+		}
+	}
+	return ""
+}
+
+func (p *Profile) masks(name string) bool {
+	for _, m := range p.mask {
+		if m == name {
+			return true
+		}
+	}
+	return false
+}
+
+// mask replaces the values of names in h.
+func mask(h http.Header, names []string) {
+	for _, name := range names {
+		if vs, ok := h[name]; ok {
+			masked := make([]string, len(vs))
+			for i := range vs {
+				masked[i] = audit.Redacted
+			}
+			h[name] = masked
+		}
+	}
+}
@@ -0,0 +1,42 @@
+// Package generic is the fallback profile: it matches every request and
+// records protocol-level details only.
+package generic
+
+import (
+	"mime"
+	"net/http"
+
+	"github.com/kdhira/audit-proxy/internal/audit"
+)
+
+// Profile is the generic profile.
+type Profile struct{}
+
+// New returns the generic profile.
+func New() *Profile { return &Profile{} }
+
+func (*Profile) Name() string { return "generic" }
+
+func (*Profile) Match(*http.Request) bool { return true }
+
+// Fallback reports that the profile matches any request, so it is
+// evaluated after the specific ones.
+func (*Profile) Fallback() bool { return true }
+
+func (*Profile) Annotate(req *http.Request, e *audit.Entry) {
+	if e.Operation == "" && req.URL != nil {
+		e.Operation = req.Method + " " + req.URL.Path
+	}
+	if ct := req.Header.Get("Content-Type"); ct != "" {
+		if mt, _, err := mime.ParseMediaType(ct); err == nil {
+			e.SetAttribute("request_content_type", mt)
+		}
+	}
+	if e.Response != nil {
+		if ct := e.Response.Headers.Get("Content-Type"); ct != "" {
+			if mt, _, err := mime.ParseMediaType(ct); err == nil {
+				e.SetAttribute("response_content_type", mt)
+			}
+		}
+	}
+}
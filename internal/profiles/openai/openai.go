@@ -0,0 +1,165 @@
+// Package openai annotates traffic to the OpenAI API with the operation,
+// model and token usage.
+package openai
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/kdhira/audit-proxy/internal/audit"
+)
+
+// Host is the OpenAI API host.
+const Host = "api.openai.com"
+
+// operations maps path prefixes (below /v1) to operation names. Longer
+// prefixes must come first.
+var operations = []struct {
+	prefix string
+	name   string
+}{
+	{"/chat/completions", "chat.completions"},
+	{"/completions", "completions"},
+	{"/responses", "responses"},
+	{"/embeddings", "embeddings"},
+	{"/audio/transcriptions", "audio.transcriptions"},
+	{"/audio/translations", "audio.translations"},
+	{"/audio/speech", "audio.speech"},
+	{"/images/generations", "images.generations"},
+	{"/images/edits", "images.edits"},
+	{"/images/variations", "images.variations"},
+	{"/moderations", "moderations"},
+	{"/models", "models"},
+	{"/files", "files"},
+	{"/fine_tuning", "fine_tuning"},
+	{"/batches", "batches"},
+	{"/assistants", "assistants"},
+	{"/threads", "threads"},
+	{"/vector_stores", "vector_stores"},
+}
+
+// deprecations lists retired or deprecated endpoints (below /v1) with their
+// shutdown dates and replacements.
+var deprecations = []struct {
+	prefix string
+	name   string
+	sunset string
+	note   string
+}{
+	{"/engines", "engines", "", "use /v1/models"},
+	{"/edits", "edits", "2024-01-04", "use /v1/chat/completions"},
+	{"/fine-tunes", "fine-tunes", "2024-01-04", "use /v1/fine_tuning/jobs"},
+	{"/answers", "answers", "2022-12-03", "removed"},
+	{"/classifications", "classifications", "2022-12-03", "removed"},
+	{"/search", "search", "2022-12-03", "removed"},
+}
+
+// Profile is the OpenAI profile.
+type Profile struct{}
+
+// New returns the OpenAI profile.
+func New() *Profile { return &Profile{} }
+
+func (*Profile) Name() string { return "openai" }
+
+func (*Profile) Match(req *http.Request) bool {
+	host := req.URL.Hostname()
+	if host == "" {
+		host = req.Host
+		if h, _, ok := strings.Cut(host, ":"); ok {
+			host = h
+		}
+	}
+	return strings.EqualFold(host, Host)
+}
+
+func (*Profile) Annotate(req *http.Request, e *audit.Entry) {
+	e.Operation = Operation(req.URL.Path)
+	annotateDeprecation(req, e)
+	AnnotateBodies(e, "openai")
+}
+
+// AnnotateBodies records the model, streaming and token usage found in
+// the excerpts of e as attributes named under prefix, such as
+// prefix.model. Providers serving the OpenAI API elsewhere share it.
+func AnnotateBodies(e *audit.Entry, prefix string) {
+	var body struct {
+		Model  string `json:"model"`
+		Stream bool   `json:"stream"`
+	}
+	if e.Request.Excerpt != "" && json.Unmarshal([]byte(e.Request.Excerpt), &body) == nil {
+		if body.Model != "" {
+			e.SetAttribute(prefix+".model", body.Model)
+		}
+		if body.Stream {
+			e.SetAttribute(prefix+".stream", true)
+		}
+	}
+
+	if e.Response == nil || e.Response.Excerpt == "" {
+		return
+	}
+	var resp struct {
+		Model string `json:"model"`
+		Usage *struct {
+			PromptTokens     int `json:"prompt_tokens"`
+			CompletionTokens int `json:"completion_tokens"`
+			InputTokens      int `json:"input_tokens"`
+			OutputTokens     int `json:"output_tokens"`
+			TotalTokens      int `json:"total_tokens"`
+		} `json:"usage"`
+	}
+	if json.Unmarshal([]byte(e.Response.Excerpt), &resp) != nil {
+		return
+	}
+	if resp.Model != "" {
+		e.SetAttribute(prefix+".response_model", resp.Model)
+	}
+	if u := resp.Usage; u != nil {
+		e.SetAttribute(prefix+".input_tokens", u.PromptTokens+u.InputTokens)
+		e.SetAttribute(prefix+".output_tokens", u.CompletionTokens+u.OutputTokens)
+		e.SetAttribute(prefix+".total_tokens", u.TotalTokens)
+	}
+}
+
+// Operation returns the operation name for an API path, or "" if unknown.
+func Operation(path string) string {
+	rest, ok := strings.CutPrefix(path, "/v1")
+	if !ok {
+		return ""
+	}
+	for _, op := range operations {
+		if rest == op.prefix || strings.HasPrefix(rest, op.prefix+"/") {
+			return op.name
+		}
+	}
+	return ""
+}
+
+// annotateDeprecation tags requests to deprecated endpoints and to the v1
+// Assistants beta.
+func annotateDeprecation(req *http.Request, e *audit.Entry) {
+	rest, _ := strings.CutPrefix(req.URL.Path, "/v1")
+	for _, d := range deprecations {
+		if rest == d.prefix || strings.HasPrefix(rest, d.prefix+"/") {
+			if e.Operation == "" {
+				e.Operation = d.name
+			}
+			setDeprecated(e, d.sunset, d.note)
+			return
+		}
+	}
+	if strings.Contains(req.Header.Get("OpenAI-Beta"), "assistants=v1") {
+		setDeprecated(e, "2024-12-18", "use OpenAI-Beta: assistants=v2")
+	}
+}
+
+func setDeprecated(e *audit.Entry, sunset, note string) {
+	e.SetAttribute(audit.AttrDeprecated, true)
+	e.SetAttribute(audit.AttrDeprecationSource, "profile")
+	e.SetAttribute(audit.AttrDeprecationNote, note)
+	if sunset != "" {
+		e.SetAttribute(audit.AttrSunset, sunset)
+	}
+}
@@ -0,0 +1,293 @@
+// Package packageregistry annotates traffic to the npm, PyPI and Go module
+// registries with the package and version fetched or published, for
+// auditing the dependencies clients pull through the proxy.
+package packageregistry
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/kdhira/audit-proxy/internal/audit"
+)
+
+// Ecosystems, as recorded in package.ecosystem.
+const (
+	NPM  = "npm"
+	PyPI = "pypi"
+	Go   = "go"
+)
+
+// hosts maps the registry hosts to their ecosystems.
+var hosts = map[string]string{
+	"registry.npmjs.org":     NPM,
+	"registry.yarnpkg.com":   NPM,
+	"pypi.org":               PyPI,
+	"files.pythonhosted.org": PyPI,
+	"upload.pypi.org":        PyPI,
+	"proxy.golang.org":       Go,
+	"sum.golang.org":         Go,
+}
+
+// Package is what a request fetches or publishes. Version is empty for
+// requests about every version, such as package metadata.
+type Package struct {
+	Ecosystem string
+	Operation string
+	Name      string
+	Version   string
+}
+
+// Profile is the package registry profile.
+type Profile struct{}
+
+// New returns the package registry profile.
+func New() *Profile { return &Profile{} }
+
+func (*Profile) Name() string { return "package_registry" }
+
+func (*Profile) Match(req *http.Request) bool {
+	return hosts[host(req)] != ""
+}
+
+func (*Profile) Annotate(req *http.Request, e *audit.Entry) {
+	p := Parse(host(req), req.Method, req.URL)
+	if p.Operation == "" {
+		return
+	}
+	switch {
+	case p.Operation == "npm.publish" && p.Version == "":
+		p.Version = npmPublishedVersion(e.Request.Excerpt)
+	case p.Operation == "pypi.upload":
+		p.Name, p.Version = pypiUploadField(e.Request.Excerpt, "name"), pypiUploadField(e.Request.Excerpt, "version")
+		p.Name = normalisePyPI(p.Name)
+	}
+	e.Operation = p.Operation
+	e.SetAttribute("package.ecosystem", p.Ecosystem)
+	if p.Name != "" {
+		e.SetAttribute("package.name", p.Name)
+	}
+	if p.Version != "" {
+		e.SetAttribute("package.version", p.Version)
+	}
+}
+
+// Parse returns the package a request to a registry host fetches or
+// publishes, with an empty Operation if the request is not recognised.
+func Parse(host, method string, u *url.URL) Package {
+	p := Package{Ecosystem: hosts[host]}
+	switch p.Ecosystem {
+	case NPM:
+		parseNPM(&p, method, u)
+	case PyPI:
+		parsePyPI(&p, host, method, u.Path)
+	case Go:
+		parseGo(&p, host, u.Path)
+	}
+	return p
+}
+
+// parseNPM reads npm registry paths: /name (metadata, or publish with
+// PUT), /name/version, /name/-/name-version.tgz and /name/-rev/rev
+// (unpublish with DELETE, otherwise an update). Scoped names,
+// @scope/name, may have the slash escaped.
+func parseNPM(p *Package, method string, u *url.URL) {
+	rest := strings.TrimPrefix(u.EscapedPath(), "/")
+	if strings.HasPrefix(rest, "-/") {
+		switch {
+		case strings.HasPrefix(rest, "-/v1/search"):
+			p.Operation = "npm.search"
+		case strings.HasPrefix(rest, "-/npm/v1/security/"):
+			p.Operation = "npm.audit"
+		}
+		return
+	}
+	segs := strings.Split(rest, "/")
+	for i, s := range segs {
+		segs[i], _ = url.PathUnescape(s)
+	}
+	if strings.HasPrefix(segs[0], "@") && !strings.Contains(segs[0], "/") && len(segs) > 1 {
+		segs = append([]string{segs[0] + "/" + segs[1]}, segs[2:]...)
+	}
+	p.Name = segs[0]
+	if p.Name == "" {
+		return
+	}
+	switch {
+	case len(segs) == 1 && method == http.MethodPut:
+		p.Operation = "npm.publish"
+	case len(segs) == 1:
+		p.Operation = "npm.metadata"
+	case len(segs) == 2:
+		p.Operation, p.Version = "npm.metadata", segs[1]
+	case len(segs) >= 3 && segs[1] == "-" && strings.HasSuffix(segs[len(segs)-1], ".tgz"):
+		p.Operation = "npm.download"
+		// The tarball of @scope/name is name-version.tgz.
+		_, base, _ := strings.Cut(p.Name, "/")
+		if base == "" {
+			base = p.Name
+		}
+		p.Version = strings.TrimPrefix(strings.TrimSuffix(segs[len(segs)-1], ".tgz"), base+"-")
+	case segs[1] == "-rev" && method == http.MethodDelete:
+		p.Operation = "npm.unpublish"
+	case segs[1] == "-rev":
+		// Deprecating or removing versions rewrites the whole document.
+		p.Operation = "npm.update"
+	}
+}
+
+// npmDistTag matches the first dist-tag of a publish document, the version
+// published, where the excerpt is too short to parse whole.
+var npmDistTag = regexp.MustCompile(`"dist-tags"\s*:\s*\{\s*"[^"]*"\s*:\s*"([^"]+)"`)
+
+// npmPublishedVersion returns the version a publish document carries.
+func npmPublishedVersion(excerpt string) string {
+	var doc struct {
+		Versions map[string]json.RawMessage `json:"versions"`
+	}
+	if json.Unmarshal([]byte(excerpt), &doc) == nil && len(doc.Versions) == 1 {
+		for v := range doc.Versions {
+			return v
+		}
+	}
+	if m := npmDistTag.FindStringSubmatch(excerpt); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+// parsePyPI reads the simple index, /simple/project/, the JSON API,
+// /pypi/project[/version]/json, distribution files on
+// files.pythonhosted.org, and uploads to upload.pypi.org.
+func parsePyPI(p *Package, host, method, urlPath string) {
+	segs := strings.Split(strings.Trim(urlPath, "/"), "/")
+	switch host {
+	case "upload.pypi.org":
+		if method == http.MethodPost {
+			p.Operation = "pypi.upload"
+		}
+	case "files.pythonhosted.org":
+		if segs[0] == "packages" {
+			p.Operation = "pypi.download"
+			p.Name, p.Version = distribution(path.Base(urlPath))
+			p.Name = normalisePyPI(p.Name)
+		}
+	default:
+		switch {
+		case segs[0] == "simple" && len(segs) == 2:
+			p.Operation, p.Name = "pypi.index", normalisePyPI(segs[1])
+		case segs[0] == "pypi" && len(segs) == 3 && segs[2] == "json":
+			p.Operation, p.Name = "pypi.metadata", normalisePyPI(segs[1])
+		case segs[0] == "pypi" && len(segs) == 4 && segs[3] == "json":
+			p.Operation, p.Name, p.Version = "pypi.metadata", normalisePyPI(segs[1]), segs[2]
+		}
+	}
+}
+
+// distribution returns the project and version of a distribution file: a
+// wheel, name-version(-build)?-python-abi-platform.whl, or an sdist,
+// name-version.tar.gz or .zip.
+func distribution(file string) (name, version string) {
+	if stem, ok := strings.CutSuffix(file, ".whl"); ok {
+		parts := strings.Split(stem, "-")
+		if len(parts) < 5 {
+			return "", ""
+		}
+		return parts[0], parts[1]
+	}
+	for _, ext := range []string{".tar.gz", ".tar.bz2", ".zip", ".tgz"} {
+		if stem, ok := strings.CutSuffix(file, ext); ok {
+			if i := strings.LastIndexByte(stem, '-'); i > 0 {
+				return stem[:i], stem[i+1:]
+			}
+		}
+	}
+	return "", ""
+}
+
+var pypiSeparators = regexp.MustCompile(`[-_.]+`)
+
+// normalisePyPI returns the normalised form of a project name (PEP 503).
+func normalisePyPI(name string) string {
+	return pypiSeparators.ReplaceAllString(strings.ToLower(name), "-")
+}
+
+// pypiUploadField returns a field of the multipart form an upload sends.
+// The metadata fields come before the file, so they are in the excerpt.
+func pypiUploadField(excerpt, field string) string {
+	re := regexp.MustCompile(`name="` + regexp.QuoteMeta(field) + `"\r?\n\r?\n([^\r\n]*)`)
+	if m := re.FindStringSubmatch(excerpt); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+// parseGo reads the module proxy protocol, /module/@v/list,
+// /module/@v/version.info, .mod and .zip, and /module/@latest, and
+// checksum database lookups, /lookup/module@version.
+func parseGo(p *Package, host, urlPath string) {
+	if host == "sum.golang.org" {
+		if rest, ok := strings.CutPrefix(urlPath, "/lookup/"); ok {
+			mod, version, _ := strings.Cut(rest, "@")
+			p.Operation, p.Name, p.Version = "go.checksum", unescapeModule(mod), unescapeModule(version)
+		}
+		return
+	}
+	rest := strings.TrimPrefix(urlPath, "/")
+	if mod, ok := strings.CutSuffix(rest, "/@latest"); ok {
+		p.Operation, p.Name = "go.latest", unescapeModule(mod)
+		return
+	}
+	mod, file, ok := strings.Cut(rest, "/@v/")
+	if !ok {
+		return
+	}
+	p.Name = unescapeModule(mod)
+	if file == "list" {
+		p.Operation = "go.list"
+		return
+	}
+	for _, kind := range []struct{ ext, op string }{
+		{".info", "go.info"},
+		{".mod", "go.mod"},
+		{".zip", "go.download"},
+	} {
+		if v, ok := strings.CutSuffix(file, kind.ext); ok {
+			p.Operation, p.Version = kind.op, unescapeModule(v)
+			return
+		}
+	}
+}
+
+// unescapeModule undoes the case encoding of module paths and versions,
+// in which an upper-case letter is written as ! and its lower case.
+func unescapeModule(s string) string {
+	if !strings.Contains(s, "!") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '!' && i+1 < len(s) {
+			i++
+			b.WriteString(strings.ToUpper(s[i : i+1]))
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// host returns req's target host name, in lower case.
+func host(req *http.Request) string {
+	h := req.URL.Hostname()
+	if h == "" {
+		h = req.Host
+		if name, _, ok := strings.Cut(h, ":"); ok {
+			h = name
+		}
+	}
+	return strings.ToLower(h)
+}
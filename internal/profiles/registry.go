@@ -0,0 +1,184 @@
+// Package profiles matches proxied requests to API-specific profiles that
+// annotate audit entries with domain knowledge (operation names, models and
+// so on).
+package profiles
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/kdhira/audit-proxy/internal/audit"
+	"github.com/kdhira/audit-proxy/internal/config"
+	"github.com/kdhira/audit-proxy/internal/profiles/azureopenai"
+	"github.com/kdhira/audit-proxy/internal/profiles/cloudmetadata"
+	"github.com/kdhira/audit-proxy/internal/profiles/containerregistry"
+	"github.com/kdhira/audit-proxy/internal/profiles/custom"
+	"github.com/kdhira/audit-proxy/internal/profiles/generic"
+	"github.com/kdhira/audit-proxy/internal/profiles/openai"
+	"github.com/kdhira/audit-proxy/internal/profiles/packageregistry"
+)
+
+// Profile recognises requests for one API and annotates their entries.
+type Profile interface {
+	Name() string
+	Match(req *http.Request) bool
+	// Annotate is called once the exchange has completed, with the entry's
+	// request and response metadata (and excerpts, if enabled) filled in.
+	Annotate(req *http.Request, e *audit.Entry)
+}
+
+// fallback is implemented by profiles that match any request, which are
+// evaluated after the others unless ordered explicitly.
+type fallback interface {
+	Fallback() bool
+}
+
+// constructors maps profile names accepted in config to implementations.
+var constructors = map[string]func() Profile{
+	"azure_openai":       func() Profile { return azureopenai.New() },
+	"cloud_metadata":     func() Profile { return cloudmetadata.New() },
+	"container_registry": func() Profile { return containerregistry.New() },
+	"generic":            func() Profile { return generic.New() },
+	"openai":             func() Profile { return openai.New() },
+	"package_registry":   func() Profile { return packageregistry.New() },
+}
+
+// Registry is an ordered list of profiles. The first match wins, and
+// unless the registry annotates with every match, is the only one applied.
+type Registry struct {
+	profiles []Profile
+	all      bool
+}
+
+// NewRegistry returns a registry evaluating profiles in the given order.
+func NewRegistry(p ...Profile) *Registry {
+	return &Registry{profiles: p}
+}
+
+// Options order the profiles of a registry built by FromNames.
+type Options struct {
+	// Order lists the profiles evaluated first, in this order.
+	Order []string
+	// All has every matching profile annotate entries, not only the
+	// first.
+	All bool
+	// Custom defines profiles in config. They are enabled without being
+	// named, ahead of the named profiles.
+	Custom []config.CustomProfile
+}
+
+// FromNames builds a registry from profile names. Profiles are evaluated
+// in opts.Order, then custom profiles not named, then in the order named,
+// fallback profiles last.
+func FromNames(names []string, opts Options) (*Registry, error) {
+	defined := map[string]Profile{}
+	var unnamed []string
+	for _, def := range opts.Custom {
+		if _, ok := constructors[def.Name]; ok {
+			return nil, fmt.Errorf("custom profile %q has the name of a built-in profile", def.Name)
+		}
+		defined[def.Name] = custom.New(def)
+		if !slices.Contains(names, def.Name) {
+			unnamed = append(unnamed, def.Name)
+		}
+	}
+	lookup := func(name string) (Profile, error) {
+		if p, ok := defined[name]; ok {
+			return p, nil
+		}
+		mk, ok := constructors[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown profile %q", name)
+		}
+		return mk(), nil
+	}
+
+	r := &Registry{all: opts.All}
+	var fallbacks []Profile
+	for _, name := range slices.Concat(unnamed, names) {
+		p, err := lookup(name)
+		if err != nil {
+			return nil, err
+		}
+		if slices.Contains(opts.Order, name) {
+			continue
+		}
+		if f, ok := p.(fallback); ok && f.Fallback() {
+			fallbacks = append(fallbacks, p)
+			continue
+		}
+		r.profiles = append(r.profiles, p)
+	}
+	var first []Profile
+	for _, name := range opts.Order {
+		p, err := lookup(name)
+		if err != nil {
+			return nil, err
+		}
+		first = append(first, p)
+	}
+	r.profiles = slices.Concat(first, r.profiles, fallbacks)
+	return r, nil
+}
+
+// Names returns the names of r's profiles in evaluation order.
+func (r *Registry) Names() []string {
+	var names []string
+	for _, p := range r.profiles {
+		names = append(names, p.Name())
+	}
+	return names
+}
+
+// Get returns the profile named name, or nil if r has none.
+func (r *Registry) Get(name string) Profile {
+	if r == nil {
+		return nil
+	}
+	for _, p := range r.profiles {
+		if p.Name() == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// Match returns the first profile matching req, or nil.
+func (r *Registry) Match(req *http.Request) Profile {
+	if r == nil {
+		return nil
+	}
+	for _, p := range r.profiles {
+		if p.Match(req) {
+			return p
+		}
+	}
+	return nil
+}
+
+// Annotate applies the matching profile, if any, to e, recording it as
+// e's profile. A registry annotating with every match applies them all in
+// order and records the first, listing them all in the attribute
+// profiles if there are several.
+func (r *Registry) Annotate(req *http.Request, e *audit.Entry) {
+	p := r.Match(req)
+	if p == nil {
+		return
+	}
+	e.Profile = p.Name()
+	if !r.all {
+		p.Annotate(req, e)
+		return
+	}
+	var matched []string
+	for _, p := range r.profiles {
+		if p.Match(req) {
+			matched = append(matched, p.Name())
+			p.Annotate(req, e)
+		}
+	}
+	if len(matched) > 1 {
+		e.SetAttribute("profiles", matched)
+	}
+}
@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenFDsStart is the first file descriptor passed by socket activation.
+const listenFDsStart = 3
+
+// inheritedListeners returns the listening sockets passed to the process
+// under the systemd socket activation protocol (LISTEN_PID and LISTEN_FDS),
+// as systemd does and a parent handing over sockets for a zero-downtime
+// restart can. It returns nil when none were passed, and unsets the
+// variables so child processes do not claim the sockets too.
+func inheritedListeners() ([]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	var lns []net.Listener
+	for i := range n {
+		name := "LISTEN_FD_" + strconv.Itoa(listenFDsStart+i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(listenFDsStart+i), name)
+		ln, err := net.FileListener(f)
+		f.Close() // FileListener holds its own copy
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return nil, fmt.Errorf("inherited socket %s: %w", name, err)
+		}
+		slog.Info("proxy listener", "inherited", name, "addr", ln.Addr().String())
+		lns = append(lns, ln)
+	}
+	return lns, nil
+}
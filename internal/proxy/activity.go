@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"cmp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kdhira/audit-proxy/internal/audit"
+)
+
+// Limits on what the activity tracker keeps.
+const (
+	maxActivityHosts = 1000
+	recentBlocks     = 20
+)
+
+// otherHosts collects the traffic of hosts beyond maxActivityHosts.
+const otherHosts = "(other)"
+
+// Activity is a snapshot of the proxy's traffic since it started, served by
+// the admin API for live views such as "audit-proxy top".
+type Activity struct {
+	Time         time.Time        `json:"time"`
+	Requests     int64            `json:"requests"`
+	Blocked      int64            `json:"blocked"`
+	InputTokens  int64            `json:"input_tokens"`
+	OutputTokens int64            `json:"output_tokens"`
+	Hosts        []HostActivity   `json:"hosts"`
+	Tunnels      []TunnelActivity `json:"tunnels"`
+	RecentBlocks []BlockActivity  `json:"recent_blocks"`
+	Filters      []FilterActivity `json:"filters"`
+}
+
+// HostActivity is the traffic to one upstream host.
+type HostActivity struct {
+	Host         string `json:"host"`
+	Requests     int64  `json:"requests"`
+	Blocked      int64  `json:"blocked"`
+	InputTokens  int64  `json:"input_tokens"`
+	OutputTokens int64  `json:"output_tokens"`
+}
+
+// TunnelActivity is an open CONNECT tunnel.
+type TunnelActivity struct {
+	ID     string    `json:"id"`
+	Client string    `json:"client"`
+	User   string    `json:"user,omitempty"`
+	Target string    `json:"target"`
+	MITM   bool      `json:"mitm,omitempty"`
+	Since  time.Time `json:"since"`
+}
+
+// BlockActivity is a recently denied or blocked request.
+type BlockActivity struct {
+	Time   time.Time `json:"time"`
+	ID     string    `json:"id"`
+	Client string    `json:"client"`
+	User   string    `json:"user,omitempty"`
+	Host   string    `json:"host"`
+	Filter string    `json:"filter,omitempty"`
+	Reason string    `json:"reason"`
+}
+
+// activity tracks the traffic summarised by Activity.
+type activity struct {
+	mu      sync.Mutex
+	totals  HostActivity
+	hosts   map[string]*HostActivity
+	tunnels map[string]TunnelActivity
+	blocks  []BlockActivity // oldest first
+}
+
+func newActivity() *activity {
+	return &activity{hosts: map[string]*HostActivity{}, tunnels: map[string]TunnelActivity{}}
+}
+
+// record counts a finished exchange.
+func (a *activity) record(e *audit.Entry) {
+	in, out := entryTokens(e)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	host := e.Request.Host
+	hs, ok := a.hosts[host]
+	if !ok {
+		if len(a.hosts) >= maxActivityHosts {
+			host = otherHosts
+		}
+		if hs, ok = a.hosts[host]; !ok {
+			hs = &HostActivity{Host: host}
+			a.hosts[host] = hs
+		}
+	}
+	for _, s := range []*HostActivity{&a.totals, hs} {
+		s.Requests++
+		s.InputTokens += in
+		s.OutputTokens += out
+		if e.Blocked {
+			s.Blocked++
+		}
+	}
+	if e.Blocked {
+		if len(a.blocks) == recentBlocks {
+			a.blocks = slices.Delete(a.blocks, 0, 1)
+		}
+		a.blocks = append(a.blocks, BlockActivity{
+			Time:   e.Time,
+			ID:     e.ID,
+			Client: e.Conn.ClientAddr,
+			User:   e.Conn.User,
+			Host:   e.Request.Host,
+			Filter: e.Filter,
+			Reason: e.Reason,
+		})
+	}
+}
+
+// tunnel registers x as an open tunnel until the returned function is
+// called.
+func (a *activity) tunnel(x *exchange, mitm bool) func() {
+	t := TunnelActivity{
+		ID:     x.entry.ID,
+		Client: x.entry.Conn.ClientAddr,
+		User:   x.entry.Conn.User,
+		Target: x.entry.Conn.Target,
+		MITM:   mitm,
+		Since:  time.Now(),
+	}
+	a.mu.Lock()
+	a.tunnels[t.ID] = t
+	a.mu.Unlock()
+	return func() {
+		a.mu.Lock()
+		delete(a.tunnels, t.ID)
+		a.mu.Unlock()
+	}
+}
+
+// snapshot returns the current activity, hosts busiest first and tunnels
+// oldest first.
+func (a *activity) snapshot() Activity {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	s := Activity{
+		Time:         time.Now(),
+		Requests:     a.totals.Requests,
+		Blocked:      a.totals.Blocked,
+		InputTokens:  a.totals.InputTokens,
+		OutputTokens: a.totals.OutputTokens,
+		Hosts:        make([]HostActivity, 0, len(a.hosts)),
+		Tunnels:      make([]TunnelActivity, 0, len(a.tunnels)),
+		RecentBlocks: slices.Clone(a.blocks),
+	}
+	for _, h := range a.hosts {
+		s.Hosts = append(s.Hosts, *h)
+	}
+	slices.SortFunc(s.Hosts, func(a, b HostActivity) int {
+		return cmp.Or(cmp.Compare(b.Requests, a.Requests), strings.Compare(a.Host, b.Host))
+	})
+	for _, t := range a.tunnels {
+		s.Tunnels = append(s.Tunnels, t)
+	}
+	slices.SortFunc(s.Tunnels, func(a, b TunnelActivity) int { return a.Since.Compare(b.Since) })
+	return s
+}
+
+// entryTokens sums the token counts profiles recorded on e, from attributes
+// named <profile>.input_tokens and <profile>.output_tokens.
+func entryTokens(e *audit.Entry) (in, out int64) {
+	for k, v := range e.Attributes {
+		n, ok := v.(int)
+		if !ok {
+			continue
+		}
+		switch {
+		case strings.HasSuffix(k, ".input_tokens"):
+			in += int64(n)
+		case strings.HasSuffix(k, ".output_tokens"):
+			out += int64(n)
+		}
+	}
+	return in, out
+}
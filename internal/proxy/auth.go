@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/kdhira/audit-proxy/internal/config"
+)
+
+// identity is the authenticated client of a request.
+type identity struct {
+	user   string
+	method string
+}
+
+type identityKey struct{}
+
+func withIdentity(ctx context.Context, id identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+func identityFrom(ctx context.Context) identity {
+	id, _ := ctx.Value(identityKey{}).(identity)
+	return id
+}
+
+// authenticator verifies Proxy-Authorization against configured Basic users
+// and Bearer tokens. Secrets are held as SHA-256 digests and compared in
+// constant time.
+type authenticator struct {
+	realm  string
+	users  map[string][]byte
+	tokens []namedDigest
+}
+
+type namedDigest struct {
+	name   string
+	digest []byte
+}
+
+func newAuthenticator(cfg config.ProxyAuthConfig) (*authenticator, error) {
+	a := &authenticator{realm: cfg.Realm, users: map[string][]byte{}}
+	if a.realm == "" {
+		a.realm = "audit-proxy"
+	}
+	for _, u := range cfg.Users {
+		d, err := digestOf(u.Password, u.PasswordSHA256)
+		if err != nil {
+			return nil, fmt.Errorf("proxy_auth user %q: %w", u.Username, err)
+		}
+		a.users[u.Username] = d
+	}
+	for _, t := range cfg.Tokens {
+		d, err := digestOf(t.Token, t.TokenSHA256)
+		if err != nil {
+			return nil, fmt.Errorf("proxy_auth token %q: %w", t.Name, err)
+		}
+		a.tokens = append(a.tokens, namedDigest{name: t.Name, digest: d})
+	}
+	return a, nil
+}
+
+func digestOf(plain, hexDigest string) ([]byte, error) {
+	if plain != "" {
+		sum := sha256.Sum256([]byte(plain))
+		return sum[:], nil
+	}
+	d, err := hex.DecodeString(hexDigest)
+	if err != nil || len(d) != sha256.Size {
+		return nil, fmt.Errorf("invalid SHA-256 digest")
+	}
+	return d, nil
+}
+
+// authenticate returns the identity presented in r's Proxy-Authorization
+// header, or false if it is missing or invalid.
+func (a *authenticator) authenticate(r *http.Request) (identity, bool) {
+	scheme, cred, ok := strings.Cut(r.Header.Get("Proxy-Authorization"), " ")
+	if !ok {
+		return identity{}, false
+	}
+	cred = strings.TrimSpace(cred)
+	switch strings.ToLower(scheme) {
+	case "basic":
+		raw, err := base64.StdEncoding.DecodeString(cred)
+		if err != nil {
+			return identity{}, false
+		}
+		user, pass, ok := strings.Cut(string(raw), ":")
+		if !ok {
+			return identity{}, false
+		}
+		want, known := a.users[user]
+		sum := sha256.Sum256([]byte(pass))
+		if !known || subtle.ConstantTimeCompare(sum[:], want) != 1 {
+			return identity{}, false
+		}
+		return identity{user: user, method: "basic"}, true
+	case "bearer":
+		sum := sha256.Sum256([]byte(cred))
+		for _, t := range a.tokens {
+			if subtle.ConstantTimeCompare(sum[:], t.digest) == 1 {
+				return identity{user: t.name, method: "bearer"}, true
+			}
+		}
+	}
+	return identity{}, false
+}
+
+// challenge writes a 407 response asking for credentials.
+func (a *authenticator) challenge(w http.ResponseWriter) {
+	if len(a.users) > 0 {
+		w.Header().Add("Proxy-Authenticate", fmt.Sprintf("Basic realm=%q", a.realm))
+	}
+	if len(a.tokens) > 0 {
+		w.Header().Add("Proxy-Authenticate", fmt.Sprintf("Bearer realm=%q", a.realm))
+	}
+	writeJSON(w, http.StatusProxyAuthRequired, errorBody{Error: "proxy authentication required"})
+}
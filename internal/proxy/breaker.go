@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/kdhira/audit-proxy/internal/config"
+	"github.com/kdhira/audit-proxy/internal/metrics"
+)
+
+// breakerBuckets is the number of slices the error-rate window is kept in.
+const breakerBuckets = 10
+
+// maxBreakers bounds the number of hosts tracked.
+const maxBreakers = 10000
+
+// breakerOpenError is returned instead of contacting a host whose breaker is
+// open.
+type breakerOpenError struct{ host string }
+
+func (e *breakerOpenError) Error() string {
+	return fmt.Sprintf("circuit breaker open for %s", e.host)
+}
+
+// breakers holds a circuit breaker per upstream host (host:port).
+type breakers struct {
+	hosts       hostList // nil for all hosts
+	errorRate   float64
+	minRequests int
+	bucket      time.Duration
+	openFor     time.Duration
+	open        *metrics.GaugeVec
+
+	mu sync.Mutex
+	m  map[string]*breaker
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen // a trial request is in flight
+)
+
+type breaker struct {
+	state    breakerState
+	openedAt time.Time
+	counts   [breakerBuckets]breakerBucket
+}
+
+// breakerBucket counts the outcomes in one slice of the window.
+type breakerBucket struct {
+	n             int64 // slice number since the epoch
+	total, failed int
+}
+
+func newBreakers(cfg config.CircuitBreakerConfig, reg *metrics.Registry) (*breakers, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	b := &breakers{
+		errorRate:   cfg.ErrorRate,
+		minRequests: cfg.MinRequests,
+		bucket:      cfg.Window / breakerBuckets,
+		openFor:     cfg.OpenFor,
+		open: reg.Gauge("auditproxy_circuit_open",
+			"Whether the circuit breaker for an upstream host is open (1) or not (0).", "host"),
+		m: map[string]*breaker{},
+	}
+	if len(cfg.Hosts) > 0 {
+		hosts, err := compileHosts(cfg.Hosts)
+		if err != nil {
+			return nil, fmt.Errorf("circuit_breaker: %w", err)
+		}
+		b.hosts = hosts
+	}
+	if b.errorRate == 0 {
+		b.errorRate = 0.5
+	}
+	if b.minRequests == 0 {
+		b.minRequests = 20
+	}
+	if b.bucket == 0 {
+		b.bucket = 30 * time.Second / breakerBuckets
+	}
+	if b.openFor == 0 {
+		b.openFor = 30 * time.Second
+	}
+	return b, nil
+}
+
+// allow reports whether a request to hostport may proceed. If it may, the
+// returned function must be called with the outcome.
+func (b *breakers) allow(hostport, defaultPort string, now time.Time) (func(failed bool), error) {
+	if b == nil || (b.hosts != nil && !b.hosts.match(hostport, defaultPort)) {
+		return func(bool) {}, nil
+	}
+	if _, _, err := net.SplitHostPort(hostport); err != nil {
+		hostport = net.JoinHostPort(hostname(hostport), defaultPort)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	br, ok := b.m[hostport]
+	if !ok {
+		if len(b.m) >= maxBreakers {
+			b.prune()
+		}
+		br = &breaker{}
+		b.m[hostport] = br
+	}
+	trial := false
+	switch br.state {
+	case breakerHalfOpen:
+		return nil, &breakerOpenError{host: hostport}
+	case breakerOpen:
+		if now.Sub(br.openedAt) < b.openFor {
+			return nil, &breakerOpenError{host: hostport}
+		}
+		br.state, trial = breakerHalfOpen, true
+	}
+	return func(failed bool) { b.record(hostport, br, trial, failed, time.Now()) }, nil
+}
+
+func (b *breakers) record(hostport string, br *breaker, trial, failed bool, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if trial {
+		if failed {
+			br.state, br.openedAt = breakerOpen, now
+			slog.Warn("circuit breaker trial failed", "host", hostport)
+			return
+		}
+		br.state = breakerClosed
+		br.counts = [breakerBuckets]breakerBucket{}
+		b.open.With(hostport).Set(0)
+		slog.Info("circuit breaker closed", "host", hostport)
+		return
+	}
+	if br.state != breakerClosed {
+		return // a request admitted before the breaker opened
+	}
+	n := now.UnixNano() / int64(b.bucket)
+	c := &br.counts[n%breakerBuckets]
+	if c.n != n {
+		*c = breakerBucket{n: n}
+	}
+	c.total++
+	if !failed {
+		return
+	}
+	c.failed++
+	total, bad := 0, 0
+	for _, c := range br.counts {
+		if n-c.n < breakerBuckets {
+			total += c.total
+			bad += c.failed
+		}
+	}
+	if total >= b.minRequests && float64(bad) >= b.errorRate*float64(total) {
+		br.state, br.openedAt = breakerOpen, now
+		b.open.With(hostport).Set(1)
+		slog.Warn("circuit breaker opened", "host", hostport, "requests", total, "failed", bad)
+	}
+}
+
+// prune forgets closed breakers. The caller holds b.mu.
+func (b *breakers) prune() {
+	for h, br := range b.m {
+		if br.state == breakerClosed {
+			delete(b.m, h)
+		}
+	}
+}
+
+// breakerFailure reports whether an upstream outcome counts against its
+// host's breaker.
+func breakerFailure(resp *http.Response, err error) bool {
+	return err != nil || resp.StatusCode >= 500
+}
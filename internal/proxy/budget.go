@@ -0,0 +1,380 @@
+package proxy
+
+import (
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kdhira/audit-proxy/internal/audit"
+	"github.com/kdhira/audit-proxy/internal/config"
+)
+
+// maxUsageBody bounds the part of a JSON response kept to read its usage
+// from; usage in larger responses is not counted.
+const maxUsageBody = 4 << 20
+
+// budgets enforces the budget rules: a daily cost ceiling per client or
+// API key, priced from the token usage LLM responses report.
+type budgets struct {
+	prices []config.ModelPrice
+	rules  []*budgetRule
+	file   string
+
+	mu    sync.Mutex
+	spend map[string]map[string]*budgetSpend // by rule, then client or key
+	dirty bool
+}
+
+type budgetRule struct {
+	name    string
+	users   []string
+	clients []string
+	hosts   hostList
+	byKey   bool
+	limit   float64
+	loc     *time.Location
+}
+
+// budgetSpend is what a client or key has spent under a rule on Day.
+type budgetSpend struct {
+	Day          string  `json:"day"` // YYYY-MM-DD in the rule's time zone
+	Cost         float64 `json:"cost"`
+	InputTokens  int64   `json:"input_tokens"`
+	OutputTokens int64   `json:"output_tokens"`
+	Requests     int64   `json:"requests"`
+}
+
+// budgetCharge is a budget an admitted request is to be charged to once
+// its usage is known.
+type budgetCharge struct {
+	rule *budgetRule
+	key  string
+}
+
+// budgetState is the state file.
+type budgetState struct {
+	Rules map[string]map[string]*budgetSpend `json:"rules"`
+}
+
+// newBudgets compiles cfg, reading the day's totals from its state file.
+// It returns nil without rules.
+func newBudgets(cfg config.BudgetsConfig) (*budgets, error) {
+	if len(cfg.Rules) == 0 {
+		return nil, nil
+	}
+	b := &budgets{prices: cfg.Prices, file: cfg.StateFile, spend: map[string]map[string]*budgetSpend{}}
+	for _, rc := range cfg.Rules {
+		hosts, err := compileHosts(rc.Hosts)
+		if err != nil {
+			return nil, fmt.Errorf("budget %s: hosts: %w", rc.Name, err)
+		}
+		r := &budgetRule{
+			name:    rc.Name,
+			users:   rc.Users,
+			clients: rc.Clients,
+			hosts:   hosts,
+			byKey:   rc.By == "api_key",
+			limit:   rc.DailyCost,
+			loc:     time.Local,
+		}
+		if rc.Timezone != "" {
+			if r.loc, err = time.LoadLocation(rc.Timezone); err != nil {
+				return nil, fmt.Errorf("budget %s: %w", rc.Name, err)
+			}
+		}
+		b.rules = append(b.rules, r)
+		b.spend[r.name] = map[string]*budgetSpend{}
+	}
+	if err := b.load(); err != nil {
+		return nil, fmt.Errorf("budgets.state_file: %w", err)
+	}
+	return b, nil
+}
+
+// selects reports whether r applies to x.
+func (r *budgetRule) selects(x *exchange) bool {
+	if len(r.users) > 0 || len(r.clients) > 0 {
+		if !slices.Contains(r.users, x.entry.Conn.User) && !slices.Contains(r.clients, x.entry.Conn.Client) {
+			return false
+		}
+	}
+	return len(r.hosts) == 0 || r.hosts.match(x.req.URL.Host, defaultPort(x.req.URL.Scheme))
+}
+
+// key returns what x's spend is totalled by under r: a hash of its API key
+// if r is by api_key and it carries one, else its client.
+func (r *budgetRule) key(x *exchange) string {
+	if r.byKey {
+		if k := apiKey(x.req.Header); k != "" {
+			sum := sha256.Sum256([]byte(k))
+			return "key:" + hex.EncodeToString(sum[:8])
+		}
+	}
+	return clientKey(x)
+}
+
+// apiKey returns the API key h carries in the headers LLM APIs take one
+// in, or "".
+func apiKey(h http.Header) string {
+	if v, ok := strings.CutPrefix(h.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(v)
+	}
+	return cmp.Or(h.Get("X-Api-Key"), h.Get("Api-Key"))
+}
+
+func (r *budgetRule) day(now time.Time) string {
+	return now.In(r.loc).Format(time.DateOnly)
+}
+
+// admit checks x against the budgets that select it, refusing it with 429
+// once one is spent. The day's spend under each is recorded as
+// budget.<rule>.spent, and the budget refusing x as budget.rule.
+func (b *budgets) admit(x *exchange) (int, string) {
+	if b == nil {
+		return 0, ""
+	}
+	now := time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, r := range b.rules {
+		if !r.selects(x) {
+			continue
+		}
+		key := r.key(x)
+		if r.byKey && strings.HasPrefix(key, "key:") {
+			x.attrs.Set("budget.key", strings.TrimPrefix(key, "key:"))
+		}
+		s := b.spendOf(r, key, now)
+		x.attrs.Set("budget."+r.name+".spent", roundCost(s.Cost))
+		if s.Cost >= r.limit {
+			x.attrs.Set("budget.rule", r.name)
+			return http.StatusTooManyRequests, fmt.Sprintf("daily budget %s exhausted", r.name)
+		}
+		x.budgets = append(x.budgets, budgetCharge{r, key})
+	}
+	return 0, ""
+}
+
+// charge prices the usage x's response reported and adds it to the
+// budgets x was admitted under, recording the model, tokens and cost as
+// attributes and each budget's new total as budget.<rule>.spent.
+func (b *budgets) charge(x *exchange) {
+	if b == nil || len(x.budgets) == 0 || x.usage == nil {
+		return
+	}
+	model, in, out, ok := x.usage.usage(x.entry.Response)
+	if !ok {
+		x.attrs.Set("budget.unmetered", true)
+		return
+	}
+	cost, priced := b.price(model, in, out)
+	if model != "" {
+		x.attrs.Set("budget.model", model)
+	}
+	x.attrs.Set("budget.tokens_in", in)
+	x.attrs.Set("budget.tokens_out", out)
+	x.attrs.Set("budget.cost", roundCost(cost))
+	if !priced {
+		x.attrs.Set("budget.unpriced", true)
+	}
+	now := time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, ch := range x.budgets {
+		s := b.spendOf(ch.rule, ch.key, now)
+		s.Cost += cost
+		s.InputTokens += int64(in)
+		s.OutputTokens += int64(out)
+		s.Requests++
+		x.attrs.Set("budget."+ch.rule.name+".spent", roundCost(s.Cost))
+	}
+	b.dirty = true
+}
+
+// price returns what in input and out output tokens of model cost, and
+// whether a price matched it.
+func (b *budgets) price(model string, in, out int) (float64, bool) {
+	for _, p := range b.prices {
+		if ok, _ := path.Match(p.Model, model); ok {
+			return (float64(in)*p.Input + float64(out)*p.Output) / 1e6, true
+		}
+	}
+	return 0, false
+}
+
+// spendOf returns the spend of key under r today, starting it afresh on
+// a new day. b.mu is held.
+func (b *budgets) spendOf(r *budgetRule, key string, now time.Time) *budgetSpend {
+	day := r.day(now)
+	s := b.spend[r.name][key]
+	if s == nil || s.Day != day {
+		s = &budgetSpend{Day: day}
+		b.spend[r.name][key] = s
+	}
+	return s
+}
+
+// roundCost rounds a cost to a millionth of a dollar for entries.
+func roundCost(c float64) float64 {
+	return math.Round(c*1e6) / 1e6
+}
+
+// load reads the totals from the state file. A missing file is no error.
+func (b *budgets) load() error {
+	if b.file == "" {
+		return nil
+	}
+	data, err := os.ReadFile(b.file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var st budgetState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return fmt.Errorf("%s: %w", b.file, err)
+	}
+	for _, r := range b.rules {
+		if spend := st.Rules[r.name]; spend != nil {
+			b.spend[r.name] = spend
+		}
+	}
+	return nil
+}
+
+// save writes the totals to the state file if they changed since the last
+// save. Totals of days gone are dropped.
+func (b *budgets) save() error {
+	if b == nil || b.file == "" {
+		return nil
+	}
+	b.mu.Lock()
+	if !b.dirty {
+		b.mu.Unlock()
+		return nil
+	}
+	st := budgetState{Rules: map[string]map[string]*budgetSpend{}}
+	now := time.Now()
+	for _, r := range b.rules {
+		day := r.day(now)
+		spend := map[string]*budgetSpend{}
+		for key, s := range b.spend[r.name] {
+			if s.Day != day {
+				delete(b.spend[r.name], key)
+				continue
+			}
+			cp := *s
+			spend[key] = &cp
+		}
+		st.Rules[r.name] = spend
+	}
+	b.dirty = false
+	b.mu.Unlock()
+	return saveState(b.file, st)
+}
+
+// run saves the totals every stateSaveInterval until ctx is done.
+func (b *budgets) run(ctx context.Context) {
+	if b == nil || b.file == "" {
+		return
+	}
+	t := time.NewTicker(stateSaveInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if err := b.save(); err != nil {
+			slog.Error("save budget totals", "file", b.file, "err", err)
+		}
+	}
+}
+
+// usageMeter picks the model and token usage out of a response as it
+// passes through: from the events of a stream, in the formats streamMeter
+// reads, and otherwise from the usage object of a JSON body, as OpenAI
+// and Anthropic return it.
+type usageMeter struct {
+	body   capture
+	stream *streamMeter
+	own    bool // stream is the meter's, not the exchange's
+}
+
+// newUsageMeter returns a meter for resp, sharing the exchange's stream
+// meter if it has one.
+func newUsageMeter(resp *http.Response, stream *streamMeter) *usageMeter {
+	m := &usageMeter{body: capture{limit: maxUsageBody}}
+	if isEventStream(resp) {
+		m.stream, m.own = stream, stream == nil
+		if m.own {
+			m.stream = &streamMeter{}
+		}
+	}
+	return m
+}
+
+func (m *usageMeter) Write(p []byte) (int, error) {
+	switch {
+	case m.stream == nil:
+		return m.body.Write(p)
+	case m.own:
+		return m.stream.Write(p)
+	}
+	return len(p), nil
+}
+
+// usage returns the model and token counts the response reported, and
+// whether it reported any.
+func (m *usageMeter) usage(resp *audit.ResponseMetadata) (model string, in, out int, ok bool) {
+	if m.stream != nil {
+		in, out = m.stream.inputTokens, m.stream.outputTokens
+		return m.stream.model, in, out, in+out > 0
+	}
+	if m.body.truncated() || m.body.buf.Len() == 0 {
+		return "", 0, 0, false
+	}
+	data := m.body.buf.Bytes()
+	if resp != nil && strings.EqualFold(resp.Headers.Get("Content-Encoding"), "gzip") {
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return "", 0, 0, false
+		}
+		if data, err = io.ReadAll(io.LimitReader(zr, maxUsageBody)); err != nil {
+			return "", 0, 0, false
+		}
+	}
+	var body struct {
+		Model string `json:"model"`
+		Usage *struct {
+			PromptTokens     int `json:"prompt_tokens"`
+			CompletionTokens int `json:"completion_tokens"`
+			InputTokens      int `json:"input_tokens"`
+			OutputTokens     int `json:"output_tokens"`
+		} `json:"usage"`
+	}
+	if json.Unmarshal(data, &body) != nil || body.Usage == nil {
+		return "", 0, 0, false
+	}
+	u := body.Usage
+	return body.Model, u.PromptTokens + u.InputTokens, u.CompletionTokens + u.OutputTokens, true
+}
@@ -0,0 +1,39 @@
+package proxy
+
+import (
+	"net/http"
+
+	"github.com/kdhira/audit-proxy/internal/mitm"
+)
+
+// caFile is a form in which the MITM CA certificate is served.
+type caFile struct {
+	contentType string
+	name        string // offered for saving
+	pem         bool   // PEM rather than DER
+}
+
+// caPaths are where the proxy serves its MITM CA certificate to clients
+// asking the listener directly.
+var caPaths = map[string]caFile{
+	"/.audit-proxy/ca.pem": {"application/x-pem-file", "audit-proxy-ca.pem", true},
+	"/.audit-proxy/ca.crt": {"application/x-x509-ca-cert", "audit-proxy-ca.crt", false},
+}
+
+// serveCA answers a request for the MITM CA certificate in form f. Only
+// the certificate is served, never its key.
+func (h *handler) serveCA(w http.ResponseWriter, r *http.Request, f caFile) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeJSON(w, http.StatusMethodNotAllowed, errorBody{Error: "method not allowed"})
+		return
+	}
+	ca := h.mitm.Issuer().CA()
+	body := ca.Raw
+	if f.pem {
+		body = mitm.EncodeCertificate(ca)
+	}
+	w.Header().Set("Content-Type", f.contentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+f.name+`"`)
+	_, _ = w.Write(body)
+}
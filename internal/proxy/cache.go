@@ -0,0 +1,145 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/kdhira/audit-proxy/internal/cache"
+	"github.com/kdhira/audit-proxy/internal/config"
+	"github.com/kdhira/audit-proxy/internal/fingerprint"
+	"github.com/kdhira/audit-proxy/internal/metrics"
+)
+
+// credentialHeaders are added to the cache key, so a cached response is
+// only served to requests made with the same credentials.
+var credentialHeaders = []string{"Authorization", "Cookie", "X-Api-Key", "Api-Key"}
+
+// responseCache is the compiled config.CacheConfig.
+type responseCache struct {
+	hosts   hostList
+	maxBody int64
+	ttl     time.Duration
+	cache   *cache.Cache
+	results *metrics.CounterVec
+	entries *metrics.GaugeVec
+	bytes   *metrics.GaugeVec
+}
+
+// newResponseCache returns nil if no hosts are cached.
+func newResponseCache(cfg config.CacheConfig, reg *metrics.Registry) (*responseCache, error) {
+	if len(cfg.Hosts) == 0 {
+		return nil, nil
+	}
+	hosts, err := compileHosts(cfg.Hosts)
+	if err != nil {
+		return nil, fmt.Errorf("cache: %w", err)
+	}
+	c := cache.NewMemory(cfg.MaxBytes)
+	if cfg.Store == "disk" {
+		if c, err = cache.NewDisk(cfg.Dir, cfg.MaxBytes); err != nil {
+			return nil, fmt.Errorf("cache: %w", err)
+		}
+	}
+	rc := &responseCache{
+		hosts:   hosts,
+		maxBody: cfg.MaxBody,
+		ttl:     cfg.DefaultTTL,
+		cache:   c,
+		results: reg.Counter("auditproxy_cache_requests_total",
+			"Cacheable requests, by lookup result (hit, miss, stale or bypass).", "result"),
+		entries: reg.Gauge("auditproxy_cache_entries",
+			"Responses held by the response cache."),
+		bytes: reg.Gauge("auditproxy_cache_bytes",
+			"Size of the responses held by the response cache."),
+	}
+	rc.update()
+	return rc, nil
+}
+
+// covers reports whether req may be answered from the cache: a GET
+// without a body to a cached host.
+func (c *responseCache) covers(req *http.Request) bool {
+	return c != nil && req.Method == http.MethodGet &&
+		(req.Body == nil || req.Body == http.NoBody) &&
+		c.hosts.match(req.URL.Host, defaultPort(req.URL.Scheme))
+}
+
+// update refreshes the size gauges.
+func (c *responseCache) update() {
+	st := c.cache.Stats()
+	c.entries.With().Set(float64(st.Entries))
+	c.bytes.With().Set(float64(st.Bytes))
+}
+
+// cacheKey returns the key of x's request: its fingerprint and the
+// credentials it carries.
+func (h *handler) cacheKey(x *exchange) string {
+	d := sha256.New()
+	d.Write([]byte(h.fingerprintOf(x)))
+	for _, name := range credentialHeaders {
+		for _, v := range x.req.Header.Values(name) {
+			d.Write([]byte("\n" + name + ":" + v))
+		}
+	}
+	return hex.EncodeToString(d.Sum(nil)[:16])
+}
+
+// cachedResponse returns the cached response for x if a fresh one is
+// held, recording it in the entry as if it had come from upstream, or nil
+// if the request should be forwarded. The lookup result is recorded as
+// the attribute cache.
+func (h *handler) cachedResponse(x *exchange) *http.Response {
+	c := h.cache
+	if !c.covers(x.req) || x.headersOnly {
+		return nil
+	}
+	x.reqBody = &capture{limit: x.excerptBytes(), hash: fingerprint.Body()}
+	result := cache.Bypass
+	var e *cache.Entry
+	if !cache.NoCache(x.req.Header) {
+		e, result = c.cache.Lookup(h.cacheKey(x), x.req.Header, time.Now())
+	}
+	c.results.With(result).Inc()
+	x.attrs.Set("cache", result)
+	if e == nil {
+		return nil
+	}
+	age := e.Age(time.Now())
+	x.attrs.Set("cache.age_s", int64(age.Seconds()))
+	hdr := e.Header.Clone()
+	hdr.Set("Age", strconv.FormatInt(int64(age.Seconds()), 10))
+	return h.cannedResponse(x, e.Status, hdr, e.Body)
+}
+
+// cacheResponse arranges for resp to be cached once its body has been read
+// to the end, if it may be stored. Call it before the response is prepared
+// for the client, so the cache holds what upstream sent.
+func (h *handler) cacheResponse(x *exchange, resp *http.Response) {
+	c := h.cache
+	if !c.covers(x.req) || x.headersOnly || isEventStream(resp) {
+		return
+	}
+	lifetime := cache.Lifetime(resp.StatusCode, x.req.Header, resp.Header, c.ttl)
+	if lifetime <= 0 {
+		return
+	}
+	key := h.cacheKey(x)
+	hdr := resp.Header.Clone()
+	removeHopHeaders(hdr)
+	hdr.Del("Content-Length")
+	status := resp.StatusCode
+	resp.Body = &recorder{ReadCloser: resp.Body, limit: c.maxBody, done: func(body []byte) {
+		e := cache.NewEntry(key, x.entry.Request.URL, x.req.Header, status, hdr, body, time.Now(), lifetime)
+		if err := c.cache.Put(e); err != nil {
+			slog.Warn("store cached response", "url", e.URL, "err", err)
+			return
+		}
+		c.update()
+		x.attrs.Set("cache.stored", true)
+	}}
+}
@@ -0,0 +1,40 @@
+package proxy
+
+import (
+	"bytes"
+	"hash"
+	"io"
+)
+
+// capture counts every byte written to it and keeps the first limit bytes
+// as an excerpt. With hash set it also hashes them all.
+type capture struct {
+	limit int
+	buf   bytes.Buffer
+	n     int64
+	hash  hash.Hash
+}
+
+func (c *capture) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	if c.hash != nil {
+		c.hash.Write(p)
+	}
+	if room := c.limit - c.buf.Len(); room > 0 {
+		c.buf.Write(p[:min(room, len(p))])
+	}
+	return len(p), nil
+}
+
+// truncated reports whether more bytes were seen than were kept.
+func (c *capture) truncated() bool {
+	return c.n > int64(c.buf.Len())
+}
+
+// teeBody returns a ReadCloser that copies everything read from rc into w.
+func teeBody(rc io.ReadCloser, w io.Writer) io.ReadCloser {
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.TeeReader(rc, w), rc}
+}
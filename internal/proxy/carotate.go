@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/kdhira/audit-proxy/internal/mitm"
+)
+
+// rotateCA loads the MITM CA from certFile and keyFile and, if it is not
+// the CA in use, issues leaves from it from now on, dropping those of the
+// old one. Open tunnels keep their leaves. Leaf key settings stay as the
+// proxy started with. A CA that fails to load leaves the running one in
+// place.
+func (h *handler) rotateCA(certFile, keyFile string) error {
+	if h.mitm == nil {
+		return nil
+	}
+	issuer, err := mitm.LoadIssuer(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("mitm: %w", err)
+	}
+	old := h.mitm.Issuer().CA()
+	if bytes.Equal(issuer.CA().Raw, old.Raw) {
+		return nil
+	}
+	if err := issuer.SetLeafKeys(h.cfg.MITMLeafKey, h.cfg.MITMReuseLeafKey); err != nil {
+		return fmt.Errorf("mitm: %w", err)
+	}
+	dropped := h.mitm.SetIssuer(issuer)
+	ca := issuer.CA()
+	slog.Info("MITM CA rotated", "subject", ca.Subject.String(), "not_after", ca.NotAfter,
+		"previous_subject", old.Subject.String(), "leaves_dropped", dropped)
+	return nil
+}
+
+// watchCA checks the CA files every interval until ctx is done, rotating
+// the CA when either changes. Files written in place or swapped under a
+// symlink, as mounted secrets are, both show up as a new modification
+// time or size.
+func (h *handler) watchCA(ctx context.Context, certFile, keyFile string, interval time.Duration) {
+	if h.mitm == nil || interval <= 0 {
+		return
+	}
+	last := caFilesState(certFile, keyFile)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		state := caFilesState(certFile, keyFile)
+		if state == last {
+			continue
+		}
+		// A half-written pair fails to load and is tried again next time.
+		if err := h.rotateCA(certFile, keyFile); err != nil {
+			slog.Warn("MITM CA files changed but could not be loaded", "err", err)
+			continue
+		}
+		last = state
+	}
+}
+
+// caFilesState returns the modification times and sizes of the files.
+func caFilesState(certFile, keyFile string) [2]fileState {
+	var s [2]fileState
+	for i, f := range []string{certFile, keyFile} {
+		if fi, err := os.Stat(f); err == nil {
+			s[i] = fileState{fi.ModTime(), fi.Size()}
+		}
+	}
+	return s
+}
+
+type fileState struct {
+	mod  time.Time
+	size int64
+}
@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/kdhira/audit-proxy/internal/audit"
+	"github.com/kdhira/audit-proxy/internal/config"
+)
+
+// errNoClientCert fails the handshakes of tunnels that require a client
+// certificate and got none.
+var errNoClientCert = errors.New("client sent no certificate")
+
+// clientCerts is the compiled mitm_client_certs: which intercepted tunnels
+// ask their clients for certificates, and how those are checked.
+type clientCerts struct {
+	hosts   hostList // nil for all hosts
+	pool    *x509.CertPool
+	require bool
+}
+
+// newClientCerts compiles cfg; nil if client certificates are not
+// requested.
+func newClientCerts(cfg config.MITMClientCertsConfig) (*clientCerts, error) {
+	if !cfg.Request {
+		return nil, nil
+	}
+	c := &clientCerts{require: cfg.Require}
+	if len(cfg.Hosts) > 0 {
+		hosts, err := compileHosts(cfg.Hosts)
+		if err != nil {
+			return nil, fmt.Errorf("mitm_client_certs.hosts: %w", err)
+		}
+		c.hosts = hosts
+	}
+	if len(cfg.ClientCAs) > 0 {
+		c.pool = x509.NewCertPool()
+		for _, f := range cfg.ClientCAs {
+			pem, err := os.ReadFile(f)
+			if err != nil {
+				return nil, fmt.Errorf("mitm_client_certs.client_cas: %w", err)
+			}
+			if !c.pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("mitm_client_certs.client_cas: no certificates in %s", f)
+			}
+		}
+	}
+	return c, nil
+}
+
+// apply has conf, serving a tunnel to hostport, request a client
+// certificate if c covers hostport.
+func (c *clientCerts) apply(conf *tls.Config, hostport string) {
+	if c == nil || (c.hosts != nil && !c.hosts.match(hostport, "443")) {
+		return
+	}
+	conf.ClientCAs = c.pool
+	conf.ClientAuth = tls.RequestClientCert
+	if c.pool != nil {
+		conf.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	// Checked here rather than by ClientAuth so the failure is known.
+	if c.require {
+		conf.VerifyConnection = func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return errNoClientCert
+			}
+			return nil
+		}
+	}
+}
+
+// clientCertRefused returns why a client handshake failed for want of a
+// valid client certificate, with the certificate if one was sent, or ""
+// if err is another failure.
+func clientCertRefused(err error) (string, *audit.ClientCert) {
+	if errors.Is(err, errNoClientCert) {
+		return "client certificate required", nil
+	}
+	var verr *tls.CertificateVerificationError
+	if errors.As(err, &verr) && len(verr.UnverifiedCertificates) > 0 {
+		return "client certificate not verified", describeCert(verr.UnverifiedCertificates[0])
+	}
+	return "", nil
+}
+
+// describeClientCert returns the audit record of the client certificate
+// in state, or nil if the client sent none.
+func describeClientCert(conf *tls.Config, state tls.ConnectionState) *audit.ClientCert {
+	if len(state.PeerCertificates) == 0 {
+		return nil
+	}
+	cc := describeCert(state.PeerCertificates[0])
+	cc.Verified = conf.ClientCAs != nil && len(state.VerifiedChains) > 0
+	return cc
+}
+
+func describeCert(c *x509.Certificate) *audit.ClientCert {
+	sum := sha256.Sum256(c.Raw)
+	return &audit.ClientCert{
+		Subject: c.Subject.String(),
+		Issuer:  c.Issuer.String(),
+		Serial:  c.SerialNumber.Text(16),
+		SHA256:  hex.EncodeToString(sum[:]),
+	}
+}
+
+type clientCertKey struct{}
+
+// withClientCert returns ctx carrying the client certificate of the tunnel
+// whose requests it is for.
+func withClientCert(ctx context.Context, cc *audit.ClientCert) context.Context {
+	if cc == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, clientCertKey{}, cc)
+}
+
+func clientCertFrom(ctx context.Context) *audit.ClientCert {
+	cc, _ := ctx.Value(clientCertKey{}).(*audit.ClientCert)
+	return cc
+}
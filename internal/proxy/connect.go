@@ -0,0 +1,264 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kdhira/audit-proxy/internal/audit"
+)
+
+// handleConnect establishes a CONNECT tunnel, intercepting it when MITM is
+// enabled for the target host.
+func (h *handler) handleConnect(w http.ResponseWriter, r *http.Request) {
+	x := h.begin(audit.KindConnect, r)
+	defer h.finish(x)
+
+	if status, body := h.admitTunnel(x); status != 0 {
+		writeJSON(w, status, body)
+		return
+	}
+	mitm := h.intercept(x)
+	h.logStart(x)
+	if mitm {
+		h.handleMitm(w, r, x)
+		return
+	}
+	upstream, status, body := h.dialTunnel(x)
+	if upstream == nil {
+		writeJSON(w, status, body)
+		return
+	}
+	defer upstream.Close()
+
+	client, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		x.entry.Error = err.Error()
+		slog.Error("hijack CONNECT", "err", err)
+		return
+	}
+	defer client.Close()
+	defer h.drain.track(client)()
+	if _, err := rw.WriteString("HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		x.entry.Error = err.Error()
+		return
+	}
+	if err := rw.Flush(); err != nil {
+		x.entry.Error = err.Error()
+		return
+	}
+	h.pipeTunnel(x, client, rw.Reader, upstream)
+}
+
+// admitTunnel checks the target of the tunnel x opens against the allowed
+// hosts, CONNECT ports and egress policy. It returns the status and body
+// refusing the tunnel, or 0 if it may open.
+func (h *handler) admitTunnel(x *exchange) (int, any) {
+	host := x.req.Host
+	if reason := h.hostDenied(x.policy, host, "443"); reason != "" {
+		x.deny(http.StatusForbidden, reason)
+		return http.StatusForbidden, errorBody{Error: reason}
+	}
+	if !h.connectPorts.allows(host) {
+		x.deny(http.StatusForbidden, "port not allowed")
+		return http.StatusForbidden, errorBody{Error: "port not allowed"}
+	}
+	if reason := h.egressDenied(x.ctx(), host); reason != "" {
+		x.deny(http.StatusForbidden, reason)
+		return http.StatusForbidden, errorBody{Error: reason}
+	}
+	return 0, nil
+}
+
+// dialTunnel runs the request filters over the tunnel x opens without
+// interception and connects to its target. It returns the connection, or
+// the status and body refusing the tunnel.
+func (h *handler) dialTunnel(x *exchange) (net.Conn, int, any) {
+	h.overrides.apply(x)
+	if err := x.policy.filters.OnRequest(x.ctx(), x.req); err != nil {
+		be := x.block(err)
+		return nil, be.StatusCode(), blockBody(be)
+	}
+	host := x.req.Host
+	done, err := h.breakers.allow(host, "443", time.Now())
+	if err != nil {
+		x.entry.Error = err.Error()
+		x.attrs.Set("circuit_breaker", "open")
+		return nil, upstreamStatus(err), errorBody{Error: "upstream unavailable"}
+	}
+	upstream, err := h.upstreams.forTarget(host, "443").dial(x.ctx(), "tcp", host)
+	done(err != nil)
+	if err != nil {
+		x.entry.Error = err.Error()
+		return nil, upstreamStatus(err), errorBody{Error: "upstream dial failed"}
+	}
+	x.entry.Conn.ResolvedIP = remoteIPOf(upstream)
+	return upstream, 0, nil
+}
+
+// pipeTunnel carries the opaque tunnel x between client, whose bytes so
+// far are buffered in br, and upstream, once the client has been told it
+// is open.
+func (h *handler) pipeTunnel(x *exchange, client net.Conn, br *bufio.Reader, upstream net.Conn) {
+	x.entry.Response = &audit.ResponseMetadata{Status: http.StatusOK}
+	defer h.activity.tunnel(x, false)()
+	sniff := func(r *bufio.Reader) {
+		if proto, err := sniffTunnel(r); err == nil {
+			x.attrs.Set("tunnel.protocol", proto)
+		}
+	}
+	if h.cfg.Connect.RequireTLS {
+		_ = client.SetReadDeadline(time.Now().Add(tunnelSniffTimeout))
+		proto, err := sniffTunnel(br)
+		_ = client.SetReadDeadline(time.Time{})
+		if proto != "" {
+			x.attrs.Set("tunnel.protocol", proto)
+		}
+		if proto != protoTLS {
+			x.entry.Blocked = true
+			x.entry.Reason = "tunnel did not start with a TLS handshake"
+			if err != nil {
+				x.entry.Error = err.Error()
+			}
+			return
+		}
+		sniff = nil
+	}
+	x.entry.BytesOut, x.entry.BytesIn = pipe(client, br, upstream, sniff)
+}
+
+// tunnelSniffTimeout bounds the wait for a client's first bytes when a
+// tunnel must carry TLS.
+const tunnelSniffTimeout = 10 * time.Second
+
+// Protocols told apart by sniffTunnel.
+const (
+	protoTLS   = "tls"
+	protoOther = "other"
+)
+
+// sniffTunnel waits for the client's first bytes in a tunnel and reports
+// whether they open a TLS handshake record (content type 22, version 3.x).
+// The bytes stay buffered in r.
+func sniffTunnel(r *bufio.Reader) (string, error) {
+	if _, err := r.Peek(1); err != nil {
+		return "", err
+	}
+	// Only look at what has arrived, so a client waiting for the server
+	// after a short first write is not held up.
+	b, _ := r.Peek(min(r.Buffered(), 2))
+	if b[0] == 0x16 && (len(b) < 2 || b[1] == 0x03) {
+		return protoTLS, nil
+	}
+	return protoOther, nil
+}
+
+// portPolicy is the set of ports CONNECT tunnels may reach.
+type portPolicy struct {
+	any    bool
+	ranges [][2]int
+}
+
+func newPortPolicy(ports []string) (*portPolicy, error) {
+	if len(ports) == 0 {
+		ports = []string{"443"}
+	}
+	p := &portPolicy{}
+	for _, s := range ports {
+		if s == "*" {
+			p.any = true
+			continue
+		}
+		lo, hi, isRange := strings.Cut(s, "-")
+		if !isRange {
+			hi = lo
+		}
+		l, err1 := strconv.Atoi(lo)
+		h, err2 := strconv.Atoi(hi)
+		if err1 != nil || err2 != nil || l < 1 || h > 65535 || l > h {
+			return nil, fmt.Errorf("connect.ports: invalid port or range %q", s)
+		}
+		p.ranges = append(p.ranges, [2]int{l, h})
+	}
+	return p, nil
+}
+
+// allows reports whether a tunnel may reach hostport, which defaults to
+// port 443.
+func (p *portPolicy) allows(hostport string) bool {
+	if p.any {
+		return true
+	}
+	port := 443
+	if _, ps, err := net.SplitHostPort(hostport); err == nil {
+		if port, err = strconv.Atoi(ps); err != nil {
+			return false
+		}
+	}
+	for _, r := range p.ranges {
+		if port >= r[0] && port <= r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// intercept reports whether the tunnel x opens should be decrypted. While
+// interception is rolled out, only the rollout's cohort is, and x records
+// the cohort as rollout.mitm. Hosts bypassed for pinning are not, and x
+// records that as mitm.bypassed.
+func (h *handler) intercept(x *exchange) bool {
+	if !h.cfg.MITM || !x.rules.mitm.selects(x.req.Host) {
+		return false
+	}
+	if h.pinning.bypassed(x.req.Host, time.Now()) {
+		x.attrs.Set("mitm.bypassed", "pinning")
+		return false
+	}
+	return x.rules.mitmCanary.Admit(x.ctx())
+}
+
+// pipe copies bytes in both directions until both sides are done,
+// returning the bytes sent upstream and the bytes returned to the client.
+// sniff, if not nil, is called with clientR before anything is sent
+// upstream, without holding up the other direction.
+func pipe(client net.Conn, clientR *bufio.Reader, upstream net.Conn, sniff func(*bufio.Reader)) (out, in int64) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if sniff != nil {
+			sniff(clientR)
+		}
+		out, _ = io.Copy(upstream, clientR)
+		closeWrite(upstream)
+	}()
+	in, _ = io.Copy(client, upstream)
+	closeWrite(client)
+	wg.Wait()
+	return out, in
+}
+
+func closeWrite(c net.Conn) {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+		return
+	}
+	_ = c.Close()
+}
+
+// bufferedConn is a net.Conn whose reads go through a bufio.Reader that may
+// already hold bytes read during hijacking.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) { return c.r.Read(p) }
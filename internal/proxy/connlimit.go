@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/kdhira/audit-proxy/internal/audit"
+	"github.com/kdhira/audit-proxy/internal/config"
+	"github.com/kdhira/audit-proxy/internal/metrics"
+)
+
+// Reasons a client connection breaks the listener limits, used in logs and
+// as the metric label.
+const (
+	violationHeaderTimeout = "header_timeout"
+	violationRequestRate   = "request_rate"
+	violationFraming       = "ambiguous_framing"
+)
+
+// connGuard enforces the per-connection listener limits. The HTTP server
+// enforces header and idle timeouts itself; connGuard counts requests and
+// notices connections closed while their headers were still arriving.
+type connGuard struct {
+	cfg        config.ListenerConfig
+	conns      sync.Map // net.Conn -> *connState
+	violations *metrics.CounterVec
+}
+
+// connState tracks one client connection, or one MITM tunnel.
+type connState struct {
+	mu       sync.Mutex
+	remote   string
+	requests int
+	tokens   float64
+	last     time.Time
+	waiting  time.Time // when the connection became ready for a request
+	pending  bool      // a request is being read but has not been handled
+	framing  *framingScanner
+	// tls is set for connections accepted over TLS that the server sees
+	// through a framedConn, and so without r.TLS.
+	tls bool
+
+	workloadOnce sync.Once
+	workload     *audit.Workload
+}
+
+type connStateKey struct{}
+
+func newConnGuard(cfg config.ListenerConfig, reg *metrics.Registry) *connGuard {
+	return &connGuard{
+		cfg: cfg,
+		violations: reg.Counter("auditproxy_connection_violations_total",
+			"Client connections breaking listener limits, by reason.", "reason"),
+	}
+}
+
+// configure applies the guard to srv.
+func (g *connGuard) configure(srv *http.Server) {
+	srv.ReadHeaderTimeout = g.cfg.ReadHeaderTimeout
+	srv.IdleTimeout = g.cfg.IdleTimeout
+	srv.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+		st := g.newConn(c.RemoteAddr().String())
+		if fc, ok := c.(*framedConn); ok {
+			st.framing = fc.scan
+			_, st.tls = fc.Conn.(*tls.Conn)
+		}
+		g.conns.Store(c, st)
+		return context.WithValue(ctx, connStateKey{}, st)
+	}
+	srv.ConnState = g.connState
+}
+
+func (g *connGuard) newConn(remote string) *connState {
+	now := time.Now()
+	return &connState{remote: remote, tokens: g.burst(), last: now, waiting: now}
+}
+
+func (g *connGuard) burst() float64 {
+	return max(g.cfg.MaxRequestRate, 1)
+}
+
+// connState follows the server's view of a connection. The server reports
+// a connection active only once it has read (or failed to read) a request,
+// so a connection that goes active and closes without a request having
+// reached the handler at least ReadHeaderTimeout after it started waiting
+// was cut off mid-headers.
+func (g *connGuard) connState(c net.Conn, s http.ConnState) {
+	v, ok := g.conns.Load(c)
+	if !ok {
+		return
+	}
+	st := v.(*connState)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	switch s {
+	case http.StateIdle:
+		st.waiting, st.pending = time.Now(), false
+	case http.StateActive:
+		st.pending = true
+	case http.StateHijacked, http.StateClosed:
+		g.conns.Delete(c)
+		if st.framing != nil && s == http.StateHijacked {
+			st.framing.stop()
+		}
+		if t := g.cfg.ReadHeaderTimeout; t > 0 && st.pending && time.Since(st.waiting) >= t {
+			g.violation(st.remote, violationHeaderTimeout)
+		}
+	}
+}
+
+func (g *connGuard) violation(remote, reason string) {
+	g.violations.With(reason).Inc()
+	slog.Warn("client connection limit exceeded", "client", remote, "reason", reason)
+}
+
+// request counts a request on st. It reports whether the connection must be
+// closed after this request and, if the request is refused, why.
+func (g *connGuard) request(st *connState) (last bool, refused string) {
+	if st == nil {
+		return false, ""
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.pending = false
+	st.requests++
+	if n := g.cfg.MaxRequestsPerConn; n > 0 && st.requests >= n {
+		last = true
+	}
+	if rate := g.cfg.MaxRequestRate; rate > 0 {
+		now := time.Now()
+		st.tokens = min(g.burst(), st.tokens+now.Sub(st.last).Seconds()*rate)
+		st.last = now
+		if st.tokens < 1 {
+			g.violation(st.remote, violationRequestRate)
+			return true, "connection request rate exceeded"
+		}
+		st.tokens--
+	}
+	return last, ""
+}
+
+// nextFraming returns the framing of the next request read on st, or nil
+// if its framing is not scanned.
+func (st *connState) nextFraming() *framingRecord {
+	if st == nil || st.framing == nil {
+		return nil
+	}
+	return st.framing.next()
+}
+
+func connStateFrom(ctx context.Context) *connState {
+	st, _ := ctx.Value(connStateKey{}).(*connState)
+	return st
+}
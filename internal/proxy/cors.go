@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kdhira/audit-proxy/internal/audit"
+	"github.com/kdhira/audit-proxy/internal/config"
+)
+
+// corsPolicy answers CORS preflights and sets CORS response headers for
+// browser clients from allowed origins.
+type corsPolicy struct {
+	hosts       hostList // nil for all hosts
+	origins     []string
+	methods     string
+	headers     string // "" to echo the requested headers
+	expose      string
+	credentials bool
+	maxAge      string
+}
+
+func newCORS(cfg config.CORSConfig) (*corsPolicy, error) {
+	if len(cfg.AllowOrigins) == 0 {
+		return nil, nil
+	}
+	c := &corsPolicy{
+		origins:     cfg.AllowOrigins,
+		methods:     strings.Join(cfg.AllowMethods, ", "),
+		headers:     strings.Join(cfg.AllowHeaders, ", "),
+		expose:      strings.Join(cfg.ExposeHeaders, ", "),
+		credentials: cfg.AllowCredentials,
+	}
+	if len(cfg.Hosts) > 0 {
+		hosts, err := compileHosts(cfg.Hosts)
+		if err != nil {
+			return nil, fmt.Errorf("cors: %w", err)
+		}
+		c.hosts = hosts
+	}
+	if c.methods == "" {
+		c.methods = "GET, HEAD, POST, PUT, PATCH, DELETE"
+	}
+	maxAge := cfg.MaxAge
+	if maxAge == 0 {
+		maxAge = 10 * time.Minute
+	}
+	c.maxAge = strconv.Itoa(int(maxAge.Seconds()))
+	return c, nil
+}
+
+// origin returns the Origin of r if the policy applies to it, or "".
+func (c *corsPolicy) origin(r *http.Request) string {
+	origin := r.Header.Get("Origin")
+	if c == nil || origin == "" || (c.hosts != nil && !c.hosts.match(r.URL.Host, defaultPort(r.URL.Scheme))) {
+		return ""
+	}
+	for _, o := range c.origins {
+		if o == "*" || o == origin {
+			return origin
+		}
+		if prefix, suffix, ok := strings.Cut(o, "*"); ok &&
+			len(origin) > len(prefix)+len(suffix) && strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) {
+			return origin
+		}
+	}
+	return ""
+}
+
+// preflight returns the headers answering r if it is a preflight the policy
+// applies to, or nil.
+func (c *corsPolicy) preflight(r *http.Request) http.Header {
+	if r.Method != http.MethodOptions || r.Header.Get("Access-Control-Request-Method") == "" {
+		return nil
+	}
+	origin := c.origin(r)
+	if origin == "" {
+		return nil
+	}
+	h := http.Header{}
+	c.allow(h, origin)
+	h.Set("Access-Control-Allow-Methods", c.methods)
+	if allowed := c.headers; allowed != "" {
+		h.Set("Access-Control-Allow-Headers", allowed)
+	} else if requested := r.Header.Get("Access-Control-Request-Headers"); requested != "" {
+		h.Set("Access-Control-Allow-Headers", requested)
+	}
+	h.Set("Access-Control-Max-Age", c.maxAge)
+	return h
+}
+
+// allow replaces the CORS headers in h with those granting origin.
+func (c *corsPolicy) allow(h http.Header, origin string) {
+	for k := range h {
+		if strings.HasPrefix(k, "Access-Control-") {
+			delete(h, k)
+		}
+	}
+	h.Set("Access-Control-Allow-Origin", origin)
+	h.Add("Vary", "Origin")
+	if c.credentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if c.expose != "" {
+		h.Set("Access-Control-Expose-Headers", c.expose)
+	}
+}
+
+// corsPreflight returns the headers of the proxy's own answer to x if it is
+// a CORS preflight, recording the answer in the entry, or nil if the request
+// should be forwarded.
+func (h *handler) corsPreflight(x *exchange) http.Header {
+	hdr := h.cors.preflight(x.req)
+	if hdr == nil {
+		return nil
+	}
+	x.attrs.Set("cors", "preflight")
+	x.entry.Response = &audit.ResponseMetadata{Status: http.StatusNoContent, Headers: hdr}
+	return hdr
+}
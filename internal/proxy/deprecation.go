@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kdhira/audit-proxy/internal/audit"
+)
+
+// annotateDeprecation records Deprecation (RFC 9745) and Sunset (RFC 8594)
+// response headers on e.
+func annotateDeprecation(e *audit.Entry, h http.Header) {
+	dep, sunset := h.Get("Deprecation"), h.Get("Sunset")
+	if dep == "" && sunset == "" {
+		return
+	}
+	e.SetAttribute(audit.AttrDeprecated, true)
+	if _, ok := e.Attributes[audit.AttrDeprecationSource]; !ok {
+		e.SetAttribute(audit.AttrDeprecationSource, "header")
+	}
+	if dep != "" && dep != "true" {
+		e.SetAttribute(audit.AttrDeprecationDate, headerDate(dep))
+	}
+	if sunset != "" {
+		e.SetAttribute(audit.AttrSunset, headerDate(sunset))
+	}
+}
+
+// headerDate normalises an RFC 9745 "@<unix>" or HTTP-date value to
+// RFC 3339, returning the raw value if it is neither.
+func headerDate(v string) string {
+	v = strings.TrimSpace(v)
+	if secs, ok := strings.CutPrefix(v, "@"); ok {
+		if n, err := strconv.ParseInt(secs, 10, 64); err == nil {
+			return time.Unix(n, 0).UTC().Format(time.RFC3339)
+		}
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return t.UTC().Format(time.RFC3339)
+	}
+	return v
+}
+
+// versionHeaders carry API versions for common providers.
+var versionHeaders = []string{"Anthropic-Version", "X-Github-Api-Version", "Openai-Beta", "Stripe-Version"}
+
+// annotateAPIVersion records the API version requested, if the request
+// names one explicitly, so version drift can be reported per host.
+func annotateAPIVersion(e *audit.Entry, req *http.Request) {
+	if v := req.URL.Query().Get("api-version"); v != "" {
+		e.SetAttribute(audit.AttrAPIVersion, v)
+		return
+	}
+	for _, k := range versionHeaders {
+		if v := req.Header.Get(k); v != "" {
+			e.SetAttribute(audit.AttrAPIVersion, v)
+			return
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// directHint tells a client that requested the proxy like a web server
+// how to use it instead.
+const directHint = "audit-proxy is a forward proxy: set it as HTTP_PROXY/HTTPS_PROXY so requests carry an absolute URL or use CONNECT"
+
+type directKey struct{}
+
+// isDirect reports whether the request in ctx reached the listener in
+// origin form and was routed to the direct upstream.
+func isDirect(ctx context.Context) bool {
+	d, _ := ctx.Value(directKey{}).(bool)
+	return d
+}
+
+// newDirectUpstream parses the direct.upstream setting; nil if unset.
+func newDirectUpstream(raw string) (*url.URL, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	return url.Parse(raw)
+}
+
+// handleDirect handles an origin-form request sent to the listener as if
+// it were a web server. Without direct.upstream it is refused with a hint;
+// with it the proxy acts as a reverse proxy, forwarding the request to the
+// upstream under the usual policy.
+func (h *handler) handleDirect(w http.ResponseWriter, r *http.Request) {
+	if h.direct == nil {
+		x := h.begin(requestKind(r), r)
+		x.deny(http.StatusBadRequest, "direct request")
+		writeJSON(w, http.StatusBadRequest, errorBody{Error: "not a proxy request", Reason: directHint})
+		h.finish(x)
+		return
+	}
+	u := *h.direct
+	u.Path = strings.TrimSuffix(h.direct.Path, "/") + r.URL.Path
+	u.RawPath = strings.TrimSuffix(h.direct.EscapedPath(), "/") + r.URL.EscapedPath()
+	u.RawQuery = r.URL.RawQuery
+	r = r.WithContext(context.WithValue(r.Context(), directKey{}, true))
+	r.URL = &u
+	r.Host = u.Host
+	h.handleHTTP(w, r)
+}
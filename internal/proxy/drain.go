@@ -0,0 +1,165 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// drainCloseGrace bounds the wait for tunnels closed at the drain deadline
+// to write their entries.
+const drainCloseGrace = time.Second
+
+// drainState tracks open tunnels, which the HTTP server forgets once their
+// connections are hijacked, and whether the proxy is draining: refusing new
+// requests while those already accepted finish.
+type drainState struct {
+	mu       sync.Mutex
+	draining bool
+	since    time.Time
+	refused  int
+	open     int                    // CONNECT requests being handled
+	conns    map[net.Conn]time.Time // hijacked client connection -> idle since, zero while busy
+	empty    chan struct{}          // closed when draining and no tunnels are left
+}
+
+func newDrainState() *drainState {
+	return &drainState{conns: make(map[net.Conn]time.Time)}
+}
+
+// enter counts a CONNECT request, and the tunnel it may open, until the
+// returned function is called.
+func (d *drainState) enter() func() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.open++
+	return func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		d.open--
+		d.signal()
+	}
+}
+
+// track registers the client connection of a tunnel, so draining can close
+// it, until the returned function is called.
+func (d *drainState) track(c net.Conn) func() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.conns[c] = time.Time{}
+	return func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		delete(d.conns, c)
+	}
+}
+
+// idle records that the MITM tunnel on c is waiting for its next request.
+// It reports false if the proxy is draining and the tunnel should close
+// instead.
+func (d *drainState) idle(c net.Conn) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.draining {
+		return false
+	}
+	d.conns[c] = time.Now()
+	return true
+}
+
+// busy records that the MITM tunnel on c is handling a request.
+func (d *drainState) busy(c net.Conn) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.conns[c] = time.Time{}
+}
+
+// closeIdle closes MITM tunnels waiting for a request since before t and
+// returns how many it closed.
+func (d *drainState) closeIdle(t time.Time) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := 0
+	for c, since := range d.conns {
+		if !since.IsZero() && since.Before(t) {
+			c.Close()
+			d.conns[c] = time.Time{} // counted once; track's release forgets it
+			n++
+		}
+	}
+	return n
+}
+
+// active reports whether the proxy is draining.
+func (d *drainState) active() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.draining
+}
+
+// refuse counts a request refused while draining.
+func (d *drainState) refuse() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.refused++
+}
+
+// begin starts draining, closing MITM tunnels waiting between requests, and
+// returns the number of tunnels open at that point. Later calls return the
+// tunnels still open.
+func (d *drainState) begin() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.draining {
+		d.draining = true
+		d.since = time.Now()
+		d.empty = make(chan struct{})
+		for c, since := range d.conns {
+			if !since.IsZero() {
+				c.Close()
+			}
+		}
+	}
+	d.signal()
+	return d.open
+}
+
+// signal closes empty once draining has no tunnels left. d.mu must be held.
+func (d *drainState) signal() {
+	if d.draining && d.open == 0 {
+		select {
+		case <-d.empty:
+		default:
+			close(d.empty)
+		}
+	}
+}
+
+// wait waits for the tunnels to end until ctx is done, then closes those
+// left and returns how many it closed. begin must have been called.
+func (d *drainState) wait(ctx context.Context) int {
+	select {
+	case <-d.empty:
+		return 0
+	case <-ctx.Done():
+	}
+	d.mu.Lock()
+	n := d.open
+	for c := range d.conns {
+		c.Close()
+	}
+	d.mu.Unlock()
+	select {
+	case <-d.empty:
+	case <-time.After(drainCloseGrace):
+	}
+	return n
+}
+
+// summary returns when draining began and how many requests it refused.
+func (d *drainState) summary() (time.Time, int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.since, d.refused
+}
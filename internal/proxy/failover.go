@@ -0,0 +1,209 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/kdhira/audit-proxy/internal/audit"
+	"github.com/kdhira/audit-proxy/internal/config"
+	"github.com/kdhira/audit-proxy/internal/health"
+)
+
+// maxReplayBody bounds the request bodies kept for a failover retry; larger
+// requests are forwarded without failover.
+const maxReplayBody = 16 << 20
+
+// failoverRule is a compiled config.FailoverRule.
+type failoverRule struct {
+	name     string
+	hosts    hostList
+	statuses []int
+	target   *url.URL
+	set      map[string]string
+	remove   []string
+	probe    *health.Target // nil unless the target is actively checked
+}
+
+func buildFailover(rules []config.FailoverRule, checker *health.Checker) ([]*failoverRule, error) {
+	var out []*failoverRule
+	for _, r := range rules {
+		hosts, err := compileHosts(r.Hosts)
+		if err != nil {
+			return nil, fmt.Errorf("failover %s: %w", r.Name, err)
+		}
+		target, err := url.Parse(r.Target)
+		if err != nil {
+			return nil, fmt.Errorf("failover %s: %w", r.Name, err)
+		}
+		f := &failoverRule{
+			name:     r.Name,
+			hosts:    hosts,
+			statuses: r.Statuses,
+			target:   target,
+			set:      map[string]string{},
+			remove:   r.RemoveHeaders,
+		}
+		for k, v := range r.SetHeaders {
+			f.set[k] = os.ExpandEnv(v)
+		}
+		if r.HealthCheck != nil {
+			f.probe = checker.Add("failover "+r.Name, probeURL(target, r.HealthCheck.Path), *r.HealthCheck)
+		}
+		out = append(out, f)
+	}
+	return out, nil
+}
+
+// triggers reports whether a primary response with status should be
+// retried.
+func (f *failoverRule) triggers(status int) bool {
+	if len(f.statuses) == 0 {
+		return status == http.StatusTooManyRequests || status >= 500
+	}
+	return slices.Contains(f.statuses, status)
+}
+
+// request builds the fallback request for out, replaying body.
+func (f *failoverRule) request(out *http.Request, body []byte) *http.Request {
+	fb := out.Clone(out.Context())
+	retarget(fb, f.target)
+	for _, k := range f.remove {
+		fb.Header.Del(k)
+	}
+	for k, v := range f.set {
+		fb.Header.Set(k, v)
+	}
+	fb.Body = replay(body)
+	return fb
+}
+
+// failoverFor returns the rule covering the target of req, if any.
+func (h *handler) failoverFor(req *http.Request) *failoverRule {
+	for _, f := range h.failover {
+		if f.hosts.match(req.URL.Host, defaultPort(req.URL.Scheme)) {
+			return f
+		}
+	}
+	return nil
+}
+
+// bufferBody reads out's body into memory so it can be sent twice. It
+// reports false, leaving the body intact, when the body is too large.
+func bufferBody(out *http.Request) ([]byte, bool) {
+	if out.Body == nil || out.Body == http.NoBody {
+		return nil, true
+	}
+	data, err := io.ReadAll(io.LimitReader(out.Body, maxReplayBody+1))
+	if err != nil || len(data) > maxReplayBody {
+		out.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(data), out.Body), out.Body}
+		return nil, false
+	}
+	out.Body.Close()
+	return data, true
+}
+
+func replay(body []byte) io.ReadCloser {
+	if body == nil {
+		return http.NoBody
+	}
+	return io.NopCloser(bytes.NewReader(body))
+}
+
+// forwardWithFailover sends out to the primary and, if rule triggers,
+// records the primary attempt as its own entry and retries against the
+// rule's target. x describes the attempt whose response is returned.
+//
+// Health checks short-circuit this: a pool primary whose endpoints are all
+// unhealthy is skipped in favour of the target, and an unhealthy target is
+// never tried, leaving the primary's response as is.
+func (h *handler) forwardWithFailover(x *exchange, out *http.Request, body []byte, rule *failoverRule, ep *endpoint) (*http.Response, error) {
+	_, _ = x.reqBody.Write(body)
+	targetUp := rule.probe.Healthy()
+	if ep != nil && targetUp && !ep.healthy(time.Now()) {
+		fb := rule.request(out, body)
+		x.entry.Conn.Upstream = ""
+		x.attrs.Set("failover.rule", rule.name)
+		x.attrs.Set("failover.url", fb.URL.String())
+		x.attrs.Set("failover.primary_unhealthy", out.URL.Host)
+		slog.Info("failing over", "rule", rule.name, "from", out.URL.Host, "to", fb.URL.Host, "reason", "primary unhealthy")
+		return h.roundTrip(x, fb)
+	}
+
+	out.Body = replay(body)
+	resp, err := h.roundTrip(x, out)
+	if ep != nil {
+		ep.observe(resp, err, time.Now())
+	}
+	if err == nil && !rule.triggers(resp.StatusCode) {
+		return resp, nil
+	}
+	if !targetUp {
+		slog.Warn("failover target unhealthy", "rule", rule.name, "from", out.URL.Host)
+		x.attrs.Set("failover.target_unhealthy", rule.name)
+		return resp, err
+	}
+
+	primary := h.primaryAttempt(x, resp, rule)
+	fb := rule.request(out, body)
+	x.entry.Error = ""
+	x.entry.Response = nil
+	x.entry.Conn.ResolvedIP = ""
+	x.entry.Conn.Upstream = ""
+	x.attrs.Set("failover.rule", rule.name)
+	x.attrs.Set("failover.primary_id", primary.ID)
+	x.attrs.Set("failover.url", fb.URL.String())
+	if primary.Response != nil {
+		x.attrs.Set("failover.primary_status", primary.Response.Status)
+	}
+	slog.Info("failing over", "rule", rule.name, "from", out.URL.Host, "to", fb.URL.Host)
+	return h.roundTrip(x, fb)
+}
+
+// primaryAttempt writes the entry for a failed primary attempt, consuming
+// resp, and returns it.
+func (h *handler) primaryAttempt(x *exchange, resp *http.Response, rule *failoverRule) audit.Entry {
+	e := x.entry
+	e.ID = audit.NewID()
+	e.Attributes = nil
+	x.attrs.RedactURLs(&e)
+	e.BytesOut = x.reqBody.n
+	e.Fingerprint = h.fingerprintOf(x)
+	if resp != nil {
+		// Drain (a bounded amount of) the error body so its excerpt is kept.
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<20))
+		resp.Body.Close()
+		r := *x.entry.Response
+		e.Response = &r
+		if c := x.respBody; c != nil {
+			e.BytesIn = c.n
+			if c.buf.Len() > 0 {
+				e.Response.Excerpt = x.rules.excerpt(c, &e)
+				e.Response.ExcerptTruncated = c.truncated()
+			}
+		}
+	}
+	if c := x.reqBody; c.buf.Len() > 0 {
+		e.Request.Excerpt = x.rules.excerpt(c, &e)
+		e.Request.ExcerptTruncated = c.truncated()
+	}
+	x.rules.profiles.Annotate(x.req, &e)
+	latency := time.Since(x.start)
+	e.DurationMS = latency.Milliseconds()
+	e.SetAttribute("failover.rule", rule.name)
+	e.SetAttribute("failover.retried_as", x.entry.ID)
+	if err := h.logger.Log(e); err != nil {
+		slog.Error("write audit entry", "err", err)
+	}
+	h.observer.observe(&e, latency, h.logger)
+	return e
+}
@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"cmp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kdhira/audit-proxy/internal/metrics"
+)
+
+// filterBuckets suit filter latencies in seconds, which are mostly well
+// under a millisecond but reach seconds for filters calling out.
+var filterBuckets = []float64{0.00005, 0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.05, 0.25, 1, 5}
+
+// FilterActivity is how often a filter was evaluated in one phase, request
+// or response, how often it blocked and how long it took.
+type FilterActivity struct {
+	Name        string    `json:"name"`
+	Phase       string    `json:"phase"`
+	Evaluations int64     `json:"evaluations"`
+	Blocks      int64     `json:"blocks"`
+	MeanMS      float64   `json:"mean_ms"`
+	MaxMS       float64   `json:"max_ms"`
+	LastBlock   time.Time `json:"last_block,omitzero"`
+
+	total time.Duration
+}
+
+// filterStats counts filter evaluations by filter name, for the metrics
+// and the filters section of Activity. Counts are kept by name, so they
+// carry over reloads and filters of the same name in client overrides
+// share them.
+type filterStats struct {
+	evaluations *metrics.CounterVec
+	blocks      *metrics.CounterVec
+	duration    *metrics.HistogramVec
+
+	mu      sync.Mutex
+	filters map[[2]string]*FilterActivity // by name and phase
+}
+
+func newFilterStats(reg *metrics.Registry) *filterStats {
+	return &filterStats{
+		evaluations: reg.Counter("auditproxy_filter_evaluations_total",
+			"Filter evaluations, by filter and phase.", "filter", "phase"),
+		blocks: reg.Counter("auditproxy_filter_blocks_total",
+			"Exchanges filters blocked, by filter and phase.", "filter", "phase"),
+		duration: reg.Histogram("auditproxy_filter_duration_seconds",
+			"Time filters took to evaluate, by filter and phase.", filterBuckets, "filter", "phase"),
+		filters: map[[2]string]*FilterActivity{},
+	}
+}
+
+// ObserveFilter implements filters.Observer.
+func (s *filterStats) ObserveFilter(name, phase string, took time.Duration, err error) {
+	s.evaluations.With(name, phase).Inc()
+	s.duration.With(name, phase).Observe(took.Seconds())
+	if err != nil {
+		s.blocks.With(name, phase).Inc()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f := s.filters[[2]string{name, phase}]
+	if f == nil {
+		f = &FilterActivity{Name: name, Phase: phase}
+		s.filters[[2]string{name, phase}] = f
+	}
+	f.Evaluations++
+	f.total += took
+	f.MaxMS = max(f.MaxMS, millis(took))
+	if err != nil {
+		f.Blocks++
+		f.LastBlock = time.Now()
+	}
+}
+
+// snapshot returns the filters' counts, most evaluated first.
+func (s *filterStats) snapshot() []FilterActivity {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]FilterActivity, 0, len(s.filters))
+	for _, f := range s.filters {
+		a := *f
+		a.MeanMS = millis(f.total / time.Duration(f.Evaluations))
+		out = append(out, a)
+	}
+	slices.SortFunc(out, func(a, b FilterActivity) int {
+		return cmp.Or(cmp.Compare(b.Evaluations, a.Evaluations),
+			strings.Compare(a.Name, b.Name), strings.Compare(a.Phase, b.Phase))
+	})
+	return out
+}
+
+// millis returns d in milliseconds, to the microsecond.
+func millis(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
@@ -0,0 +1,489 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/kdhira/audit-proxy/internal/audit"
+)
+
+// Classes of ambiguous request framing, recorded in the framing.anomalies
+// attribute.
+const (
+	framingDuplicateLength   = "duplicate_content_length"
+	framingInvalidLength     = "invalid_content_length"
+	framingLengthAndEncoding = "content_length_with_transfer_encoding"
+	framingInvalidEncoding   = "invalid_transfer_encoding"
+	framingInvalidChunk      = "invalid_chunk"
+	framingInvalidExtension  = "invalid_chunk_extension"
+)
+
+const (
+	// maxFramingLine bounds a header line the scanner holds; the server
+	// refuses longer headers itself.
+	maxFramingLine = http.DefaultMaxHeaderBytes + 4096
+	// maxChunkLine bounds a chunk size line, as the server does.
+	maxChunkLine = 4096
+)
+
+// errAmbiguousFraming ends the reading of a request body found to be
+// malformed, so what follows is not forwarded.
+var errAmbiguousFraming = errors.New("ambiguous request framing")
+
+// framingRecord is what the scanner found in the framing of one request.
+// Anomalies in a chunked body are added while the request is handled.
+type framingRecord struct {
+	method string
+	target string
+
+	mu        sync.Mutex
+	anomalies []string
+}
+
+func (f *framingRecord) add(class string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !slices.Contains(f.anomalies, class) {
+		f.anomalies = append(f.anomalies, class)
+	}
+}
+
+// classes returns the anomalies found so far; none for a nil record.
+func (f *framingRecord) classes() []string {
+	if f == nil {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.anomalies)
+}
+
+type framingState int
+
+const (
+	framingRequestLine framingState = iota
+	framingHeaders
+	framingBody
+	framingChunkSize
+	framingChunkData
+	framingChunkEnd
+	framingTrailers
+	framingStopped // the connection no longer carries requests to follow
+)
+
+// framingScanner follows the bytes a client sends on a connection as the
+// server reads them, finding where each request's headers and body end as
+// the server will. It records the ambiguities in each request's framing:
+// those the server resolves on its own, such as Content-Length alongside
+// Transfer-Encoding, which a handler cannot see, and malformed chunks.
+type framingScanner struct {
+	// skipOptions leaves out "OPTIONS *" requests, which the HTTP server
+	// answers without a handler.
+	skipOptions bool
+
+	mu        sync.Mutex
+	state     framingState
+	line      []byte
+	left      int64 // bytes of the body or chunk left, or of the CRLF ending a chunk
+	cur       *framingRecord
+	proto     string
+	lengths   []string // Content-Length values
+	encodings []string // Transfer-Encoding header values
+	last      string   // the previous header's name, for continuation lines
+	ready     []*framingRecord
+	err       error
+}
+
+// scan follows p, the next bytes read from the connection. It returns
+// errAmbiguousFraming once a body is found malformed.
+func (s *framingScanner) scan(p []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(p) > 0 && s.err == nil && s.state != framingStopped {
+		switch s.state {
+		case framingBody, framingChunkData:
+			n := min(int64(len(p)), s.left)
+			p, s.left = p[n:], s.left-n
+			if s.left > 0 {
+				continue
+			}
+			if s.state == framingBody {
+				s.state = framingRequestLine
+			} else {
+				s.state, s.left = framingChunkEnd, 2
+			}
+		case framingChunkEnd:
+			if p[0] != "\r\n"[2-s.left] {
+				s.fail(framingInvalidChunk)
+				continue
+			}
+			p, s.left = p[1:], s.left-1
+			if s.left == 0 {
+				s.state = framingChunkSize
+			}
+		default:
+			i := bytes.IndexByte(p, '\n')
+			if i < 0 {
+				s.line = append(s.line, p...)
+				p = nil
+			} else {
+				s.line = append(s.line, p[:i+1]...)
+				p = p[i+1:]
+			}
+			chunked := s.state == framingChunkSize || s.state == framingTrailers
+			switch {
+			case chunked && len(s.line) > maxChunkLine:
+				s.fail(framingInvalidChunk)
+			case len(s.line) > maxFramingLine:
+				s.state = framingStopped
+			case i >= 0:
+				s.endLine(s.line)
+				s.line = s.line[:0]
+			}
+		}
+	}
+	return s.err
+}
+
+// fail records a malformed body and stops the connection.
+func (s *framingScanner) fail(class string) {
+	s.cur.add(class)
+	s.err = errAmbiguousFraming
+}
+
+// endLine handles a line ending in LF.
+func (s *framingScanner) endLine(line []byte) {
+	text := bytes.TrimSuffix(bytes.TrimSuffix(line, []byte("\n")), []byte("\r"))
+	switch s.state {
+	case framingRequestLine:
+		if len(text) == 0 {
+			return
+		}
+		s.cur = &framingRecord{}
+		if f := strings.Fields(string(text)); len(f) == 3 {
+			s.cur.method, s.cur.target, s.proto = f[0], f[1], f[2]
+		}
+		s.lengths, s.encodings, s.last = nil, nil, ""
+		s.state = framingHeaders
+	case framingHeaders:
+		if len(text) == 0 {
+			s.endHeaders()
+			return
+		}
+		if text[0] == ' ' || text[0] == '\t' {
+			// A continuation line folds into the previous header.
+			switch s.last {
+			case "content-length":
+				s.cur.add(framingInvalidLength)
+			case "transfer-encoding":
+				s.cur.add(framingInvalidEncoding)
+			}
+			return
+		}
+		name, value, _ := strings.Cut(string(text), ":")
+		s.last = strings.ToLower(name)
+		switch s.last {
+		case "content-length":
+			for v := range strings.SplitSeq(value, ",") {
+				s.lengths = append(s.lengths, strings.TrimSpace(v))
+			}
+		case "transfer-encoding":
+			s.encodings = append(s.encodings, strings.TrimSpace(value))
+		}
+	case framingChunkSize:
+		size, class := parseChunkLine(line)
+		switch {
+		case class != "":
+			s.fail(class)
+		case size == 0:
+			s.state = framingTrailers
+		default:
+			s.state, s.left = framingChunkData, size
+		}
+	case framingTrailers:
+		if len(text) == 0 {
+			s.state = framingRequestLine
+		}
+	}
+}
+
+// endHeaders records the anomalies in the headers just read and follows
+// the body as the server will read it.
+func (s *framingScanner) endHeaders() {
+	rec := s.cur
+	if len(s.lengths) > 1 {
+		rec.add(framingDuplicateLength)
+	}
+	for _, v := range s.lengths {
+		if !validLength(v) {
+			rec.add(framingInvalidLength)
+		}
+	}
+	// HTTP/1.0 has no Transfer-Encoding; the server ignores it there.
+	encoded := len(s.encodings) > 0 && s.proto != "HTTP/1.0"
+	chunked := len(s.encodings) == 1 && strings.EqualFold(s.encodings[0], "chunked")
+	if len(s.encodings) > 0 {
+		if len(s.lengths) > 0 {
+			rec.add(framingLengthAndEncoding)
+		}
+		if !chunked || !encoded {
+			rec.add(framingInvalidEncoding)
+		}
+	}
+	if !s.skipOptions || rec.method != http.MethodOptions || rec.target != "*" {
+		s.ready = append(s.ready, rec)
+	}
+	s.state = framingRequestLine
+	switch {
+	case encoded && chunked:
+		s.state = framingChunkSize
+	case encoded:
+		// The server refuses other encodings and closes the connection.
+		s.state = framingStopped
+	case len(s.lengths) > 0:
+		n, err := strconv.ParseInt(s.lengths[0], 10, 64)
+		if err != nil || !validLength(s.lengths[0]) || slices.ContainsFunc(s.lengths, func(v string) bool { return v != s.lengths[0] }) {
+			// The server refuses the request and closes the connection.
+			s.state = framingStopped
+		} else if n > 0 {
+			s.state, s.left = framingBody, n
+		}
+	}
+}
+
+// next returns the record of the oldest request whose headers were read
+// and not yet handled, or nil if there is none.
+func (s *framingScanner) next() *framingRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.ready) == 0 {
+		return nil
+	}
+	rec := s.ready[0]
+	s.ready = s.ready[1:]
+	return rec
+}
+
+// unhandled returns the records of requests read but never handled that
+// have anomalies: those the server refused to read.
+func (s *framingScanner) unhandled() []*framingRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []*framingRecord
+	for _, rec := range s.ready {
+		if len(rec.classes()) > 0 {
+			out = append(out, rec)
+		}
+	}
+	s.ready = nil
+	return out
+}
+
+// stop ends scanning, once the connection is hijacked for a tunnel.
+func (s *framingScanner) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state = framingStopped
+}
+
+// validLength reports whether v is a Content-Length the server accepts.
+func validLength(v string) bool {
+	if v == "" || len(v) > 19 {
+		return false
+	}
+	for i := range len(v) {
+		if v[i] < '0' || v[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// parseChunkLine returns the size of the chunk line, or the class of
+// anomaly it has. The line must end in CRLF and any extensions must be
+// well formed: ;name or ;name=value, the value a token or quoted string.
+func parseChunkLine(line []byte) (int64, string) {
+	text, ok := bytes.CutSuffix(line, []byte("\r\n"))
+	if !ok {
+		return 0, framingInvalidChunk
+	}
+	i := 0
+	for i < len(text) && isHexDigit(text[i]) {
+		i++
+	}
+	if i == 0 || i > 15 {
+		return 0, framingInvalidChunk
+	}
+	size, _ := strconv.ParseInt(string(text[:i]), 16, 64)
+	if !validChunkExtensions(text[i:]) {
+		return 0, framingInvalidExtension
+	}
+	return size, ""
+}
+
+func validChunkExtensions(ext []byte) bool {
+	for len(ext) > 0 {
+		ext = trimBWS(ext)
+		if len(ext) == 0 || ext[0] != ';' {
+			return false
+		}
+		ext = trimBWS(ext[1:])
+		n := tokenLen(ext)
+		if n == 0 {
+			return false
+		}
+		ext = ext[n:]
+		if rest := trimBWS(ext); len(rest) > 0 && rest[0] == '=' {
+			ext = trimBWS(rest[1:])
+			if n = tokenLen(ext); n == 0 {
+				n = quotedLen(ext)
+			}
+			if n == 0 {
+				return false
+			}
+			ext = ext[n:]
+		}
+	}
+	return true
+}
+
+func trimBWS(b []byte) []byte {
+	return bytes.TrimLeft(b, " \t")
+}
+
+func isHexDigit(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+// tokenLen returns the length of the token b starts with.
+func tokenLen(b []byte) int {
+	n := 0
+	for n < len(b) && (b[n] >= '0' && b[n] <= '9' || b[n] >= 'a' && b[n] <= 'z' ||
+		b[n] >= 'A' && b[n] <= 'Z' || strings.IndexByte("!#$%&'*+-.^_`|~", b[n]) >= 0) {
+		n++
+	}
+	return n
+}
+
+// quotedLen returns the length of the quoted string b starts with, or 0.
+func quotedLen(b []byte) int {
+	if len(b) == 0 || b[0] != '"' {
+		return 0
+	}
+	for i := 1; i < len(b); i++ {
+		switch c := b[i]; {
+		case c == '"':
+			return i + 1
+		case c == '\\':
+			if i++; i == len(b) || b[i] < ' ' && b[i] != '\t' || b[i] == 0x7f {
+				return 0
+			}
+		case c < ' ' && c != '\t' || c == 0x7f:
+			return 0
+		}
+	}
+	return 0
+}
+
+// framedConn scans what is read from a client connection.
+type framedConn struct {
+	net.Conn
+	scan *framingScanner
+	// closed is called with the requests the server refused to read.
+	closed func(refused []*framingRecord)
+}
+
+func (c *framedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		if serr := c.scan.scan(p[:n]); serr != nil {
+			return 0, serr
+		}
+	}
+	return n, err
+}
+
+func (c *framedConn) Close() error {
+	if c.closed != nil {
+		if refused := c.scan.unhandled(); len(refused) > 0 {
+			c.closed(refused)
+		}
+	}
+	return c.Conn.Close()
+}
+
+// framingListener scans the connections the proxy listener accepts.
+type framingListener struct {
+	net.Listener
+	h *handler
+}
+
+func (l framingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	remote := c.RemoteAddr().String()
+	return &framedConn{Conn: c, scan: &framingScanner{skipOptions: true}, closed: func(refused []*framingRecord) {
+		for _, rec := range refused {
+			l.h.auditRefusedFraming(remote, "", rec)
+		}
+	}}, nil
+}
+
+type framingKey struct{}
+
+func withFraming(ctx context.Context, rec *framingRecord) context.Context {
+	return context.WithValue(ctx, framingKey{}, rec)
+}
+
+func framingFrom(ctx context.Context) *framingRecord {
+	rec, _ := ctx.Value(framingKey{}).(*framingRecord)
+	return rec
+}
+
+// refuseFraming denies x for the anomalies in its framing.
+func (h *handler) refuseFraming(x *exchange) {
+	x.deny(http.StatusBadRequest, errAmbiguousFraming.Error())
+	h.conns.violation(x.entry.Conn.ClientAddr, violationFraming)
+}
+
+// auditRefusedFraming writes an entry for a request from remote that the
+// server refused to read because of its framing, so no handler saw it. An
+// authority is the host of the MITM tunnel the request came through.
+func (h *handler) auditRefusedFraming(remote, authority string, rec *framingRecord) {
+	kind := audit.KindHTTP
+	u, err := url.ParseRequestURI(rec.target)
+	switch {
+	case authority != "":
+		kind = audit.KindMITM
+		if err != nil {
+			u = &url.URL{Path: "/"}
+		}
+		u.Scheme, u.Host = "https", authority
+	case rec.method == http.MethodConnect:
+		kind = audit.KindConnect
+		u = &url.URL{Host: rec.target}
+	case err != nil:
+		u = &url.URL{}
+	}
+	r := (&http.Request{
+		Method:     rec.method,
+		URL:        u,
+		Host:       u.Host,
+		RemoteAddr: remote,
+		Header:     http.Header{},
+	}).WithContext(withFraming(context.Background(), rec))
+	x := h.begin(kind, r)
+	x.entry.Conn.TLS = authority != ""
+	h.refuseFraming(x)
+	h.finish(x)
+}
@@ -0,0 +1,662 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/kdhira/audit-proxy/internal/audit"
+	"github.com/kdhira/audit-proxy/internal/config"
+	"github.com/kdhira/audit-proxy/internal/filters"
+	"github.com/kdhira/audit-proxy/internal/fingerprint"
+	"github.com/kdhira/audit-proxy/internal/forward"
+	"github.com/kdhira/audit-proxy/internal/mitm"
+	"github.com/kdhira/audit-proxy/internal/rollout"
+	"github.com/kdhira/audit-proxy/internal/threatintel"
+	"github.com/kdhira/audit-proxy/internal/workload"
+)
+
+// handler is the http.Handler behind Server.
+type handler struct {
+	cfg          config.Config
+	logger       audit.Logger
+	upstreams    *upstreams
+	resolver     *forward.Resolver
+	mitm         *mitm.Manager
+	pinning      *pinning
+	clientCerts  *clientCerts
+	clientTLS    *clientTLSPolicy
+	resumption   *resumption
+	auth         *authenticator
+	rules        atomic.Pointer[rules]
+	failover     []*failoverRule
+	shadows      []*shadowRule
+	shadowSlots  chan struct{}
+	cache        *responseCache
+	hostsSeen    *hostTracker
+	unaudited    *unaudited
+	workloads    *workload.Resolver
+	pools        []*pool
+	retry        retryPolicy
+	breakers     *breakers
+	limiter      *limiter
+	quotas       *quotas
+	budgets      *budgets
+	threats      *threatintel.Feeds
+	overrides    *overrides
+	conns        *connGuard
+	respEdits    responseEdits
+	fingerprint  *fingerprint.Fingerprinter
+	cors         *corsPolicy
+	direct       *url.URL
+	connectPorts *portPolicy
+	observer     *observer
+	activity     *activity
+	filterStats  *filterStats
+	drain        *drainState
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// The framing of each request the server reads is checked before
+	// anything else answers it.
+	if rec := connStateFrom(r.Context()).nextFraming(); rec != nil {
+		r = r.WithContext(withFraming(r.Context(), rec))
+		if len(rec.classes()) > 0 {
+			x := h.begin(requestKind(r), r)
+			h.refuseFraming(x)
+			w.Header().Set("Connection", "close")
+			writeJSON(w, http.StatusBadRequest, errorBody{Error: x.entry.Reason})
+			h.finish(x)
+			return
+		}
+	}
+	// Browsers fetch the PAC file directly and without proxy credentials.
+	if h.cfg.PAC.Enabled && r.URL.Host == "" && pacPaths[r.URL.Path] {
+		h.servePAC(w, r)
+		return
+	}
+	// Clients fetch the CA certificate before they can trust the proxy.
+	if f, ok := caPaths[r.URL.Path]; ok && h.mitm != nil && r.URL.Host == "" {
+		h.serveCA(w, r, f)
+		return
+	}
+	if h.drain.active() {
+		h.drain.refuse()
+		x := h.begin(requestKind(r), r)
+		x.deny(http.StatusServiceUnavailable, "proxy draining")
+		w.Header().Set("Connection", "close")
+		writeJSON(w, http.StatusServiceUnavailable, errorBody{Error: "proxy draining"})
+		h.finish(x)
+		return
+	}
+	last, refused := h.conns.request(connStateFrom(r.Context()))
+	if last {
+		w.Header().Set("Connection", "close")
+	}
+	if refused != "" {
+		x := h.begin(requestKind(r), r)
+		x.deny(http.StatusTooManyRequests, refused)
+		w.Header().Set("Connection", "close")
+		writeJSON(w, http.StatusTooManyRequests, errorBody{Error: refused})
+		h.finish(x)
+		return
+	}
+	if h.auth != nil {
+		id, ok := h.auth.authenticate(r)
+		if !ok {
+			x := h.begin(requestKind(r), r)
+			x.deny(http.StatusProxyAuthRequired, "proxy authentication required")
+			h.auth.challenge(w)
+			h.finish(x)
+			return
+		}
+		r = r.WithContext(withIdentity(r.Context(), id))
+	}
+	if pattern, ok := h.rules.Load().unauditedTarget(r); ok {
+		h.passUnaudited(w, r, pattern)
+		return
+	}
+	if r.Method == http.MethodConnect {
+		defer h.drain.enter()()
+		h.handleConnect(w, r)
+		return
+	}
+	if r.URL.Host == "" {
+		h.handleDirect(w, r)
+		return
+	}
+	h.handleHTTP(w, r)
+}
+
+// canonicalise records how r's target was sent and whether its Host header
+// agrees with its URL. The server replaces the Host header of proxy-form
+// requests with the URL's host, so mismatches show up on intercepted
+// requests, where the URL carries the tunnel's host.
+func canonicalise(m *audit.RequestMetadata, r *http.Request) {
+	if r.RequestURI != "" && r.RequestURI != m.URL {
+		m.RawTarget = r.RequestURI
+	}
+	if c := fingerprint.NormalizeURL(r.URL); c != m.URL {
+		m.CanonicalURL = c
+	}
+	port := defaultPort(r.URL.Scheme)
+	if r.Host != "" && !sameHost(r.Host, r.URL.Host, port) {
+		m.HostMismatch = true
+		m.HostHeader = r.Host
+	}
+}
+
+// sameHost reports whether hostports a and b name the same host and port,
+// defaultPort applying to either without one.
+func sameHost(a, b, defaultPort string) bool {
+	norm := func(hp string) string {
+		port := defaultPort
+		if _, p, err := net.SplitHostPort(hp); err == nil {
+			port = p
+		}
+		return net.JoinHostPort(strings.TrimSuffix(hostname(hp), "."), port)
+	}
+	return norm(a) == norm(b)
+}
+
+// requestKind is the entry kind for a request received on the listener.
+func requestKind(r *http.Request) string {
+	if r.Method == http.MethodConnect {
+		return audit.KindConnect
+	}
+	return audit.KindHTTP
+}
+
+// hostDenied returns why hostport may not be reached under p, or "" if it
+// may: it must match AllowHosts and not match DenyHosts or a threat feed,
+// which take precedence. defaultPort applies when hostport has no port.
+func (h *handler) hostDenied(p *policy, hostport, defaultPort string) string {
+	if p.denyHosts.match(hostport, defaultPort) {
+		return "host denied"
+	}
+	if feed, entry, ok := h.threats.Match(hostport); ok {
+		return "host listed by threat feed " + feed + " (" + entry + ")"
+	}
+	if !p.allowHosts.match(hostport, defaultPort) {
+		return "host not allowed"
+	}
+	return ""
+}
+
+// handleHTTP forwards a proxy-form HTTP request.
+func (h *handler) handleHTTP(w http.ResponseWriter, r *http.Request) {
+	x := h.begin(audit.KindHTTP, r)
+	defer h.finish(x)
+
+	if reason := h.hostDenied(x.policy, r.URL.Host, defaultPort(r.URL.Scheme)); reason != "" {
+		x.deny(http.StatusForbidden, reason)
+		writeJSON(w, http.StatusForbidden, errorBody{Error: reason})
+		return
+	}
+	if reason := h.egressDenied(x.ctx(), r.URL.Host); reason != "" {
+		x.deny(http.StatusForbidden, reason)
+		writeJSON(w, http.StatusForbidden, errorBody{Error: reason})
+		return
+	}
+	if hdr := h.corsPreflight(x); hdr != nil {
+		copyHeaders(w.Header(), hdr)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	h.overrides.apply(x)
+	if err := x.policy.filters.OnRequest(x.ctx(), x.req); err != nil {
+		be := x.block(err)
+		writeJSON(w, be.StatusCode(), blockBody(be))
+		return
+	}
+	if resp := h.mockResponse(x); resp != nil {
+		copyHeaders(w.Header(), resp.Header)
+		w.WriteHeader(resp.StatusCode)
+		_, _ = io.Copy(w, resp.Body)
+		return
+	}
+	if resp := h.replayResponse(x); resp != nil {
+		copyHeaders(w.Header(), resp.Header)
+		w.WriteHeader(resp.StatusCode)
+		_, _ = io.Copy(w, resp.Body)
+		return
+	}
+	if resp := h.cachedResponse(x); resp != nil {
+		copyHeaders(w.Header(), resp.Header)
+		w.WriteHeader(resp.StatusCode)
+		_, _ = io.Copy(w, resp.Body)
+		return
+	}
+	if status, reason := h.quotas.admit(x); status != 0 {
+		x.deny(status, reason)
+		writeJSON(w, status, errorBody{Error: reason})
+		return
+	}
+	if status, reason := h.budgets.admit(x); status != 0 {
+		x.deny(status, reason)
+		writeJSON(w, status, errorBody{Error: reason})
+		return
+	}
+	if reason := h.admit(x); reason != "" {
+		x.deny(http.StatusServiceUnavailable, reason)
+		writeJSON(w, http.StatusServiceUnavailable, errorBody{Error: reason})
+		return
+	}
+
+	resp, err := h.forward(x)
+	if err != nil {
+		writeJSON(w, upstreamStatus(err), errorBody{Error: "upstream request failed"})
+		return
+	}
+	defer resp.Body.Close()
+	if err := x.policy.filters.OnResponse(x.ctx(), x.req, resp); err != nil {
+		be := x.block(err)
+		writeJSON(w, be.StatusCode(), blockBody(be))
+		return
+	}
+
+	h.recordResponse(x, resp)
+	h.cacheResponse(x, resp)
+	h.prepareResponse(x, resp)
+	copyHeaders(w.Header(), resp.Header)
+	w.WriteHeader(resp.StatusCode)
+	if _, err := copyStream(w, resp.Body); err != nil {
+		x.entry.Error = err.Error()
+	}
+}
+
+// exchange carries the audit state of one proxied request.
+type exchange struct {
+	entry    audit.Entry
+	attrs    *audit.Attributes
+	start    time.Time
+	req      *http.Request
+	rules    *rules
+	policy   *policy
+	reqBody  *capture
+	respBody *capture
+	shadowed chan audit.Entry // receives the finished entry if mirrored
+	sampled  []*captureRule   // capture rules the response may trigger
+	stream   *streamMeter
+	release  func()         // frees the concurrency slot, if one is held
+	quotas   []quotaCharge  // quotas the exchange's bytes count against
+	budgets  []budgetCharge // budgets the exchange's usage is charged to
+	usage    *usageMeter    // reads the usage budgets are charged
+	framing  *framingRecord // the request's framing, if scanned
+	started  bool           // a start record was written
+	// headersOnly keeps the bodies out of everything retained: excerpts,
+	// capture, the cache, recordings and shadows.
+	headersOnly bool
+}
+
+func (x *exchange) ctx() context.Context {
+	return x.req.Context()
+}
+
+// deny marks the entry as rejected by the proxy's own policy.
+func (x *exchange) deny(status int, reason string) {
+	x.entry.Blocked = true
+	x.entry.Reason = reason
+	x.entry.Response = &audit.ResponseMetadata{Status: status}
+}
+
+// block marks the entry as blocked by a filter.
+func (x *exchange) block(err error) *filters.BlockError {
+	var be *filters.BlockError
+	if !errors.As(err, &be) {
+		be = &filters.BlockError{Reason: err.Error()}
+	}
+	x.entry.Blocked = true
+	x.entry.Filter = be.Filter
+	x.entry.Reason = be.Reason
+	x.entry.Response = &audit.ResponseMetadata{Status: be.StatusCode()}
+	return be
+}
+
+// begin starts auditing r. The request stored on the exchange carries the
+// attribute set filters annotate.
+func (h *handler) begin(kind string, r *http.Request) *exchange {
+	ctx, attrs := audit.WithAttributes(r.Context())
+	rs := h.rules.Load()
+	p := rs.policyFor(r)
+	id := identityFrom(r.Context())
+	ctx = rollout.WithSubject(ctx, rollout.Subject{User: id.user, Client: p.client, Source: sourceOf(r.RemoteAddr)})
+	x := &exchange{
+		entry:   audit.NewEntry(kind),
+		attrs:   attrs,
+		start:   time.Now(),
+		req:     r.WithContext(ctx),
+		rules:   rs,
+		policy:  p,
+		framing: framingFrom(r.Context()),
+	}
+	x.entry.Conn.ClientAddr = r.RemoteAddr
+	x.entry.Conn.Client = x.policy.client
+	x.entry.Conn.User, x.entry.Conn.AuthMethod = id.user, id.method
+	x.entry.Conn.Target = targetOf(r)
+	x.entry.Conn.Workload = h.workloadOf(r)
+	x.entry.Conn.ClientCert = clientCertFrom(r.Context())
+	x.entry.Conn.ClientTLS = clientTLSFrom(r.Context())
+	x.entry.Request = audit.RequestMetadata{
+		Method:  r.Method,
+		URL:     r.URL.String(),
+		Host:    hostname(targetOf(r)),
+		Headers: audit.SanitiseHeaders(r.Header),
+	}
+	port := defaultPort(r.URL.Scheme)
+	if kind == audit.KindConnect {
+		x.entry.Request.URL = ""
+		port = "443"
+	} else {
+		canonicalise(&x.entry.Request, r)
+		x.sampled = h.captureCandidates(x)
+	}
+	x.entry.Service = rs.serviceFor(targetOf(r), port)
+	if isDirect(r.Context()) {
+		x.attrs.Set("direct", true)
+	}
+	return x
+}
+
+// forward sends the exchange's request upstream, capturing body excerpts.
+// Targets served by an upstream pool are routed to one of its endpoints.
+// When a failover rule covers the request, a failed primary attempt is
+// retried against the rule's target. Requests a shadow rule covers are
+// also mirrored to its target.
+func (h *handler) forward(x *exchange) (*http.Response, error) {
+	h.logStart(x)
+	out := cloneRequest(x.req)
+	if h.cfg.ForwardedHeaders {
+		addForwarded(out, x.req)
+	}
+	limit := x.excerptBytes()
+	x.reqBody = &capture{limit: limit, hash: fingerprint.Body()}
+	if rule := h.shadowFor(x.req); rule != nil && !x.headersOnly {
+		h.shadow(x, rule, out)
+	}
+	var ep *endpoint
+	if p := h.poolFor(out); p != nil {
+		ep = p.pick(time.Now())
+		retarget(out, ep.url)
+		x.entry.Conn.Upstream = ep.url.String()
+	}
+	if rule := h.failoverFor(x.req); rule != nil {
+		if body, ok := bufferBody(out); ok {
+			return h.forwardWithFailover(x, out, body, rule, ep)
+		}
+	}
+	if out.Body != nil && out.Body != http.NoBody {
+		out.Body = teeBody(out.Body, x.reqBody)
+	}
+	resp, err := h.roundTrip(x, out)
+	if ep != nil {
+		ep.observe(resp, err, time.Now())
+	}
+	return resp, err
+}
+
+// roundTrip sends out, retrying idempotent requests under the retry
+// policy, and records the response metadata and resolved address on x. It
+// fails fast while the target's circuit breaker is open.
+func (h *handler) roundTrip(x *exchange, out *http.Request) (*http.Response, error) {
+	out = out.WithContext(httptrace.WithClientTrace(out.Context(), &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			x.entry.Conn.ResolvedIP = remoteIPOf(info.Conn)
+		},
+	}))
+	done, err := h.breakers.allow(out.URL.Host, defaultPort(out.URL.Scheme), time.Now())
+	if err != nil {
+		x.entry.Error = err.Error()
+		x.attrs.Set("circuit_breaker", "open")
+		return nil, err
+	}
+	up := h.upstreams.forTarget(out.URL.Host, defaultPort(out.URL.Scheme))
+	if up.insecure && out.URL.Scheme == "https" {
+		x.attrs.Set("upstream.tls_insecure", true)
+	}
+	if up.clientCert != "" && out.URL.Scheme == "https" {
+		x.attrs.Set("upstream.client_cert_sha256", up.clientCert)
+	}
+	resp, attempts, err := h.retry.roundTrip(up.transport, out)
+	done(breakerFailure(resp, err))
+	if attempts > 1 {
+		x.attrs.Set("retry.attempts", attempts)
+	}
+	if err != nil {
+		x.entry.Error = err.Error()
+		annotateUpstreamTLS(x, nil, err)
+		h.upstreams.revocation.annotate(x, nil, err)
+		slog.Warn("upstream request failed", "url", x.attrs.RedactURL(out.URL.String()), "err", err)
+		return nil, err
+	}
+	annotateUpstreamTLS(x, resp.TLS, nil)
+	h.upstreams.revocation.annotate(x, resp.TLS, nil)
+	x.entry.Response = &audit.ResponseMetadata{
+		Status:  resp.StatusCode,
+		Headers: audit.SanitiseHeaders(resp.Header),
+	}
+	x.respBody = &capture{limit: x.excerptBytes()}
+	x.stream, x.usage = nil, nil
+	meters := []io.Writer{x.respBody}
+	if isEventStream(resp) && !x.headersOnly {
+		x.stream = &streamMeter{}
+		meters = append(meters, x.stream)
+	}
+	if len(x.budgets) > 0 {
+		x.usage = newUsageMeter(resp, x.stream)
+		meters = append(meters, x.usage)
+	}
+	resp.Body = teeBody(resp.Body, io.MultiWriter(meters...))
+	return resp, nil
+}
+
+// logStart writes the start record for x, holding what is known of the
+// request before it goes upstream, if two-phase logging is enabled.
+func (h *handler) logStart(x *exchange) {
+	if !h.cfg.LogBeforeForward {
+		return
+	}
+	x.started = true
+	e := x.entry
+	e.Phase = audit.PhaseStart
+	e.Attributes = maps.Clone(e.Attributes)
+	x.attrs.CopyTo(&e)
+	if e.Kind != audit.KindConnect {
+		x.rules.profiles.Annotate(x.req, &e)
+	}
+	if err := h.logger.Log(e); err != nil {
+		slog.Error("write audit entry", "err", err)
+	}
+}
+
+// fingerprintOf returns the fingerprint of the request x forwarded, over
+// the body bytes sent so far.
+func (h *handler) fingerprintOf(x *exchange) string {
+	return h.fingerprint.Sum(x.req.Method, x.req.URL, x.req.Header, x.reqBody.hash.Sum(nil))
+}
+
+// finish completes and writes the entry.
+func (h *handler) finish(x *exchange) {
+	if x.release != nil {
+		x.release()
+	}
+	e := &x.entry
+	latency := time.Since(x.start)
+	e.DurationMS = latency.Milliseconds()
+	x.settleCapture()
+	if c := x.reqBody; c != nil {
+		e.BytesOut = c.n
+		e.Fingerprint = h.fingerprintOf(x)
+		if c.buf.Len() > 0 {
+			e.Request.Excerpt = x.rules.excerpt(c, e)
+			e.Request.ExcerptTruncated = c.truncated()
+		}
+	}
+	if c := x.respBody; c != nil && e.Response != nil {
+		e.BytesIn = c.n
+		if c.buf.Len() > 0 {
+			e.Response.Excerpt = x.rules.excerpt(c, e)
+			e.Response.ExcerptTruncated = c.truncated()
+		}
+	}
+	if e.Kind != audit.KindConnect {
+		x.rules.profiles.Annotate(x.req, e)
+		annotateAPIVersion(e, x.req)
+	}
+	if x.stream != nil {
+		x.stream.annotate(x.attrs, x.start)
+	}
+	h.quotas.charge(x)
+	h.budgets.charge(x)
+	if classes := x.framing.classes(); len(classes) > 0 {
+		x.attrs.Set("framing.anomalies", classes)
+		// Anomalies in a chunked body are found only as it is read.
+		if !e.Blocked {
+			e.Blocked, e.Reason = true, errAmbiguousFraming.Error()
+			h.conns.violation(e.Conn.ClientAddr, violationFraming)
+		}
+	}
+	x.attrs.CopyTo(e)
+	if e.Response != nil {
+		annotateDeprecation(e, e.Response.Headers)
+	}
+	if x.started {
+		e.Phase = audit.PhaseFinish
+	}
+	if err := h.logger.Log(*e); err != nil {
+		slog.Error("write audit entry", "err", err)
+	}
+	h.observer.observe(e, latency, h.logger)
+	h.observer.observeStream(e, x.stream)
+	if x.shadowed != nil {
+		x.shadowed <- *e
+	}
+	h.activity.record(e)
+}
+
+// cloneRequest prepares an inbound request for the upstream transport,
+// dropping hop-by-hop and proxy headers.
+func cloneRequest(r *http.Request) *http.Request {
+	out := r.Clone(r.Context())
+	out.RequestURI = ""
+	removeHopHeaders(out.Header)
+	for k := range out.Header {
+		if strings.HasPrefix(k, "Proxy-") {
+			out.Header.Del(k)
+		}
+	}
+	return out
+}
+
+func copyHeaders(dst, src http.Header) {
+	for k, vs := range src {
+		for _, v := range vs {
+			dst.Add(k, v)
+		}
+	}
+}
+
+// copyStream copies src to w, flushing after every read so streamed
+// responses (SSE, chunked) reach the client without delay.
+func copyStream(w http.ResponseWriter, src io.Reader) (int64, error) {
+	rc := http.NewResponseController(w)
+	return copyFlushing(w, rc.Flush, src)
+}
+
+// copyFlushing copies src to w, calling flush after every read.
+func copyFlushing(w io.Writer, flush func() error, src io.Reader) (int64, error) {
+	buf := make([]byte, 32<<10)
+	var n int64
+	for {
+		nr, rerr := src.Read(buf)
+		if nr > 0 {
+			nw, werr := w.Write(buf[:nr])
+			n += int64(nw)
+			if werr != nil {
+				return n, werr
+			}
+			if err := flush(); err != nil {
+				return n, err
+			}
+		}
+		if rerr == io.EOF {
+			return n, nil
+		}
+		if rerr != nil {
+			return n, rerr
+		}
+	}
+}
+
+type errorBody struct {
+	Error  string `json:"error"`
+	Filter string `json:"filter,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+func blockBody(be *filters.BlockError) errorBody {
+	return errorBody{Error: filters.ErrBlocked.Error(), Filter: be.Filter, Reason: be.Reason}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// targetOf returns the host:port (or host) a request is addressed to.
+func targetOf(r *http.Request) string {
+	if r.Method == http.MethodConnect || r.URL.Host == "" {
+		return r.Host
+	}
+	return r.URL.Host
+}
+
+// egressDenied returns why the target of hostport may not be reached under
+// the egress policy, or "". Lookup failures are left for the dial to
+// report.
+func (h *handler) egressDenied(ctx context.Context, hostport string) string {
+	if !h.cfg.Egress.BlockPrivate {
+		return ""
+	}
+	var blocked *forward.BlockedError
+	if _, err := h.resolver.Resolve(ctx, hostname(hostport)); errors.As(err, &blocked) {
+		return blocked.Error()
+	}
+	return ""
+}
+
+// remoteIPOf returns the IP of c's remote address.
+func remoteIPOf(c net.Conn) string {
+	if addr, ok := remoteIP(c.RemoteAddr().String()); ok {
+		return addr.String()
+	}
+	return ""
+}
+
+// defaultPort returns the port implied by a URL scheme.
+func defaultPort(scheme string) string {
+	if strings.EqualFold(scheme, "https") {
+		return "443"
+	}
+	return "80"
+}
+
+// hostname strips any port and brackets from hostport and lower-cases it.
+func hostname(hostport string) string {
+	host := hostport
+	if h, _, err := net.SplitHostPort(hostport); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.Trim(host, "[]"))
+}
@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"slices"
+	"strings"
+
+	"github.com/kdhira/audit-proxy/internal/config"
+)
+
+// hopHeaders are the hop-by-hop headers of RFC 7230 section 6.1 that a
+// proxy must not forward, plus the Proxy-Connection header some clients
+// still send.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders deletes hop-by-hop headers from h, including any named in
+// Connection. "TE: trailers" is kept, as it tells an HTTP/2 upstream the
+// client accepts trailers.
+func removeHopHeaders(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			if name = textproto.TrimString(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	trailers := false
+	for _, v := range h.Values("Te") {
+		for _, t := range strings.Split(v, ",") {
+			trailers = trailers || strings.EqualFold(textproto.TrimString(t), "trailers")
+		}
+	}
+	for _, k := range hopHeaders {
+		h.Del(k)
+	}
+	if trailers {
+		h.Set("Te", "trailers")
+	}
+}
+
+// viaValue is this proxy's entry in a Via header for a message of r's
+// protocol version.
+func viaValue(r *http.Request) string {
+	return fmt.Sprintf("%d.%d audit-proxy", r.ProtoMajor, r.ProtoMinor)
+}
+
+// addForwarded appends this hop to the Via and X-Forwarded-For headers of
+// out, the upstream request for in.
+func addForwarded(out, in *http.Request) {
+	out.Header.Add("Via", viaValue(in))
+	if ip, ok := remoteIP(in.RemoteAddr); ok {
+		if prior := out.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+			out.Header.Set("X-Forwarded-For", strings.Join(prior, ", ")+", "+ip.String())
+		} else {
+			out.Header.Set("X-Forwarded-For", ip.String())
+		}
+	}
+}
+
+// responseEdits are the configured changes to upstream response headers.
+type responseEdits struct {
+	names    map[string]bool // canonical names to remove
+	prefixes []string        // canonical prefixes to remove
+	set      http.Header
+}
+
+func newResponseEdits(cfg config.ResponseHeadersConfig) responseEdits {
+	e := responseEdits{names: map[string]bool{}, set: http.Header{}}
+	for _, n := range cfg.Remove {
+		if p, ok := strings.CutSuffix(n, "*"); ok {
+			e.prefixes = append(e.prefixes, textproto.CanonicalMIMEHeaderKey(p))
+		} else {
+			e.names[textproto.CanonicalMIMEHeaderKey(n)] = true
+		}
+	}
+	for k, v := range cfg.Set {
+		e.set.Set(k, v)
+	}
+	return e
+}
+
+// apply edits h and returns the names of the headers it removed, sorted.
+func (e responseEdits) apply(h http.Header) []string {
+	var removed []string
+	for k := range h {
+		if e.names[k] || e.matchPrefix(k) {
+			removed = append(removed, k)
+			delete(h, k)
+		}
+	}
+	for k, v := range e.set {
+		h[k] = v
+	}
+	slices.Sort(removed)
+	return removed
+}
+
+func (e responseEdits) matchPrefix(k string) bool {
+	for _, p := range e.prefixes {
+		if strings.HasPrefix(k, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// prepareResponse readies resp's headers for the client. The audit entry
+// keeps the headers as the upstream sent them, and lists any removed by
+// configuration.
+func (h *handler) prepareResponse(x *exchange, resp *http.Response) {
+	removeHopHeaders(resp.Header)
+	if removed := h.respEdits.apply(resp.Header); len(removed) > 0 {
+		x.attrs.Set("response.headers_removed", removed)
+	}
+	if origin := h.cors.origin(x.req); origin != "" {
+		h.cors.allow(resp.Header, origin)
+	}
+	if h.cfg.ForwardedHeaders {
+		resp.Header.Add("Via", viaValue(x.req))
+	}
+}
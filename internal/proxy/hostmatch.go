@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// hostPattern is one compiled allow_hosts entry. Supported forms:
+//
+//	example.com      exactly example.com
+//	*.example.com    any subdomain of example.com, but not example.com itself
+//	10.0.0.0/8       IP literal targets within the range (also IPv6)
+//	192.0.2.1, ::1   a single IP literal
+//	*                any host
+//
+// Any form may carry a port constraint: example.com:443, *:443,
+// 10.0.0.0/8:8443, [2001:db8::1]:443 or [2001:db8::/32]:443.
+type hostPattern struct {
+	any    bool
+	host   string       // exact name, lower-case
+	suffix string       // ".example.com" for *.example.com
+	prefix netip.Prefix // IP literal or range
+	port   string       // empty for any port
+}
+
+// hostList is an ordered set of patterns; a target matches if any does.
+type hostList []hostPattern
+
+func compileHosts(patterns []string) (hostList, error) {
+	list := make(hostList, 0, len(patterns))
+	for _, s := range patterns {
+		p, err := parseHostPattern(s)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, p)
+	}
+	return list, nil
+}
+
+func parseHostPattern(s string) (hostPattern, error) {
+	var p hostPattern
+	host := strings.TrimSpace(s)
+	// A bare IPv6 address or range contains colons but no port.
+	if _, err := netip.ParsePrefix(host); err != nil {
+		if _, err := netip.ParseAddr(host); err != nil {
+			if h, port, err := net.SplitHostPort(host); err == nil {
+				if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+					return p, fmt.Errorf("host pattern %q: invalid port %q", s, port)
+				}
+				host, p.port = h, port
+			}
+		}
+	}
+	host = strings.ToLower(strings.Trim(host, "[]"))
+
+	switch {
+	case host == "*":
+		p.any = true
+	case strings.Contains(host, "/"):
+		prefix, err := netip.ParsePrefix(host)
+		if err != nil {
+			return p, fmt.Errorf("host pattern %q: %w", s, err)
+		}
+		p.prefix = prefix.Masked()
+	case strings.HasPrefix(host, "*."):
+		if strings.Contains(host[2:], "*") || len(host) == 2 {
+			return p, fmt.Errorf("host pattern %q: only a leading *. wildcard is supported", s)
+		}
+		p.suffix = host[1:]
+	case strings.Contains(host, "*"):
+		return p, fmt.Errorf("host pattern %q: only a leading *. wildcard is supported", s)
+	case host == "":
+		return p, fmt.Errorf("host pattern %q: empty host", s)
+	default:
+		if addr, err := netip.ParseAddr(host); err == nil {
+			addr = addr.Unmap()
+			p.prefix = netip.PrefixFrom(addr, addr.BitLen())
+		} else {
+			p.host = host
+		}
+	}
+	return p, nil
+}
+
+// match reports whether the target host and port match p. host must be
+// lower-case without brackets, as returned by hostname.
+func (p hostPattern) match(host, port string) bool {
+	if p.port != "" && p.port != port {
+		return false
+	}
+	switch {
+	case p.any:
+		return true
+	case p.prefix.IsValid():
+		addr, err := netip.ParseAddr(host)
+		return err == nil && p.prefix.Contains(addr.Unmap())
+	case p.suffix != "":
+		return strings.HasSuffix(host, p.suffix)
+	default:
+		return p.host == host
+	}
+}
+
+// match reports whether hostport matches any pattern. defaultPort is used
+// when hostport has no port.
+func (l hostList) match(hostport, defaultPort string) bool {
+	return l.index(hostport, defaultPort) >= 0
+}
+
+// index returns the index of the first pattern matching hostport, or -1.
+func (l hostList) index(hostport, defaultPort string) int {
+	host, port := hostname(hostport), defaultPort
+	if _, p, err := net.SplitHostPort(hostport); err == nil {
+		port = p
+	}
+	host = strings.TrimSuffix(host, ".")
+	for i, p := range l {
+		if p.match(host, port) {
+			return i
+		}
+	}
+	return -1
+}
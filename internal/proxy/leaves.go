@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kdhira/audit-proxy/internal/audit"
+	"github.com/kdhira/audit-proxy/internal/metrics"
+	"github.com/kdhira/audit-proxy/internal/mitm"
+)
+
+// observeLeaves exports m's leaf certificate cache as metrics.
+func observeLeaves(m *mitm.Manager, reg *metrics.Registry) {
+	requests := reg.Counter("auditproxy_mitm_leaf_requests_total",
+		"Leaf certificate lookups for intercepted tunnels, by result (hit or miss).", "result")
+	issued := reg.Counter("auditproxy_mitm_leaves_issued_total",
+		"Leaf certificates issued for intercepted tunnels.")
+	dropped := reg.Counter("auditproxy_mitm_leaf_evictions_total",
+		"Leaf certificates dropped from the cache, by reason (capacity, expired or rotated).", "reason")
+	cached := reg.Gauge("auditproxy_mitm_leaves_cached",
+		"Hosts whose leaf certificates are cached.")
+	m.OnEvent = func(event string, n int) {
+		switch event {
+		case mitm.EventHit, mitm.EventMiss:
+			requests.With(event).Inc()
+		case mitm.EventIssue:
+			issued.With().Inc()
+		case mitm.EventEvict:
+			dropped.With("capacity").Inc()
+		case mitm.EventExpire:
+			dropped.With("expired").Inc()
+		case mitm.EventRotate:
+			dropped.With("rotated").Inc()
+		}
+		cached.With().Set(float64(n))
+	}
+}
+
+// logLeaves writes a leaf entry for each leaf m issues, so what identities
+// the proxy has impersonated, and when, can be audited.
+func logLeaves(m *mitm.Manager, logger audit.Logger) {
+	m.OnIssue = func(host string, leaf *x509.Certificate, flaw string) {
+		sum := sha256.Sum256(leaf.Raw)
+		e := audit.NewEntry(audit.KindLeaf)
+		e.Request.Host = host
+		e.SetAttribute("leaf.serial", leaf.SerialNumber.Text(16))
+		e.SetAttribute("leaf.sha256", hex.EncodeToString(sum[:]))
+		e.SetAttribute("leaf.subject", leaf.Subject.String())
+		e.SetAttribute("leaf.issuer", leaf.Issuer.String())
+		e.SetAttribute("leaf.names", leafNames(leaf))
+		e.SetAttribute("leaf.not_before", leaf.NotBefore.UTC().Format(time.RFC3339))
+		e.SetAttribute("leaf.not_after", leaf.NotAfter.UTC().Format(time.RFC3339))
+		e.SetAttribute("leaf.key_algorithm", keyAlgorithm(leaf))
+		if flaw != "" {
+			e.SetAttribute("leaf.flaw", flaw)
+		}
+		if err := logger.Log(e); err != nil {
+			slog.Error("write audit entry", "err", err)
+		}
+	}
+}
+
+// leafNames returns the DNS names and IP addresses leaf is valid for.
+func leafNames(leaf *x509.Certificate) []string {
+	names := append([]string(nil), leaf.DNSNames...)
+	for _, ip := range leaf.IPAddresses {
+		names = append(names, ip.String())
+	}
+	return names
+}
+
+// keyAlgorithm names leaf's key as ecdsa-p256 or rsa-2048 do.
+func keyAlgorithm(leaf *x509.Certificate) string {
+	switch k := leaf.PublicKey.(type) {
+	case *ecdsa.PublicKey:
+		return "ecdsa-" + strings.ToLower(strings.ReplaceAll(k.Curve.Params().Name, "-", ""))
+	case *rsa.PublicKey:
+		return "rsa-" + strconv.Itoa(k.N.BitLen())
+	}
+	return strings.ToLower(leaf.PublicKeyAlgorithm.String())
+}
@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/kdhira/audit-proxy/internal/config"
+	"github.com/kdhira/audit-proxy/internal/profiles"
+)
+
+// hostMatcher is a compiled list of host patterns and /regular
+// expressions/.
+type hostMatcher struct {
+	hosts   hostList
+	regexps []*regexp.Regexp
+}
+
+func compileHostMatcher(patterns []string) (hostMatcher, error) {
+	var m hostMatcher
+	var hosts []string
+	for _, s := range patterns {
+		expr, ok := strings.CutPrefix(s, "/")
+		if !ok || !strings.HasSuffix(expr, "/") || expr == "" {
+			hosts = append(hosts, s)
+			continue
+		}
+		re, err := regexp.Compile(`^(?:` + strings.TrimSuffix(expr, "/") + `)$`)
+		if err != nil {
+			return m, fmt.Errorf("host pattern %q: %w", s, err)
+		}
+		m.regexps = append(m.regexps, re)
+	}
+	var err error
+	m.hosts, err = compileHosts(hosts)
+	return m, err
+}
+
+func (m hostMatcher) empty() bool {
+	return len(m.hosts) == 0 && len(m.regexps) == 0
+}
+
+// match reports whether hostport matches a pattern. Regular expressions
+// see the host name alone.
+func (m hostMatcher) match(hostport, defaultPort string) bool {
+	if m.hosts.match(hostport, defaultPort) {
+		return true
+	}
+	host := strings.TrimSuffix(hostname(hostport), ".")
+	return slices.ContainsFunc(m.regexps, func(re *regexp.Regexp) bool { return re.MatchString(host) })
+}
+
+// mitmSelector is the compiled mitm_disable_hosts and mitm_hosts.
+type mitmSelector struct {
+	disabled    []string
+	include     hostMatcher
+	exclude     hostMatcher
+	profiles    []profiles.Profile
+	headersOnly hostMatcher
+}
+
+func compileMITMSelector(cfg config.Config, reg *profiles.Registry) (*mitmSelector, error) {
+	s := &mitmSelector{disabled: slices.Clone(cfg.MITMDisableHosts)}
+	var err error
+	if s.include, err = compileHostMatcher(cfg.MITMHosts.Include); err != nil {
+		return nil, fmt.Errorf("mitm_hosts.include: %w", err)
+	}
+	if s.exclude, err = compileHostMatcher(cfg.MITMHosts.Exclude); err != nil {
+		return nil, fmt.Errorf("mitm_hosts.exclude: %w", err)
+	}
+	if s.headersOnly, err = compileHostMatcher(cfg.MITMHosts.HeadersOnly); err != nil {
+		return nil, fmt.Errorf("mitm_hosts.headers_only: %w", err)
+	}
+	for _, name := range cfg.MITMHosts.Profiles {
+		p := reg.Get(name)
+		if p == nil {
+			return nil, fmt.Errorf("mitm_hosts.profiles: profile %q is not enabled", name)
+		}
+		s.profiles = append(s.profiles, p)
+	}
+	return s, nil
+}
+
+// selects reports whether a tunnel to hostport is to be intercepted.
+func (s *mitmSelector) selects(hostport string) bool {
+	host := hostname(hostport)
+	if slices.ContainsFunc(s.disabled, func(d string) bool { return strings.EqualFold(d, host) }) ||
+		s.exclude.match(hostport, "443") {
+		return false
+	}
+	if s.include.empty() && len(s.profiles) == 0 {
+		return true
+	}
+	if s.include.match(hostport, "443") {
+		return true
+	}
+	req := &http.Request{
+		Method: http.MethodGet,
+		URL:    &url.URL{Scheme: "https", Host: hostport, Path: "/"},
+		Host:   hostport,
+		Header: http.Header{},
+	}
+	return slices.ContainsFunc(s.profiles, func(p profiles.Profile) bool { return p.Match(req) })
+}
+
+// bodiesHidden reports whether intercepted requests to hostport are
+// audited by their headers alone.
+func (s *mitmSelector) bodiesHidden(hostport string) bool {
+	return s.headersOnly.match(hostport, "443")
+}
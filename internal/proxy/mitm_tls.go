@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/kdhira/audit-proxy/internal/audit"
+	"github.com/kdhira/audit-proxy/internal/config"
+)
+
+// clientTLSPolicy is the compiled mitm_tls: what clients of intercepted
+// tunnels may negotiate with the proxy.
+type clientTLSPolicy struct {
+	min, max uint16
+	suites   []uint16 // nil for Go's defaults
+	alpn     []string
+}
+
+func newClientTLSPolicy(cfg config.MITMTLSConfig) *clientTLSPolicy {
+	p := &clientTLSPolicy{
+		min:  config.TLSVersion(cfg.MinVersion),
+		max:  config.TLSVersion(cfg.MaxVersion),
+		alpn: cfg.ALPN,
+	}
+	if p.min == 0 {
+		p.min = tls.VersionTLS12
+	}
+	if p.max == 0 {
+		p.max = tls.VersionTLS13
+	}
+	if len(p.alpn) == 0 {
+		p.alpn = []string{"http/1.1"}
+	}
+	for _, name := range cfg.CipherSuites {
+		p.suites = append(p.suites, config.TLSCipherSuite(name))
+	}
+	return p
+}
+
+// apply sets the policy on conf.
+func (p *clientTLSPolicy) apply(conf *tls.Config) {
+	conf.MinVersion, conf.MaxVersion = p.min, p.max
+	conf.CipherSuites = p.suites
+	conf.NextProtos = p.alpn
+}
+
+// refusal returns why the policy refuses the client that sent hello, or ""
+// if they have parameters in common. It is checked before the handshake
+// fails so the failure is not taken for a client rejecting the leaf.
+func (p *clientTLSPolicy) refusal(hello *tls.ClientHelloInfo) string {
+	var best uint16
+	for _, v := range hello.SupportedVersions {
+		if v >= p.min && v <= p.max {
+			best = max(best, v)
+		}
+	}
+	if best == 0 {
+		return "client TLS versions not allowed by mitm_tls"
+	}
+	if best < tls.VersionTLS13 && p.suites != nil && !slices.ContainsFunc(hello.CipherSuites, func(cs uint16) bool {
+		return slices.Contains(p.suites, cs)
+	}) {
+		return "client cipher suites not allowed by mitm_tls"
+	}
+	if len(hello.SupportedProtos) > 0 && !slices.ContainsFunc(hello.SupportedProtos, func(proto string) bool {
+		return slices.Contains(p.alpn, proto)
+	}) {
+		return "client application protocols not allowed by mitm_tls"
+	}
+	return ""
+}
+
+// describeTLS returns the audit record of the parameters in state.
+func describeTLS(state tls.ConnectionState) *audit.TLSSession {
+	return &audit.TLSSession{
+		Version:     tlsVersionName(state.Version),
+		CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+		ALPN:        state.NegotiatedProtocol,
+		ServerName:  state.ServerName,
+	}
+}
+
+// tlsVersionName names v as min_version values do.
+func tlsVersionName(v uint16) string {
+	if name, ok := strings.CutPrefix(tls.VersionName(v), "TLS "); ok {
+		return name
+	}
+	return fmt.Sprintf("0x%04X", v)
+}
+
+type clientTLSKey struct{}
+
+// withClientTLS returns ctx carrying the TLS parameters of the tunnel
+// whose requests it is for.
+func withClientTLS(ctx context.Context, s *audit.TLSSession) context.Context {
+	return context.WithValue(ctx, clientTLSKey{}, s)
+}
+
+func clientTLSFrom(ctx context.Context) *audit.TLSSession {
+	s, _ := ctx.Value(clientTLSKey{}).(*audit.TLSSession)
+	return s
+}
@@ -0,0 +1,519 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kdhira/audit-proxy/internal/audit"
+)
+
+// handleMitm terminates TLS for an allowed CONNECT tunnel and forwards each
+// decrypted request as its own audited exchange. tunnel is the CONNECT
+// entry, which is written when the tunnel closes. Like a server connection,
+// the tunnel serves requests in turn, pipelined ones included, until either
+// side asks to close, the client goes idle or half-closes, or the listener
+// limits end it.
+func (h *handler) handleMitm(w http.ResponseWriter, r *http.Request, tunnel *exchange) {
+	tunnel.entry.SetAttribute("mitm", true)
+	client, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		tunnel.entry.Error = err.Error()
+		slog.Error("hijack CONNECT", "err", err)
+		return
+	}
+	defer client.Close()
+	defer h.drain.track(client)()
+	if _, err := rw.WriteString("HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		tunnel.entry.Error = err.Error()
+		return
+	}
+	if err := rw.Flush(); err != nil {
+		tunnel.entry.Error = err.Error()
+		return
+	}
+
+	_ = client.SetReadDeadline(time.Now().Add(tunnelSniffTimeout))
+	proto, _ := sniffTunnel(rw.Reader)
+	_ = client.SetReadDeadline(time.Time{})
+	if proto != "" {
+		tunnel.attrs.Set("tunnel.protocol", proto)
+	}
+	if proto != protoTLS {
+		tunnel.entry.Blocked = true
+		tunnel.entry.Reason = "tunnel did not start with a TLS handshake"
+		return
+	}
+	h.serveMitm(r, tunnel, client, rw.Reader)
+}
+
+// serveMitm completes the TLS handshake the client of tunnel has started
+// on client, whose bytes so far are buffered in clientR, and serves the
+// requests it then sends. r is the request opening the tunnel. It is the
+// one place TLS is terminated: CONNECT tunnels and transparent listeners
+// both end here, and other listener types should too, standing for their
+// connections with a CONNECT request as handleTransparent does.
+func (h *handler) serveMitm(r *http.Request, tunnel *exchange, client net.Conn, clientR *bufio.Reader) {
+	host := hostname(r.Host)
+	conf := h.mitm.TLSConfig(host)
+	h.clientTLS.apply(conf)
+	h.clientCerts.apply(conf, r.Host)
+	h.resumption.apply(conf, time.Now())
+	var refusal string
+	conf.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		refusal = h.clientTLS.refusal(hello)
+		return nil, nil
+	}
+	var leaf *tls.Certificate
+	getCertificate := conf.GetCertificate
+	var mirrored bool
+	if h.cfg.MITMUpstreamErrors == "mirror" {
+		if flawed := h.mirrorUpstreamTLS(r.Context(), tunnel, r.Host); flawed != nil {
+			getCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return flawed, nil }
+			mirrored = true
+			// A resumed session would skip the leaf.
+			conf.SessionTicketsDisabled = true
+		}
+	}
+	conf.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		c, err := getCertificate(hello)
+		leaf = c
+		return c, err
+	}
+	tlsConn := tls.Server(&bufferedConn{Conn: client, r: clientR}, conf)
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	start := time.Now()
+	err := tlsConn.HandshakeContext(ctx)
+	cancel()
+	annotateLeaf(tunnel, leaf)
+	if err != nil {
+		tunnel.entry.Error = "client handshake: " + err.Error()
+		if refusal != "" {
+			tunnel.entry.Blocked = true
+			tunnel.entry.Reason = refusal
+			return
+		}
+		if reason, cc := clientCertRefused(err); reason != "" {
+			tunnel.entry.Blocked = true
+			tunnel.entry.Reason = reason
+			tunnel.entry.Conn.ClientCert = cc
+			return
+		}
+		// A client rejecting a leaf made to be rejected is not pinning.
+		if leaf != nil && !mirrored && rejectedLeaf(err) {
+			h.suspectPinning(tunnel, r.Host)
+		}
+		return
+	}
+	handshaken := time.Now()
+	state := tlsConn.ConnectionState()
+	h.resumption.observe(tunnel, handshaken.Sub(start), state.DidResume)
+	clientCert, clientTLS := describeClientCert(conf, state), describeTLS(state)
+	tunnel.entry.Conn.ClientCert = clientCert
+	tunnel.entry.Conn.ClientTLS = clientTLS
+	if tunnel.rules.mitm.bodiesHidden(r.Host) {
+		tunnel.attrs.Set("mitm.level", "headers_only")
+	}
+	tunnel.entry.Response = &audit.ResponseMetadata{Status: http.StatusOK}
+	tunnel.entry.Conn.TLS = true
+	defer h.activity.tunnel(tunnel, true)()
+
+	authority := strings.TrimSuffix(r.Host, ":443")
+	// The tunnel is a connection of its own for the listener limits.
+	st := h.conns.newConn(r.RemoteAddr)
+	var in io.Reader = tlsConn
+	if h.cfg.Listener.StrictFraming {
+		st.framing = &framingScanner{}
+		in = &framedConn{Conn: tlsConn, scan: st.framing}
+	}
+	br := bufio.NewReader(in)
+	for first := true; ; first = false {
+		// A draining proxy closes the tunnel rather than wait for another
+		// request, and closes it under the read if draining starts there.
+		if !h.drain.idle(client) {
+			return
+		}
+		req, err := h.readTunnelRequest(tlsConn, br, r.RemoteAddr)
+		if err != nil {
+			if err != io.EOF {
+				slog.Debug("read MITM request", "host", host, "err", err)
+			}
+			// Clients checking pins after the handshake hang up at once.
+			if first && !mirrored && hungUp(err) && time.Since(handshaken) < pinningCheckWindow {
+				h.suspectPinning(tunnel, r.Host)
+			}
+			if st.framing != nil {
+				for _, rec := range st.framing.unhandled() {
+					h.auditRefusedFraming(r.RemoteAddr, authority, rec)
+				}
+			}
+			return
+		}
+		h.drain.busy(client)
+		// Inner requests inherit the tunnel's identity and lifetime, but
+		// not the framing of the CONNECT.
+		ctx := withClientTLS(withClientCert(r.Context(), clientCert), clientTLS)
+		req = req.WithContext(withFraming(ctx, st.nextFraming()))
+		req.URL.Scheme = "https"
+		req.URL.Host = authority
+		req.RemoteAddr = r.RemoteAddr
+		if len(framingFrom(req.Context()).classes()) > 0 {
+			req.Close = true
+			x := h.begin(audit.KindMITM, req)
+			x.entry.Conn.TLS = true
+			h.refuseFraming(x)
+			_ = jsonResponse(req, http.StatusBadRequest, errorBody{Error: x.entry.Reason}).Write(tlsConn)
+			h.finish(x)
+			return
+		}
+		last, refused := h.conns.request(st)
+		if refused != "" {
+			req.Close = true
+			x := h.begin(audit.KindMITM, req)
+			x.entry.Conn.TLS = true
+			x.deny(http.StatusTooManyRequests, refused)
+			_ = jsonResponse(req, http.StatusTooManyRequests, errorBody{Error: refused}).Write(tlsConn)
+			h.finish(x)
+			return
+		}
+		req.Close = req.Close || last || h.drain.active()
+		var w io.Writer = tlsConn
+		gate := newContinueGate(req, tlsConn)
+		if gate != nil {
+			req.Body, w = gate, gate.writer()
+		}
+		if err := h.processMitmRequest(w, req); err != nil {
+			slog.Debug("write MITM response", "host", host, "err", err)
+			return
+		}
+		// A client told neither to continue nor to stop may still send the
+		// body it held back, so the connection cannot be reused.
+		if req.Close || (gate != nil && !gate.continued()) {
+			return
+		}
+		if err := h.drainTunnelRequest(tlsConn, req); err != nil {
+			slog.Debug("drain MITM request", "host", host, "err", err)
+			return
+		}
+	}
+}
+
+// drainTunnelRequest reads the rest of req's body, if the upstream left any,
+// so the next request on the tunnel starts where it should. The client gets
+// the idle timeout to finish sending it.
+func (h *handler) drainTunnelRequest(conn net.Conn, req *http.Request) error {
+	if t := h.cfg.Listener.IdleTimeout; t > 0 {
+		_ = conn.SetReadDeadline(time.Now().Add(t))
+		defer conn.SetReadDeadline(time.Time{})
+	}
+	// Closing a body from http.ReadRequest consumes what is left of it.
+	return req.Body.Close()
+}
+
+// continueGate handles "Expect: 100-continue" on a tunnel: it sends the
+// interim 100 response when the request body is first read, unless the
+// final response has already started. It is the request body, and its
+// writer carries the responses.
+type continueGate struct {
+	body io.ReadCloser
+	conn io.Writer
+
+	mu        sync.Mutex
+	sent      bool
+	responded bool
+	err       error
+}
+
+// newContinueGate returns a gate for req, or nil if it expects no 100
+// response.
+func newContinueGate(req *http.Request, conn io.Writer) *continueGate {
+	if !req.ProtoAtLeast(1, 1) || req.ContentLength == 0 ||
+		!strings.EqualFold(req.Header.Get("Expect"), "100-continue") {
+		return nil
+	}
+	return &continueGate{body: req.Body, conn: conn}
+}
+
+func (g *continueGate) Read(p []byte) (int, error) {
+	g.mu.Lock()
+	if !g.sent && !g.responded {
+		g.sent = true
+		_, g.err = io.WriteString(g.conn, "HTTP/1.1 100 Continue\r\n\r\n")
+	}
+	err := g.err
+	g.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	return g.body.Read(p)
+}
+
+func (g *continueGate) Close() error {
+	return g.body.Close()
+}
+
+// continued reports whether the client was told to send the body.
+func (g *continueGate) continued() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.sent
+}
+
+func (g *continueGate) writer() io.Writer {
+	return gateWriter{g}
+}
+
+type gateWriter struct{ g *continueGate }
+
+func (w gateWriter) Write(p []byte) (int, error) {
+	w.g.mu.Lock()
+	defer w.g.mu.Unlock()
+	w.g.responded = true
+	return w.g.conn.Write(p)
+}
+
+// annotateLeaf records the leaf certificate the client was shown, so it
+// can be matched with what the client saw.
+func annotateLeaf(tunnel *exchange, c *tls.Certificate) {
+	if c == nil || c.Leaf == nil {
+		return
+	}
+	sum := sha256.Sum256(c.Leaf.Raw)
+	tunnel.attrs.Set("mitm.cert_serial", c.Leaf.SerialNumber.Text(16))
+	tunnel.attrs.Set("mitm.cert_sha256", hex.EncodeToString(sum[:]))
+}
+
+// readTunnelRequest reads the next request from a MITM tunnel under the
+// listener's idle and header timeouts.
+func (h *handler) readTunnelRequest(conn net.Conn, br *bufio.Reader, remote string) (*http.Request, error) {
+	cfg := h.cfg.Listener
+	var deadline time.Time
+	if cfg.IdleTimeout > 0 {
+		deadline = time.Now().Add(cfg.IdleTimeout)
+	}
+	_ = conn.SetReadDeadline(deadline)
+	if _, err := br.Peek(1); err != nil {
+		return nil, err
+	}
+	deadline = time.Time{}
+	if cfg.ReadHeaderTimeout > 0 {
+		deadline = time.Now().Add(cfg.ReadHeaderTimeout)
+	}
+	_ = conn.SetReadDeadline(deadline)
+	req, err := http.ReadRequest(br)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		h.conns.violation(remote, violationHeaderTimeout)
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	return req, err
+}
+
+// processMitmRequest forwards one decrypted request and writes the response
+// back into the tunnel.
+func (h *handler) processMitmRequest(conn io.Writer, r *http.Request) error {
+	x := h.begin(audit.KindMITM, r)
+	defer h.finish(x)
+	x.entry.Conn.TLS = true
+	if x.rules.mitm.bodiesHidden(r.URL.Host) {
+		x.headersOnly, x.sampled = true, nil
+		x.attrs.Set("mitm.level", "headers_only")
+	}
+
+	// The tunnel was allowed when it opened; the rules may have been
+	// reloaded since.
+	if reason := h.hostDenied(x.policy, r.URL.Host, "443"); reason != "" {
+		x.deny(http.StatusForbidden, reason)
+		_, _ = io.Copy(io.Discard, r.Body)
+		return jsonResponse(r, http.StatusForbidden, errorBody{Error: reason}).Write(conn)
+	}
+	if x.entry.Request.HostMismatch && h.cfg.RejectHostMismatch {
+		x.deny(http.StatusMisdirectedRequest, "host mismatch")
+		_, _ = io.Copy(io.Discard, r.Body)
+		return jsonResponse(r, http.StatusMisdirectedRequest, errorBody{Error: "host header does not match the tunnel"}).Write(conn)
+	}
+	if hdr := h.corsPreflight(x); hdr != nil {
+		_, _ = io.Copy(io.Discard, r.Body)
+		resp := &http.Response{StatusCode: http.StatusNoContent, Header: hdr, Close: r.Close}
+		_, err := writeStreaming(conn, r, resp)
+		return err
+	}
+	h.overrides.apply(x)
+	if err := x.policy.filters.OnRequest(x.ctx(), x.req); err != nil {
+		be := x.block(err)
+		_, _ = io.Copy(io.Discard, r.Body)
+		return jsonResponse(r, be.StatusCode(), blockBody(be)).Write(conn)
+	}
+	if resp := h.mockResponse(x); resp != nil {
+		resp.Close = r.Close
+		_, err := writeStreaming(conn, r, resp)
+		return err
+	}
+	if resp := h.replayResponse(x); resp != nil {
+		resp.Close = r.Close
+		_, err := writeStreaming(conn, r, resp)
+		return err
+	}
+	if resp := h.cachedResponse(x); resp != nil {
+		resp.Close = r.Close
+		_, err := writeStreaming(conn, r, resp)
+		return err
+	}
+	if status, reason := h.quotas.admit(x); status != 0 {
+		x.deny(status, reason)
+		_, _ = io.Copy(io.Discard, r.Body)
+		return jsonResponse(r, status, errorBody{Error: reason}).Write(conn)
+	}
+	if status, reason := h.budgets.admit(x); status != 0 {
+		x.deny(status, reason)
+		_, _ = io.Copy(io.Discard, r.Body)
+		return jsonResponse(r, status, errorBody{Error: reason}).Write(conn)
+	}
+	if reason := h.admit(x); reason != "" {
+		x.deny(http.StatusServiceUnavailable, reason)
+		_, _ = io.Copy(io.Discard, r.Body)
+		return jsonResponse(r, http.StatusServiceUnavailable, errorBody{Error: reason}).Write(conn)
+	}
+	resp, err := h.forward(x)
+	if err != nil {
+		return jsonResponse(r, upstreamStatus(err), errorBody{Error: "upstream request failed"}).Write(conn)
+	}
+	defer resp.Body.Close()
+	if err := x.policy.filters.OnResponse(x.ctx(), x.req, resp); err != nil {
+		be := x.block(err)
+		return jsonResponse(r, be.StatusCode(), blockBody(be)).Write(conn)
+	}
+	h.recordResponse(x, resp)
+	h.cacheResponse(x, resp)
+	h.prepareResponse(x, resp)
+	resp.Close = resp.Close || r.Close
+	closed, err := writeStreaming(conn, r, resp)
+	r.Close = r.Close || closed
+	if err != nil {
+		x.entry.Error = err.Error()
+		return err
+	}
+	return nil
+}
+
+// writeStreaming writes resp into a tunnel as the answer to req, passing the
+// body on as it arrives so streamed responses such as server-sent events
+// are not held back. A body of unknown length is sent chunked, or for an
+// HTTP/1.0 client delimited by closing the connection, which writeStreaming
+// then reports.
+func writeStreaming(conn io.Writer, req *http.Request, resp *http.Response) (closed bool, err error) {
+	code := resp.StatusCode
+	bodyless := req.Method == http.MethodHead || code/100 == 1 ||
+		code == http.StatusNoContent || code == http.StatusNotModified
+	chunked := !bodyless && resp.ContentLength < 0 && req.ProtoAtLeast(1, 1)
+	closed = resp.Close || (!bodyless && resp.ContentLength < 0 && !chunked)
+
+	hdr := resp.Header.Clone()
+	hdr.Del("Transfer-Encoding")
+	switch {
+	case chunked:
+		hdr.Del("Content-Length")
+		hdr.Set("Transfer-Encoding", "chunked")
+		if len(resp.Trailer) > 0 {
+			hdr.Set("Trailer", strings.Join(slices.Sorted(maps.Keys(resp.Trailer)), ", "))
+		}
+	case !bodyless && resp.ContentLength >= 0:
+		hdr.Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	}
+	if closed {
+		hdr.Set("Connection", "close")
+	}
+	bw := bufio.NewWriter(conn)
+	text := strings.TrimPrefix(resp.Status, strconv.Itoa(code)+" ")
+	if text == "" || text == resp.Status {
+		text = http.StatusText(code)
+	}
+	fmt.Fprintf(bw, "HTTP/1.1 %03d %s\r\n", code, text)
+	if err := hdr.Write(bw); err != nil {
+		return closed, err
+	}
+	bw.WriteString("\r\n")
+	if err := bw.Flush(); err != nil {
+		return closed, err
+	}
+	if bodyless || resp.Body == nil {
+		return closed, nil
+	}
+	if !chunked {
+		if _, err := copyFlushing(bw, bw.Flush, resp.Body); err != nil {
+			return true, err
+		}
+		return closed, bw.Flush()
+	}
+	cw := httputil.NewChunkedWriter(bw)
+	if _, err := copyFlushing(cw, bw.Flush, resp.Body); err != nil {
+		return true, err
+	}
+	if err := cw.Close(); err != nil {
+		return true, err
+	}
+	// Trailers are known once the body has been read.
+	if err := resp.Trailer.Write(bw); err != nil {
+		return true, err
+	}
+	bw.WriteString("\r\n")
+	return closed, bw.Flush()
+}
+
+// jsonResponse builds a response with a JSON body for writing into a tunnel.
+func jsonResponse(req *http.Request, status int, v any) *http.Response {
+	body, _ := json.Marshal(v)
+	body = append(body, '\n')
+	return &http.Response{
+		StatusCode:    status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"application/json"}},
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+		Close:         req.Close,
+	}
+}
+
+// mirrorUpstreamTLS checks the certificate of the upstream at hostport
+// and, if it fails verification, records why on tunnel and returns a leaf
+// the client rejects for the same reason. It returns nil if the
+// certificate verifies or the leaf cannot be issued.
+func (h *handler) mirrorUpstreamTLS(ctx context.Context, tunnel *exchange, hostport string) *tls.Certificate {
+	flaw, chain := h.probeUpstreamTLS(ctx, hostport)
+	if flaw == "" {
+		return nil
+	}
+	tunnel.attrs.Set("upstream.tls_error", flaw)
+	tunnel.attrs.Set("upstream.tls_chain_sha256", chainFingerprints(chain))
+	var up *x509.Certificate
+	if len(chain) > 0 {
+		up = chain[0]
+	}
+	c, err := h.mitm.IssueFlawed(hostname(hostport), up, flaw)
+	if err != nil {
+		slog.Error("issue mirrored leaf", "host", hostport, "err", err)
+		return nil
+	}
+	tunnel.attrs.Set("mitm.mirrored", flaw)
+	return c
+}
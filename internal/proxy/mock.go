@@ -0,0 +1,179 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/kdhira/audit-proxy/internal/audit"
+	"github.com/kdhira/audit-proxy/internal/config"
+	"github.com/kdhira/audit-proxy/internal/fingerprint"
+)
+
+// maxMockRequestBody bounds the request body a mock template can see.
+const maxMockRequestBody = 1 << 20
+
+// mock is a compiled config.MockRule.
+type mock struct {
+	hosts   hostList // nil for all hosts
+	methods []string // upper case; nil for any
+	path    string
+	prefix  bool // path ended in *
+	status  int
+	headers http.Header
+	body    []byte             // from body_file
+	tmpl    *template.Template // from body; nil with body_file
+}
+
+// mockFuncs are available to mock body templates.
+var mockFuncs = template.FuncMap{
+	"json": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+func compileMocks(rules []config.MockRule) ([]*mock, error) {
+	var out []*mock
+	for i, r := range rules {
+		m := &mock{status: r.Status, headers: http.Header{}}
+		if m.status == 0 {
+			m.status = http.StatusOK
+		}
+		if len(r.Hosts) > 0 {
+			hosts, err := compileHosts(r.Hosts)
+			if err != nil {
+				return nil, fmt.Errorf("mocks[%d]: %w", i, err)
+			}
+			m.hosts = hosts
+		}
+		for _, meth := range r.Methods {
+			m.methods = append(m.methods, strings.ToUpper(meth))
+		}
+		m.path, m.prefix = strings.CutSuffix(r.Path, "*")
+		for k, v := range r.Headers {
+			m.headers.Set(k, v)
+		}
+		if r.BodyFile != "" {
+			b, err := os.ReadFile(r.BodyFile)
+			if err != nil {
+				return nil, fmt.Errorf("mocks[%d]: %w", i, err)
+			}
+			m.body = b
+		} else {
+			t, err := template.New(fmt.Sprintf("mocks[%d]", i)).Funcs(mockFuncs).Option("missingkey=zero").Parse(r.Body)
+			if err != nil {
+				return nil, fmt.Errorf("mocks[%d]: %w", i, err)
+			}
+			m.tmpl = t
+		}
+		out = append(out, m)
+	}
+	return out, nil
+}
+
+// match reports whether m answers r.
+func (m *mock) match(r *http.Request) bool {
+	if m.methods != nil && !slices.Contains(m.methods, r.Method) {
+		return false
+	}
+	if m.hosts != nil && !m.hosts.match(r.URL.Host, defaultPort(r.URL.Scheme)) {
+		return false
+	}
+	if m.prefix {
+		return strings.HasPrefix(r.URL.Path, m.path)
+	}
+	return m.path == "" || r.URL.Path == m.path
+}
+
+// mockRequest is what a mock body template sees as its data.
+type mockRequest struct {
+	Method string
+	Host   string
+	Path   string
+	Query  url.Values
+	Header http.Header
+	Body   string
+}
+
+// mockFor returns the first mock answering r, or nil.
+func (r *rules) mockFor(req *http.Request) *mock {
+	for _, m := range r.mocks {
+		if m.match(req) {
+			return m
+		}
+	}
+	return nil
+}
+
+// mockResponse returns the canned response for x if a mock rule matches,
+// recording it in the entry as if it had come from upstream, or nil if the
+// request should be forwarded. The request body is consumed.
+func (h *handler) mockResponse(x *exchange) *http.Response {
+	m := x.rules.mockFor(x.req)
+	if m == nil {
+		return nil
+	}
+	limit := x.excerptBytes()
+	x.reqBody = &capture{limit: limit, hash: fingerprint.Body()}
+	reqBody := &capture{limit: maxMockRequestBody}
+	if x.req.Body != nil {
+		_, _ = io.Copy(io.MultiWriter(x.reqBody, reqBody), x.req.Body)
+	}
+	body := m.body
+	if m.tmpl != nil {
+		var b bytes.Buffer
+		data := mockRequest{
+			Method: x.req.Method,
+			Host:   x.req.URL.Hostname(),
+			Path:   x.req.URL.Path,
+			Query:  x.req.URL.Query(),
+			Header: x.req.Header,
+			Body:   reqBody.buf.String(),
+		}
+		if err := m.tmpl.Execute(&b, data); err != nil {
+			x.entry.Error = "mock template: " + err.Error()
+			x.attrs.Set("mocked", true)
+			x.entry.Response = &audit.ResponseMetadata{Status: http.StatusInternalServerError}
+			return mockHTTPResponse(x.req, http.StatusInternalServerError, http.Header{"Content-Type": {"application/json"}},
+				[]byte(`{"error":"mock template failed"}`+"\n"))
+		}
+		body = b.Bytes()
+	}
+	x.attrs.Set("mocked", true)
+	return h.cannedResponse(x, m.status, m.headers.Clone(), body)
+}
+
+// cannedResponse builds the response to x from status, hdr and body rather
+// than upstream, recording it in the entry as if it had come from there.
+// hdr is modified.
+func (h *handler) cannedResponse(x *exchange, status int, hdr http.Header, body []byte) *http.Response {
+	resp := mockHTTPResponse(x.req, status, hdr, body)
+	h.prepareResponse(x, resp)
+	x.entry.Response = &audit.ResponseMetadata{Status: resp.StatusCode, Headers: audit.SanitiseHeaders(resp.Header)}
+	x.respBody = &capture{limit: x.excerptBytes()}
+	_, _ = x.respBody.Write(body)
+	return resp
+}
+
+func mockHTTPResponse(req *http.Request, status int, hdr http.Header, body []byte) *http.Response {
+	if hdr.Get("Content-Type") == "" {
+		hdr.Set("Content-Type", http.DetectContentType(body))
+	}
+	hdr.Set("Content-Length", strconv.Itoa(len(body)))
+	return &http.Response{
+		StatusCode:    status,
+		Header:        hdr,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kdhira/audit-proxy/internal/anomaly"
+	"github.com/kdhira/audit-proxy/internal/audit"
+	"github.com/kdhira/audit-proxy/internal/health"
+	"github.com/kdhira/audit-proxy/internal/metrics"
+)
+
+// observer records per-exchange metrics and feeds the anomaly detector.
+type observer struct {
+	requests  *metrics.CounterVec
+	duration  *metrics.HistogramVec
+	bytes     *metrics.CounterVec
+	blocked   *metrics.CounterVec
+	anomalies *metrics.CounterVec
+	upstreams *metrics.GaugeVec
+
+	streamRate  *metrics.HistogramVec
+	streamFirst *metrics.HistogramVec
+	streamGap   *metrics.HistogramVec
+
+	detector *anomaly.Detector
+}
+
+func newObserver(reg *metrics.Registry, detector *anomaly.Detector) *observer {
+	return &observer{
+		requests: reg.Counter("auditproxy_requests_total",
+			"Exchanges handled, by kind and response status.", "kind", "status"),
+		duration: reg.Histogram("auditproxy_request_duration_seconds",
+			"Time from receiving a request to finishing its response.", metrics.DefaultBuckets, "kind"),
+		bytes: reg.Counter("auditproxy_bytes_total",
+			"Body bytes relayed, by direction (in is upstream to client).", "direction"),
+		blocked: reg.Counter("auditproxy_blocked_total",
+			"Requests denied or blocked, by filter (proxy for host and auth policy).", "filter"),
+		anomalies: reg.Counter("auditproxy_anomalies_total",
+			"Anomalies detected, by host and kind.", "host", "kind"),
+		upstreams: reg.Gauge("auditproxy_upstream_healthy",
+			"Whether an actively checked upstream is healthy (1) or not (0).", "upstream"),
+		streamRate: reg.Histogram("auditproxy_stream_tokens_per_second",
+			"Output token rate of streamed responses, by destination and model.", tokenRateBuckets, "destination", "model"),
+		streamFirst: reg.Histogram("auditproxy_stream_first_chunk_seconds",
+			"Time from receiving a request to the first event of its streamed response.", metrics.DefaultBuckets, "destination"),
+		streamGap: reg.Histogram("auditproxy_stream_chunk_gap_seconds",
+			"Gaps between consecutive events of streamed responses.", metrics.DefaultBuckets, "destination"),
+		detector: detector,
+	}
+}
+
+// observe records e and logs a warning entry for each anomaly it triggers.
+func (o *observer) observe(e *audit.Entry, latency time.Duration, logger audit.Logger) {
+	status := "0"
+	if e.Response != nil {
+		status = strconv.Itoa(e.Response.Status)
+	}
+	o.requests.With(e.Kind, status).Inc()
+	o.duration.With(e.Kind).ObserveWithExemplar(latency.Seconds(), exemplarLabels(e)...)
+	o.bytes.With("in").Add(float64(e.BytesIn))
+	o.bytes.With("out").Add(float64(e.BytesOut))
+	if e.Blocked {
+		filter := e.Filter
+		if filter == "" {
+			filter = "proxy" // denied by the proxy's own policy
+		}
+		o.blocked.With(filter).Inc()
+	}
+
+	// Only upstream responses teach the detector; proxy denials and opaque
+	// tunnels say nothing about the host.
+	if o.detector == nil || e.Kind == audit.KindConnect || e.Blocked || e.Response == nil {
+		return
+	}
+	for _, a := range o.detector.Observe(e.Request.Host, e.Response.Status, latency, e.Time.Add(latency)) {
+		o.anomalies.With(a.Host, a.Kind).Inc()
+		w := audit.NewEntry(audit.KindAnomaly)
+		w.Level = audit.LevelWarn
+		w.Request.Host = a.Host
+		w.Reason = a.Message()
+		w.SetAttribute("anomaly.kind", a.Kind)
+		if a.Class != "" {
+			w.SetAttribute("anomaly.status_class", a.Class)
+		}
+		w.SetAttribute("anomaly.baseline", a.Baseline)
+		w.SetAttribute("anomaly.current", a.Current)
+		w.SetAttribute("anomaly.samples", a.Samples)
+		w.SetAttribute("anomaly.trigger_id", e.ID)
+		slog.Warn("traffic anomaly", "host", a.Host, "kind", a.Kind, "detail", w.Reason)
+		if err := logger.Log(w); err != nil {
+			slog.Error("write audit entry", "err", err)
+		}
+	}
+}
+
+// tokenRateBuckets suit LLM output rates in tokens per second.
+var tokenRateBuckets = []float64{5, 10, 20, 30, 50, 75, 100, 150, 200, 300, 500, 1000}
+
+// observeStream records the timing of a streamed response, if e had one.
+// Destinations are services where known, else hosts.
+func (o *observer) observeStream(e *audit.Entry, m *streamMeter) {
+	if m == nil || m.chunks == 0 {
+		return
+	}
+	dest := e.Service
+	if dest == "" {
+		dest = e.Request.Host
+	}
+	if ms, ok := e.Attributes["stream.first_chunk_ms"].(int64); ok {
+		o.streamFirst.With(dest).ObserveWithExemplar(float64(ms)/1000, exemplarLabels(e)...)
+	}
+	for _, g := range m.gaps {
+		o.streamGap.With(dest).Observe(g.Seconds())
+	}
+	if r := m.tokensPerSecond(); r > 0 {
+		o.streamRate.With(dest, m.model).ObserveWithExemplar(r, exemplarLabels(e)...)
+	}
+}
+
+// exemplarLabels identify e in histogram exemplars, so a spike on a
+// dashboard leads to the entries behind it: the entry ID and, if the
+// request carried a W3C traceparent, its trace ID.
+func exemplarLabels(e *audit.Entry) []string {
+	labels := []string{"entry_id", e.ID}
+	if id := traceID(e.Request.Headers.Get("Traceparent")); id != "" {
+		labels = append(labels, "trace_id", id)
+	}
+	return labels
+}
+
+// traceID returns the trace ID of a traceparent header value, or "" if it
+// has none.
+func traceID(traceparent string) string {
+	parts := strings.Split(traceparent, "-")
+	if len(parts) < 4 || len(parts[1]) != 32 || strings.Trim(parts[1], "0") == "" {
+		return ""
+	}
+	for _, c := range parts[1] {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return ""
+		}
+	}
+	return parts[1]
+}
+
+// health records an actively checked upstream's state.
+func (o *observer) health(s health.Status) {
+	v := 0.0
+	if s.Healthy {
+		v = 1
+	}
+	o.upstreams.With(s.Name).Set(v)
+}
@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"time"
+)
+
+// The parts of RFC 6960 needed to read a stapled OCSP response.
+
+var (
+	oidOCSPBasic   = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1}
+	oidOCSPSigning = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 9}
+)
+
+// ocspHashes are the hash algorithms of certificate IDs.
+var ocspHashes = map[string]crypto.Hash{
+	"1.3.14.3.2.26":          crypto.SHA1,
+	"2.16.840.1.101.3.4.2.1": crypto.SHA256,
+	"2.16.840.1.101.3.4.2.2": crypto.SHA384,
+	"2.16.840.1.101.3.4.2.3": crypto.SHA512,
+}
+
+// ocspSignatures are the signature algorithms of responses.
+var ocspSignatures = map[string]x509.SignatureAlgorithm{
+	"1.2.840.113549.1.1.5":  x509.SHA1WithRSA,
+	"1.2.840.113549.1.1.11": x509.SHA256WithRSA,
+	"1.2.840.113549.1.1.12": x509.SHA384WithRSA,
+	"1.2.840.113549.1.1.13": x509.SHA512WithRSA,
+	"1.2.840.10045.4.1":     x509.ECDSAWithSHA1,
+	"1.2.840.10045.4.3.2":   x509.ECDSAWithSHA256,
+	"1.2.840.10045.4.3.3":   x509.ECDSAWithSHA384,
+	"1.2.840.10045.4.3.4":   x509.ECDSAWithSHA512,
+	"1.3.101.112":           x509.PureEd25519,
+}
+
+type ocspResponse struct {
+	Status asn1.Enumerated
+	Bytes  ocspResponseBytes `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspResponseBytes struct {
+	Type     asn1.ObjectIdentifier
+	Response []byte
+}
+
+type ocspBasicResponse struct {
+	TBS                asn1.RawValue
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+	Certificates       []asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspResponseData struct {
+	Version     int           `asn1:"optional,explicit,default:0,tag:0"`
+	ResponderID asn1.RawValue // by name or key hash; the signer is found by signature
+	ProducedAt  time.Time     `asn1:"generalized"`
+	Responses   []ocspSingleResponse
+}
+
+type ocspSingleResponse struct {
+	CertID     ocspCertID
+	Good       asn1.Flag       `asn1:"tag:0,optional"`
+	Revoked    ocspRevokedInfo `asn1:"tag:1,optional"`
+	Unknown    asn1.Flag       `asn1:"tag:2,optional"`
+	ThisUpdate time.Time       `asn1:"generalized"`
+	NextUpdate time.Time       `asn1:"generalized,explicit,tag:0,optional"`
+	Extensions asn1.RawValue   `asn1:"explicit,tag:1,optional"`
+}
+
+type ocspRevokedInfo struct {
+	Time   time.Time       `asn1:"generalized"`
+	Reason asn1.Enumerated `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspCertID struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	NameHash      []byte
+	KeyHash       []byte
+	Serial        *big.Int
+}
+
+// ocspStatus returns the status the OCSP response der gives leaf, issued
+// by issuer, at now: revocationGood, revocationRevoked or
+// revocationUnknown, and until when it holds. It fails if der is not a
+// response for leaf signed by issuer or a responder it delegated to, or
+// is out of date.
+func ocspStatus(der []byte, leaf, issuer *x509.Certificate, now time.Time) (string, time.Time, error) {
+	var resp ocspResponse
+	if rest, err := asn1.Unmarshal(der, &resp); err != nil || len(rest) > 0 {
+		return "", time.Time{}, errors.New("malformed OCSP response")
+	}
+	if resp.Status != 0 {
+		return "", time.Time{}, fmt.Errorf("OCSP responder status %d", resp.Status)
+	}
+	if !resp.Bytes.Type.Equal(oidOCSPBasic) {
+		return "", time.Time{}, errors.New("OCSP response is not basic")
+	}
+	var basic ocspBasicResponse
+	if _, err := asn1.Unmarshal(resp.Bytes.Response, &basic); err != nil {
+		return "", time.Time{}, errors.New("malformed OCSP basic response")
+	}
+	var data ocspResponseData
+	if _, err := asn1.Unmarshal(basic.TBS.FullBytes, &data); err != nil {
+		return "", time.Time{}, errors.New("malformed OCSP response data")
+	}
+	if err := checkOCSPSignature(&basic, issuer); err != nil {
+		return "", time.Time{}, err
+	}
+	i := slices.IndexFunc(data.Responses, func(r ocspSingleResponse) bool {
+		return r.CertID.Serial != nil && r.CertID.Serial.Cmp(leaf.SerialNumber) == 0 && issuedBy(r.CertID, issuer)
+	})
+	if i < 0 {
+		return "", time.Time{}, errors.New("OCSP response is for another certificate")
+	}
+	r := data.Responses[i]
+	if now.Before(r.ThisUpdate) || (!r.NextUpdate.IsZero() && !now.Before(r.NextUpdate)) {
+		return "", time.Time{}, errors.New("OCSP response is out of date")
+	}
+	status := revocationUnknown
+	switch {
+	case bool(r.Good):
+		status = revocationGood
+	case !r.Revoked.Time.IsZero():
+		status = revocationRevoked
+	}
+	return status, r.NextUpdate, nil
+}
+
+// issuedBy reports whether id names a certificate of issuer.
+func issuedBy(id ocspCertID, issuer *x509.Certificate) bool {
+	h, ok := ocspHashes[id.HashAlgorithm.Algorithm.String()]
+	if !ok || !h.Available() {
+		return false
+	}
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(issuer.RawSubjectPublicKeyInfo, &spki); err != nil {
+		return false
+	}
+	name, key := h.New(), h.New()
+	name.Write(issuer.RawSubject)
+	key.Write(spki.PublicKey.RightAlign())
+	return bytes.Equal(id.NameHash, name.Sum(nil)) && bytes.Equal(id.KeyHash, key.Sum(nil))
+}
+
+// checkOCSPSignature checks that issuer, or a responder certificate in
+// basic that issuer issued for OCSP signing, signed basic.
+func checkOCSPSignature(basic *ocspBasicResponse, issuer *x509.Certificate) error {
+	alg, ok := ocspSignatures[basic.SignatureAlgorithm.Algorithm.String()]
+	if !ok {
+		return errors.New("unsupported OCSP signature algorithm")
+	}
+	signer := issuer
+	if len(basic.Certificates) > 0 {
+		c, err := x509.ParseCertificate(basic.Certificates[0].FullBytes)
+		if err != nil {
+			return errors.New("malformed OCSP responder certificate")
+		}
+		if !bytes.Equal(c.Raw, issuer.Raw) {
+			if err := c.CheckSignatureFrom(issuer); err != nil {
+				return fmt.Errorf("OCSP responder certificate: %w", err)
+			}
+			if !slices.ContainsFunc(c.UnknownExtKeyUsage, oidOCSPSigning.Equal) &&
+				!slices.Contains(c.ExtKeyUsage, x509.ExtKeyUsageOCSPSigning) {
+				return errors.New("OCSP responder certificate is not for OCSP signing")
+			}
+			signer = c
+		}
+	}
+	if err := signer.CheckSignature(alg, basic.TBS.FullBytes, basic.Signature.RightAlign()); err != nil {
+		return fmt.Errorf("OCSP response signature: %w", err)
+	}
+	return nil
+}
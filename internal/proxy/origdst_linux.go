@@ -0,0 +1,43 @@
+//go:build linux
+
+package proxy
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"syscall"
+)
+
+// soOriginalDst is SO_ORIGINAL_DST, and IP6T_SO_ORIGINAL_DST, through
+// which netfilter reports where a redirected connection was headed.
+const soOriginalDst = 80
+
+// redirectedDst returns the destination c had before iptables REDIRECT
+// sent it to the proxy.
+func redirectedDst(c net.Conn) (netip.AddrPort, bool) {
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
+		return netip.AddrPort{}, false
+	}
+	raw, err := tc.SyscallConn()
+	if err != nil {
+		return netip.AddrPort{}, false
+	}
+	var dst netip.AddrPort
+	_ = raw.Control(func(fd uintptr) {
+		// Both sockaddr_in and sockaddr_in6 hold the port in network order
+		// after the family; the structs are only used for their size.
+		if mreq, err := syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, soOriginalDst); err == nil {
+			a := mreq.Multiaddr
+			dst = netip.AddrPortFrom(netip.AddrFrom4([4]byte(a[4:8])), binary.BigEndian.Uint16(a[2:4]))
+			return
+		}
+		if info, err := syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.SOL_IPV6, soOriginalDst); err == nil {
+			var port [2]byte
+			binary.NativeEndian.PutUint16(port[:], info.Addr.Port)
+			dst = netip.AddrPortFrom(netip.AddrFrom16(info.Addr.Addr), binary.BigEndian.Uint16(port[:]))
+		}
+	})
+	return dst, dst.IsValid()
+}
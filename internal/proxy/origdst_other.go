@@ -0,0 +1,13 @@
+//go:build !linux
+
+package proxy
+
+import (
+	"net"
+	"net/netip"
+)
+
+// redirectedDst reports no destination: only Linux redirects connections.
+func redirectedDst(net.Conn) (netip.AddrPort, bool) {
+	return netip.AddrPort{}, false
+}
@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/kdhira/audit-proxy/internal/audit"
+	"github.com/kdhira/audit-proxy/internal/config"
+	"github.com/kdhira/audit-proxy/internal/filters"
+	"github.com/kdhira/audit-proxy/internal/metrics"
+	"github.com/kdhira/audit-proxy/internal/override"
+)
+
+const (
+	defaultOverrideHeader = "X-Audit-Override"
+	defaultOverrideTTL    = time.Hour
+	// overrideSkew is how far ahead of the proxy's clock an issuer's may
+	// run.
+	overrideSkew = time.Minute
+)
+
+// overrides checks the override headers of requests, letting the callers
+// tokens name skip a filter for one request each.
+type overrides struct {
+	header  string
+	secret  []byte
+	filters []string
+	maxTTL  time.Duration
+	results *metrics.CounterVec
+
+	mu   sync.Mutex
+	used map[string]time.Time // IDs of tokens spent, until they expire
+}
+
+// newOverrides returns nil if overrides are off.
+func newOverrides(cfg config.OverrideConfig, reg *metrics.Registry) *overrides {
+	if cfg.Secret == "" {
+		return nil
+	}
+	o := &overrides{
+		header:  http.CanonicalHeaderKey(cfg.Header),
+		secret:  []byte(os.ExpandEnv(cfg.Secret)),
+		filters: cfg.Filters,
+		maxTTL:  cfg.MaxTTL,
+		results: reg.Counter("auditproxy_overrides_total",
+			"Override headers received, by result: applied or refused.", "result"),
+		used: map[string]time.Time{},
+	}
+	if o.header == "" {
+		o.header = defaultOverrideHeader
+	}
+	if o.maxTTL == 0 {
+		o.maxTTL = defaultOverrideTTL
+	}
+	return o
+}
+
+// apply checks x's override header, if it has one, and lets x skip the
+// filter a valid token names. The header is never forwarded or logged, and
+// a token is refused once it has been spent.
+func (o *overrides) apply(x *exchange) {
+	if o == nil {
+		return
+	}
+	token := x.req.Header.Get(o.header)
+	if token == "" {
+		return
+	}
+	x.req.Header.Del(o.header)
+	if _, ok := x.entry.Request.Headers[o.header]; ok {
+		x.entry.Request.Headers[o.header] = []string{audit.Redacted}
+	}
+	c, err := o.check(token, identityFrom(x.ctx()).user, x.policy.client, time.Now())
+	if err != nil {
+		o.results.With("refused").Inc()
+		x.attrs.Set("override.error", err.Error())
+		slog.Warn("override refused", "client", x.entry.Conn.ClientAddr, "err", err)
+		return
+	}
+	o.results.With("applied").Inc()
+	x.req = x.req.WithContext(filters.WithOverride(x.ctx(), c.Filter))
+	x.attrs.Set("override.id", c.ID)
+	x.attrs.Set("override.filter", c.Filter)
+	x.attrs.Set("override.expires", time.Unix(c.Expires, 0).UTC().Format(time.RFC3339))
+	if c.Operator != "" {
+		x.attrs.Set("override.operator", c.Operator)
+	}
+	if c.Reason != "" {
+		x.attrs.Set("override.reason", c.Reason)
+	}
+}
+
+// check verifies token for the caller authenticated as user under the
+// client policy client, and spends it.
+func (o *overrides) check(token, user, client string, now time.Time) (override.Claims, error) {
+	c, err := override.Verify(o.secret, token, now)
+	if err != nil {
+		return c, err
+	}
+	switch {
+	case !slices.Contains(o.filters, c.Filter):
+		return c, fmt.Errorf("filter %s may not be overridden", c.Filter)
+	case c.User == "" && c.Client == "":
+		return c, errors.New("override token names no caller")
+	case c.User != "" && c.User != user, c.Client != "" && c.Client != client:
+		return c, errors.New("override token was issued to another caller")
+	case time.Unix(c.Expires, 0).Sub(time.Unix(c.IssuedAt, 0)) > o.maxTTL,
+		time.Unix(c.Expires, 0).Sub(now) > o.maxTTL+overrideSkew:
+		return c, fmt.Errorf("override token is valid for longer than %s", o.maxTTL)
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for id, exp := range o.used {
+		if !now.Before(exp) {
+			delete(o.used, id)
+		}
+	}
+	if _, ok := o.used[c.ID]; ok {
+		return c, errors.New("override token already used")
+	}
+	o.used[c.ID] = time.Unix(c.Expires, 0)
+	return c, nil
+}
@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// pacPaths are where the proxy serves its proxy auto-config file: the
+// conventional name, and the one WPAD clients fetch.
+var pacPaths = map[string]bool{"/proxy.pac": true, "/wpad.dat": true}
+
+// pacCondition returns the PAC expression matching hosts p matches, or ""
+// if there is none. Ports are not checked; the proxy enforces them.
+func (p hostPattern) pacCondition() string {
+	switch {
+	case p.any:
+		return "true"
+	case p.suffix != "":
+		return "dnsDomainIs(host, " + strconv.Quote(p.suffix) + ")"
+	case p.prefix.IsValid() && p.prefix.IsSingleIP():
+		return "host == " + strconv.Quote(p.prefix.Addr().String())
+	case p.prefix.IsValid() && p.prefix.Addr().Is4():
+		mask := net.CIDRMask(p.prefix.Bits(), 32)
+		return fmt.Sprintf("(isIPv4(host) && isInNet(host, %q, %q))", p.prefix.Addr(), net.IP(mask).String())
+	case p.prefix.IsValid():
+		return "" // PAC has no IPv6 range test; such targets go direct
+	default:
+		return "host == " + strconv.Quote(p.host)
+	}
+}
+
+// pacConditions joins the conditions of l into one PAC expression, "false"
+// if it matches nothing.
+func (l hostList) pacConditions() string {
+	var conds []string
+	for _, p := range l {
+		if c := p.pacCondition(); c != "" {
+			conds = append(conds, c)
+		}
+	}
+	if len(conds) == 0 {
+		return "false"
+	}
+	return strings.Join(conds, " ||\n\t    ")
+}
+
+// pacScript renders the PAC file sending hosts matching cond to proxy.
+func pacScript(cond, proxy string) string {
+	return `// Generated by audit-proxy from allow_hosts.
+function isIPv4(host) {
+	return /^\d+\.\d+\.\d+\.\d+$/.test(host);
+}
+
+function FindProxyForURL(url, host) {
+	host = host.toLowerCase();
+	if (` + cond + `)
+		return "` + proxy + `";
+	return "DIRECT";
+}
+`
+}
+
+// servePAC answers a request for the proxy auto-config file. The proxy is
+// named as the client reached it unless pac.proxy says otherwise.
+func (h *handler) servePAC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeJSON(w, http.StatusMethodNotAllowed, errorBody{Error: "method not allowed"})
+		return
+	}
+	addr := h.cfg.PAC.Proxy
+	if addr == "" {
+		addr = pacAddr(r)
+	}
+	proxy := "PROXY " + addr
+	if st := connStateFrom(r.Context()); r.TLS != nil || st != nil && st.tls {
+		proxy = "HTTPS " + addr
+	}
+	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	w.Header().Set("Cache-Control", "no-cache")
+	_, _ = w.Write([]byte(pacScript(h.rules.Load().pac, proxy)))
+}
+
+// pacAddr is the proxy address r was sent to: its Host, with the listener's
+// port if Host has none.
+func pacAddr(r *http.Request) string {
+	local, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if local == nil {
+		return r.Host
+	}
+	if r.Host == "" {
+		return local.String()
+	}
+	if _, _, err := net.SplitHostPort(r.Host); err != nil {
+		if _, port, err := net.SplitHostPort(local.String()); err == nil {
+			return net.JoinHostPort(strings.Trim(r.Host, "[]"), port)
+		}
+	}
+	return r.Host
+}
@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/kdhira/audit-proxy/internal/audit"
+	"github.com/kdhira/audit-proxy/internal/config"
+)
+
+// piiKinds are the built-in kinds of personal data, config.PIIKinds.
+// Card numbers come first so their digits are not taken for a phone number.
+var piiKinds = []piiPattern{
+	{
+		name: "credit_card",
+		re:   regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`),
+		// Only numbers passing the Luhn check, as card numbers do.
+		check: func(s string) bool { return luhn(digits(s)) },
+	},
+	{
+		name: "email",
+		re:   regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9\-]+(?:\.[A-Za-z0-9\-]+)*\.[A-Za-z]{2,}`),
+	},
+	{
+		name: "phone",
+		re:   regexp.MustCompile(`(?:\+\d{1,3}[ .\-]?)?(?:\(\d{1,4}\)[ .\-]?)?\b\d{2,4}[ .\-]\d{3,4}[ .\-]?\d{3,4}\b`),
+		// Between the shortest local and the longest E.164 number.
+		check: func(s string) bool { n := len(digits(s)); return n >= 8 && n <= 15 },
+	},
+}
+
+type piiPattern struct {
+	name  string
+	re    *regexp.Regexp
+	check func(string) bool // nil if every match counts
+}
+
+// piiScrubber is the compiled excerpt_pii: it replaces personal data in
+// excerpts with a marker naming its kind, such as ***EMAIL***. A nil
+// piiScrubber leaves excerpts as they are.
+type piiScrubber struct {
+	patterns []piiPattern
+}
+
+// newPIIScrubber returns the scrubber cfg describes, or nil if it
+// scrubs nothing.
+func newPIIScrubber(cfg config.ExcerptPIIConfig) (*piiScrubber, error) {
+	if len(cfg.Detect) == 0 && len(cfg.Patterns) == 0 {
+		return nil, nil
+	}
+	s := &piiScrubber{}
+	for _, p := range piiKinds {
+		if slices.Contains(cfg.Detect, p.name) {
+			s.patterns = append(s.patterns, p)
+		}
+	}
+	for i, p := range cfg.Patterns {
+		re, err := regexp.Compile(p.Match)
+		if err != nil {
+			return nil, fmt.Errorf("excerpt_pii.patterns[%d]: %w", i, err)
+		}
+		s.patterns = append(s.patterns, piiPattern{name: p.Name, re: re})
+	}
+	return s, nil
+}
+
+// scrub returns text with the personal data s detects replaced, and the
+// kinds it replaced.
+func (s *piiScrubber) scrub(text string) (string, []string) {
+	if s == nil {
+		return text, nil
+	}
+	var kinds []string
+	for _, p := range s.patterns {
+		marker := "***" + strings.ToUpper(p.name) + "***"
+		found := false
+		text = p.re.ReplaceAllStringFunc(text, func(m string) string {
+			if p.check != nil && !p.check(m) {
+				return m
+			}
+			found = true
+			return marker
+		})
+		if found {
+			kinds = append(kinds, p.name)
+		}
+	}
+	return text, kinds
+}
+
+// excerpt returns the excerpt of the body c captured, with credentials and
+// the personal data r.pii detects scrubbed. The kinds of personal data
+// scrubbed are added to e's pii.redacted attribute.
+func (r *rules) excerpt(c *capture, e *audit.Entry) string {
+	s, kinds := r.pii.scrub(audit.RedactExcerpt(c.buf.String()))
+	if len(kinds) > 0 {
+		prev, _ := e.Attributes["pii.redacted"].([]string)
+		kinds = append(slices.Clone(prev), kinds...)
+		slices.Sort(kinds)
+		e.SetAttribute("pii.redacted", slices.Compact(kinds))
+	}
+	return s
+}
+
+// digits returns the decimal digits in s.
+func digits(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, s)
+}
+
+// luhn reports whether the digits in num pass the Luhn checksum.
+func luhn(num string) bool {
+	sum := 0
+	for i := range len(num) {
+		d := int(num[len(num)-1-i] - '0')
+		if i%2 == 1 {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return len(num) > 0 && sum%10 == 0
+}
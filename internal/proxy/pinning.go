@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/kdhira/audit-proxy/internal/config"
+	"github.com/kdhira/audit-proxy/internal/metrics"
+)
+
+// pinningCheckWindow is how soon after the handshake a client closing
+// an intercepted tunnel without a request is taken to reject the leaf, as
+// clients checking pins once the handshake is done do. Later closes are
+// taken as unused connections.
+const pinningCheckWindow = time.Second
+
+// maxPinnedHosts bounds the number of hosts bypassed for pinning.
+const maxPinnedHosts = 10000
+
+// pinning learns the hosts whose clients reject the proxy's leaf, taken
+// to pin their certificates, and, if configured, has their tunnels passed
+// through without interception for a while.
+type pinning struct {
+	bypass    bool
+	bypassFor time.Duration // 0 for until restart
+	suspected *metrics.CounterVec
+	bypassing *metrics.GaugeVec
+
+	mu    sync.Mutex
+	hosts map[string]time.Time // host:port → end of the bypass; zero for none
+}
+
+func newPinning(cfg config.MITMPinningConfig, reg *metrics.Registry) *pinning {
+	return &pinning{
+		bypass:    cfg.Bypass,
+		bypassFor: cfg.BypassFor,
+		suspected: reg.Counter("auditproxy_mitm_pinning_suspected_total",
+			"Intercepted tunnels whose clients rejected the leaf certificate during the handshake."),
+		bypassing: reg.Gauge("auditproxy_mitm_pinning_bypassed_hosts",
+			"Hosts tunnelled without interception because their clients rejected the leaf certificate."),
+		hosts: map[string]time.Time{},
+	}
+}
+
+// rejected records that a client of hostport rejected the proxy's leaf at
+// now, and reports whether hostport is now bypassed.
+func (p *pinning) rejected(hostport string, now time.Time) bool {
+	if p == nil {
+		return false
+	}
+	p.suspected.With().Inc()
+	if !p.bypass {
+		return false
+	}
+	var until time.Time
+	if p.bypassFor > 0 {
+		until = now.Add(p.bypassFor)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.hosts) >= maxPinnedHosts {
+		p.prune(now)
+		if len(p.hosts) >= maxPinnedHosts {
+			return false
+		}
+	}
+	p.hosts[strings.ToLower(hostport)] = until
+	p.bypassing.With().Set(float64(len(p.hosts)))
+	return true
+}
+
+// bypassed reports whether tunnels to hostport are passed through at now.
+func (p *pinning) bypassed(hostport string, now time.Time) bool {
+	if p == nil || !p.bypass {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	until, ok := p.hosts[strings.ToLower(hostport)]
+	if !ok {
+		return false
+	}
+	if !until.IsZero() && !now.Before(until) {
+		delete(p.hosts, strings.ToLower(hostport))
+		p.bypassing.With().Set(float64(len(p.hosts)))
+		return false
+	}
+	return true
+}
+
+// prune drops the bypasses ended at now. p.mu must be held.
+func (p *pinning) prune(now time.Time) {
+	for host, until := range p.hosts {
+		if !until.IsZero() && !now.Before(until) {
+			delete(p.hosts, host)
+		}
+	}
+}
+
+// rejectedLeaf reports whether err, ending a client handshake in which
+// the proxy's leaf was presented, means the client refused the leaf. Any
+// failure but a timeout does: clients reject the leaf with an alert, some
+// encrypted with keys the proxy does not expect yet, or by hanging up.
+func rejectedLeaf(err error) bool {
+	var ne net.Error
+	return !errors.Is(err, context.DeadlineExceeded) && !(errors.As(err, &ne) && ne.Timeout())
+}
+
+// hungUp reports whether err, reading the first request of a tunnel, is
+// the client sending an alert or closing the connection.
+func hungUp(err error) bool {
+	var op *net.OpError
+	if errors.As(err, &op) && op.Op == "remote error" {
+		return true
+	}
+	return errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET)
+}
+
+// suspectPinning records on tunnel that its client rejected the leaf for
+// hostport and learns hostport.
+func (h *handler) suspectPinning(tunnel *exchange, hostport string) {
+	tunnel.attrs.Set("mitm_pinning_suspected", true)
+	if h.pinning.rejected(hostport, time.Now()) {
+		slog.Info("tunnelling host without interception after its client rejected the leaf", "host", hostport)
+	}
+}
@@ -0,0 +1,255 @@
+package proxy
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/kdhira/audit-proxy/internal/config"
+	"github.com/kdhira/audit-proxy/internal/filters"
+	"github.com/kdhira/audit-proxy/internal/forward"
+)
+
+// policy is the effective policy for one request: the global configuration,
+// possibly overridden by a matching client entry.
+type policy struct {
+	client       string
+	allowHosts   hostList
+	denyHosts    hostList
+	filters      filters.Chain
+	logBodies    bool
+	excerptLimit int
+}
+
+// excerptBytes returns how many body bytes to keep per excerpt.
+func (p *policy) excerptBytes() int {
+	if !p.logBodies {
+		return 0
+	}
+	return p.excerptLimit
+}
+
+// clientPolicy is a compiled config.ClientConfig.
+type clientPolicy struct {
+	users  []string
+	source netip.Prefix
+	policy *policy
+}
+
+func (c *clientPolicy) matches(id identity, remoteAddr string) bool {
+	if len(c.users) > 0 && !slices.Contains(c.users, id.user) {
+		return false
+	}
+	if c.source.IsValid() {
+		addr, ok := remoteIP(remoteAddr)
+		if !ok || !c.source.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// buildPolicies compiles the global policy and per-client overrides.
+func buildPolicies(cfg config.Config, global filters.Chain, obs filters.Observer) (*policy, []*clientPolicy, error) {
+	allow, err := compileHosts(cfg.AllowHosts)
+	if err != nil {
+		return nil, nil, fmt.Errorf("allow_hosts: %w", err)
+	}
+	deny, err := compileHosts(cfg.DenyHosts)
+	if err != nil {
+		return nil, nil, fmt.Errorf("deny_hosts: %w", err)
+	}
+	base := &policy{
+		allowHosts:   allow,
+		denyHosts:    deny,
+		filters:      global,
+		logBodies:    cfg.LogBodies,
+		excerptLimit: cfg.ExcerptLimit,
+	}
+	var clients []*clientPolicy
+	for _, cc := range cfg.Clients {
+		p := *base
+		p.client = cc.Name
+		if cc.AllowHosts != nil {
+			if p.allowHosts, err = compileHosts(cc.AllowHosts); err != nil {
+				return nil, nil, fmt.Errorf("client %s: allow_hosts: %w", cc.Name, err)
+			}
+		}
+		if len(cc.DenyHosts) > 0 {
+			extra, err := compileHosts(cc.DenyHosts)
+			if err != nil {
+				return nil, nil, fmt.Errorf("client %s: deny_hosts: %w", cc.Name, err)
+			}
+			p.denyHosts = append(slices.Clone(deny), extra...)
+		}
+		if len(cc.Filters) > 0 {
+			extra, err := filters.Build(cc.Filters, obs)
+			if err != nil {
+				return nil, nil, fmt.Errorf("client %s: %w", cc.Name, err)
+			}
+			p.filters = global.Append(extra)
+		}
+		if cc.LogBodies != nil {
+			p.logBodies = *cc.LogBodies
+		}
+		if cc.ExcerptLimit != nil {
+			p.excerptLimit = *cc.ExcerptLimit
+		}
+		c := &clientPolicy{users: cc.Users, policy: &p}
+		if cc.SourceCIDR != "" {
+			prefix, err := netip.ParsePrefix(cc.SourceCIDR)
+			if err != nil {
+				return nil, nil, fmt.Errorf("client %s: %w", cc.Name, err)
+			}
+			c.source = prefix.Masked()
+		}
+		clients = append(clients, c)
+	}
+	return base, clients, nil
+}
+
+// policyFor resolves the policy for r from its identity and source address.
+func (rs *rules) policyFor(r *http.Request) *policy {
+	id := identityFrom(r.Context())
+	for _, c := range rs.clients {
+		if c.matches(id, r.RemoteAddr) {
+			return c.policy
+		}
+	}
+	return rs.policy
+}
+
+// sourceOf returns the IP address of remoteAddr, or remoteAddr itself if it
+// has none, e.g. for a Unix socket.
+func sourceOf(remoteAddr string) string {
+	if addr, ok := remoteIP(remoteAddr); ok {
+		return addr.String()
+	}
+	return remoteAddr
+}
+
+func remoteIP(remoteAddr string) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+// rootCAs returns the system roots plus the CA certificates in files, or
+// nil for the system roots alone. field names the setting in errors.
+func rootCAs(field string, files []string) (*x509.CertPool, error) {
+	if len(files) == 0 {
+		return nil, nil
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	for _, f := range files {
+		pem, err := os.ReadFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", field, err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates in %s", field, f)
+		}
+	}
+	return pool, nil
+}
+
+// newResolver builds the upstream resolver from the egress settings.
+func newResolver(cfg config.EgressConfig) (*forward.Resolver, error) {
+	opts := forward.ResolverOptions{TTL: cfg.CacheTTL, BlockPrivate: cfg.BlockPrivate}
+	for _, s := range cfg.DNSServers {
+		if _, _, err := net.SplitHostPort(s); err != nil {
+			s = net.JoinHostPort(strings.Trim(s, "[]"), "53")
+		}
+		opts.Servers = append(opts.Servers, s)
+	}
+	for _, p := range cfg.AllowPrivate {
+		prefix, err := netip.ParsePrefix(p)
+		if err != nil {
+			return nil, fmt.Errorf("egress.allow_private: %w", err)
+		}
+		opts.Allow = append(opts.Allow, prefix.Masked())
+	}
+	for host, addrs := range cfg.Hosts {
+		if opts.Hosts == nil {
+			opts.Hosts = map[string][]netip.Addr{}
+		}
+		key := strings.ToLower(host)
+		for _, a := range addrs {
+			addr, err := netip.ParseAddr(a)
+			if err != nil {
+				return nil, fmt.Errorf("egress.hosts: %w", err)
+			}
+			opts.Hosts[key] = append(opts.Hosts[key], addr.Unmap())
+		}
+	}
+	switch {
+	case cfg.BindAddress != "":
+		addr, err := netip.ParseAddr(cfg.BindAddress)
+		if err != nil {
+			return nil, fmt.Errorf("egress.bind_address: %w", err)
+		}
+		opts.LocalAddrs = []netip.Addr{addr.Unmap()}
+	case cfg.Interface != "":
+		addrs, err := interfaceAddrs(cfg.Interface)
+		if err != nil {
+			return nil, fmt.Errorf("egress.interface: %w", err)
+		}
+		opts.LocalAddrs = addrs
+	}
+	opts.FallbackDelay = cfg.FallbackDelay
+	return forward.NewResolver(opts), nil
+}
+
+// interfaceAddrs returns the first IPv4 and the first IPv6 address of the
+// named interface, skipping link-local ones, which need a zone to bind.
+func interfaceAddrs(name string) ([]netip.Addr, error) {
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	ifaddrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var v4, v6 netip.Addr
+	for _, ia := range ifaddrs {
+		ipnet, ok := ia.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		a, ok := netip.AddrFromSlice(ipnet.IP)
+		if !ok || a.IsLinkLocalUnicast() {
+			continue
+		}
+		switch a = a.Unmap(); {
+		case a.Is4() && !v4.IsValid():
+			v4 = a
+		case a.Is6() && !v6.IsValid():
+			v6 = a
+		}
+	}
+	var out []netip.Addr
+	for _, a := range []netip.Addr{v4, v6} {
+		if a.IsValid() {
+			out = append(out, a)
+		}
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("%s has no usable address", name)
+	}
+	return out, nil
+}
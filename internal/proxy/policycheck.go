@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/kdhira/audit-proxy/internal/audit"
+	"github.com/kdhira/audit-proxy/internal/config"
+)
+
+// Policy outcomes reported by PolicyChecker.
+const (
+	OutcomeAllow = "allow" // forwarded upstream
+	OutcomeDeny  = "deny"  // refused by the proxy's own policy
+	OutcomeBlock = "block" // blocked by a filter
+	OutcomeMock  = "mock"  // answered by a mock rule
+
+	OutcomeUnaudited = "unaudited" // passed through as a direct_hosts target
+)
+
+// Decision is what the proxy's policy decides about a request.
+type Decision struct {
+	Outcome string
+	Status  int    // status the client would receive; 0 when forwarded
+	Filter  string // the blocking filter
+	Reason  string
+	// Intercepted is set for https requests whose tunnel would be
+	// decrypted, so that filters see the request rather than the CONNECT.
+	Intercepted bool
+	Client      string
+	Profile     string
+	Service     string
+	Attributes  map[string]any
+}
+
+// PolicyChecker evaluates requests against a configuration's policy
+// without forwarding them: proxy authentication, direct_hosts, host lists,
+// CONNECT ports, client overrides, interception, request filters, mocks and
+// profiles.
+// Egress checks, which need DNS, and response filters are not evaluated.
+type PolicyChecker struct {
+	h *handler
+}
+
+// NewPolicyChecker compiles the policy of cfg.
+func NewPolicyChecker(cfg config.Config) (*PolicyChecker, error) {
+	rs, err := buildRules(cfg, nil)
+	if err != nil {
+		return nil, err
+	}
+	ports, err := newPortPolicy(cfg.Connect.Ports)
+	if err != nil {
+		return nil, err
+	}
+	h := &handler{cfg: cfg, connectPorts: ports}
+	h.rules.Store(rs)
+	return &PolicyChecker{h: h}, nil
+}
+
+// Check decides req, an absolute-form request, as sent by the proxy user
+// user ("" for none) from the IP address source. An https request is
+// checked as the CONNECT a client would open for it and, if the tunnel is
+// intercepted, as the request inside it.
+func (c *PolicyChecker) Check(req *http.Request, user, source string) Decision {
+	h := c.h
+	if h.cfg.ProxyAuth.Enabled() && user == "" {
+		return Decision{Outcome: OutcomeDeny, Status: http.StatusProxyAuthRequired, Reason: "proxy authentication required"}
+	}
+	ctx := req.Context()
+	if user != "" {
+		ctx = withIdentity(ctx, identity{user: user, method: "basic"})
+	}
+	req = req.WithContext(ctx)
+	req.RemoteAddr = net.JoinHostPort(source, "0")
+	if pattern, ok := h.rules.Load().unauditedTarget(req); ok {
+		return Decision{Outcome: OutcomeUnaudited, Reason: "direct_hosts " + pattern}
+	}
+	if req.URL.Scheme != "https" {
+		return c.checkRequest(h.begin(audit.KindHTTP, req), false)
+	}
+
+	hostport := req.URL.Host
+	if _, _, err := net.SplitHostPort(hostport); err != nil {
+		hostport = net.JoinHostPort(hostname(hostport), "443")
+	}
+	connect := (&http.Request{
+		Method:     http.MethodConnect,
+		URL:        &url.URL{Host: hostport},
+		Host:       hostport,
+		Header:     http.Header{},
+		RemoteAddr: req.RemoteAddr,
+	}).WithContext(ctx)
+	x := h.begin(audit.KindConnect, connect)
+	if reason := h.hostDenied(x.policy, hostport, "443"); reason != "" {
+		x.deny(http.StatusForbidden, reason)
+		return decision(x, OutcomeDeny)
+	}
+	if !h.connectPorts.allows(hostport) {
+		x.deny(http.StatusForbidden, "port not allowed")
+		return decision(x, OutcomeDeny)
+	}
+	if !h.intercept(x) {
+		if err := x.policy.filters.OnRequest(x.ctx(), x.req); err != nil {
+			x.block(err)
+			return decision(x, OutcomeBlock)
+		}
+		return decision(x, OutcomeAllow)
+	}
+	return c.checkRequest(h.begin(audit.KindMITM, req), true)
+}
+
+// checkRequest decides a plain HTTP or intercepted request as handleHTTP
+// and processMitmRequest would.
+func (c *PolicyChecker) checkRequest(x *exchange, intercepted bool) Decision {
+	d := c.requestOutcome(x)
+	d.Intercepted = intercepted
+	if p := x.rules.profiles.Match(x.req); p != nil {
+		d.Profile = p.Name()
+	}
+	return d
+}
+
+func (c *PolicyChecker) requestOutcome(x *exchange) Decision {
+	if reason := c.h.hostDenied(x.policy, x.req.URL.Host, defaultPort(x.req.URL.Scheme)); reason != "" {
+		x.deny(http.StatusForbidden, reason)
+		return decision(x, OutcomeDeny)
+	}
+	if err := x.policy.filters.OnRequest(x.ctx(), x.req); err != nil {
+		x.block(err)
+		return decision(x, OutcomeBlock)
+	}
+	if m := x.rules.mockFor(x.req); m != nil {
+		d := decision(x, OutcomeMock)
+		d.Status = m.status
+		return d
+	}
+	return decision(x, OutcomeAllow)
+}
+
+// decision summarises the state of x.
+func decision(x *exchange, outcome string) Decision {
+	e := &x.entry
+	x.attrs.CopyTo(e)
+	d := Decision{
+		Outcome:    outcome,
+		Filter:     e.Filter,
+		Reason:     e.Reason,
+		Client:     e.Conn.Client,
+		Service:    e.Service,
+		Attributes: e.Attributes,
+	}
+	if e.Response != nil {
+		d.Status = e.Response.Status
+	}
+	return d
+}
@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kdhira/audit-proxy/internal/config"
+	"github.com/kdhira/audit-proxy/internal/health"
+)
+
+// pool load-balances a logical host across weighted endpoints using smooth
+// weighted round robin, skipping endpoints marked down.
+type pool struct {
+	name      string
+	match     hostList
+	endpoints []*endpoint
+
+	mu sync.Mutex
+}
+
+// endpoint is one pool member with its passive health state: after
+// maxFails consecutive failures it is taken out of rotation for failTimeout.
+// An endpoint with an active probe is also out of rotation while the probe
+// reports it unhealthy.
+type endpoint struct {
+	url    *url.URL
+	weight int
+	probe  *health.Target
+
+	maxFails    int
+	failTimeout time.Duration
+
+	current   int // smooth weighted round robin state, guarded by pool.mu
+	mu        sync.Mutex
+	fails     int
+	downUntil time.Time
+}
+
+func buildPools(cfgs []config.UpstreamPool, checker *health.Checker) ([]*pool, error) {
+	var out []*pool
+	for _, c := range cfgs {
+		match, err := compileHosts([]string{c.Host})
+		if err != nil {
+			return nil, fmt.Errorf("upstream_pools %s: %w", c.Host, err)
+		}
+		p := &pool{name: c.Host, match: match}
+		maxFails, failTimeout := c.MaxFails, c.FailTimeout
+		if maxFails == 0 {
+			maxFails = 3
+		}
+		if failTimeout == 0 {
+			failTimeout = 30 * time.Second
+		}
+		for _, e := range c.Endpoints {
+			u, err := url.Parse(e.URL)
+			if err != nil {
+				return nil, fmt.Errorf("upstream_pools %s: %w", c.Host, err)
+			}
+			weight := e.Weight
+			if weight == 0 {
+				weight = 1
+			}
+			ep := &endpoint{url: u, weight: weight, maxFails: maxFails, failTimeout: failTimeout}
+			if c.HealthCheck != nil {
+				ep.probe = checker.Add(c.Host+" "+e.URL, probeURL(u, c.HealthCheck.Path), *c.HealthCheck)
+			}
+			p.endpoints = append(p.endpoints, ep)
+		}
+		out = append(out, p)
+	}
+	return out, nil
+}
+
+// pick chooses the next endpoint. If every endpoint is down, all are
+// considered rather than failing the request outright.
+func (p *pool) pick(now time.Time) *endpoint {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	candidates := make([]*endpoint, 0, len(p.endpoints))
+	for _, e := range p.endpoints {
+		if e.healthy(now) {
+			candidates = append(candidates, e)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = p.endpoints
+	}
+	var best *endpoint
+	total := 0
+	for _, e := range candidates {
+		e.current += e.weight
+		total += e.weight
+		if best == nil || e.current > best.current {
+			best = e
+		}
+	}
+	best.current -= total
+	return best
+}
+
+func (e *endpoint) healthy(now time.Time) bool {
+	if !e.probe.Healthy() {
+		return false
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return !now.Before(e.downUntil)
+}
+
+// observe records the outcome of a request. Transport errors and 502, 503
+// and 504 responses count as failures.
+func (e *endpoint) observe(resp *http.Response, err error, now time.Time) {
+	failed := err != nil
+	if resp != nil {
+		switch resp.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			failed = true
+		}
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !failed {
+		e.fails = 0
+		return
+	}
+	e.fails++
+	if e.fails >= e.maxFails {
+		e.downUntil = now.Add(e.failTimeout)
+		e.fails = 0
+	}
+}
+
+// poolFor returns the pool serving the target of out, if any.
+func (h *handler) poolFor(out *http.Request) *pool {
+	for _, p := range h.pools {
+		if p.match.match(out.URL.Host, defaultPort(out.URL.Scheme)) {
+			return p
+		}
+	}
+	return nil
+}
+
+// probeURL is the health check URL for an upstream at base.
+func probeURL(base *url.URL, p string) string {
+	u := *base
+	u.Path = path.Join("/", base.Path, p)
+	u.RawPath = ""
+	return u.String()
+}
+
+// retarget points out at base, appending the request path to base's path.
+func retarget(out *http.Request, base *url.URL) {
+	p := path.Join("/", base.Path, out.URL.Path)
+	if strings.HasSuffix(out.URL.Path, "/") && !strings.HasSuffix(p, "/") {
+		p += "/"
+	}
+	out.URL.Scheme = base.Scheme
+	out.URL.Host = base.Host
+	out.URL.Path = p
+	out.URL.RawPath = ""
+	out.Host = ""
+}
@@ -0,0 +1,280 @@
+package proxy
+
+import (
+	"container/list"
+	"context"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/kdhira/audit-proxy/internal/config"
+	"github.com/kdhira/audit-proxy/internal/metrics"
+)
+
+// Admission outcomes that refuse a request.
+const (
+	reasonQueueFull    = "proxy queue full"
+	reasonQueueTimeout = "timed out waiting in proxy queue"
+)
+
+// limiter enforces the concurrency limits. Every request joins its class's
+// queue, and slots are handed out by stride scheduling, a form of weighted
+// fair queueing: each class has a pass value advanced by 1/weight per slot
+// it receives, and the waiting class with the lowest pass goes next. Within
+// a class, the oldest request whose host is under PerHost and whose client
+// is under PerClient goes first, so a saturated host or a client flooding
+// the proxy does not hold up the rest.
+type limiter struct {
+	max, perHost int
+	perClient    int
+	maxQueue     int
+	timeout      time.Duration
+	header       string
+
+	classes  []*queueClass
+	byUser   map[string]*queueClass
+	byClient map[string]*queueClass
+	byName   map[string]*queueClass
+	def      *queueClass
+
+	depth *metrics.GaugeVec
+	wait  *metrics.HistogramVec
+
+	mu      sync.Mutex
+	active  int
+	hosts   map[string]int
+	clients map[string]int
+	queued  int
+	vtime   float64
+}
+
+type queueClass struct {
+	name    string
+	stride  float64
+	pass    float64
+	waiting *list.List // of *waiter
+}
+
+type waiter struct {
+	host    string
+	client  string
+	ready   chan struct{}
+	granted bool
+}
+
+func newLimiter(cfg config.ConcurrencyConfig, reg *metrics.Registry) *limiter {
+	l := &limiter{
+		max:       cfg.MaxRequests,
+		perHost:   cfg.PerHost,
+		perClient: cfg.PerClient,
+		maxQueue:  cfg.MaxQueue,
+		timeout:   cfg.QueueTimeout,
+		header:    cfg.PriorityHeader,
+		byUser:    map[string]*queueClass{},
+		byClient:  map[string]*queueClass{},
+		byName:    map[string]*queueClass{},
+		hosts:     map[string]int{},
+		clients:   map[string]int{},
+		depth: reg.Gauge("auditproxy_queue_depth",
+			"Requests waiting for an upstream slot, by priority class.", "class"),
+		wait: reg.Histogram("auditproxy_queue_wait_seconds",
+			"Time requests waited for an upstream slot, by priority class.", metrics.DefaultBuckets, "class"),
+	}
+	if l.maxQueue == 0 {
+		l.maxQueue = 1000
+	}
+	if l.timeout == 0 {
+		l.timeout = 30 * time.Second
+	}
+	if l.header == "" {
+		l.header = "X-Priority-Class"
+	}
+	classes := cfg.Classes
+	if len(classes) == 0 {
+		classes = []config.PriorityClass{{Name: "default"}}
+	}
+	for _, c := range classes {
+		weight := c.Weight
+		if weight == 0 {
+			weight = 1
+		}
+		qc := &queueClass{name: c.Name, stride: 1 / float64(weight), waiting: list.New()}
+		l.classes = append(l.classes, qc)
+		l.byName[c.Name] = qc
+		for _, u := range c.Users {
+			if _, ok := l.byUser[u]; !ok {
+				l.byUser[u] = qc
+			}
+		}
+		for _, cl := range c.Clients {
+			if _, ok := l.byClient[cl]; !ok {
+				l.byClient[cl] = qc
+			}
+		}
+	}
+	l.def = l.classes[0]
+	if c, ok := l.byName[cfg.DefaultClass]; ok {
+		l.def = c
+	}
+	return l
+}
+
+// enabled reports whether any limit is configured.
+func (l *limiter) enabled() bool {
+	return l.max > 0 || l.perHost > 0 || l.perClient > 0
+}
+
+// classify returns the class of a request from user or client, falling back
+// to the priority header and then the default class.
+func (l *limiter) classify(user, client string, h http.Header) *queueClass {
+	if c, ok := l.byUser[user]; ok && user != "" {
+		return c
+	}
+	if c, ok := l.byClient[client]; ok && client != "" {
+		return c
+	}
+	if c, ok := l.byName[h.Get(l.header)]; ok {
+		return c
+	}
+	return l.def
+}
+
+// acquire waits for a slot for a request from client to host. On success it returns the function
+// releasing the slot and how long the request queued; otherwise it returns
+// the reason for refusal. A cancelled ctx is reported as a timeout.
+func (l *limiter) acquire(ctx context.Context, c *queueClass, host, client string) (release func(), waited time.Duration, reason string) {
+	start := time.Now()
+	l.mu.Lock()
+	if l.queued >= l.maxQueue {
+		l.mu.Unlock()
+		return nil, 0, reasonQueueFull
+	}
+	w := &waiter{host: host, client: client, ready: make(chan struct{})}
+	if c.waiting.Len() == 0 {
+		// An idle class rejoins at the current virtual time rather than
+		// spending credit banked while it had nothing to send.
+		c.pass = max(c.pass, l.vtime)
+	}
+	elem := c.waiting.PushBack(w)
+	l.queued++
+	l.dispatch()
+	l.mu.Unlock()
+
+	release = func() { l.release(host, client) }
+	if w.granted {
+		return release, 0, ""
+	}
+	l.depth.With(c.name).Add(1)
+	defer l.depth.With(c.name).Add(-1)
+
+	timer := time.NewTimer(l.timeout)
+	defer timer.Stop()
+	select {
+	case <-w.ready:
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	waited = time.Since(start)
+	l.wait.With(c.name).Observe(waited.Seconds())
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if w.granted {
+		return release, waited, ""
+	}
+	c.waiting.Remove(elem)
+	l.queued--
+	return nil, waited, reasonQueueTimeout
+}
+
+// dispatch grants free slots to waiting requests. The caller holds l.mu.
+func (l *limiter) dispatch() {
+	for l.max <= 0 || l.active < l.max {
+		if !l.grantOne() {
+			return
+		}
+	}
+}
+
+func (l *limiter) grantOne() bool {
+	order := make([]*queueClass, 0, len(l.classes))
+	for _, c := range l.classes {
+		if c.waiting.Len() > 0 {
+			order = append(order, c)
+		}
+	}
+	// Stable, so classes with equal pass keep their configured order.
+	slices.SortStableFunc(order, func(a, b *queueClass) int {
+		switch {
+		case a.pass < b.pass:
+			return -1
+		case a.pass > b.pass:
+			return 1
+		}
+		return 0
+	})
+	for _, c := range order {
+		for e := c.waiting.Front(); e != nil; e = e.Next() {
+			w := e.Value.(*waiter)
+			if l.perHost > 0 && l.hosts[w.host] >= l.perHost ||
+				l.perClient > 0 && l.clients[w.client] >= l.perClient {
+				continue
+			}
+			c.waiting.Remove(e)
+			l.queued--
+			l.vtime = c.pass
+			c.pass += c.stride
+			l.active++
+			l.hosts[w.host]++
+			l.clients[w.client]++
+			w.granted = true
+			close(w.ready)
+			return true
+		}
+	}
+	return false
+}
+
+func (l *limiter) release(host, client string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active--
+	if l.hosts[host]--; l.hosts[host] <= 0 {
+		delete(l.hosts, host)
+	}
+	if l.clients[client]--; l.clients[client] <= 0 {
+		delete(l.clients, client)
+	}
+	l.dispatch()
+}
+
+// admit applies the concurrency limits to x, recording its class and any
+// wait. It returns why the request was refused, or "" once it holds a slot,
+// which finish releases.
+func (h *handler) admit(x *exchange) string {
+	l := h.limiter
+	if !l.enabled() {
+		return ""
+	}
+	c := l.classify(x.entry.Conn.User, x.entry.Conn.Client, x.req.Header)
+	x.req.Header.Del(l.header)
+	x.attrs.Set("priority.class", c.name)
+	release, waited, reason := l.acquire(x.ctx(), c, x.entry.Request.Host, clientKey(x))
+	if waited > 0 {
+		x.attrs.Set("queue.wait_ms", waited.Milliseconds())
+	}
+	x.release = release
+	return reason
+}
+
+// clientKey identifies the client of x for PerClient: its authenticated
+// user, else its client policy, else its source address.
+func clientKey(x *exchange) string {
+	switch {
+	case x.entry.Conn.User != "":
+		return "user:" + x.entry.Conn.User
+	case x.entry.Conn.Client != "":
+		return "client:" + x.entry.Conn.Client
+	}
+	return "addr:" + sourceOf(x.req.RemoteAddr)
+}
@@ -0,0 +1,380 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/kdhira/audit-proxy/internal/config"
+)
+
+const (
+	// quotaBuckets is how many slices a quota's period is counted in: usage
+	// leaves the rolling period a slice at a time.
+	quotaBuckets = 60
+	// stateSaveInterval is how often quota counters and budget totals are
+	// written to their state files.
+	stateSaveInterval = 30 * time.Second
+)
+
+// quotas enforces the quota rules: time windows, and rolling request and
+// byte limits per client.
+type quotas struct {
+	rules []*quotaRule
+	file  string
+
+	mu       sync.Mutex
+	counters map[string]map[string]*quotaCounter // by rule, then client
+	dirty    bool
+}
+
+type quotaRule struct {
+	name     string
+	users    []string
+	clients  []string
+	hosts    hostList
+	windows  []timeWindow
+	loc      *time.Location
+	period   time.Duration
+	requests int64
+	bytes    int64
+}
+
+type timeWindow struct {
+	days     []time.Weekday // nil for every day
+	from, to time.Duration  // since midnight
+}
+
+// quotaCounter is a client's usage under a rule, in slices of the period.
+// Slice i of the period counts in Requests[i%quotaBuckets].
+type quotaCounter struct {
+	Last     int64               `json:"last"` // the latest slice counted in
+	Requests [quotaBuckets]int64 `json:"requests"`
+	Bytes    [quotaBuckets]int64 `json:"bytes"`
+}
+
+// quotaCharge is what an admitted request is to be charged for once its
+// bytes are known.
+type quotaCharge struct {
+	rule   *quotaRule
+	client string
+}
+
+// quotaState is the state file.
+type quotaState struct {
+	Rules map[string]quotaRuleState `json:"rules"`
+}
+
+type quotaRuleState struct {
+	Period   time.Duration            `json:"period"`
+	Counters map[string]*quotaCounter `json:"counters"`
+}
+
+// newQuotas compiles cfg, reading the counters from its state file. It
+// returns nil without rules.
+func newQuotas(cfg config.QuotasConfig) (*quotas, error) {
+	if len(cfg.Rules) == 0 {
+		return nil, nil
+	}
+	q := &quotas{file: cfg.StateFile, counters: map[string]map[string]*quotaCounter{}}
+	for _, rc := range cfg.Rules {
+		hosts, err := compileHosts(rc.Hosts)
+		if err != nil {
+			return nil, fmt.Errorf("quota %s: hosts: %w", rc.Name, err)
+		}
+		r := &quotaRule{
+			name:     rc.Name,
+			users:    rc.Users,
+			clients:  rc.Clients,
+			hosts:    hosts,
+			loc:      time.Local,
+			period:   rc.Period,
+			requests: rc.Requests,
+			bytes:    rc.Bytes,
+		}
+		if r.period == 0 {
+			r.period = time.Hour
+		}
+		if rc.Timezone != "" {
+			if r.loc, err = time.LoadLocation(rc.Timezone); err != nil {
+				return nil, fmt.Errorf("quota %s: %w", rc.Name, err)
+			}
+		}
+		for _, wc := range rc.Windows {
+			var w timeWindow
+			for _, d := range wc.Days {
+				day, _ := config.Weekday(d)
+				w.days = append(w.days, day)
+			}
+			w.from, _ = config.ClockTime(wc.From)
+			w.to, _ = config.ClockTime(wc.To)
+			r.windows = append(r.windows, w)
+		}
+		q.rules = append(q.rules, r)
+		q.counters[r.name] = map[string]*quotaCounter{}
+	}
+	if err := q.load(); err != nil {
+		return nil, fmt.Errorf("quotas.state_file: %w", err)
+	}
+	return q, nil
+}
+
+// selects reports whether r applies to x.
+func (r *quotaRule) selects(x *exchange) bool {
+	if len(r.users) > 0 || len(r.clients) > 0 {
+		if !slices.Contains(r.users, x.entry.Conn.User) && !slices.Contains(r.clients, x.entry.Conn.Client) {
+			return false
+		}
+	}
+	return len(r.hosts) == 0 || r.hosts.match(x.req.URL.Host, defaultPort(x.req.URL.Scheme))
+}
+
+// open reports whether now falls in one of r's windows, or r has none.
+func (r *quotaRule) open(now time.Time) bool {
+	if len(r.windows) == 0 {
+		return true
+	}
+	now = now.In(r.loc)
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, r.loc)
+	since := now.Sub(midnight)
+	yesterday := midnight.AddDate(0, 0, -1).Weekday()
+	for _, w := range r.windows {
+		if w.from < w.to {
+			if since >= w.from && since < w.to && w.on(now.Weekday()) {
+				return true
+			}
+			continue
+		}
+		// The window spans midnight: its evening starts today and its
+		// morning is the end of yesterday's.
+		if (since >= w.from && w.on(now.Weekday())) || (since < w.to && w.on(yesterday)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (w timeWindow) on(d time.Weekday) bool {
+	return w.days == nil || slices.Contains(w.days, d)
+}
+
+// slice returns the index of the slice of r's period now falls in.
+func (r *quotaRule) slice(now time.Time) int64 {
+	return now.UnixNano() / int64(r.period/quotaBuckets)
+}
+
+// advance moves c to slice, dropping usage that has left the period.
+func (c *quotaCounter) advance(slice int64) {
+	if slice <= c.Last {
+		return
+	}
+	if slice-c.Last >= quotaBuckets {
+		c.Requests, c.Bytes = [quotaBuckets]int64{}, [quotaBuckets]int64{}
+	} else {
+		for i := c.Last + 1; i <= slice; i++ {
+			c.Requests[i%quotaBuckets], c.Bytes[i%quotaBuckets] = 0, 0
+		}
+	}
+	c.Last = slice
+}
+
+func (c *quotaCounter) totals() (requests, bytes int64) {
+	for i := range quotaBuckets {
+		requests += c.Requests[i]
+		bytes += c.Bytes[i]
+	}
+	return requests, bytes
+}
+
+// admit checks x against the rules that select it, counting it against
+// their limits if it is let through. It returns the status and reason
+// refusing x, or 0. The usage of each rule, before x, is recorded as
+// quota.<rule>.requests and quota.<rule>.bytes.
+func (q *quotas) admit(x *exchange) (int, string) {
+	if q == nil {
+		return 0, ""
+	}
+	now := time.Now()
+	client := clientKey(x)
+	var counted []*quotaCounter
+	var at []int64 // the slice each counter is counted in
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, r := range q.rules {
+		if !r.selects(x) {
+			continue
+		}
+		if !r.open(now) {
+			x.attrs.Set("quota.rule", r.name)
+			return http.StatusForbidden, fmt.Sprintf("outside the hours of quota %s", r.name)
+		}
+		if r.requests == 0 && r.bytes == 0 {
+			continue
+		}
+		c := q.counter(r, client)
+		slice := r.slice(now)
+		c.advance(slice)
+		reqs, bytes := c.totals()
+		x.attrs.Set("quota."+r.name+".requests", reqs)
+		x.attrs.Set("quota."+r.name+".bytes", bytes)
+		if (r.requests > 0 && reqs >= r.requests) || (r.bytes > 0 && bytes >= r.bytes) {
+			x.attrs.Set("quota.rule", r.name)
+			return http.StatusTooManyRequests, fmt.Sprintf("quota %s exceeded", r.name)
+		}
+		counted = append(counted, c)
+		at = append(at, slice)
+		x.quotas = append(x.quotas, quotaCharge{r, client})
+	}
+	// Only a request every rule lets through counts against them.
+	for i, c := range counted {
+		c.Requests[at[i]%quotaBuckets]++
+	}
+	if len(counted) > 0 {
+		q.dirty = true
+	}
+	return 0, ""
+}
+
+// charge adds the bytes x sent and received to the quotas it was admitted
+// under.
+func (q *quotas) charge(x *exchange) {
+	if q == nil || len(x.quotas) == 0 {
+		return
+	}
+	n := x.entry.BytesOut + x.entry.BytesIn
+	if n == 0 {
+		return
+	}
+	now := time.Now()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, ch := range x.quotas {
+		c := q.counter(ch.rule, ch.client)
+		slice := ch.rule.slice(now)
+		c.advance(slice)
+		c.Bytes[slice%quotaBuckets] += n
+	}
+	q.dirty = true
+}
+
+// counter returns the counter of client under r, creating it. q.mu is
+// held.
+func (q *quotas) counter(r *quotaRule, client string) *quotaCounter {
+	c := q.counters[r.name][client]
+	if c == nil {
+		c = &quotaCounter{}
+		q.counters[r.name][client] = c
+	}
+	return c
+}
+
+// load reads the counters from the state file, keeping those of rules
+// whose period is unchanged. A missing file is no error.
+func (q *quotas) load() error {
+	if q.file == "" {
+		return nil
+	}
+	data, err := os.ReadFile(q.file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var st quotaState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return fmt.Errorf("%s: %w", q.file, err)
+	}
+	for _, r := range q.rules {
+		if rs, ok := st.Rules[r.name]; ok && rs.Period == r.period && rs.Counters != nil {
+			q.counters[r.name] = rs.Counters
+		}
+	}
+	return nil
+}
+
+// save writes the counters to the state file if they changed since the
+// last save.
+func (q *quotas) save() error {
+	if q == nil || q.file == "" {
+		return nil
+	}
+	q.mu.Lock()
+	if !q.dirty {
+		q.mu.Unlock()
+		return nil
+	}
+	st := quotaState{Rules: map[string]quotaRuleState{}}
+	now := time.Now()
+	for _, r := range q.rules {
+		if r.requests == 0 && r.bytes == 0 {
+			continue
+		}
+		rs := quotaRuleState{Period: r.period, Counters: map[string]*quotaCounter{}}
+		for client, c := range q.counters[r.name] {
+			// Clients with nothing left in the period are dropped.
+			c.advance(r.slice(now))
+			if reqs, bytes := c.totals(); reqs > 0 || bytes > 0 {
+				cc := *c
+				rs.Counters[client] = &cc
+			} else {
+				delete(q.counters[r.name], client)
+			}
+		}
+		st.Rules[r.name] = rs
+	}
+	q.dirty = false
+	q.mu.Unlock()
+	return saveState(q.file, st)
+}
+
+// saveState writes v as JSON to file, replacing the file whole so a crash
+// leaves the old one.
+func saveState(file string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(file), "."+filepath.Base(file)+"-*")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), file)
+}
+
+// run saves the counters every stateSaveInterval until ctx is done.
+func (q *quotas) run(ctx context.Context) {
+	if q == nil || q.file == "" {
+		return
+	}
+	t := time.NewTicker(stateSaveInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if err := q.save(); err != nil {
+			slog.Error("save quota counters", "file", q.file, "err", err)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/kdhira/audit-proxy/internal/config"
+	"github.com/kdhira/audit-proxy/internal/metrics"
+	"github.com/kdhira/audit-proxy/internal/mitm"
+)
+
+// reaper periodically closes idle connections, so file descriptors held by
+// pools and tunnels nobody uses any more do not pile up over time.
+type reaper struct {
+	cfg       config.ReaperConfig
+	upstreams *upstreams
+	drain     *drainState
+	mitm      *mitm.Manager
+	reaped    *metrics.CounterVec
+}
+
+func newReaper(cfg config.ReaperConfig, ups *upstreams, drain *drainState, mgr *mitm.Manager, reg *metrics.Registry) *reaper {
+	return &reaper{
+		cfg:       cfg,
+		upstreams: ups,
+		drain:     drain,
+		mitm:      mgr,
+		reaped: reg.Counter("auditproxy_reaped_connections_total",
+			"Idle connections closed by the reaper, by kind (upstream or mitm).", "kind"),
+	}
+}
+
+// run sweeps every interval until ctx is done.
+func (r *reaper) run(ctx context.Context) {
+	if r.cfg.Interval <= 0 {
+		return
+	}
+	t := time.NewTicker(r.cfg.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			r.sweep(now)
+		}
+	}
+}
+
+// sweep closes idle upstream connections and, with mitm_idle set,
+// intercepted tunnels idle for longer, and drops expiring leaf
+// certificates.
+func (r *reaper) sweep(now time.Time) {
+	upstream := r.upstreams.closeIdle()
+	tunnels := 0
+	if r.cfg.MITMIdle > 0 {
+		tunnels = r.drain.closeIdle(now.Add(-r.cfg.MITMIdle))
+	}
+	r.reaped.With("upstream").Add(float64(upstream))
+	r.reaped.With("mitm").Add(float64(tunnels))
+	if upstream > 0 || tunnels > 0 {
+		slog.Info("reaped idle connections", "upstream", upstream, "mitm", tunnels,
+			"upstream_open", r.upstreams.open.Load())
+	}
+	if r.mitm != nil {
+		if n := r.mitm.Sweep(now); n > 0 {
+			slog.Debug("dropped expiring leaf certificates", "count", n)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/kdhira/audit-proxy/internal/config"
+	"github.com/kdhira/audit-proxy/internal/filters"
+	"github.com/kdhira/audit-proxy/internal/profiles"
+	"github.com/kdhira/audit-proxy/internal/rollout"
+)
+
+// rules is the part of the configuration Reload swaps while the proxy
+// runs: host lists, including direct_hosts, filters, body logging,
+// excerpt limits and PII scrubbing, per-client overrides, profiles,
+// services, mocks, record-and-replay rules, capture rules and the hosts selected for
+// interception or, while interception is rolled out, included in it. An
+// exchange keeps the rules it began with.
+type rules struct {
+	policy     *policy
+	clients    []*clientPolicy
+	direct     hostList // direct_hosts, passed through unaudited
+	directPats []string // direct_hosts as configured, by index into direct
+	profiles   *profiles.Registry
+	services   []service
+	mocks      []*mock
+	replay     *replaySet // nil without replay rules
+	capture    *captureSet
+	pii        *piiScrubber // nil without excerpt_pii
+	mitm       *mitmSelector
+	mitmCanary *rollout.Rollout
+	pac        string // PAC expression for the global allow_hosts
+}
+
+// buildRules compiles the rules of cfg. obs, if not nil, observes filter
+// evaluations.
+func buildRules(cfg config.Config, obs filters.Observer) (*rules, error) {
+	reg, err := profiles.FromNames(cfg.Profiles, profiles.Options{
+		Order:  cfg.ProfileMatching.Order,
+		All:    !cfg.ProfileMatching.StopOnFirstMatch,
+		Custom: cfg.CustomProfiles,
+	})
+	if err != nil {
+		return nil, err
+	}
+	chain, err := filters.Build(cfg.Filters, obs)
+	if err != nil {
+		return nil, err
+	}
+	base, clients, err := buildPolicies(cfg, chain, obs)
+	if err != nil {
+		return nil, err
+	}
+	var services []service
+	for _, s := range cfg.Services {
+		hosts, err := compileHosts(s.Hosts)
+		if err != nil {
+			return nil, fmt.Errorf("service %s: %w", s.Name, err)
+		}
+		services = append(services, service{name: s.Name, hosts: hosts})
+	}
+	mocks, err := compileMocks(cfg.Mocks)
+	if err != nil {
+		return nil, err
+	}
+	replay, err := compileReplay(cfg.Replay)
+	if err != nil {
+		return nil, err
+	}
+	capture, err := compileCapture(cfg.Capture)
+	if err != nil {
+		return nil, err
+	}
+	pii, err := newPIIScrubber(cfg.ExcerptPII)
+	if err != nil {
+		return nil, err
+	}
+	mitm, err := compileMITMSelector(cfg, reg)
+	if err != nil {
+		return nil, err
+	}
+	direct, err := compileHosts(cfg.DirectHosts)
+	if err != nil {
+		return nil, fmt.Errorf("direct_hosts: %w", err)
+	}
+	return &rules{
+		policy:     base,
+		clients:    clients,
+		direct:     direct,
+		directPats: slices.Clone(cfg.DirectHosts),
+		profiles:   reg,
+		services:   services,
+		mocks:      mocks,
+		replay:     replay,
+		capture:    capture,
+		pii:        pii,
+		mitm:       mitm,
+		mitmCanary: rollout.New("mitm", cfg.MITMRollout),
+		pac:        base.allowHosts.pacConditions(),
+	}, nil
+}
+
+// service is a compiled config.ServiceConfig.
+type service struct {
+	name  string
+	hosts hostList
+}
+
+// serviceFor returns the name of the first service matching hostport, or
+// "" if none does. defaultPort applies when hostport has no port.
+func (r *rules) serviceFor(hostport, defaultPort string) string {
+	for _, s := range r.services {
+		if s.hosts.match(hostport, defaultPort) {
+			return s.name
+		}
+	}
+	return ""
+}
+
+// Reload swaps in the rules from cfg: host lists, direct_hosts, filters,
+// profiles and their order, body logging, excerpt limits and excerpt_pii,
+// client overrides, services, mocks, replay, capture rules,
+// mitm_disable_hosts, mitm_hosts and mitm_rollout. A changed MITM CA is rotated in and session
+// ticket keys are read again. Requests already in flight and open tunnels
+// finish under the old rules. Other settings, such as listeners, MITM
+// itself or timeouts, take effect only on restart. On error the running
+// rules and CA are kept.
+func (s *Server) Reload(cfg config.Config) error {
+	r, err := buildRules(cfg, s.handler.filterStats)
+	if err != nil {
+		return err
+	}
+	if s.cfg.MITM {
+		if err := s.handler.resumption.load(cfg.MITMSessionTickets.KeyFile, time.Now()); err != nil {
+			return err
+		}
+		if err := s.handler.rotateCA(cfg.MITMCACert, cfg.MITMCAKey); err != nil {
+			return err
+		}
+	}
+	s.handler.rules.Store(r)
+	slog.Info("rules reloaded", "filters", len(cfg.Filters), "clients", len(cfg.Clients), "profiles", r.profiles.Names())
+	return nil
+}
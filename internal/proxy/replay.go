@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/kdhira/audit-proxy/internal/audit"
+	"github.com/kdhira/audit-proxy/internal/config"
+	"github.com/kdhira/audit-proxy/internal/fingerprint"
+	"github.com/kdhira/audit-proxy/internal/recordings"
+)
+
+// Record-and-replay modes; see config.ReplayRule.
+const (
+	modeRecord = "record"
+	modeReplay = "replay"
+	modeAuto   = "auto"
+)
+
+// replaySet is the compiled config.ReplayConfig.
+type replaySet struct {
+	store   *recordings.Store
+	maxBody int64 // 0 for no limit
+	rules   []replayRule
+}
+
+type replayRule struct {
+	hosts hostList // nil for all hosts
+	mode  string
+}
+
+// compileReplay returns nil if no rules are configured.
+func compileReplay(cfg config.ReplayConfig) (*replaySet, error) {
+	if len(cfg.Rules) == 0 {
+		return nil, nil
+	}
+	store, err := recordings.NewStore(cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+	set := &replaySet{store: store, maxBody: cfg.MaxBody}
+	for i, r := range cfg.Rules {
+		rule := replayRule{mode: r.Mode}
+		if len(r.Hosts) > 0 {
+			hosts, err := compileHosts(r.Hosts)
+			if err != nil {
+				return nil, fmt.Errorf("replay.rules[%d]: %w", i, err)
+			}
+			rule.hosts = hosts
+		}
+		set.rules = append(set.rules, rule)
+	}
+	return set, nil
+}
+
+// modeFor returns the mode of the first rule matching req's host, or "".
+func (s *replaySet) modeFor(req *http.Request) string {
+	if s == nil {
+		return ""
+	}
+	for _, r := range s.rules {
+		if r.hosts == nil || r.hosts.match(req.URL.Host, defaultPort(req.URL.Scheme)) {
+			return r.mode
+		}
+	}
+	return ""
+}
+
+// replayResponse returns the recorded response for x in replay and auto
+// mode, recording it in the entry as if it had come from upstream, or nil
+// if the request should be forwarded. Without a recording, replay mode
+// answers 502; auto mode forwards the request, its body restored.
+func (h *handler) replayResponse(x *exchange) *http.Response {
+	set := x.rules.replay
+	mode := set.modeFor(x.req)
+	if mode != modeReplay && mode != modeAuto {
+		return nil
+	}
+	x.reqBody = &capture{limit: x.excerptBytes(), hash: fingerprint.Body()}
+	var body bytes.Buffer
+	if x.req.Body != nil {
+		w := io.Writer(x.reqBody)
+		if mode == modeAuto {
+			w = io.MultiWriter(x.reqBody, &body)
+		}
+		_, _ = io.Copy(w, x.req.Body)
+	}
+	fp := h.fingerprintOf(x)
+	rec, err := set.store.Load(fp)
+	if err == nil {
+		hdr := rec.Response.Headers
+		if hdr == nil {
+			hdr = http.Header{}
+		}
+		x.attrs.Set("replay", "replayed")
+		return h.cannedResponse(x, rec.Response.Status, hdr, rec.Response.Body)
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		slog.Warn("load recording", "fingerprint", fp, "err", err)
+	}
+	if mode == modeAuto {
+		if x.req.Body != nil {
+			x.req.Body = io.NopCloser(&body)
+		}
+		return nil
+	}
+	x.attrs.Set("replay", "miss")
+	x.entry.Error = "no recording for request"
+	x.entry.Response = &audit.ResponseMetadata{Status: http.StatusBadGateway}
+	return jsonResponse(x.req, http.StatusBadGateway, errorBody{Error: "no recording for request"})
+}
+
+// recordResponse arranges for resp to be recorded once its body has been
+// read to the end, in record and auto mode. Call it before the response
+// is prepared for the client, so the recording holds what upstream sent.
+func (h *handler) recordResponse(x *exchange, resp *http.Response) {
+	set := x.rules.replay
+	if mode := set.modeFor(x.req); (mode != modeRecord && mode != modeAuto) || x.headersOnly {
+		return
+	}
+	hdr := resp.Header.Clone()
+	removeHopHeaders(hdr)
+	hdr.Del("Content-Length")
+	status := resp.StatusCode
+	resp.Body = &recorder{ReadCloser: resp.Body, limit: set.maxBody, done: func(body []byte) {
+		rec := &recordings.Recording{
+			Fingerprint: h.fingerprintOf(x),
+			RecordedAt:  time.Now().UTC(),
+			Request: recordings.Request{
+				Method:  x.req.Method,
+				URL:     x.entry.Request.URL,
+				Headers: audit.SanitiseHeaders(x.req.Header),
+			},
+			Response: recordings.Response{Status: status, Headers: hdr, Body: body},
+		}
+		if err := set.store.Save(rec); err != nil {
+			slog.Warn("save recording", "fingerprint", rec.Fingerprint, "err", err)
+			return
+		}
+		x.attrs.Set("replay", "recorded")
+	}}
+}
+
+// recorder buffers a response body as it is read and hands it to done at
+// EOF, unless it outgrew limit or was closed early.
+type recorder struct {
+	io.ReadCloser
+	limit int64
+	buf   bytes.Buffer
+	over  bool
+	done  func(body []byte)
+}
+
+func (r *recorder) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if !r.over {
+		if r.limit > 0 && int64(r.buf.Len()+n) > r.limit {
+			r.over = true
+			r.buf = bytes.Buffer{}
+		} else {
+			r.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF && r.done != nil {
+		if !r.over {
+			r.done(r.buf.Bytes())
+		}
+		r.done = nil
+	}
+	return n, err
+}
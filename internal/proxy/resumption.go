@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kdhira/audit-proxy/internal/config"
+	"github.com/kdhira/audit-proxy/internal/metrics"
+)
+
+// resumption shares TLS session ticket keys among the server configs of
+// intercepted tunnels, each made afresh, so a client reconnecting resumes
+// its session instead of paying for a full handshake and a leaf signature
+// check. It also times the handshakes.
+type resumption struct {
+	disable    bool
+	rotate     time.Duration // of generated keys; 0 never
+	handshakes *metrics.HistogramVec
+
+	mu      sync.Mutex
+	file    string     // "" for generated keys
+	keys    [][32]byte // the first encrypts
+	rotated time.Time
+}
+
+func newResumption(cfg config.MITMSessionTicketsConfig, reg *metrics.Registry) (*resumption, error) {
+	r := &resumption{
+		disable: cfg.Disable,
+		rotate:  cfg.Rotate,
+		handshakes: reg.Histogram("auditproxy_mitm_handshake_duration_seconds",
+			"Time to complete the TLS handshakes of intercepted tunnels, by whether the session was resumed.",
+			metrics.DefaultBuckets, "resumed"),
+	}
+	if err := r.load(cfg.KeyFile, time.Now()); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// load reads the ticket keys from file or, if file is "", keeps the
+// generated ones, generating them if there were none. On error the keys in
+// use are kept.
+func (r *resumption) load(file string, now time.Time) error {
+	if r.disable {
+		return nil
+	}
+	var keys [][32]byte
+	if file != "" {
+		var err error
+		if keys, err = readTicketKeys(file); err != nil {
+			return fmt.Errorf("mitm_session_tickets.key_file: %w", err)
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch {
+	case file != "":
+		r.keys = keys
+	case r.file != "" || r.keys == nil:
+		r.keys = [][32]byte{newTicketKey()}
+		r.rotated = now
+	}
+	r.file = file
+	return nil
+}
+
+// apply has conf issue and accept tickets under the current keys, first
+// rotating generated keys that are due.
+func (r *resumption) apply(conf *tls.Config, now time.Time) {
+	if r.disable {
+		conf.SessionTicketsDisabled = true
+		return
+	}
+	r.mu.Lock()
+	if r.file == "" && r.rotate > 0 && now.Sub(r.rotated) >= r.rotate {
+		r.keys = [][32]byte{newTicketKey(), r.keys[0]}
+		r.rotated = now
+	}
+	keys := r.keys
+	r.mu.Unlock()
+	conf.SetSessionTicketKeys(keys)
+}
+
+// observe records on tunnel how long its handshake took and whether it
+// resumed a session.
+func (r *resumption) observe(tunnel *exchange, took time.Duration, resumed bool) {
+	tunnel.attrs.Set("mitm.handshake_ms", took.Milliseconds())
+	tunnel.attrs.Set("mitm.resumed", resumed)
+	r.handshakes.With(strconv.FormatBool(resumed)).Observe(took.Seconds())
+}
+
+func newTicketKey() [32]byte {
+	var k [32]byte
+	_, _ = rand.Read(k[:])
+	return k
+}
+
+// readTicketKeys reads hex-encoded 32-byte keys, one per line, as written
+// by openssl rand -hex 32. Blank lines and lines starting with # are
+// skipped.
+func readTicketKeys(file string) ([][32]byte, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var keys [][32]byte
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		b, err := hex.DecodeString(line)
+		if err != nil || len(b) != 32 {
+			return nil, fmt.Errorf("%s:%d: want 64 hex digits", file, n)
+		}
+		keys = append(keys, [32]byte(b))
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no keys", file)
+	}
+	return keys, nil
+}
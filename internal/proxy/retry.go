@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/kdhira/audit-proxy/internal/config"
+	"github.com/kdhira/audit-proxy/internal/forward"
+)
+
+// retryPolicy retries idempotent requests that fail to reach the upstream
+// or are answered 502 or 503, waiting with exponential backoff in between.
+type retryPolicy struct {
+	attempts   int
+	backoff    time.Duration
+	maxBackoff time.Duration
+}
+
+func newRetryPolicy(cfg config.RetryConfig) retryPolicy {
+	p := retryPolicy{attempts: cfg.Attempts, backoff: cfg.Backoff, maxBackoff: cfg.MaxBackoff}
+	if p.backoff == 0 {
+		p.backoff = 100 * time.Millisecond
+	}
+	if p.maxBackoff == 0 {
+		p.maxBackoff = 2 * time.Second
+	}
+	return p
+}
+
+// retryable reports whether req may be sent more than once.
+func (p retryPolicy) retryable(req *http.Request) bool {
+	if p.attempts < 2 || (req.Body != nil && req.Body != http.NoBody) {
+		return false
+	}
+	return req.Method == http.MethodGet || req.Method == http.MethodHead
+}
+
+// roundTrip sends req through rt, retrying when allowed. It returns the
+// final outcome and the number of attempts made.
+func (p retryPolicy) roundTrip(rt http.RoundTripper, req *http.Request) (*http.Response, int, error) {
+	if !p.retryable(req) {
+		resp, err := rt.RoundTrip(req)
+		return resp, 1, err
+	}
+	wait := p.backoff
+	for n := 1; ; n++ {
+		resp, err := rt.RoundTrip(req)
+		if n == p.attempts || !retryOutcome(req, resp, err) {
+			return resp, n, err
+		}
+		if resp != nil {
+			_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+		}
+		if !sleep(req.Context(), wait) {
+			return nil, n, req.Context().Err()
+		}
+		wait = min(2*wait, p.maxBackoff)
+	}
+}
+
+func retryOutcome(req *http.Request, resp *http.Response, err error) bool {
+	if err != nil {
+		// Not worth repeating once the client has gone away, nor when
+		// egress policy refused the target.
+		var be *forward.BlockedError
+		return req.Context().Err() == nil && !errors.As(err, &be)
+	}
+	return resp.StatusCode == http.StatusBadGateway || resp.StatusCode == http.StatusServiceUnavailable
+}
+
+// sleep waits for d, reporting false if ctx ends first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,251 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kdhira/audit-proxy/internal/config"
+)
+
+// Revocation statuses of upstream certificates.
+const (
+	revocationGood    = "good"
+	revocationRevoked = "revoked"
+	revocationUnknown = "unknown"
+)
+
+const (
+	// maxCRLSize bounds the CRLs fetched.
+	maxCRLSize = 16 << 20
+	// crlFetchTimeout bounds fetching a CRL, which holds up the handshake
+	// that needs it.
+	crlFetchTimeout = 10 * time.Second
+	// revocationRecheck is how long a status is reused at most, and how
+	// long a CRL that could not be fetched is not asked for again.
+	revocationRecheck = 5 * time.Minute
+	// maxRevocationStatuses bounds the statuses kept.
+	maxRevocationStatuses = 10000
+)
+
+// revocation checks whether verified upstream certificates are revoked,
+// by the OCSP response stapled to the handshake or by CRL.
+type revocation struct {
+	crl        bool
+	failClosed bool
+	client     *http.Client // fetches CRLs
+
+	mu       sync.Mutex
+	crls     map[string]*crlEntry          // by URL
+	statuses map[[32]byte]revocationResult // by leaf and staple
+}
+
+// revocationResult is what is known of a certificate's revocation.
+type revocationResult struct {
+	status string
+	source string // ocsp_staple or crl; "" if neither gave a status
+	until  time.Time
+}
+
+type crlEntry struct {
+	list  *x509.RevocationList
+	err   error
+	until time.Time
+}
+
+// revocationError fails a connection to an upstream whose certificate is
+// revoked or, failing closed, of unknown status.
+type revocationError struct {
+	result revocationResult
+}
+
+func (e *revocationError) Error() string {
+	if e.result.status == revocationRevoked {
+		return "upstream certificate is revoked (" + e.result.source + ")"
+	}
+	return "upstream certificate revocation status unknown"
+}
+
+// newRevocation returns a checker for cfg, or nil if revocation is not
+// checked.
+func newRevocation(cfg config.RevocationConfig) *revocation {
+	if !cfg.Check {
+		return nil
+	}
+	return &revocation{
+		crl:        cfg.CRL,
+		failClosed: cfg.FailClosed,
+		client:     &http.Client{Timeout: crlFetchTimeout},
+		crls:       map[string]*crlEntry{},
+		statuses:   map[[32]byte]revocationResult{},
+	}
+}
+
+// verify is a tls.Config.VerifyConnection failing the connections the
+// policy refuses.
+func (r *revocation) verify(state tls.ConnectionState) error {
+	if len(state.VerifiedChains) == 0 {
+		return nil
+	}
+	res := r.check(state, time.Now())
+	if res.status == revocationRevoked || (r.failClosed && res.status == revocationUnknown) {
+		return &revocationError{result: res}
+	}
+	return nil
+}
+
+// annotate records on x the revocation status of the certificate upstream
+// presented on the connection with state, or that err failed for.
+func (r *revocation) annotate(x *exchange, state *tls.ConnectionState, err error) {
+	if r == nil {
+		return
+	}
+	var res revocationResult
+	var rerr *revocationError
+	switch {
+	case errors.As(err, &rerr):
+		res = rerr.result
+	case state != nil && len(state.VerifiedChains) > 0:
+		res = r.check(*state, time.Now())
+	default:
+		return
+	}
+	x.attrs.Set("upstream.revocation", res.status)
+	if res.source != "" {
+		x.attrs.Set("upstream.revocation_source", res.source)
+	}
+}
+
+// check returns the revocation status of the leaf of state's first
+// verified chain at now, by its stapled OCSP response if it is valid, or
+// else by CRL if configured. Statuses are reused until they may change.
+func (r *revocation) check(state tls.ConnectionState, now time.Time) revocationResult {
+	chain := state.VerifiedChains[0]
+	if len(chain) < 2 {
+		// A trusted self-signed certificate has no one to revoke it.
+		return revocationResult{status: revocationUnknown}
+	}
+	leaf, issuer := chain[0], chain[1]
+	key := sha256.Sum256(append(slices.Clip(leaf.Raw), state.OCSPResponse...))
+	r.mu.Lock()
+	res, ok := r.statuses[key]
+	r.mu.Unlock()
+	if ok && now.Before(res.until) {
+		return res
+	}
+
+	res = revocationResult{status: revocationUnknown, until: now.Add(revocationRecheck)}
+	if len(state.OCSPResponse) > 0 {
+		if status, until, err := ocspStatus(state.OCSPResponse, leaf, issuer, now); err == nil {
+			res = revocationResult{status: status, source: "ocsp_staple", until: recheckBy(until, now)}
+		}
+	}
+	if res.source == "" && r.crl {
+		if status, until, err := r.crlStatus(leaf, issuer, now); err == nil {
+			res = revocationResult{status: status, source: "crl", until: recheckBy(until, now)}
+		}
+	}
+	r.mu.Lock()
+	if len(r.statuses) >= maxRevocationStatuses {
+		clear(r.statuses)
+	}
+	r.statuses[key] = res
+	r.mu.Unlock()
+	return res
+}
+
+// recheckBy returns when a status that holds until next, if set, is to be
+// established again.
+func recheckBy(next, now time.Time) time.Time {
+	limit := now.Add(revocationRecheck)
+	if next.IsZero() || next.After(limit) {
+		return limit
+	}
+	return next
+}
+
+// crlStatus returns whether the first of leaf's CRLs that can be fetched
+// lists it, and until when the CRL holds.
+func (r *revocation) crlStatus(leaf, issuer *x509.Certificate, now time.Time) (string, time.Time, error) {
+	err := errors.New("no CRL to fetch over HTTP")
+	for _, url := range leaf.CRLDistributionPoints {
+		if !strings.HasPrefix(url, "http://") {
+			continue
+		}
+		var list *x509.RevocationList
+		if list, err = r.fetchCRL(url, issuer, now); err != nil {
+			continue
+		}
+		if slices.ContainsFunc(list.RevokedCertificateEntries, func(e x509.RevocationListEntry) bool {
+			return e.SerialNumber.Cmp(leaf.SerialNumber) == 0
+		}) {
+			return revocationRevoked, list.NextUpdate, nil
+		}
+		return revocationGood, list.NextUpdate, nil
+	}
+	return "", time.Time{}, err
+}
+
+// fetchCRL returns the CRL at url, signed by issuer and current at now,
+// from the cache if it has not passed its next update.
+func (r *revocation) fetchCRL(url string, issuer *x509.Certificate, now time.Time) (*x509.RevocationList, error) {
+	r.mu.Lock()
+	e, ok := r.crls[url]
+	r.mu.Unlock()
+	if !ok || !now.Before(e.until) {
+		e = &crlEntry{until: now.Add(revocationRecheck)}
+		e.list, e.err = r.downloadCRL(url)
+		if e.err == nil && !e.list.NextUpdate.IsZero() {
+			e.until = e.list.NextUpdate
+		}
+		r.mu.Lock()
+		r.crls[url] = e
+		r.mu.Unlock()
+	}
+	if e.err != nil {
+		return nil, e.err
+	}
+	// Checked on each use, as CRLs of different issuers may share a URL.
+	if err := e.list.CheckSignatureFrom(issuer); err != nil {
+		return nil, fmt.Errorf("CRL %s: %w", url, err)
+	}
+	if !e.list.NextUpdate.IsZero() && !now.Before(e.list.NextUpdate) {
+		return nil, fmt.Errorf("CRL %s is out of date", url)
+	}
+	return e.list, nil
+}
+
+func (r *revocation) downloadCRL(url string) (*x509.RevocationList, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), crlFetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetch CRL: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch CRL %s: %s", url, resp.Status)
+	}
+	der, err := io.ReadAll(io.LimitReader(resp.Body, maxCRLSize))
+	if err != nil {
+		return nil, fmt.Errorf("fetch CRL %s: %w", url, err)
+	}
+	list, err := x509.ParseRevocationList(der)
+	if err != nil {
+		return nil, fmt.Errorf("CRL %s: %w", url, err)
+	}
+	return list, nil
+}
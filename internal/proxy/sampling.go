@@ -0,0 +1,179 @@
+package proxy
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/kdhira/audit-proxy/internal/config"
+)
+
+// maxSeenHosts bounds the hosts remembered for first_seen capture rules;
+// past it no host counts as new.
+const maxSeenHosts = 10000
+
+// captureRule is a compiled config.CaptureRule.
+type captureRule struct {
+	name      string
+	hosts     hostList // nil for all hosts
+	methods   []string // upper case; nil for any
+	path      string
+	prefix    bool // path ended in *
+	profile   string
+	clients   []string
+	minStatus int
+	maxStatus int // 0 for no upper bound
+	firstSeen bool
+	percent   float64
+}
+
+// captureSet is the compiled config.CaptureConfig.
+type captureSet struct {
+	maxBytes int
+	rules    []*captureRule
+}
+
+// compileCapture returns nil if no rules are configured.
+func compileCapture(cfg config.CaptureConfig) (*captureSet, error) {
+	if len(cfg.Rules) == 0 {
+		return nil, nil
+	}
+	set := &captureSet{maxBytes: cfg.MaxBytes}
+	for _, r := range cfg.Rules {
+		c := &captureRule{
+			name:      r.Name,
+			profile:   r.Profile,
+			clients:   r.Clients,
+			minStatus: r.MinStatus,
+			maxStatus: r.MaxStatus,
+			firstSeen: r.FirstSeen,
+			percent:   r.Percent,
+		}
+		if c.percent == 0 {
+			c.percent = 100
+		}
+		if len(r.Hosts) > 0 {
+			hosts, err := compileHosts(r.Hosts)
+			if err != nil {
+				return nil, fmt.Errorf("capture %s: %w", r.Name, err)
+			}
+			c.hosts = hosts
+		}
+		for _, m := range r.Methods {
+			c.methods = append(c.methods, strings.ToUpper(m))
+		}
+		c.path, c.prefix = strings.CutSuffix(r.Path, "*")
+		set.rules = append(set.rules, c)
+	}
+	return set, nil
+}
+
+// matchRequest reports whether c's request conditions hold for req,
+// recognised as profile and sent under client, its host new if first.
+func (c *captureRule) matchRequest(req *http.Request, profile, client string, first bool) bool {
+	switch {
+	case c.methods != nil && !slices.Contains(c.methods, req.Method),
+		c.hosts != nil && !c.hosts.match(req.URL.Host, defaultPort(req.URL.Scheme)),
+		c.prefix && !strings.HasPrefix(req.URL.Path, c.path),
+		!c.prefix && c.path != "" && req.URL.Path != c.path,
+		c.profile != "" && profile != c.profile,
+		c.clients != nil && !slices.Contains(c.clients, client),
+		c.firstSeen && !first:
+		return false
+	}
+	return true
+}
+
+// matchStatus reports whether status, 0 without a response, is in c's
+// range.
+func (c *captureRule) matchStatus(status int) bool {
+	return status >= c.minStatus && (c.maxStatus == 0 || status <= c.maxStatus)
+}
+
+// captureCandidates returns the capture rules x may trigger once its
+// response is known, sampling each by its percentage.
+func (h *handler) captureCandidates(x *exchange) []*captureRule {
+	set := x.rules.capture
+	first := h.hostsSeen.first(x.entry.Request.Host)
+	if set == nil {
+		return nil
+	}
+	profile := ""
+	if p := x.rules.profiles.Match(x.req); p != nil {
+		profile = p.Name()
+	}
+	var out []*captureRule
+	for _, c := range set.rules {
+		if c.matchRequest(x.req, profile, x.policy.client, first) && (c.percent >= 100 || rand.Float64()*100 < c.percent) {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// excerptBytes returns how many body bytes to capture for x: its policy's
+// excerpt size, or the capture limit while a capture rule may apply, and
+// none for an exchange audited by its headers alone.
+func (x *exchange) excerptBytes() int {
+	if x.headersOnly {
+		return 0
+	}
+	n := x.policy.excerptBytes()
+	if len(x.sampled) > 0 {
+		n = max(n, x.rules.capture.maxBytes)
+	}
+	return n
+}
+
+// settleCapture decides, once x's response is known, whether a capture
+// rule applies, recording it as the attribute capture.rule, and otherwise
+// cuts the bodies captured back to the policy's excerpt size.
+func (x *exchange) settleCapture() {
+	if len(x.sampled) == 0 {
+		return
+	}
+	status := 0
+	if x.entry.Response != nil {
+		status = x.entry.Response.Status
+	}
+	for _, c := range x.sampled {
+		if c.matchStatus(status) {
+			x.attrs.Set("capture.rule", c.name)
+			return
+		}
+	}
+	limit := x.policy.excerptBytes()
+	for _, c := range []*capture{x.reqBody, x.respBody} {
+		if c != nil && c.buf.Len() > limit {
+			c.buf.Truncate(limit)
+		}
+	}
+}
+
+// hostTracker remembers the hosts requested so far.
+type hostTracker struct {
+	mu   sync.Mutex
+	seen map[string]bool
+}
+
+func newHostTracker() *hostTracker {
+	return &hostTracker{seen: map[string]bool{}}
+}
+
+// first records host and reports whether it had not been seen before. A
+// nil tracker has seen every host.
+func (t *hostTracker) first(host string) bool {
+	if t == nil {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.seen[host] || len(t.seen) >= maxSeenHosts {
+		return false
+	}
+	t.seen[host] = true
+	return true
+}
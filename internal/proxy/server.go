@@ -0,0 +1,382 @@
+// Package proxy implements the forward proxy: plain HTTP forwarding, CONNECT
+// tunnelling and, when enabled, MITM interception of tunnels.
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/kdhira/audit-proxy/internal/anomaly"
+	"github.com/kdhira/audit-proxy/internal/audit"
+	"github.com/kdhira/audit-proxy/internal/cache"
+	"github.com/kdhira/audit-proxy/internal/config"
+	"github.com/kdhira/audit-proxy/internal/fingerprint"
+	"github.com/kdhira/audit-proxy/internal/health"
+	"github.com/kdhira/audit-proxy/internal/metrics"
+	"github.com/kdhira/audit-proxy/internal/mitm"
+	"github.com/kdhira/audit-proxy/internal/threatintel"
+	"github.com/kdhira/audit-proxy/internal/workload"
+)
+
+// Server is a running proxy listener.
+type Server struct {
+	cfg     config.Config
+	handler *handler
+	srv     *http.Server
+	metrics *metrics.Registry
+	health  *health.Checker
+	stop    context.CancelFunc // ends the health checks
+
+	mu          sync.Mutex
+	transparent []net.Listener
+}
+
+// New builds a Server from cfg, writing audit entries to logger. Upstream
+// health checks start immediately and run until Shutdown.
+func New(cfg config.Config, logger audit.Logger) (*Server, error) {
+	mreg := metrics.NewRegistry()
+	fstats := newFilterStats(mreg)
+	rs, err := buildRules(cfg, fstats)
+	if err != nil {
+		return nil, err
+	}
+	var mgr *mitm.Manager
+	if cfg.MITM {
+		issuer, err := mitm.LoadIssuer(cfg.MITMCACert, cfg.MITMCAKey)
+		if err != nil {
+			return nil, fmt.Errorf("mitm: %w", err)
+		}
+		if err := issuer.SetLeafKeys(cfg.MITMLeafKey, cfg.MITMReuseLeafKey); err != nil {
+			return nil, fmt.Errorf("mitm: %w", err)
+		}
+		mgr = mitm.NewManager(issuer, cfg.MITMCacheSize)
+	}
+	var auth *authenticator
+	if cfg.ProxyAuth.Enabled() {
+		if auth, err = newAuthenticator(cfg.ProxyAuth); err != nil {
+			return nil, err
+		}
+	}
+	resolver, err := newResolver(cfg.Egress)
+	if err != nil {
+		return nil, err
+	}
+	ups, err := newUpstreams(resolver, cfg.Timeouts, cfg.UpstreamTLS, cfg.Egress.RootCAs)
+	if err != nil {
+		return nil, err
+	}
+	checker := health.NewChecker(ups.def.transport)
+	failover, err := buildFailover(cfg.Failover, checker)
+	if err != nil {
+		return nil, err
+	}
+	shadows, err := buildShadows(cfg.Shadow)
+	if err != nil {
+		return nil, err
+	}
+	pools, err := buildPools(cfg.UpstreamPools, checker)
+	if err != nil {
+		return nil, err
+	}
+	var detector *anomaly.Detector
+	if cfg.Anomaly.Enabled {
+		detector = anomaly.New(cfg.Anomaly)
+	}
+	var pins *pinning
+	var resume *resumption
+	if mgr != nil {
+		observeLeaves(mgr, mreg)
+		logLeaves(mgr, logger)
+		pins = newPinning(cfg.MITMPinning, mreg)
+		if resume, err = newResumption(cfg.MITMSessionTickets, mreg); err != nil {
+			return nil, err
+		}
+	}
+	breakers, err := newBreakers(cfg.CircuitBreaker, mreg)
+	if err != nil {
+		return nil, err
+	}
+	clientCerts, err := newClientCerts(cfg.MITMClientCerts)
+	if err != nil {
+		return nil, err
+	}
+	cors, err := newCORS(cfg.CORS)
+	if err != nil {
+		return nil, err
+	}
+	connectPorts, err := newPortPolicy(cfg.Connect.Ports)
+	if err != nil {
+		return nil, err
+	}
+	direct, err := newDirectUpstream(cfg.Direct.Upstream)
+	if err != nil {
+		return nil, err
+	}
+	rcache, err := newResponseCache(cfg.Cache, mreg)
+	if err != nil {
+		return nil, err
+	}
+	workloads, err := workload.New(cfg.Workload)
+	if err != nil {
+		return nil, err
+	}
+	quotas, err := newQuotas(cfg.Quotas)
+	if err != nil {
+		return nil, err
+	}
+	budgets, err := newBudgets(cfg.Budgets)
+	if err != nil {
+		return nil, err
+	}
+	obs := newObserver(mreg, detector)
+	for _, st := range checker.Statuses() {
+		obs.health(st)
+	}
+	checker.OnChange = func(st health.Status) {
+		obs.health(st)
+		slog.Warn("upstream health changed", "upstream", st.Name, "healthy", st.Healthy, "err", st.LastError)
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	checker.Start(ctx)
+	h := &handler{
+		cfg:          cfg,
+		logger:       logger,
+		upstreams:    ups,
+		resolver:     resolver,
+		mitm:         mgr,
+		pinning:      pins,
+		clientCerts:  clientCerts,
+		clientTLS:    newClientTLSPolicy(cfg.MITMTLS),
+		resumption:   resume,
+		auth:         auth,
+		failover:     failover,
+		shadows:      shadows,
+		shadowSlots:  make(chan struct{}, maxShadowsInFlight),
+		cache:        rcache,
+		hostsSeen:    newHostTracker(),
+		unaudited:    newUnaudited(logger, cfg.DirectSummaryInterval, mreg),
+		workloads:    workloads,
+		pools:        pools,
+		retry:        newRetryPolicy(cfg.Retry),
+		breakers:     breakers,
+		limiter:      newLimiter(cfg.Concurrency, mreg),
+		quotas:       quotas,
+		budgets:      budgets,
+		threats:      threatintel.New(cfg.ThreatFeeds),
+		overrides:    newOverrides(cfg.Overrides, mreg),
+		conns:        newConnGuard(cfg.Listener, mreg),
+		respEdits:    newResponseEdits(cfg.ResponseHeaders),
+		fingerprint:  fingerprint.New(cfg.Fingerprint.Headers),
+		cors:         cors,
+		direct:       direct,
+		connectPorts: connectPorts,
+		observer:     obs,
+		activity:     newActivity(),
+		filterStats:  fstats,
+		drain:        newDrainState(),
+	}
+	h.rules.Store(rs)
+	go newReaper(cfg.Reaper, ups, h.drain, mgr, mreg).run(ctx)
+	go h.unaudited.run(ctx)
+	go workloads.Run(ctx)
+	go quotas.run(ctx)
+	go budgets.run(ctx)
+	go h.threats.Run(ctx)
+	go h.watchCA(ctx, cfg.MITMCACert, cfg.MITMCAKey, cfg.MITMCAWatch)
+	srv := &http.Server{Handler: h}
+	h.conns.configure(srv)
+	return &Server{
+		cfg:     cfg,
+		handler: h,
+		srv:     srv,
+		metrics: mreg,
+		health:  checker,
+		stop:    stop,
+	}, nil
+}
+
+// Metrics returns the registry holding the proxy's metrics.
+func (s *Server) Metrics() *metrics.Registry {
+	return s.metrics
+}
+
+// Activity returns a snapshot of the traffic handled so far.
+func (s *Server) Activity() Activity {
+	a := s.handler.activity.snapshot()
+	a.Filters = s.handler.filterStats.snapshot()
+	return a
+}
+
+// CacheStats returns the statistics of the response cache, or nil if it
+// is disabled.
+func (s *Server) CacheStats() *cache.Stats {
+	if s.handler.cache == nil {
+		return nil
+	}
+	st := s.handler.cache.cache.Stats()
+	return &st
+}
+
+// ThreatFeeds returns the state of the threat feeds, or nil if none are
+// configured.
+func (s *Server) ThreatFeeds() []threatintel.Status {
+	return s.handler.threats.Statuses()
+}
+
+// Health returns the state of the actively checked upstreams.
+func (s *Server) Health() []health.Status {
+	return s.health.Statuses()
+}
+
+// ListenAndServe listens on the configured address and listeners and
+// serves them all until Shutdown is called or one fails. Sockets passed by
+// socket activation are served in place of the address.
+func (s *Server) ListenAndServe() error {
+	lns, err := inheritedListeners()
+	if err != nil {
+		return err
+	}
+	specs := s.cfg.Listeners
+	if s.cfg.Addr != "" && len(lns) == 0 {
+		specs = append([]config.ListenSpec{{Addr: s.cfg.Addr}}, specs...)
+	}
+	var transparent []net.Listener
+	for _, spec := range specs {
+		ln, err := listen(spec)
+		if err != nil {
+			for _, ln := range slices.Concat(lns, transparent) {
+				ln.Close()
+			}
+			return err
+		}
+		if spec.Transparent {
+			transparent = append(transparent, ln)
+		} else {
+			lns = append(lns, ln)
+		}
+	}
+	s.mu.Lock()
+	s.transparent = transparent
+	s.mu.Unlock()
+	errc := make(chan error, len(lns)+len(transparent))
+	for _, ln := range lns {
+		go func() { errc <- s.Serve(ln) }()
+	}
+	for _, ln := range transparent {
+		go func() { errc <- s.handler.serveTransparent(ln) }()
+	}
+	var first error
+	for range len(lns) + len(transparent) {
+		if err := <-errc; err != nil && first == nil {
+			first = err
+			s.srv.Close()
+			s.closeTransparent()
+		}
+	}
+	return first
+}
+
+// closeTransparent closes the transparent listeners.
+func (s *Server) closeTransparent() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, ln := range s.transparent {
+		ln.Close()
+	}
+	s.transparent = nil
+}
+
+// listen opens the listener described by spec.
+func listen(spec config.ListenSpec) (net.Listener, error) {
+	network := spec.Network
+	if network == "" {
+		network = "tcp"
+	}
+	var tlsConfig *tls.Config
+	if spec.TLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(spec.TLSCert, spec.TLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("listener %s: %w", spec.Addr, err)
+		}
+		// HTTP/1.1 only: CONNECT over HTTP/2 is a different protocol.
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"http/1.1"}}
+	}
+	if network == "unix" {
+		// A socket left behind by an unclean exit would block the bind.
+		if fi, err := os.Lstat(spec.Addr); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			_ = os.Remove(spec.Addr)
+		}
+	}
+	ln, err := net.Listen(network, spec.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+	slog.Info("proxy listener", "network", network, "addr", spec.Addr, "tls", tlsConfig != nil, "transparent", spec.Transparent)
+	return ln, nil
+}
+
+// Serve serves the proxy on ln, which it closes, until Shutdown is called.
+// It lets embedders and tests supply their own listener.
+func (s *Server) Serve(ln net.Listener) error {
+	if s.cfg.Listener.StrictFraming {
+		ln = framingListener{Listener: ln, h: s.handler}
+	}
+	if err := s.srv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// Drain refuses new requests with 503 while in-flight requests and open
+// tunnels finish. Intercepted tunnels close after their current request.
+// Shutdown drains first; Drain lets a caller start earlier, for instance
+// while a load balancer stops sending traffic.
+func (s *Server) Drain() {
+	s.handler.drain.begin()
+}
+
+// Shutdown drains the proxy, stops accepting connections and waits for
+// in-flight requests and open tunnels until ctx is done, then closes the
+// tunnels left. It writes a drain entry summarising what it waited for.
+func (s *Server) Shutdown(ctx context.Context) error {
+	open := s.handler.drain.begin()
+	s.stop()
+	s.closeTransparent()
+	err := s.srv.Shutdown(ctx)
+	forced := s.handler.drain.wait(ctx)
+	s.handler.unaudited.summarise()
+	if qerr := s.handler.quotas.save(); qerr != nil {
+		slog.Error("save quota counters", "err", qerr)
+	}
+	if berr := s.handler.budgets.save(); berr != nil {
+		slog.Error("save budget totals", "err", berr)
+	}
+	since, refused := s.handler.drain.summary()
+
+	e := audit.NewEntry(audit.KindDrain)
+	e.DurationMS = time.Since(since).Milliseconds()
+	e.SetAttribute("drain.tunnels", open)
+	e.SetAttribute("drain.tunnels_closed", forced)
+	e.SetAttribute("drain.refused", refused)
+	if forced > 0 || err != nil {
+		e.Level = audit.LevelWarn
+		e.Reason = "drain deadline passed"
+	}
+	slog.Info("proxy drained", "tunnels", open, "tunnels_closed", forced, "refused", refused)
+	if lerr := s.handler.logger.Log(e); lerr != nil {
+		slog.Error("write audit entry", "err", lerr)
+	}
+	return err
+}
@@ -0,0 +1,166 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/kdhira/audit-proxy/internal/audit"
+	"github.com/kdhira/audit-proxy/internal/config"
+)
+
+const (
+	// maxShadowsInFlight bounds the mirrored requests outstanding at once;
+	// past it requests are not mirrored, so a slow shadow upstream cannot
+	// pile up goroutines and buffered bodies.
+	maxShadowsInFlight = 64
+	// defaultShadowTimeout applies to rules without a timeout.
+	defaultShadowTimeout = 30 * time.Second
+)
+
+// shadowRule is a compiled config.ShadowRule.
+type shadowRule struct {
+	name    string
+	hosts   hostList
+	path    string
+	prefix  bool // path ended in *
+	target  *url.URL
+	set     map[string]string
+	remove  []string
+	timeout time.Duration
+}
+
+func buildShadows(rules []config.ShadowRule) ([]*shadowRule, error) {
+	var out []*shadowRule
+	for _, r := range rules {
+		hosts, err := compileHosts(r.Hosts)
+		if err != nil {
+			return nil, fmt.Errorf("shadow %s: %w", r.Name, err)
+		}
+		target, err := url.Parse(r.Target)
+		if err != nil {
+			return nil, fmt.Errorf("shadow %s: %w", r.Name, err)
+		}
+		s := &shadowRule{
+			name:    r.Name,
+			hosts:   hosts,
+			target:  target,
+			set:     map[string]string{},
+			remove:  r.RemoveHeaders,
+			timeout: r.Timeout,
+		}
+		s.path, s.prefix = strings.CutSuffix(r.Path, "*")
+		if s.timeout == 0 {
+			s.timeout = defaultShadowTimeout
+		}
+		for k, v := range r.SetHeaders {
+			s.set[k] = os.ExpandEnv(v)
+		}
+		out = append(out, s)
+	}
+	return out, nil
+}
+
+// shadowFor returns the rule mirroring req, if any.
+func (h *handler) shadowFor(req *http.Request) *shadowRule {
+	for _, s := range h.shadows {
+		if !s.hosts.match(req.URL.Host, defaultPort(req.URL.Scheme)) {
+			continue
+		}
+		if s.prefix && strings.HasPrefix(req.URL.Path, s.path) || !s.prefix && (s.path == "" || req.URL.Path == s.path) {
+			return s
+		}
+	}
+	return nil
+}
+
+// request builds the mirrored request for out, replaying body.
+func (s *shadowRule) request(ctx context.Context, out *http.Request, body []byte) *http.Request {
+	sr := out.Clone(ctx)
+	retarget(sr, s.target)
+	for _, k := range s.remove {
+		sr.Header.Del(k)
+	}
+	for k, v := range s.set {
+		sr.Header.Set(k, v)
+	}
+	sr.Body = replay(body)
+	return sr
+}
+
+// shadow mirrors out to rule's target in the background. The body of out
+// is buffered so both requests can send it; requests too large for that,
+// or arriving while maxShadowsInFlight mirrors are outstanding, are not
+// mirrored. The mirror is audited as its own entry once x has finished.
+func (h *handler) shadow(x *exchange, rule *shadowRule, out *http.Request) {
+	body, ok := bufferBody(out)
+	if !ok {
+		x.attrs.Set("shadow.skipped", "body too large")
+		return
+	}
+	out.Body = replay(body)
+	select {
+	case h.shadowSlots <- struct{}{}:
+	default:
+		x.attrs.Set("shadow.skipped", "busy")
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(out.Context()), rule.timeout)
+	sr := rule.request(ctx, out, body)
+	e := audit.NewEntry(audit.KindShadow)
+	e.Request = audit.RequestMetadata{
+		Method:  sr.Method,
+		URL:     x.attrs.RedactURL(sr.URL.String()),
+		Host:    sr.URL.Host,
+		Headers: audit.SanitiseHeaders(sr.Header),
+	}
+	e.BytesOut = int64(len(body))
+	e.SetAttribute("shadow.rule", rule.name)
+	e.SetAttribute("shadow.primary_id", x.entry.ID)
+	x.attrs.Set("shadow.id", e.ID)
+	x.shadowed = make(chan audit.Entry, 1)
+	finished := x.shadowed
+	go func() {
+		defer func() { <-h.shadowSlots }()
+		defer cancel()
+		h.mirror(e, rule, sr, finished)
+	}()
+}
+
+// mirror sends sr and writes its entry e, comparing it with the primary's
+// once that is finished. The comparison is left out if the primary is
+// still running when the rule's timeout has passed again.
+func (h *handler) mirror(e audit.Entry, rule *shadowRule, sr *http.Request, finished <-chan audit.Entry) {
+	start := time.Now()
+	resp, err := h.upstreams.forTarget(sr.URL.Host, defaultPort(sr.URL.Scheme)).transport.RoundTrip(sr)
+	if err == nil {
+		e.Response = &audit.ResponseMetadata{Status: resp.StatusCode, Headers: audit.SanitiseHeaders(resp.Header)}
+		e.BytesIn, err = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	e.DurationMS = time.Since(start).Milliseconds()
+
+	select {
+	case p := <-finished:
+		e.SetAttribute("shadow.latency_delta_ms", e.DurationMS-p.DurationMS)
+		if p.Response != nil {
+			e.SetAttribute("shadow.primary_status", p.Response.Status)
+			if e.Response != nil {
+				e.SetAttribute("shadow.status_match", p.Response.Status == e.Response.Status)
+			}
+		}
+	case <-time.After(rule.timeout):
+	}
+	if err := h.logger.Log(e); err != nil {
+		slog.Error("write audit entry", "err", err)
+	}
+}
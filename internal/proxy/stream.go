@@ -0,0 +1,212 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"mime"
+	"net/http"
+	"time"
+
+	"github.com/kdhira/audit-proxy/internal/audit"
+)
+
+const (
+	// maxStreamLine bounds the part of one SSE line held while it arrives;
+	// longer data lines are timed but not parsed.
+	maxStreamLine = 256 << 10
+	// maxStreamGaps bounds the inter-chunk gaps kept for metrics. Longer
+	// streams still count towards the maximum and mean gap.
+	maxStreamGaps = 4096
+)
+
+// isEventStream reports whether resp is a server-sent event stream.
+func isEventStream(resp *http.Response) bool {
+	mt, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return mt == "text/event-stream"
+}
+
+// streamMeter times the events of a server-sent event stream as they pass
+// through and picks the model and token counts out of LLM streaming
+// formats: OpenAI chat completion chunks and Responses events, and
+// Anthropic messages.
+type streamMeter struct {
+	line    []byte
+	long    bool // line outgrew maxStreamLine
+	data    []byte
+	hasData bool
+
+	chunks       int
+	first, last  time.Time
+	gaps         []time.Duration
+	maxGap       time.Duration
+	totalGap     time.Duration
+	model        string
+	inputTokens  int
+	outputTokens int
+}
+
+// Write consumes stream bytes, dispatching each complete event.
+func (m *streamMeter) Write(p []byte) (int, error) {
+	now := time.Now()
+	rest := p
+	for len(rest) > 0 {
+		i := bytes.IndexByte(rest, '\n')
+		if i < 0 {
+			m.buffer(rest)
+			break
+		}
+		m.buffer(rest[:i])
+		m.endLine(now)
+		rest = rest[i+1:]
+	}
+	return len(p), nil
+}
+
+func (m *streamMeter) buffer(b []byte) {
+	if len(m.line)+len(b) > maxStreamLine {
+		m.long = true
+		return
+	}
+	m.line = append(m.line, b...)
+}
+
+func (m *streamMeter) endLine(now time.Time) {
+	line := bytes.TrimSuffix(m.line, []byte{'\r'})
+	long := m.long
+	m.line, m.long = m.line[:0], false
+	if len(line) == 0 && !long {
+		m.dispatch(now)
+		return
+	}
+	v, ok := bytes.CutPrefix(line, []byte("data:"))
+	if !ok {
+		return // event, id, retry and comment lines
+	}
+	m.hasData = true
+	if long {
+		m.data = nil
+		return
+	}
+	if len(m.data) > 0 {
+		m.data = append(m.data, '\n')
+	}
+	m.data = append(m.data, bytes.TrimPrefix(v, []byte(" "))...)
+}
+
+// dispatch ends an event. Events without data, and OpenAI's closing
+// [DONE], are not chunks.
+func (m *streamMeter) dispatch(now time.Time) {
+	data, hasData := m.data, m.hasData
+	m.data, m.hasData = m.data[:0], false
+	if !hasData || string(data) == "[DONE]" {
+		return
+	}
+	if m.chunks == 0 {
+		m.first = now
+	} else {
+		gap := now.Sub(m.last)
+		m.maxGap = max(m.maxGap, gap)
+		m.totalGap += gap
+		if len(m.gaps) < maxStreamGaps {
+			m.gaps = append(m.gaps, gap)
+		}
+	}
+	m.chunks++
+	m.last = now
+	m.parse(data)
+}
+
+type streamUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	InputTokens      int `json:"input_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	OutputTokens     int `json:"output_tokens"`
+}
+
+type streamChunk struct {
+	Model    string       `json:"model"`
+	Usage    *streamUsage `json:"usage"`
+	Response *struct {
+		Model string       `json:"model"`
+		Usage *streamUsage `json:"usage"`
+	} `json:"response"` // OpenAI Responses events
+	Message *struct {
+		Model string       `json:"model"`
+		Usage *streamUsage `json:"usage"`
+	} `json:"message"` // Anthropic message_start
+}
+
+// parse picks the model and usage out of one event's data. Usage counts
+// are cumulative in every format, so the largest seen is kept.
+func (m *streamMeter) parse(data []byte) {
+	if len(data) == 0 || data[0] != '{' {
+		return
+	}
+	var c streamChunk
+	if json.Unmarshal(data, &c) != nil {
+		return
+	}
+	usages := []*streamUsage{c.Usage}
+	models := []string{c.Model}
+	if c.Response != nil {
+		usages, models = append(usages, c.Response.Usage), append(models, c.Response.Model)
+	}
+	if c.Message != nil {
+		usages, models = append(usages, c.Message.Usage), append(models, c.Message.Model)
+	}
+	for _, md := range models {
+		if md != "" {
+			m.model = md
+		}
+	}
+	for _, u := range usages {
+		if u != nil {
+			m.inputTokens = max(m.inputTokens, u.PromptTokens+u.InputTokens)
+			m.outputTokens = max(m.outputTokens, u.CompletionTokens+u.OutputTokens)
+		}
+	}
+}
+
+// tokens returns the output token count the stream reported, or else the
+// number of chunks, which LLM APIs send about one per token, and whether
+// it is such an estimate.
+func (m *streamMeter) tokens() (n int, estimated bool) {
+	if m.outputTokens > 0 {
+		return m.outputTokens, false
+	}
+	return m.chunks, true
+}
+
+// tokensPerSecond returns the output rate between the first and the last
+// chunk, or 0 if there is too little of the stream to tell.
+func (m *streamMeter) tokensPerSecond() float64 {
+	n, _ := m.tokens()
+	d := m.last.Sub(m.first)
+	if m.chunks < 2 || d <= 0 {
+		return 0
+	}
+	return float64(n) / d.Seconds()
+}
+
+// annotate records the stream's timing on attrs. start is when the request
+// was received.
+func (m *streamMeter) annotate(attrs *audit.Attributes, start time.Time) {
+	if m.chunks == 0 {
+		return
+	}
+	n, estimated := m.tokens()
+	attrs.Set("stream.chunks", m.chunks)
+	attrs.Set("stream.first_chunk_ms", m.first.Sub(start).Milliseconds())
+	attrs.Set("stream.output_tokens", n)
+	if estimated {
+		attrs.Set("stream.tokens_estimated", true)
+	}
+	if m.chunks > 1 {
+		attrs.Set("stream.max_gap_ms", m.maxGap.Milliseconds())
+		attrs.Set("stream.mean_gap_ms", (m.totalGap / time.Duration(m.chunks-1)).Milliseconds())
+	}
+	if r := m.tokensPerSecond(); r > 0 {
+		attrs.Set("stream.tokens_per_second", math.Round(r*10)/10)
+	}
+}
@@ -0,0 +1,187 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/kdhira/audit-proxy/internal/audit"
+)
+
+// extensionECH is the TLS extension carrying an encrypted ClientHello,
+// whose outer server name is not the one the client wants.
+const extensionECH = 0xfe0d
+
+// errHelloRead ends the handshake readClientHello starts.
+var errHelloRead = errors.New("client hello read")
+
+// serveTransparent accepts the connections the kernel redirects to ln and
+// handles each as a tunnel, until ln is closed.
+func (h *handler) serveTransparent(ln net.Listener) error {
+	var delay time.Duration
+	for {
+		c, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			// Back off on temporary failures, such as running out of file
+			// descriptors, as http.Server does.
+			if ne, ok := err.(interface{ Temporary() bool }); ok && ne.Temporary() {
+				delay = min(max(2*delay, 5*time.Millisecond), time.Second)
+				slog.Error("accept transparent connection", "err", err, "retry_in", delay)
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+		go h.handleTransparent(c, ln.Addr())
+	}
+}
+
+// handleTransparent handles a redirected connection as a tunnel to the
+// server name in its ClientHello or, without one, to its original
+// destination: the tunnel is checked, intercepted or passed through, and
+// audited as if the client had sent CONNECT. The entry records how the
+// target was chosen.
+func (h *handler) handleTransparent(c net.Conn, listener net.Addr) {
+	defer c.Close()
+	if h.drain.active() {
+		h.drain.refuse()
+		return
+	}
+	defer h.drain.track(c)()
+	dst := originalDst(c)
+
+	_ = c.SetReadDeadline(time.Now().Add(tunnelSniffTimeout))
+	hello, br, helloErr := readClientHello(c)
+	_ = c.SetReadDeadline(time.Time{})
+	target, fallback := dst.String(), "no_sni"
+	if hello != nil && hello.ServerName != "" {
+		if slices.Contains(hello.Extensions, extensionECH) {
+			fallback = "ech"
+		} else {
+			target, fallback = net.JoinHostPort(hello.ServerName, strconv.Itoa(int(dst.Port()))), ""
+		}
+	}
+
+	// The connection stands for a client connection and its CONNECT.
+	st := h.conns.newConn(c.RemoteAddr().String())
+	r := (&http.Request{
+		Method:     http.MethodConnect,
+		URL:        &url.URL{Host: target},
+		Host:       target,
+		RemoteAddr: c.RemoteAddr().String(),
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+	}).WithContext(context.WithValue(context.WithValue(context.Background(),
+		http.LocalAddrContextKey, c.LocalAddr()), connStateKey{}, st))
+	defer h.drain.enter()()
+	x := h.begin(audit.KindConnect, r)
+	defer h.finish(x)
+	x.attrs.Set("transparent.original_dst", dst.String())
+	if hello != nil && hello.ServerName != "" {
+		x.attrs.Set("transparent.sni", hello.ServerName)
+	}
+	if fallback == "" {
+		x.attrs.Set("transparent.decision", "sni")
+	} else {
+		x.attrs.Set("transparent.decision", "ip")
+		x.attrs.Set("transparent.ip_reason", fallback)
+	}
+
+	if hello == nil {
+		x.entry.Blocked = true
+		x.entry.Reason = "connection did not start with a TLS handshake"
+		if helloErr != nil {
+			x.entry.Error = helloErr.Error()
+		}
+		return
+	}
+	x.attrs.Set("tunnel.protocol", protoTLS)
+	if redirectedToSelf(dst, listener) {
+		x.deny(http.StatusMisdirectedRequest, "connection was not redirected to the proxy")
+		return
+	}
+	if status, _ := h.admitTunnel(x); status != 0 {
+		return
+	}
+	mitm := h.intercept(x)
+	h.logStart(x)
+	if mitm {
+		x.entry.SetAttribute("mitm", true)
+		h.serveMitm(r, x, c, br)
+		return
+	}
+	upstream, _, _ := h.dialTunnel(x)
+	if upstream == nil {
+		return
+	}
+	defer upstream.Close()
+	h.pipeTunnel(x, c, br, upstream)
+}
+
+// originalDst returns where c was headed before the kernel handed it to
+// the proxy: conntrack knows for iptables REDIRECT, and TPROXY leaves the
+// local address in place.
+func originalDst(c net.Conn) netip.AddrPort {
+	if dst, ok := redirectedDst(c); ok {
+		return dst
+	}
+	local, _ := netip.ParseAddrPort(c.LocalAddr().String())
+	return netip.AddrPortFrom(local.Addr().Unmap(), local.Port())
+}
+
+// redirectedToSelf reports whether dst is the listener itself, as for a
+// client connecting to it directly, which would have the proxy connect to
+// itself.
+func redirectedToSelf(dst netip.AddrPort, listener net.Addr) bool {
+	l, err := netip.ParseAddrPort(listener.String())
+	if err != nil || l.Port() != dst.Port() {
+		return false
+	}
+	return l.Addr().IsUnspecified() || l.Addr().Unmap() == dst.Addr()
+}
+
+// readClientHello reads the TLS ClientHello c opens with. It returns the
+// hello, or nil if c does not start with one, and a reader giving back the
+// bytes read followed by the rest of c.
+func readClientHello(c net.Conn) (*tls.ClientHelloInfo, *bufio.Reader, error) {
+	var read bytes.Buffer
+	var hello *tls.ClientHelloInfo
+	err := tls.Server(&helloConn{Conn: c, r: io.TeeReader(c, &read)}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = info
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	br := bufio.NewReader(io.MultiReader(&read, c))
+	if hello == nil {
+		return nil, br, err
+	}
+	return hello, br, nil
+}
+
+// helloConn lets a TLS server read a ClientHello from a connection and
+// discards what it would send back.
+type helloConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *helloConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c *helloConn) Write(p []byte) (int, error) { return len(p), nil }
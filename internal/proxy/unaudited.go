@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"context"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/kdhira/audit-proxy/internal/audit"
+	"github.com/kdhira/audit-proxy/internal/metrics"
+)
+
+// unaudited counts the traffic to direct_hosts, which is passed through
+// without policy, interception or audit entries. Summaries of the counts,
+// by direct_hosts pattern, are written to the audit log so the log still
+// shows that such traffic happened.
+type unaudited struct {
+	logger   audit.Logger
+	interval time.Duration
+	requests *metrics.CounterVec
+	bytes    *metrics.CounterVec
+
+	mu     sync.Mutex
+	since  time.Time
+	counts map[string]*unauditedCount
+}
+
+// unauditedCount is the traffic to one direct_hosts pattern since the last
+// summary.
+type unauditedCount struct {
+	Tunnels  int64 `json:"tunnels,omitempty"`
+	Requests int64 `json:"requests,omitempty"`
+	Errors   int64 `json:"errors,omitempty"`
+	BytesOut int64 `json:"bytes_out"`
+	BytesIn  int64 `json:"bytes_in"`
+}
+
+func newUnaudited(logger audit.Logger, interval time.Duration, reg *metrics.Registry) *unaudited {
+	return &unaudited{
+		logger:   logger,
+		interval: interval,
+		requests: reg.Counter("auditproxy_unaudited_total",
+			"Tunnels and requests to direct_hosts passed through without auditing, by kind (connect or http) and direct_hosts pattern.", "kind", "pattern"),
+		bytes: reg.Counter("auditproxy_unaudited_bytes_total",
+			"Bytes passed through to and from direct_hosts without auditing, by direction (out or in).", "direction"),
+		since:  time.Now(),
+		counts: map[string]*unauditedCount{},
+	}
+}
+
+// record counts a tunnel or request to a target matching pattern.
+func (u *unaudited) record(kind, pattern string, out, in int64, failed bool) {
+	u.requests.With(kind, pattern).Inc()
+	u.bytes.With("out").Add(float64(out))
+	u.bytes.With("in").Add(float64(in))
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	c := u.counts[pattern]
+	if c == nil {
+		c = &unauditedCount{}
+		u.counts[pattern] = c
+	}
+	if kind == audit.KindConnect {
+		c.Tunnels++
+	} else {
+		c.Requests++
+	}
+	if failed {
+		c.Errors++
+	}
+	c.BytesOut += out
+	c.BytesIn += in
+}
+
+// run writes a summary every interval until ctx is done.
+func (u *unaudited) run(ctx context.Context) {
+	if u.interval <= 0 {
+		return
+	}
+	t := time.NewTicker(u.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			u.summarise()
+		}
+	}
+}
+
+// summarise writes an unaudited entry with the counts since the last one,
+// if there was any traffic, and starts counting afresh.
+func (u *unaudited) summarise() {
+	u.mu.Lock()
+	counts, since := u.counts, u.since
+	u.counts, u.since = map[string]*unauditedCount{}, time.Now()
+	u.mu.Unlock()
+	if len(counts) == 0 {
+		return
+	}
+	e := audit.NewEntry(audit.KindUnaudited)
+	e.DurationMS = time.Since(since).Milliseconds()
+	e.Reason = "direct_hosts passed through unaudited"
+	e.SetAttribute("unaudited.since", since.UTC().Format(time.RFC3339))
+	e.SetAttribute("unaudited.hosts", counts)
+	var total unauditedCount
+	for _, p := range slices.Sorted(maps.Keys(counts)) {
+		c := counts[p]
+		slog.Info("unaudited traffic", "pattern", p, "tunnels", c.Tunnels, "requests", c.Requests,
+			"errors", c.Errors, "bytes_out", c.BytesOut, "bytes_in", c.BytesIn)
+		total.Tunnels += c.Tunnels
+		total.Requests += c.Requests
+	}
+	e.SetAttribute("unaudited.tunnels", total.Tunnels)
+	e.SetAttribute("unaudited.requests", total.Requests)
+	if err := u.logger.Log(e); err != nil {
+		slog.Error("write audit entry", "err", err)
+	}
+}
+
+// unauditedTarget returns the direct_hosts pattern r's target matches, if
+// any.
+func (r *rules) unauditedTarget(req *http.Request) (string, bool) {
+	hostport, port := req.URL.Host, defaultPort(req.URL.Scheme)
+	if req.Method == http.MethodConnect {
+		hostport, port = req.Host, "443"
+	}
+	if hostport == "" {
+		return "", false
+	}
+	i := r.direct.index(hostport, port)
+	if i < 0 {
+		return "", false
+	}
+	return r.directPats[i], true
+}
+
+// passUnaudited tunnels or forwards r, whose target matches the
+// direct_hosts pattern, without policy, interception or an audit entry.
+func (h *handler) passUnaudited(w http.ResponseWriter, r *http.Request, pattern string) {
+	if r.Method == http.MethodConnect {
+		h.tunnelUnaudited(w, r, pattern)
+		return
+	}
+	out := cloneRequest(r)
+	sent := &capture{}
+	if out.Body != nil && out.Body != http.NoBody {
+		out.Body = teeBody(out.Body, sent)
+	}
+	resp, err := h.upstreams.forTarget(out.URL.Host, defaultPort(out.URL.Scheme)).transport.RoundTrip(out)
+	if err != nil {
+		h.unaudited.record(audit.KindHTTP, pattern, sent.n, 0, true)
+		writeJSON(w, upstreamStatus(err), errorBody{Error: "upstream request failed"})
+		return
+	}
+	defer resp.Body.Close()
+	removeHopHeaders(resp.Header)
+	copyHeaders(w.Header(), resp.Header)
+	w.WriteHeader(resp.StatusCode)
+	n, err := copyStream(w, resp.Body)
+	h.unaudited.record(audit.KindHTTP, pattern, sent.n, n, err != nil)
+}
+
+func (h *handler) tunnelUnaudited(w http.ResponseWriter, r *http.Request, pattern string) {
+	defer h.drain.enter()()
+	upstream, err := h.upstreams.forTarget(r.Host, "443").dial(r.Context(), "tcp", r.Host)
+	if err != nil {
+		h.unaudited.record(audit.KindConnect, pattern, 0, 0, true)
+		writeJSON(w, upstreamStatus(err), errorBody{Error: "upstream dial failed"})
+		return
+	}
+	defer upstream.Close()
+	client, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		h.unaudited.record(audit.KindConnect, pattern, 0, 0, true)
+		slog.Error("hijack CONNECT", "err", err)
+		return
+	}
+	defer client.Close()
+	defer h.drain.track(client)()
+	if _, err := rw.WriteString("HTTP/1.1 200 Connection Established\r\n\r\n"); err == nil {
+		err = rw.Flush()
+	}
+	if err != nil {
+		h.unaudited.record(audit.KindConnect, pattern, 0, 0, true)
+		return
+	}
+	out, in := pipe(client, rw.Reader, upstream, nil)
+	h.unaudited.record(audit.KindConnect, pattern, out, in, false)
+}
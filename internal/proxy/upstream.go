@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kdhira/audit-proxy/internal/config"
+	"github.com/kdhira/audit-proxy/internal/forward"
+)
+
+// upstream is how the proxy reaches a target: a pooled transport for
+// requests and a dialer for CONNECT tunnels, sharing the same timeouts.
+type upstream struct {
+	transport http.RoundTripper
+	dial      func(ctx context.Context, network, address string) (net.Conn, error)
+	tls       *tls.Config // the transport's; nil for Go's defaults
+	handshake time.Duration
+	insecure  bool // the transport does not verify server certificates
+	// clientCert is the SHA-256 of the certificate presented to servers
+	// that ask for one, in hex; "" for none.
+	clientCert string
+}
+
+// upstreams picks the upstream for a target from the per-host timeout and
+// TLS overrides.
+type upstreams struct {
+	def      upstream
+	timeouts []hostList   // of timeouts.hosts
+	tls      []hostList   // of upstream_tls.hosts
+	table    [][]upstream // by timeouts override, then TLS override; 0 for none
+	open     atomic.Int64 // connections the transports hold, idle or in use
+	// revocation checks upstream certificates; nil if they are not.
+	revocation *revocation
+}
+
+func newUpstreams(r *forward.Resolver, cfg config.TimeoutsConfig, tlsCfg config.UpstreamTLSConfig, roots []string) (*upstreams, error) {
+	rev := newRevocation(tlsCfg.Revocation)
+	clients, tlsHosts, err := compileUpstreamTLS(tlsCfg, roots, rev)
+	if err != nil {
+		return nil, err
+	}
+	u := &upstreams{tls: tlsHosts, revocation: rev}
+	timeouts := []config.Timeouts{cfg.Timeouts}
+	for i, h := range cfg.Hosts {
+		match, err := compileHosts(h.Match)
+		if err != nil {
+			return nil, fmt.Errorf("timeouts.hosts[%d]: %w", i, err)
+		}
+		u.timeouts = append(u.timeouts, match)
+		timeouts = append(timeouts, cfg.Timeouts.Merge(h.Timeouts))
+	}
+	for _, t := range timeouts {
+		row := make([]upstream, len(clients))
+		for i, c := range clients {
+			tr := forward.NewTransport(r, t, c.config)
+			tr.DialContext = u.counted(tr.DialContext)
+			row[i] = upstream{transport: tr, dial: forward.Dialer(r, t.Dial), tls: c.config, handshake: t.TLSHandshake, insecure: c.insecure}
+			if c.config != nil && len(c.config.Certificates) > 0 {
+				row[i].clientCert = chainFingerprints([]*x509.Certificate{c.config.Certificates[0].Leaf})[0]
+			}
+		}
+		u.table = append(u.table, row)
+	}
+	u.def = u.table[0][0]
+	if rev != nil {
+		// CRLs are fetched as other requests are sent.
+		rev.client.Transport = u.def.transport
+	}
+	return u, nil
+}
+
+// forTarget returns the upstream for hostport; defaultPort applies when
+// hostport has no port.
+func (u *upstreams) forTarget(hostport, defaultPort string) upstream {
+	return u.table[matchIndex(u.timeouts, hostport, defaultPort)][matchIndex(u.tls, hostport, defaultPort)]
+}
+
+// matchIndex returns one more than the index of the first of lists
+// matching hostport, or 0 if none does.
+func matchIndex(lists []hostList, hostport, defaultPort string) int {
+	for i, l := range lists {
+		if l.match(hostport, defaultPort) {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// counted wraps a transport's dial function to keep u.open up to date.
+func (u *upstreams) counted(dial func(ctx context.Context, network, address string) (net.Conn, error)) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		c, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		u.open.Add(1)
+		return &countedConn{Conn: c, open: &u.open}, nil
+	}
+}
+
+// closeIdle closes the idle pooled connections of every transport and
+// returns roughly how many there were: connections opened or closed by
+// requests meanwhile skew the count.
+func (u *upstreams) closeIdle() int {
+	before := u.open.Load()
+	closeIdle := func(rt http.RoundTripper) {
+		if c, ok := rt.(interface{ CloseIdleConnections() }); ok {
+			c.CloseIdleConnections()
+		}
+	}
+	for _, row := range u.table {
+		for _, up := range row {
+			closeIdle(up.transport)
+		}
+	}
+	return int(max(before-u.open.Load(), 0))
+}
+
+// countedConn decrements open when first closed.
+type countedConn struct {
+	net.Conn
+	open *atomic.Int64
+	once sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(func() { c.open.Add(-1) })
+	return c.Conn.Close()
+}
+
+// upstreamStatus is the status returned to the client when reaching the
+// upstream failed: 503 when its circuit breaker is open, 504 for timeouts,
+// otherwise 502.
+func upstreamStatus(err error) int {
+	var open *breakerOpenError
+	if errors.As(err, &open) {
+		return http.StatusServiceUnavailable
+	}
+	var ne net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &ne) && ne.Timeout()) {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
@@ -0,0 +1,168 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+
+	"github.com/kdhira/audit-proxy/internal/config"
+	"github.com/kdhira/audit-proxy/internal/mitm"
+)
+
+// tlsClient is how the proxy speaks TLS to some upstreams.
+type tlsClient struct {
+	config   *tls.Config // nil for Go's defaults
+	insecure bool        // server certificates are not verified
+}
+
+// compileUpstreamTLS returns the TLS client for upstreams that no
+// upstream_tls.hosts entry matches, followed by one per entry, and the
+// entries' compiled host lists. roots are the egress.root_cas files. rev,
+// if not nil, checks the certificates of all of them.
+func compileUpstreamTLS(cfg config.UpstreamTLSConfig, roots []string, rev *revocation) ([]tlsClient, []hostList, error) {
+	pool, err := rootCAs("egress.root_cas", roots)
+	if err != nil {
+		return nil, nil, err
+	}
+	minVersion := config.TLSVersion(cfg.MinVersion)
+	def := tlsClient{}
+	if pool != nil || minVersion != 0 || rev != nil {
+		def.config = &tls.Config{RootCAs: pool, MinVersion: minVersion}
+	}
+	clients := []tlsClient{def}
+	var matches []hostList
+	for i, h := range cfg.Hosts {
+		field := fmt.Sprintf("upstream_tls.hosts[%d]", i)
+		match, err := compileHosts(h.Match)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", field, err)
+		}
+		c := &tls.Config{RootCAs: pool, MinVersion: minVersion}
+		if len(h.RootCAs) > 0 {
+			if c.RootCAs, err = rootCAs(field+".root_cas", slices.Concat(roots, h.RootCAs)); err != nil {
+				return nil, nil, err
+			}
+		}
+		if h.ClientCert != "" {
+			cert, err := tls.LoadX509KeyPair(h.ClientCert, h.ClientKey)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s: client certificate: %w", field, err)
+			}
+			c.Certificates = []tls.Certificate{cert}
+		}
+		if h.MinVersion != "" {
+			c.MinVersion = config.TLSVersion(h.MinVersion)
+		}
+		if h.InsecureSkipVerify {
+			c.InsecureSkipVerify = true
+			slog.Warn("INSECURE: upstream TLS certificates will not be verified; use only for testing", "hosts", h.Match)
+		}
+		matches = append(matches, match)
+		clients = append(clients, tlsClient{config: c, insecure: h.InsecureSkipVerify})
+	}
+	if rev != nil {
+		for _, c := range clients {
+			c.config.VerifyConnection = rev.verify
+		}
+	}
+	return clients, matches, nil
+}
+
+// certificateFlaw classifies a failure to verify an upstream certificate
+// as one of the mitm.Flaw values, revoked or revocation_unknown, or
+// "invalid" for other reasons. It returns "" if err is not a verification
+// failure.
+func certificateFlaw(err error) string {
+	var (
+		unknown  x509.UnknownAuthorityError
+		hostname x509.HostnameError
+		invalid  x509.CertificateInvalidError
+		verr     *tls.CertificateVerificationError
+		revoked  *revocationError
+	)
+	switch {
+	case errors.As(err, &revoked) && revoked.result.status == revocationRevoked:
+		return "revoked"
+	case errors.As(err, &revoked):
+		return "revocation_unknown"
+	case errors.As(err, &unknown):
+		return mitm.FlawUntrusted
+	case errors.As(err, &hostname):
+		return mitm.FlawHostname
+	case errors.As(err, &invalid) && invalid.Reason == x509.Expired:
+		return mitm.FlawExpired
+	case errors.As(err, &invalid), errors.As(err, &verr):
+		return "invalid"
+	}
+	return ""
+}
+
+// unverifiedChain returns the certificates upstream presented if err is
+// their failing verification.
+func unverifiedChain(err error) []*x509.Certificate {
+	var verr *tls.CertificateVerificationError
+	if errors.As(err, &verr) {
+		return verr.UnverifiedCertificates
+	}
+	return nil
+}
+
+// chainFingerprints returns the SHA-256 of each certificate, in hex.
+func chainFingerprints(certs []*x509.Certificate) []string {
+	sums := make([]string, len(certs))
+	for i, c := range certs {
+		sum := sha256.Sum256(c.Raw)
+		sums[i] = hex.EncodeToString(sum[:])
+	}
+	return sums
+}
+
+// annotateUpstreamTLS records on x the certificates upstream presented
+// and, if err is their failing verification, why.
+func annotateUpstreamTLS(x *exchange, state *tls.ConnectionState, err error) {
+	chain := unverifiedChain(err)
+	if state != nil {
+		chain = state.PeerCertificates
+	}
+	if len(chain) > 0 {
+		x.attrs.Set("upstream.tls_chain_sha256", chainFingerprints(chain))
+	}
+	if flaw := certificateFlaw(err); flaw != "" {
+		x.attrs.Set("upstream.tls_error", flaw)
+	}
+}
+
+// probeUpstreamTLS handshakes with hostport as requests through an
+// intercepted tunnel would and returns why its certificate fails
+// verification, with the chain it presented. It returns "" if the
+// certificate verifies, is not verified, or hostport cannot be reached;
+// requests then fail on their own.
+func (h *handler) probeUpstreamTLS(ctx context.Context, hostport string) (string, []*x509.Certificate) {
+	up := h.upstreams.forTarget(hostport, "443")
+	if up.insecure {
+		return "", nil
+	}
+	if up.handshake > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, up.handshake)
+		defer cancel()
+	}
+	conn, err := up.dial(ctx, "tcp", hostport)
+	if err != nil {
+		return "", nil
+	}
+	defer conn.Close()
+	conf := &tls.Config{}
+	if up.tls != nil {
+		conf = up.tls.Clone()
+	}
+	conf.ServerName = hostname(hostport)
+	err = tls.Client(conn, conf).HandshakeContext(ctx)
+	return certificateFlaw(err), unverifiedChain(err)
+}
@@ -0,0 +1,32 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+
+	"github.com/kdhira/audit-proxy/internal/audit"
+)
+
+// workloadOf returns the workload behind r's client connection, resolved
+// once per connection. Requests in an intercepted tunnel share the
+// connection the tunnel came in on.
+func (h *handler) workloadOf(r *http.Request) *audit.Workload {
+	if h.workloads == nil {
+		return nil
+	}
+	resolve := func() *audit.Workload {
+		remote, _ := netip.ParseAddrPort(r.RemoteAddr)
+		var local netip.AddrPort
+		if a, ok := r.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr); ok {
+			local = a.AddrPort()
+		}
+		return h.workloads.Resolve(remote, local)
+	}
+	st := connStateFrom(r.Context())
+	if st == nil {
+		return resolve()
+	}
+	st.workloadOnce.Do(func() { st.workload = resolve() })
+	return st.workload
+}
@@ -0,0 +1,110 @@
+// Package recordings stores upstream responses keyed by request
+// fingerprint, so the proxy can serve them back instead of contacting the
+// upstream: a deterministic stand-in for APIs under test.
+package recordings
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Recording is one recorded exchange. The request is kept for reference
+// only; its fingerprint is what a replayed request must match.
+type Recording struct {
+	Fingerprint string    `json:"fingerprint"`
+	RecordedAt  time.Time `json:"recorded_at"`
+	Request     Request   `json:"request"`
+	Response    Response  `json:"response"`
+}
+
+// Request describes the recorded request.
+type Request struct {
+	Method  string      `json:"method"`
+	URL     string      `json:"url"`
+	Headers http.Header `json:"headers,omitempty"`
+}
+
+// Response is the recorded response. Body is base64 in the file.
+type Response struct {
+	Status  int         `json:"status"`
+	Headers http.Header `json:"headers,omitempty"`
+	Body    []byte      `json:"body"`
+}
+
+// Store keeps recordings as one JSON file per fingerprint in a directory.
+// A new recording of a fingerprint replaces the old one.
+type Store struct {
+	dir string
+}
+
+// NewStore returns a Store in dir, creating it if needed.
+func NewStore(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("create recordings directory: %w", err)
+	}
+	return &Store{dir: dir}, nil
+}
+
+func (s *Store) path(fingerprint string) string {
+	return filepath.Join(s.dir, fingerprint+".json")
+}
+
+// Load returns the recording for fingerprint. A missing recording is
+// reported with an error satisfying errors.Is(err, fs.ErrNotExist).
+func (s *Store) Load(fingerprint string) (*Recording, error) {
+	if !validFingerprint(fingerprint) {
+		return nil, fmt.Errorf("invalid fingerprint %q", fingerprint)
+	}
+	b, err := os.ReadFile(s.path(fingerprint))
+	if err != nil {
+		return nil, err
+	}
+	var r Recording
+	if err := json.Unmarshal(b, &r); err != nil {
+		return nil, fmt.Errorf("recording %s: %w", fingerprint, err)
+	}
+	return &r, nil
+}
+
+// Save writes r, replacing any recording of the same fingerprint. Readers
+// never see a partly written file.
+func (s *Store) Save(r *Recording) error {
+	if !validFingerprint(r.Fingerprint) {
+		return fmt.Errorf("invalid fingerprint %q", r.Fingerprint)
+	}
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(s.dir, ".recording-*")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), s.path(r.Fingerprint))
+}
+
+// validFingerprint reports whether fp is hex, so it is safe as a file name.
+func validFingerprint(fp string) bool {
+	if fp == "" {
+		return false
+	}
+	for _, c := range fp {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
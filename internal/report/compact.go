@@ -0,0 +1,46 @@
+package report
+
+import "github.com/kdhira/audit-proxy/internal/audit"
+
+// Compactor merges the start and finish records of two-phase entries back
+// into single entries. Entries without a phase pass through unchanged.
+type Compactor struct {
+	pending map[string]audit.Entry
+	order   []string
+}
+
+// NewCompactor returns an empty Compactor.
+func NewCompactor() *Compactor {
+	return &Compactor{pending: map[string]audit.Entry{}}
+}
+
+// Add consumes e and returns the entry it completes, if any. A start record
+// is held until its finish record arrives; the finish record, which
+// describes the whole exchange, is returned without its phase.
+func (c *Compactor) Add(e audit.Entry) (audit.Entry, bool) {
+	switch e.Phase {
+	case audit.PhaseStart:
+		if _, ok := c.pending[e.ID]; !ok {
+			c.order = append(c.order, e.ID)
+		}
+		c.pending[e.ID] = e
+		return audit.Entry{}, false
+	case audit.PhaseFinish:
+		delete(c.pending, e.ID)
+		e.Phase = ""
+	}
+	return e, true
+}
+
+// Incomplete returns the start records that never finished, in the order
+// they were added. They keep their start phase, so an exchange cut short
+// (by a crash, say) stays recognisable.
+func (c *Compactor) Incomplete() []audit.Entry {
+	var out []audit.Entry
+	for _, id := range c.order {
+		if e, ok := c.pending[id]; ok {
+			out = append(out, e)
+		}
+	}
+	return out
+}
@@ -0,0 +1,116 @@
+package report
+
+import (
+	"cmp"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/kdhira/audit-proxy/internal/audit"
+)
+
+// Deprecation summarises observed traffic to one deprecated operation. Host
+// is the service name for entries that have one, here and in VersionDrift.
+type Deprecation struct {
+	Host      string    `json:"host"`
+	Operation string    `json:"operation"`
+	Count     int       `json:"count"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Sources   []string  `json:"sources"`
+	Sunset    string    `json:"sunset,omitempty"`
+	Note      string    `json:"note,omitempty"`
+}
+
+// VersionDrift lists the API versions observed for a host that has been
+// called with more than one.
+type VersionDrift struct {
+	Host     string         `json:"host"`
+	Versions map[string]int `json:"versions"`
+}
+
+// DeprecationReport is the result of Deprecations.
+type DeprecationReport struct {
+	Deprecations []Deprecation  `json:"deprecations"`
+	VersionDrift []VersionDrift `json:"version_drift"`
+}
+
+// DeprecationCollector accumulates entries for a DeprecationReport.
+type DeprecationCollector struct {
+	deps     map[[2]string]*Deprecation
+	sources  map[[2]string]map[string]bool
+	versions map[string]map[string]int
+}
+
+// NewDeprecationCollector returns an empty collector.
+func NewDeprecationCollector() *DeprecationCollector {
+	return &DeprecationCollector{
+		deps:     map[[2]string]*Deprecation{},
+		sources:  map[[2]string]map[string]bool{},
+		versions: map[string]map[string]int{},
+	}
+}
+
+// Add records one entry.
+func (c *DeprecationCollector) Add(e audit.Entry) {
+	host := destinationOf(e)
+	if v := stringAttr(e, audit.AttrAPIVersion); v != "" {
+		if c.versions[host] == nil {
+			c.versions[host] = map[string]int{}
+		}
+		c.versions[host][v]++
+	}
+	if !boolAttr(e, audit.AttrDeprecated) {
+		return
+	}
+	key := [2]string{host, operationOf(e)}
+	d := c.deps[key]
+	if d == nil {
+		d = &Deprecation{Host: key[0], Operation: key[1]}
+		c.deps[key] = d
+		c.sources[key] = map[string]bool{}
+	}
+	d.Count++
+	d.FirstSeen = earlier(d.FirstSeen, e.Time)
+	d.LastSeen = later(d.LastSeen, e.Time)
+	if s := stringAttr(e, audit.AttrSunset); s != "" {
+		d.Sunset = s
+	}
+	if n := stringAttr(e, audit.AttrDeprecationNote); n != "" {
+		d.Note = n
+	}
+	if s := stringAttr(e, audit.AttrDeprecationSource); s != "" {
+		c.sources[key][s] = true
+	}
+}
+
+// Report returns the accumulated report, with the soonest sunsets first.
+func (c *DeprecationCollector) Report() DeprecationReport {
+	r := DeprecationReport{Deprecations: []Deprecation{}, VersionDrift: []VersionDrift{}}
+	for key, d := range c.deps {
+		d.Sources = slices.Sorted(maps.Keys(c.sources[key]))
+		r.Deprecations = append(r.Deprecations, *d)
+	}
+	slices.SortFunc(r.Deprecations, func(a, b Deprecation) int {
+		// Entries without a sunset date sort last.
+		if (a.Sunset == "") != (b.Sunset == "") {
+			if a.Sunset == "" {
+				return 1
+			}
+			return -1
+		}
+		return cmp.Or(
+			cmp.Compare(a.Sunset, b.Sunset),
+			cmp.Compare(b.Count, a.Count),
+			cmp.Compare(a.Host, b.Host),
+			cmp.Compare(a.Operation, b.Operation),
+		)
+	})
+	for host, vs := range c.versions {
+		if len(vs) > 1 {
+			r.VersionDrift = append(r.VersionDrift, VersionDrift{Host: host, Versions: vs})
+		}
+	}
+	slices.SortFunc(r.VersionDrift, func(a, b VersionDrift) int { return cmp.Compare(a.Host, b.Host) })
+	return r
+}
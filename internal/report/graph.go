@@ -0,0 +1,139 @@
+package report
+
+import (
+	"cmp"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/kdhira/audit-proxy/internal/audit"
+)
+
+// Node kinds in a dependency graph.
+const (
+	NodeClient    = "client"
+	NodeHost      = "host"
+	NodeOperation = "operation"
+)
+
+// GraphNode is a client identity, destination host or operation. Hosts
+// belonging to a service are merged into one node named after it.
+type GraphNode struct {
+	ID    string `json:"id"`
+	Kind  string `json:"kind"`
+	Label string `json:"label"`
+}
+
+// GraphEdge counts the exchanges between two nodes: client to host, or host
+// to one of its operations.
+type GraphEdge struct {
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	Count     int       `json:"count"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// Graph is the observed dependency graph: client identities to the hosts
+// they reached, and hosts to the operations called on them.
+type Graph struct {
+	Nodes []GraphNode `json:"nodes"`
+	Edges []GraphEdge `json:"edges"`
+}
+
+// GraphCollector accumulates entries for a Graph.
+type GraphCollector struct {
+	nodes map[string]GraphNode
+	edges map[[2]string]*GraphEdge
+}
+
+// NewGraphCollector returns an empty collector.
+func NewGraphCollector() *GraphCollector {
+	return &GraphCollector{
+		nodes: map[string]GraphNode{},
+		edges: map[[2]string]*GraphEdge{},
+	}
+}
+
+// Add records one entry. Blocked exchanges and entries that do not describe
+// traffic are ignored, as nothing was actually reached.
+func (c *GraphCollector) Add(e audit.Entry) {
+	if e.Blocked || e.Request.Host == "" {
+		return
+	}
+	switch e.Kind {
+	case audit.KindHTTP, audit.KindMITM, audit.KindConnect:
+	default:
+		return
+	}
+	client := c.node(NodeClient, clientOf(e))
+	dest := destinationOf(e)
+	host := c.node(NodeHost, dest)
+	c.edge(client, host, e.Time)
+	// Opaque tunnels reveal only the host.
+	if e.Kind != audit.KindConnect {
+		op := operationOf(e)
+		c.edge(host, c.nodeID(NodeOperation, dest+" "+op, op), e.Time)
+	}
+}
+
+// Graph returns the nodes sorted by kind and ID and the edges by endpoints.
+func (c *GraphCollector) Graph() Graph {
+	g := Graph{Nodes: []GraphNode{}, Edges: []GraphEdge{}}
+	for _, n := range c.nodes {
+		g.Nodes = append(g.Nodes, n)
+	}
+	for _, e := range c.edges {
+		g.Edges = append(g.Edges, *e)
+	}
+	order := map[string]int{NodeClient: 0, NodeHost: 1, NodeOperation: 2}
+	slices.SortFunc(g.Nodes, func(a, b GraphNode) int {
+		return cmp.Or(cmp.Compare(order[a.Kind], order[b.Kind]), cmp.Compare(a.ID, b.ID))
+	})
+	slices.SortFunc(g.Edges, func(a, b GraphEdge) int {
+		return cmp.Or(cmp.Compare(a.From, b.From), cmp.Compare(a.To, b.To))
+	})
+	return g
+}
+
+func (c *GraphCollector) node(kind, label string) string {
+	return c.nodeID(kind, label, label)
+}
+
+func (c *GraphCollector) nodeID(kind, key, label string) string {
+	id := kind + ":" + key
+	if _, ok := c.nodes[id]; !ok {
+		c.nodes[id] = GraphNode{ID: id, Kind: kind, Label: label}
+	}
+	return id
+}
+
+func (c *GraphCollector) edge(from, to string, t time.Time) {
+	k := [2]string{from, to}
+	e := c.edges[k]
+	if e == nil {
+		e = &GraphEdge{From: from, To: to, FirstSeen: t}
+		c.edges[k] = e
+	}
+	e.Count++
+	e.FirstSeen = earlier(e.FirstSeen, t)
+	e.LastSeen = later(e.LastSeen, t)
+}
+
+// clientOf identifies the client of e: its authenticated user, else the
+// client policy that matched, else its source IP.
+func clientOf(e audit.Entry) string {
+	switch {
+	case e.Conn.User != "":
+		return e.Conn.User
+	case e.Conn.Client != "":
+		return e.Conn.Client
+	}
+	if host, _, err := net.SplitHostPort(e.Conn.ClientAddr); err == nil {
+		return host
+	}
+	if e.Conn.ClientAddr != "" {
+		return e.Conn.ClientAddr
+	}
+	return "unknown"
+}
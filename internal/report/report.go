@@ -0,0 +1,63 @@
+// Package report aggregates audit entries into summaries for the report
+// subcommand.
+package report
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/kdhira/audit-proxy/internal/audit"
+)
+
+// operationOf returns the entry's operation, falling back to method and
+// path for entries without a profile-assigned name.
+func operationOf(e audit.Entry) string {
+	if e.Operation != "" {
+		return e.Operation
+	}
+	path := e.Request.URL
+	if u, err := url.Parse(e.Request.URL); err == nil {
+		path = u.Path
+	}
+	return e.Request.Method + " " + path
+}
+
+// destinationOf returns the entry's service, falling back to its host, so
+// that a service reached under several hostnames is reported once.
+func destinationOf(e audit.Entry) string {
+	if e.Service != "" {
+		return e.Service
+	}
+	return e.Request.Host
+}
+
+func stringAttr(e audit.Entry, key string) string {
+	switch v := e.Attributes[key].(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func boolAttr(e audit.Entry, key string) bool {
+	v, _ := e.Attributes[key].(bool)
+	return v
+}
+
+func later(a, b time.Time) time.Time {
+	if b.After(a) {
+		return b
+	}
+	return a
+}
+
+func earlier(a, b time.Time) time.Time {
+	if a.IsZero() || b.Before(a) {
+		return b
+	}
+	return a
+}
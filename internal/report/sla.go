@@ -0,0 +1,128 @@
+package report
+
+import (
+	"cmp"
+	"math"
+	"slices"
+	"time"
+
+	"github.com/kdhira/audit-proxy/internal/audit"
+)
+
+// DefaultObjective is the availability objective, in percent, used when
+// none is given.
+const DefaultObjective = 99.9
+
+// ServiceSLA is the latency baseline and error budget of one service, or
+// host for traffic outside the services table, over the period read.
+type ServiceSLA struct {
+	Service  string `json:"service"`
+	Requests int    `json:"requests"`
+	// Errors counts responses with a 5xx status and requests that failed
+	// upstream without a response.
+	Errors       int     `json:"errors"`
+	Availability float64 `json:"availability"` // percent of requests without error
+	P50MS        int64   `json:"p50_ms"`
+	P90MS        int64   `json:"p90_ms"`
+	P99MS        int64   `json:"p99_ms"`
+	MaxMS        int64   `json:"max_ms"`
+	// ErrorBudget is the number of errors the objective allows for the
+	// requests seen, and BudgetRemaining the fraction of it left; it is
+	// negative once the budget is overspent.
+	ErrorBudget     float64   `json:"error_budget"`
+	BudgetRemaining float64   `json:"budget_remaining"`
+	FirstSeen       time.Time `json:"first_seen"`
+	LastSeen        time.Time `json:"last_seen"`
+}
+
+// SLAReport is the result of an SLACollector.
+type SLAReport struct {
+	Objective float64      `json:"objective"` // availability objective in percent
+	Services  []ServiceSLA `json:"services"`
+}
+
+// SLACollector accumulates entries for an SLAReport.
+type SLACollector struct {
+	objective float64
+	services  map[string]*slaStats
+}
+
+type slaStats struct {
+	ServiceSLA
+	durations []int64
+}
+
+// NewSLACollector returns an empty collector measuring against objective,
+// the availability target in percent, e.g. 99.9.
+func NewSLACollector(objective float64) *SLACollector {
+	return &SLACollector{objective: objective, services: map[string]*slaStats{}}
+}
+
+// Add records one entry. Only forwarded requests count: blocked exchanges
+// never reached the service, and the duration of an opaque tunnel says
+// nothing about the latency of the requests inside it.
+func (c *SLACollector) Add(e audit.Entry) {
+	if e.Blocked || e.Request.Host == "" {
+		return
+	}
+	if e.Kind != audit.KindHTTP && e.Kind != audit.KindMITM {
+		return
+	}
+	name := destinationOf(e)
+	s := c.services[name]
+	if s == nil {
+		s = &slaStats{ServiceSLA: ServiceSLA{Service: name}}
+		c.services[name] = s
+	}
+	s.Requests++
+	if e.Response == nil && e.Error != "" || e.Response != nil && e.Response.Status >= 500 {
+		s.Errors++
+	}
+	s.durations = append(s.durations, e.DurationMS)
+	s.FirstSeen = earlier(s.FirstSeen, e.Time)
+	s.LastSeen = later(s.LastSeen, e.Time)
+}
+
+// Report returns the accumulated report, services with the least budget
+// remaining first.
+func (c *SLACollector) Report() SLAReport {
+	r := SLAReport{Objective: c.objective, Services: []ServiceSLA{}}
+	for _, s := range c.services {
+		slices.Sort(s.durations)
+		s.P50MS = percentile(s.durations, 50)
+		s.P90MS = percentile(s.durations, 90)
+		s.P99MS = percentile(s.durations, 99)
+		s.MaxMS = s.durations[len(s.durations)-1]
+		s.Availability = round(100*float64(s.Requests-s.Errors)/float64(s.Requests), 3)
+		budget := (100 - c.objective) / 100 * float64(s.Requests)
+		s.ErrorBudget = round(budget, 2)
+		switch {
+		case budget > 0:
+			s.BudgetRemaining = round(1-float64(s.Errors)/budget, 3)
+		case s.Errors == 0:
+			s.BudgetRemaining = 1
+		default:
+			s.BudgetRemaining = -float64(s.Errors) // no errors allowed at all
+		}
+		r.Services = append(r.Services, s.ServiceSLA)
+	}
+	slices.SortFunc(r.Services, func(a, b ServiceSLA) int {
+		return cmp.Or(
+			cmp.Compare(a.BudgetRemaining, b.BudgetRemaining),
+			cmp.Compare(b.Requests, a.Requests),
+			cmp.Compare(a.Service, b.Service),
+		)
+	})
+	return r
+}
+
+// percentile returns the nearest-rank p-th percentile of sorted.
+func percentile(sorted []int64, p int) int64 {
+	i := (p*len(sorted)+99)/100 - 1
+	return sorted[max(i, 0)]
+}
+
+func round(v float64, places int) float64 {
+	f := math.Pow(10, float64(places))
+	return math.Round(v*f) / f
+}
@@ -0,0 +1,96 @@
+// Package rollout decides which clients a gradually rolled out policy
+// change applies to. Clients are assigned to the canary or the control
+// cohort by a hash of their identity, so each stays in its cohort across
+// requests, and raising the percentage only moves clients into the canary.
+package rollout
+
+import (
+	"context"
+	"hash/fnv"
+	"math"
+	"slices"
+
+	"github.com/kdhira/audit-proxy/internal/audit"
+	"github.com/kdhira/audit-proxy/internal/config"
+)
+
+// Cohorts, as recorded in entries.
+const (
+	Canary  = "canary"
+	Control = "control"
+)
+
+// Subject identifies the client of a request.
+type Subject struct {
+	User   string // authenticated proxy user, if any
+	Client string // name of the matching client policy, if any
+	Source string // source IP
+}
+
+type subjectKey struct{}
+
+// WithSubject returns a context carrying s.
+func WithSubject(ctx context.Context, s Subject) context.Context {
+	return context.WithValue(ctx, subjectKey{}, s)
+}
+
+// SubjectFrom returns the subject carried by ctx.
+func SubjectFrom(ctx context.Context) Subject {
+	s, _ := ctx.Value(subjectKey{}).(Subject)
+	return s
+}
+
+// Rollout is a compiled config.RolloutConfig.
+type Rollout struct {
+	name    string
+	basis   uint64 // Percent in hundredths
+	users   []string
+	clients []string
+}
+
+// New returns the rollout named name, or nil if cfg is nil. The name is
+// recorded with the cohort and salts the hash, so different rollouts of
+// the same percentage pick different clients.
+func New(name string, cfg *config.RolloutConfig) *Rollout {
+	if cfg == nil {
+		return nil
+	}
+	return &Rollout{
+		name:    name,
+		basis:   uint64(math.Round(cfg.Percent * 100)),
+		users:   cfg.Users,
+		clients: cfg.Clients,
+	}
+}
+
+// Cohort returns the cohort of s.
+func (r *Rollout) Cohort(s Subject) string {
+	if s.User != "" && slices.Contains(r.users, s.User) ||
+		s.Client != "" && slices.Contains(r.clients, s.Client) {
+		return Canary
+	}
+	key := s.User
+	if key == "" {
+		key = s.Source
+	}
+	h := fnv.New64a()
+	h.Write([]byte(r.name))
+	h.Write([]byte{0})
+	h.Write([]byte(key))
+	if h.Sum64()%10000 < r.basis {
+		return Canary
+	}
+	return Control
+}
+
+// Admit reports whether the change applies to the request carrying ctx,
+// recording its cohort as the attribute rollout.<name>. A nil Rollout
+// admits everything and records nothing.
+func (r *Rollout) Admit(ctx context.Context) bool {
+	if r == nil {
+		return true
+	}
+	c := r.Cohort(SubjectFrom(ctx))
+	audit.Annotate(ctx, "rollout."+r.name, c)
+	return c == Canary
+}
@@ -0,0 +1,139 @@
+package threatintel
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// normalise lower-cases host and strips a port, brackets and a trailing
+// dot.
+func normalise(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(strings.Trim(host, "[]")), ".")
+}
+
+// hostOfURL returns the host of rawURL, or "" if it has none.
+func hostOfURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+// parseText adds the entries of a plain list, one per line. Text after #
+// is a comment. Lines in hosts file form, an address followed by names,
+// add the names.
+func parseText(r io.Reader, l *list) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64<<10), 1<<20)
+	for sc.Scan() {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if _, err := netip.ParseAddr(fields[0]); err == nil && len(fields) > 1 {
+			for _, name := range fields[1:] {
+				l.add(name)
+			}
+			continue
+		}
+		l.add(fields[0])
+	}
+	return sc.Err()
+}
+
+// parseCSV adds the entries in column of a CSV list, a header name or
+// 1-based index; the first column if empty. Lines starting with # are
+// comments. With a header name, the first row is the header.
+func parseCSV(r io.Reader, column string, l *list) error {
+	cr := csv.NewReader(r)
+	cr.Comment = '#'
+	cr.FieldsPerRecord = -1
+	cr.LazyQuotes = true
+	cr.TrimLeadingSpace = true
+	col := 0
+	if column != "" {
+		if n, err := strconv.Atoi(column); err == nil && n > 0 {
+			col = n - 1
+		} else {
+			header, err := cr.Read()
+			if err != nil {
+				return fmt.Errorf("csv header: %w", err)
+			}
+			if col = slices.IndexFunc(header, func(h string) bool { return strings.EqualFold(strings.TrimSpace(h), column) }); col < 0 {
+				return fmt.Errorf("csv header has no column %q", column)
+			}
+		}
+	}
+	for {
+		rec, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if col < len(rec) {
+			l.add(rec[col])
+		}
+	}
+}
+
+// stixValue matches the comparisons of STIX patterns that name a domain,
+// address or URL.
+var stixValue = regexp.MustCompile(`(?:domain-name|ipv4-addr|ipv6-addr|url):value\s*=\s*'((?:[^'\\]|\\.)*)'`)
+
+// stixObject holds the fields of the STIX objects read from a bundle.
+type stixObject struct {
+	Type        string    `json:"type"`
+	Value       string    `json:"value"`
+	Pattern     string    `json:"pattern"`
+	PatternType string    `json:"pattern_type"`
+	Revoked     bool      `json:"revoked"`
+	ValidUntil  time.Time `json:"valid_until"`
+}
+
+// parseSTIX adds the entries of a STIX 2 bundle, or a TAXII envelope, of
+// objects: the domains, addresses and URLs compared in the patterns of
+// indicators that are valid at now, and domain-name, ipv4-addr, ipv6-addr
+// and url objects.
+func parseSTIX(data []byte, l *list, now time.Time) error {
+	var doc struct {
+		Objects []stixObject `json:"objects"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("stix: %w", err)
+	}
+	for _, o := range doc.Objects {
+		switch o.Type {
+		case "indicator":
+			if o.Revoked || !o.ValidUntil.IsZero() && o.ValidUntil.Before(now) ||
+				o.PatternType != "" && o.PatternType != "stix" {
+				continue
+			}
+			for _, m := range stixValue.FindAllStringSubmatch(o.Pattern, -1) {
+				v := strings.NewReplacer(`\'`, `'`, `\\`, `\`).Replace(m[1])
+				l.add(v)
+			}
+		case "domain-name", "ipv4-addr", "ipv6-addr", "url":
+			l.add(o.Value)
+		}
+	}
+	return nil
+}
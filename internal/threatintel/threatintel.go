@@ -0,0 +1,332 @@
+// Package threatintel loads deny lists of malicious domains and IP
+// addresses from threat-intelligence feeds and matches proxy targets
+// against them.
+//
+// Feeds are fetched when the proxy starts and again every refresh
+// interval. A feed that cannot be fetched or parsed keeps the entries it
+// last loaded, and its status records the error, so a feed going down does
+// not open the proxy to what it listed.
+package threatintel
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kdhira/audit-proxy/internal/config"
+)
+
+const (
+	// defaultRefresh is how often a feed is fetched unless it sets
+	// refresh.
+	defaultRefresh = time.Hour
+	// fetchTimeout bounds one fetch of a feed.
+	fetchTimeout = time.Minute
+	// maxFeedBytes bounds the size of a feed.
+	maxFeedBytes = 256 << 20
+)
+
+// Status is the state of one feed, as reported by the admin API.
+type Status struct {
+	Name        string    `json:"name"`
+	URL         string    `json:"url"`
+	Format      string    `json:"format"`
+	Entries     int       `json:"entries"`
+	Refresh     string    `json:"refresh"`
+	LastAttempt time.Time `json:"last_attempt,omitzero"`
+	// LastUpdate is when the entries were last loaded, or found unchanged.
+	LastUpdate time.Time `json:"last_update,omitzero"`
+	LastError  string    `json:"last_error,omitempty"`
+	NextUpdate time.Time `json:"next_update,omitzero"`
+}
+
+// list is the parsed entries of a feed.
+type list struct {
+	domains  map[string]bool
+	addrs    map[netip.Addr]bool
+	prefixes []netip.Prefix
+}
+
+func newList() *list {
+	return &list{domains: map[string]bool{}, addrs: map[netip.Addr]bool{}}
+}
+
+func (l *list) len() int {
+	return len(l.domains) + len(l.addrs) + len(l.prefixes)
+}
+
+// add adds entry, a domain, IP address, CIDR range or URL, and reports
+// whether it was one.
+func (l *list) add(entry string) bool {
+	entry = strings.TrimSpace(entry)
+	if strings.Contains(entry, "://") {
+		entry = hostOfURL(entry)
+	}
+	if p, err := netip.ParsePrefix(entry); err == nil {
+		if p.Bits() == p.Addr().BitLen() {
+			l.addrs[p.Addr().Unmap()] = true
+		} else {
+			l.prefixes = append(l.prefixes, p.Masked())
+		}
+		return true
+	}
+	host := normalise(entry)
+	if a, err := netip.ParseAddr(host); err == nil {
+		if a.IsUnspecified() {
+			return false
+		}
+		l.addrs[a.Unmap()] = true
+		return true
+	}
+	host = strings.TrimPrefix(host, "*.")
+	// Names without a dot, such as localhost in a hosts file, are not
+	// domains a feed means to deny.
+	if !strings.Contains(host, ".") || strings.ContainsAny(host, " \t*/") {
+		return false
+	}
+	l.domains[host] = true
+	return true
+}
+
+// match returns the entry host is listed under, if any: the host itself,
+// a domain it is a subdomain of, or a range holding its address.
+func (l *list) match(host string) (string, bool) {
+	if a, err := netip.ParseAddr(host); err == nil {
+		a = a.Unmap()
+		if l.addrs[a] {
+			return a.String(), true
+		}
+		for _, p := range l.prefixes {
+			if p.Contains(a) {
+				return p.String(), true
+			}
+		}
+		return "", false
+	}
+	for d := host; d != ""; {
+		if l.domains[d] {
+			return d, true
+		}
+		_, d, _ = strings.Cut(d, ".")
+	}
+	return "", false
+}
+
+// feed is one configured feed and what was last loaded from it.
+type feed struct {
+	cfg     config.ThreatFeed
+	refresh time.Duration
+
+	mu           sync.RWMutex
+	list         *list
+	etag         string // validators of the last response, for
+	lastModified string // conditional fetches
+	status       Status
+}
+
+// Feeds is the set of configured feeds. A nil *Feeds matches nothing.
+type Feeds struct {
+	feeds  []*feed
+	client *http.Client
+}
+
+// New returns nil if no feeds are configured.
+func New(cfgs []config.ThreatFeed) *Feeds {
+	if len(cfgs) == 0 {
+		return nil
+	}
+	fs := &Feeds{client: &http.Client{Timeout: fetchTimeout}}
+	for _, c := range cfgs {
+		if c.Format == "" {
+			c.Format = "text"
+		}
+		f := &feed{cfg: c, refresh: c.Refresh, list: newList()}
+		if f.refresh == 0 {
+			f.refresh = defaultRefresh
+		}
+		f.status = Status{Name: c.Name, URL: c.URL, Format: c.Format, Refresh: f.refresh.String()}
+		fs.feeds = append(fs.feeds, f)
+	}
+	return fs
+}
+
+// Run fetches each feed now and then every refresh interval, until ctx is
+// done.
+func (fs *Feeds) Run(ctx context.Context) {
+	if fs == nil {
+		return
+	}
+	var wg sync.WaitGroup
+	for _, f := range fs.feeds {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				fs.update(ctx, f)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(f.refresh):
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Match returns the name of the first feed listing host, a host name or IP
+// address, and the entry that matched.
+func (fs *Feeds) Match(host string) (name, entry string, ok bool) {
+	if fs == nil {
+		return "", "", false
+	}
+	host = normalise(host)
+	for _, f := range fs.feeds {
+		f.mu.RLock()
+		entry, ok = f.list.match(host)
+		f.mu.RUnlock()
+		if ok {
+			return f.cfg.Name, entry, true
+		}
+	}
+	return "", "", false
+}
+
+// Statuses returns the state of each feed, in configuration order.
+func (fs *Feeds) Statuses() []Status {
+	if fs == nil {
+		return nil
+	}
+	out := make([]Status, len(fs.feeds))
+	for i, f := range fs.feeds {
+		f.mu.RLock()
+		out[i] = f.status
+		f.mu.RUnlock()
+	}
+	return out
+}
+
+// update fetches f and swaps in its entries, keeping those it had if the
+// fetch fails.
+func (fs *Feeds) update(ctx context.Context, f *feed) {
+	start := time.Now()
+	l, err := fs.load(ctx, f)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.status.LastAttempt = start
+	f.status.NextUpdate = start.Add(f.refresh)
+	if err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		f.status.LastError = err.Error()
+		slog.Warn("load threat feed", "feed", f.cfg.Name, "err", err)
+		return
+	}
+	f.status.LastError = ""
+	f.status.LastUpdate = start
+	if l != nil {
+		f.list = l
+		f.status.Entries = l.len()
+		slog.Info("loaded threat feed", "feed", f.cfg.Name, "entries", f.status.Entries)
+	}
+}
+
+// load fetches and parses f. It returns a nil list if f is unchanged since
+// it was last fetched.
+func (fs *Feeds) load(ctx context.Context, f *feed) (*list, error) {
+	var data []byte
+	var etag, lastModified string
+	var err error
+	if strings.Contains(f.cfg.URL, "://") {
+		data, etag, lastModified, err = fs.fetch(ctx, f)
+	} else {
+		data, err = readFile(f.cfg.URL)
+	}
+	if err != nil || data == nil {
+		return nil, err
+	}
+	l := newList()
+	switch f.cfg.Format {
+	case "csv":
+		err = parseCSV(bytes.NewReader(data), f.cfg.Column, l)
+	case "stix":
+		err = parseSTIX(data, l, time.Now())
+	default:
+		err = parseText(bytes.NewReader(data), l)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if l.len() == 0 {
+		return nil, errors.New("no entries found")
+	}
+	f.mu.Lock()
+	f.etag, f.lastModified = etag, lastModified
+	f.mu.Unlock()
+	return l, nil
+}
+
+// fetch returns the body of f's URL and its validators, or a nil body if
+// the server says it has not changed.
+func (fs *Feeds) fetch(ctx context.Context, f *feed) (data []byte, etag, lastModified string, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.cfg.URL, nil)
+	if err != nil {
+		return nil, "", "", err
+	}
+	for k, v := range f.cfg.Headers {
+		req.Header.Set(k, os.ExpandEnv(v))
+	}
+	f.mu.RLock()
+	if f.etag != "" {
+		req.Header.Set("If-None-Match", f.etag)
+	}
+	if f.lastModified != "" {
+		req.Header.Set("If-Modified-Since", f.lastModified)
+	}
+	f.mu.RUnlock()
+	resp, err := fs.client.Do(req)
+	if err != nil {
+		return nil, "", "", err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return nil, "", "", nil
+	default:
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+		return nil, "", "", fmt.Errorf("fetch %s: %s", f.cfg.URL, resp.Status)
+	}
+	if data, err = readAll(resp.Body); err != nil {
+		return nil, "", "", fmt.Errorf("fetch %s: %w", f.cfg.URL, err)
+	}
+	return data, resp.Header.Get("ETag"), resp.Header.Get("Last-Modified"), nil
+}
+
+func readFile(name string) ([]byte, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return readAll(file)
+}
+
+// readAll reads r, failing if it holds more than maxFeedBytes.
+func readAll(r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxFeedBytes+1))
+	if err == nil && len(data) > maxFeedBytes {
+		err = fmt.Errorf("feed is larger than %d MiB", maxFeedBytes>>20)
+	}
+	return data, err
+}
@@ -0,0 +1,99 @@
+package workload
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/kdhira/audit-proxy/internal/audit"
+)
+
+// maxContainerList bounds the container list read.
+const maxContainerList = 16 << 20
+
+// docker lists running containers from the Docker Engine API.
+type docker struct {
+	socket string
+	client *http.Client
+}
+
+func newDocker(socket string) *docker {
+	var d net.Dialer
+	return &docker{socket: socket, client: &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return d.DialContext(ctx, "unix", socket)
+		},
+	}}}
+}
+
+func (d *docker) name() string { return "docker" }
+
+// container holds the fields of a /containers/json item the proxy uses.
+type container struct {
+	ID              string            `json:"Id"`
+	Names           []string          `json:"Names"`
+	Image           string            `json:"Image"`
+	Labels          map[string]string `json:"Labels"`
+	NetworkSettings struct {
+		Networks map[string]struct {
+			IPAddress         string `json:"IPAddress"`
+			GlobalIPv6Address string `json:"GlobalIPv6Address"`
+		} `json:"Networks"`
+	} `json:"NetworkSettings"`
+}
+
+func (d *docker) load(ctx context.Context, ix *index) error {
+	// The host is ignored: requests go to the socket.
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://docker/containers/json", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", d.socket, resp.Status)
+	}
+	var list []container
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxContainerList)).Decode(&list); err != nil {
+		return fmt.Errorf("%s: %w", d.socket, err)
+	}
+	for _, c := range list {
+		w := c.workload()
+		ix.byContainer[c.ID] = w
+		for _, n := range c.NetworkSettings.Networks {
+			for _, a := range []string{n.IPAddress, n.GlobalIPv6Address} {
+				if ip, err := netip.ParseAddr(a); err == nil {
+					ix.byIP[ip.Unmap()] = w
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// workload describes c: as a container, named for Compose projects by
+// the project, or as the pod it belongs to on nodes running pods through
+// Docker.
+func (c container) workload() *audit.Workload {
+	w := &audit.Workload{Kind: KindContainer, ContainerID: c.ID, Image: c.Image}
+	if len(c.Names) > 0 {
+		w.Name = strings.TrimPrefix(c.Names[0], "/")
+	}
+	if pod := c.Labels["io.kubernetes.pod.name"]; pod != "" {
+		w.Kind = KindPod
+		w.Name = pod
+		w.Namespace = c.Labels["io.kubernetes.pod.namespace"]
+		w.Container = c.Labels["io.kubernetes.container.name"]
+	} else if project := c.Labels["com.docker.compose.project"]; project != "" {
+		w.Namespace = project
+	}
+	return w
+}
@@ -0,0 +1,170 @@
+package workload
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/kdhira/audit-proxy/internal/audit"
+	"github.com/kdhira/audit-proxy/internal/config"
+)
+
+// The service account files mounted into pods.
+const (
+	serviceAccountToken = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	serviceAccountCA    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+)
+
+// maxPodList bounds the pod list read.
+const maxPodList = 64 << 20
+
+// kubernetes lists pods from the API server or a kubelet.
+type kubernetes struct {
+	url       string
+	tokenFile string
+	client    *http.Client
+}
+
+func newKubernetes(cfg config.KubernetesConfig) (*kubernetes, error) {
+	k := &kubernetes{url: cfg.PodsURL, tokenFile: cfg.TokenFile}
+	if k.url == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, errors.New("workload: kubernetes.pods_url is required outside a cluster")
+		}
+		k.url = "https://" + net.JoinHostPort(host, port) + "/api/v1/pods"
+		if node := os.Getenv("NODE_NAME"); node != "" {
+			k.url += "?fieldSelector=" + url.QueryEscape("spec.nodeName="+node)
+		}
+	}
+	if k.tokenFile == "" && exists(serviceAccountToken) {
+		k.tokenFile = serviceAccountToken
+	}
+	caFile := cfg.CAFile
+	if caFile == "" && exists(serviceAccountCA) {
+		caFile = serviceAccountCA
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: cfg.InsecureSkipVerify}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("workload: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("workload: %s: no certificates found", caFile)
+		}
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = nil
+	t.TLSClientConfig = tlsConfig
+	k.client = &http.Client{Transport: t}
+	return k, nil
+}
+
+func exists(file string) bool {
+	_, err := os.Stat(file)
+	return err == nil
+}
+
+func (k *kubernetes) name() string { return "kubernetes" }
+
+// podList holds the fields of a PodList the proxy uses.
+type podList struct {
+	Items []struct {
+		Metadata struct {
+			Name      string `json:"name"`
+			Namespace string `json:"namespace"`
+		} `json:"metadata"`
+		Spec struct {
+			HostNetwork bool `json:"hostNetwork"`
+			Containers  []struct {
+				Image string `json:"image"`
+			} `json:"containers"`
+		} `json:"spec"`
+		Status struct {
+			Phase  string `json:"phase"`
+			PodIPs []struct {
+				IP string `json:"ip"`
+			} `json:"podIPs"`
+			ContainerStatuses []struct {
+				Name        string `json:"name"`
+				Image       string `json:"image"`
+				ContainerID string `json:"containerID"`
+			} `json:"containerStatuses"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+func (k *kubernetes) load(ctx context.Context, ix *index) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, k.url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if k.tokenFile != "" {
+		// Service account tokens are rotated, so the file is read each time.
+		token, err := os.ReadFile(k.tokenFile)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", k.url, resp.Status)
+	}
+	var list podList
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxPodList)).Decode(&list); err != nil {
+		return fmt.Errorf("%s: %w", k.url, err)
+	}
+	for _, p := range list.Items {
+		pod := &audit.Workload{Kind: KindPod, Name: p.Metadata.Name, Namespace: p.Metadata.Namespace}
+		var images []string
+		for _, c := range p.Spec.Containers {
+			images = append(images, c.Image)
+		}
+		pod.Image = strings.Join(images, ",")
+		ix.byPod[pod.Namespace+"/"+pod.Name] = pod
+		for _, c := range p.Status.ContainerStatuses {
+			// containerID is <runtime>://<id>.
+			_, id, ok := strings.Cut(c.ContainerID, "://")
+			if !ok || id == "" {
+				continue
+			}
+			ix.byContainer[id] = &audit.Workload{
+				Kind:        KindPod,
+				Name:        pod.Name,
+				Namespace:   pod.Namespace,
+				Container:   c.Name,
+				ContainerID: id,
+				Image:       c.Image,
+			}
+		}
+		// Host network pods share the node's address, and finished pods'
+		// addresses may already belong to others.
+		if p.Spec.HostNetwork || p.Status.Phase == "Succeeded" || p.Status.Phase == "Failed" {
+			continue
+		}
+		for _, a := range p.Status.PodIPs {
+			if ip, err := netip.ParseAddr(a.IP); err == nil {
+				ix.byIP[ip.Unmap()] = pod
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package workload
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// containerIDPattern matches the container IDs Docker, containerd and
+// CRI-O put in cgroup paths.
+var containerIDPattern = regexp.MustCompile(`[0-9a-f]{64}`)
+
+// socketInode returns the inode of the TCP socket from local to remote
+// found in /proc/net/tcp or tcp6, or 0 if there is none.
+func socketInode(local, remote netip.AddrPort) uint64 {
+	for _, file := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		if inode := findSocket(file, local, remote); inode != 0 {
+			return inode
+		}
+	}
+	return 0
+}
+
+func findSocket(file string, local, remote netip.AddrPort) uint64 {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	s.Scan() // header
+	for s.Scan() {
+		// sl local_address rem_address st tx_queue:rx_queue tr:tm->when
+		// retrnsmt uid timeout inode ...
+		fields := strings.Fields(s.Text())
+		if len(fields) < 10 {
+			continue
+		}
+		if sameAddrPort(fields[1], local) && sameAddrPort(fields[2], remote) {
+			inode, _ := strconv.ParseUint(fields[9], 10, 64)
+			return inode
+		}
+	}
+	return 0
+}
+
+// sameAddrPort reports whether the /proc/net/tcp address s, the hex
+// address and port, is ap. The address is written as 32-bit words in host
+// byte order.
+func sameAddrPort(s string, ap netip.AddrPort) bool {
+	a, p, ok := strings.Cut(s, ":")
+	if !ok {
+		return false
+	}
+	port, err := strconv.ParseUint(p, 16, 16)
+	if err != nil || uint16(port) != ap.Port() {
+		return false
+	}
+	words, err := hex.DecodeString(a)
+	if err != nil || (len(words) != 4 && len(words) != 16) {
+		return false
+	}
+	b := make([]byte, len(words))
+	for i := 0; i < len(words); i += 4 {
+		binary.NativeEndian.PutUint32(b[i:], binary.BigEndian.Uint32(words[i:]))
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr.Unmap() == ap.Addr().Unmap()
+}
+
+// socketOwner returns the ID of a process holding the socket with inode,
+// or 0 if none is visible.
+func socketOwner(inode uint64) int {
+	target := "socket:[" + strconv.FormatUint(inode, 10) + "]"
+	procs, _ := filepath.Glob("/proc/[0-9]*/fd")
+	for _, dir := range procs {
+		fds, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			if link, err := os.Readlink(filepath.Join(dir, fd.Name())); err == nil && link == target {
+				pid, _ := strconv.Atoi(filepath.Base(filepath.Dir(dir)))
+				return pid
+			}
+		}
+	}
+	return 0
+}
+
+// containerID returns the ID of the container process pid runs in, found
+// in its cgroup, or "" if it runs in none.
+func containerID(pid int) string {
+	b, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/cgroup")
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if ids := containerIDPattern.FindAllString(line, -1); len(ids) > 0 {
+			return ids[len(ids)-1]
+		}
+	}
+	return ""
+}
+
+func processName(pid int) string {
+	b, _ := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/comm")
+	return strings.TrimSpace(string(b))
+}
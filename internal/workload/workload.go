@@ -0,0 +1,214 @@
+// Package workload resolves client connections to the Kubernetes pods,
+// Docker containers or host processes they come from.
+//
+// Pods and containers are listed periodically and indexed by IP address
+// and container ID. A client from the same host is traced through /proc
+// to the process owning its socket, and through the process's cgroup to
+// its container. A sidecar's loopback clients are its own pod, named by
+// the POD_NAME and POD_NAMESPACE environment variables.
+package workload
+
+import (
+	"context"
+	"log/slog"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/kdhira/audit-proxy/internal/audit"
+	"github.com/kdhira/audit-proxy/internal/config"
+)
+
+// minRefresh spaces the refreshes made because a client matched nothing.
+const minRefresh = 5 * time.Second
+
+// Kinds of workload.
+const (
+	KindPod       = "pod"
+	KindContainer = "container"
+	KindProcess   = "process"
+)
+
+// index maps addresses and container IDs to workloads.
+type index struct {
+	byIP        map[netip.Addr]*audit.Workload
+	byContainer map[string]*audit.Workload
+	byPod       map[string]*audit.Workload // namespace/name
+}
+
+func newIndex() *index {
+	return &index{
+		byIP:        map[netip.Addr]*audit.Workload{},
+		byContainer: map[string]*audit.Workload{},
+		byPod:       map[string]*audit.Workload{},
+	}
+}
+
+// source lists the workloads of one runtime.
+type source interface {
+	name() string
+	load(ctx context.Context, ix *index) error
+}
+
+// Resolver resolves client connections to workloads.
+type Resolver struct {
+	sources []source
+	proc    bool
+	refresh time.Duration
+	self    *audit.Workload // the pod a sidecar runs in
+	missed  chan struct{}
+
+	mu      sync.RWMutex
+	indexes map[string]*index // by source; kept when a refresh fails
+}
+
+// New returns nil if cfg enables no way of resolving workloads.
+func New(cfg config.WorkloadConfig) (*Resolver, error) {
+	r := &Resolver{
+		proc:    cfg.Proc,
+		refresh: cfg.Refresh,
+		missed:  make(chan struct{}, 1),
+		indexes: map[string]*index{},
+	}
+	if cfg.Kubernetes.Enabled {
+		k, err := newKubernetes(cfg.Kubernetes)
+		if err != nil {
+			return nil, err
+		}
+		r.sources = append(r.sources, k)
+	}
+	if cfg.DockerSocket != "" {
+		r.sources = append(r.sources, newDocker(cfg.DockerSocket))
+	}
+	if name, ns := os.Getenv("POD_NAME"), os.Getenv("POD_NAMESPACE"); name != "" {
+		r.self = &audit.Workload{Kind: KindPod, Name: name, Namespace: ns}
+	}
+	if len(r.sources) == 0 && !r.proc {
+		return nil, nil
+	}
+	return r, nil
+}
+
+// Run lists the workloads every refresh interval, and after a client
+// matched none, until ctx is done.
+func (r *Resolver) Run(ctx context.Context) {
+	if r == nil || len(r.sources) == 0 {
+		return
+	}
+	r.load(ctx)
+	t := time.NewTicker(r.refresh)
+	defer t.Stop()
+	last := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		case <-r.missed:
+			if time.Since(last) < minRefresh {
+				continue
+			}
+		}
+		r.load(ctx)
+		last = time.Now()
+	}
+}
+
+func (r *Resolver) load(ctx context.Context) {
+	for _, s := range r.sources {
+		ix := newIndex()
+		lctx, cancel := context.WithTimeout(ctx, r.refresh)
+		err := s.load(lctx, ix)
+		cancel()
+		if err != nil {
+			slog.Warn("list workloads", "source", s.name(), "err", err)
+			continue
+		}
+		slog.Debug("listed workloads", "source", s.name(), "addresses", len(ix.byIP), "containers", len(ix.byContainer))
+		r.mu.Lock()
+		r.indexes[s.name()] = ix
+		r.mu.Unlock()
+	}
+}
+
+// lookup returns the first workload found by key in the sources' indexes.
+func (r *Resolver) lookup(key func(*index) *audit.Workload) *audit.Workload {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, s := range r.sources {
+		if ix := r.indexes[s.name()]; ix != nil {
+			if w := key(ix); w != nil {
+				return w
+			}
+		}
+	}
+	return nil
+}
+
+// Resolve returns the workload behind the client connection from remote
+// to the proxy's local address, or nil if it cannot be found. The result
+// is the caller's to keep.
+func (r *Resolver) Resolve(remote, local netip.AddrPort) *audit.Workload {
+	if r == nil || !remote.IsValid() {
+		return nil
+	}
+	addr := remote.Addr().Unmap()
+	sameHost := addr.IsLoopback() || local.IsValid() && addr == local.Addr().Unmap()
+	var proc *audit.Workload
+	if r.proc && sameHost {
+		proc = r.fromProc(remote, local)
+		if proc != nil && proc.Kind != KindProcess {
+			return proc
+		}
+	}
+	if w := r.lookup(func(ix *index) *audit.Workload { return ix.byIP[addr] }); w != nil {
+		return clone(w)
+	}
+	if r.self != nil && addr.IsLoopback() {
+		key := r.self.Namespace + "/" + r.self.Name
+		if w := r.lookup(func(ix *index) *audit.Workload { return ix.byPod[key] }); w != nil {
+			return clone(w)
+		}
+		return clone(r.self)
+	}
+	if proc != nil {
+		return proc
+	}
+	if len(r.sources) > 0 && !sameHost {
+		select {
+		case r.missed <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// fromProc finds the process owning the client's socket and, if it runs
+// in a known container, that container's workload.
+func (r *Resolver) fromProc(remote, local netip.AddrPort) *audit.Workload {
+	// The client's socket is bound to its end of the connection.
+	inode := socketInode(remote, local)
+	if inode == 0 {
+		return nil
+	}
+	pid := socketOwner(inode)
+	if pid == 0 {
+		return nil
+	}
+	if id := containerID(pid); id != "" {
+		w := r.lookup(func(ix *index) *audit.Workload { return ix.byContainer[id] })
+		if w == nil {
+			w = &audit.Workload{Kind: KindContainer, ContainerID: id}
+		}
+		w = clone(w)
+		w.PID = pid
+		return w
+	}
+	return &audit.Workload{Kind: KindProcess, Name: processName(pid), PID: pid}
+}
+
+func clone(w *audit.Workload) *audit.Workload {
+	c := *w
+	return &c
+}